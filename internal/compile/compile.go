@@ -46,7 +46,7 @@ var Disassemble = false
 const debug = false // make code generation verbose, for debugging the compiler
 
 // Increment this to force recompilation of saved bytecode files.
-const Version = 14
+const Version = 15
 
 type Opcode uint8
 
@@ -108,6 +108,7 @@ const (
 	SETDICT      // dict key value SETDICT      -
 	SETDICTUNIQ  // dict key value SETDICTUNIQ  -
 	APPEND       //      list elem APPEND       -
+	PRESIZE      //  list iterable PRESIZE      list iterable  [reserves capacity for len(iterable)]
 	SLICE        //   x lo hi step SLICE        slice
 	INPLACE_ADD  //            x y INPLACE_ADD  z      where z is x+y or x.extend(y)
 	INPLACE_PIPE //            x y INPLACE_PIPE z      where z is x|y
@@ -203,6 +204,7 @@ var opcodeNames = [...]string{
 	PLUS:         "plus",
 	POP:          "pop",
 	PREDECLARED:  "predeclared",
+	PRESIZE:      "presize",
 	RETURN:       "return",
 	SETDICT:      "setdict",
 	SETDICTUNIQ:  "setdictuniq",
@@ -277,6 +279,7 @@ var stackEffect = [...]int8{
 	PLUS:         -1,
 	POP:          -1,
 	PREDECLARED:  +1,
+	PRESIZE:      0,
 	RETURN:       -1,
 	SETLOCALCELL: -1,
 	SETDICT:      -3,
@@ -1784,6 +1787,10 @@ func (fcomp *fcomp) comprehension(comp *syntax.Comprehension, clauseIndex int) {
 		tail := fcomp.newBlock()
 
 		fcomp.expr(clause.X)
+		if !comp.Curly && len(comp.Clauses) == 1 {
+			// The result of [body for vars in x] has len(x) elements.
+			fcomp.emit(PRESIZE)
+		}
 		fcomp.setPos(clause.For)
 		fcomp.emit(ITERPUSH)
 		fcomp.jump(head)
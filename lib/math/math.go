@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"strconv"
 
 	"github.com/canonical/starlark/starlark"
 	"github.com/canonical/starlark/starlarkstruct"
@@ -57,6 +58,10 @@ import (
 //
 //	gamma(x) - Returns the Gamma function of x.
 //
+//	format(x, notation="general", precision=None) - Returns x as a string in "fixed", "scientific" or "general" notation.
+//	              precision is the number of digits after the decimal point, or of significant digits in general notation.
+//	              By default, the fewest digits needed to represent x exactly are used.
+//
 // All functions accept both int and float values as arguments.
 //
 // The module also defines approximations of the following constants:
@@ -101,6 +106,8 @@ var Module = &starlarkstruct.Module{
 
 		"gamma": newUnaryBuiltin("gamma", math.Gamma),
 
+		"format": starlark.NewBuiltin("format", format),
+
 		"e":  starlark.Float(math.E),
 		"pi": starlark.Float(math.Pi),
 	},
@@ -134,6 +141,7 @@ var safeties = map[string]starlark.SafetyFlags{
 	"tanh":      starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe,
 	"log":       starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe,
 	"gamma":     starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe,
+	"format":    starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe,
 }
 
 var floatSize = starlark.EstimateSize(starlark.Float(0))
@@ -270,3 +278,111 @@ func degrees(x float64) float64 {
 func radians(x float64) float64 {
 	return 2 * math.Pi * x / 360
 }
+
+// maxShortestDigits is the most significant digits needed to represent
+// any float64 exactly.
+const maxShortestDigits = 17
+
+// format returns x formatted in the requested notation. As the precision
+// is chosen by the caller, the length of the result is bounded and checked
+// against the thread's budget before any formatting is done.
+func format(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		x         floatOrInt
+		notation  = "general"
+		precision starlark.Value
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x, "notation?", &notation, "precision?", &precision); err != nil {
+		return nil, err
+	}
+	var conv byte
+	switch notation {
+	case "fixed":
+		conv = 'f'
+	case "scientific":
+		conv = 'e'
+	case "general":
+		conv = 'g'
+	default:
+		return nil, fmt.Errorf("%s: unknown notation %q, want \"fixed\", \"scientific\" or \"general\"", b.Name(), notation)
+	}
+	digits := -1
+	if precision != nil && precision != starlark.None {
+		n, err := starlark.AsInt32(precision)
+		if err != nil {
+			return nil, fmt.Errorf("%s: for parameter precision: %v", b.Name(), err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%s: precision must be non-negative, got %d", b.Name(), n)
+		}
+		digits = n
+	}
+
+	f := float64(x)
+	var s string
+	switch {
+	case math.IsInf(f, +1):
+		s = "+inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		if thread != nil {
+			size := formatSizeBound(f, conv, digits)
+			if err := thread.CheckSteps(size); err != nil {
+				return nil, err
+			}
+			resultSize := starlark.SafeAdd(starlark.EstimateMakeSize([]byte{}, size), starlark.StringTypeOverhead)
+			if err := thread.CheckAllocs(resultSize); err != nil {
+				return nil, err
+			}
+		}
+		s = strconv.FormatFloat(f, conv, digits, 64)
+	}
+
+	buf := starlark.NewSafeStringBuilder(thread)
+	if _, err := buf.WriteString(s); err != nil {
+		return nil, err
+	}
+	if thread != nil {
+		if err := thread.AddAllocs(starlark.StringTypeOverhead); err != nil {
+			return nil, err
+		}
+	}
+	return starlark.String(buf.String()), nil
+}
+
+// formatSizeBound returns an upper bound on the length of the finite
+// float f when formatted by strconv.FormatFloat with the given
+// conversion and precision, where a negative precision requests the
+// fewest digits which represent f exactly.
+func formatSizeBound(f float64, conv byte, precision int) starlark.SafeInteger {
+	// Decimal exponent of the leading digit of f.
+	exp := 0
+	if f != 0 {
+		exp = int(math.Floor(math.Log10(math.Abs(f))))
+	}
+
+	// Sign, decimal point and an exponent such as "e+308".
+	const overhead = len("-.e+308")
+	digits := starlark.SafeInt(precision)
+	if precision < 0 {
+		digits = starlark.SafeInt(maxShortestDigits)
+	}
+	if conv == 'f' {
+		// Digits before the point, and leading zeros after it if
+		// the precision is chosen to represent f exactly.
+		if exp >= 0 {
+			digits = starlark.SafeAdd(digits, exp+1)
+		} else {
+			digits = starlark.SafeAdd(digits, 1)
+			if precision < 0 {
+				digits = starlark.SafeAdd(digits, -exp)
+			}
+		}
+	} else {
+		digits = starlark.SafeAdd(digits, 1)
+	}
+	return starlark.SafeAdd(digits, overhead)
+}
@@ -1,6 +1,7 @@
 package math_test
 
 import (
+	"errors"
 	"math"
 	"testing"
 
@@ -554,3 +555,76 @@ func TestMathGammaSteps(t *testing.T) {
 func TestMathGammaAllocs(t *testing.T) {
 	testUnarySafety(t, "gamma", []float64{0, 1, 170})
 }
+
+func TestMathFormatSteps(t *testing.T) {
+	format, ok := starlarkmath.Module.Members["format"]
+	if !ok {
+		t.Fatal("no such builtin: math.format")
+	}
+
+	// General notation drops trailing zeros, so its length is bounded.
+	for _, notation := range []string{"fixed", "scientific"} {
+		t.Run(notation, func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.CPUSafe)
+			st.SetMinSteps(1)
+			st.SetMaxSteps(1)
+			st.RunThread(func(thread *starlark.Thread) {
+				args := starlark.Tuple{starlark.Float(math.Pi), starlark.String(notation), starlark.MakeInt(st.N)}
+				if _, err := starlark.Call(thread, format, args, nil); err != nil {
+					st.Error(err)
+				}
+			})
+		})
+	}
+}
+
+func TestMathFormatAllocs(t *testing.T) {
+	format, ok := starlarkmath.Module.Members["format"]
+	if !ok {
+		t.Fatal("no such builtin: math.format")
+	}
+
+	// General notation drops trailing zeros, so its length is bounded.
+	for _, notation := range []string{"fixed", "scientific"} {
+		t.Run(notation, func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunThread(func(thread *starlark.Thread) {
+				args := starlark.Tuple{starlark.Float(math.Pi), starlark.String(notation), starlark.MakeInt(st.N)}
+				result, err := starlark.Call(thread, format, args, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			})
+		})
+	}
+
+	t.Run("shortest", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				args := starlark.Tuple{starlark.Float(math.SmallestNonzeroFloat64), starlark.String("fixed")}
+				result, err := starlark.Call(thread, format, args, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			}
+		})
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(1 << 20)
+		args := starlark.Tuple{starlark.Float(1), starlark.String("fixed"), starlark.MakeInt(1 << 30)}
+		_, err := starlark.Call(thread, format, args, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
@@ -84,6 +84,7 @@ package resolve // import "github.com/canonical/starlark/resolve"
 import (
 	"fmt"
 	"log"
+	"math/big"
 	"sort"
 	"strings"
 
@@ -233,6 +234,10 @@ type resolver struct {
 	loops   int // number of enclosing for/while loops
 	ifstmts int // number of enclosing if statements loops
 
+	// literalBytes is the total size of the literals seen so far,
+	// checked against options.MaxLiteralBytes.
+	literalBytes int
+
 	errors ErrorList
 }
 
@@ -299,6 +304,28 @@ func (r *resolver) errorf(posn syntax.Position, format string, args ...interface
 	r.errors = append(r.errors, Error{posn, fmt.Sprintf(format, args...)})
 }
 
+// literal accounts for the size of the constant denoted by lit, reporting an
+// error at the literal which first takes the total over the limit.
+func (r *resolver) literal(lit *syntax.Literal) {
+	max := r.options.MaxLiteralBytes
+	if max <= 0 || r.literalBytes > max {
+		return
+	}
+	var size int
+	switch v := lit.Value.(type) {
+	case string:
+		size = len(v)
+	case *big.Int:
+		size = (v.BitLen() + 7) / 8
+	default:
+		size = 8 // int64 or float64
+	}
+	r.literalBytes += size
+	if r.literalBytes > max {
+		r.errorf(lit.TokenPos, "literals exceed the limit of %d bytes", max)
+	}
+}
+
 // A use records an identifier and the environment in which it appears.
 type use struct {
 	id  *syntax.Ident
@@ -646,6 +673,7 @@ func (r *resolver) expr(e syntax.Expr) {
 		r.use(e)
 
 	case *syntax.Literal:
+		r.literal(e)
 
 	case *syntax.ListExpr:
 		for _, x := range e.List {
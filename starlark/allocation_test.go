@@ -2,6 +2,7 @@ package starlark_test
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"strings"
 	"sync"
@@ -243,6 +244,290 @@ func TestInvalidDeltaAllocs(t *testing.T) {
 	}
 }
 
+func TestAllocCount(t *testing.T) {
+	t.Run("counting", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocCount(2)
+
+		if err := thread.CheckAllocs(starlark.SafeInt(8)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if count := thread.AllocCount(); count != 0 {
+			t.Errorf("CheckAllocs recorded allocations: expected 0 but got %d", count)
+		}
+
+		// Only claims of memory are counted.
+		for _, delta := range []int64{8, 0, -8, 16} {
+			if err := thread.AddAllocs(starlark.SafeInt(delta)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if count := thread.AllocCount(); count != 2 {
+			t.Errorf("unexpected alloc count: expected 2 but got %d", count)
+		}
+
+		expected := &starlark.AllocCountSafetyError{}
+		if err := thread.CheckAllocs(starlark.SafeInt(1)); !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := thread.AddAllocs(starlark.SafeInt(1)); !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		const maxAllocs = 1 << 30
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(maxAllocs)
+		thread.SetMaxAllocCount(1000)
+
+		const src = `
+def create():
+	for i in range(100000):
+		x = [i]
+create()
+`
+		_, err := starlark.ExecFile(thread, "alloc_count_test", src, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		expected := &starlark.AllocCountSafetyError{}
+		if !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Error("alloc count invalidated")
+		} else if allocs >= maxAllocs {
+			t.Errorf("allocation byte budget unexpectedly exhausted: %d bytes", allocs)
+		}
+	})
+}
+
+func TestMaxSingleAlloc(t *testing.T) {
+	t.Run("limit", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxSingleAlloc(100)
+
+		// Many small allocations are unaffected, as are releases.
+		for _, delta := range []int64{100, 100, 100, -300} {
+			if err := thread.AddAllocs(starlark.SafeInt(delta)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		expected := &starlark.SingleAllocSafetyError{}
+		if err := thread.CheckAllocs(starlark.SafeInt(101)); !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		} else if allocs, _ := thread.Allocs(); allocs != 0 {
+			t.Errorf("CheckAllocs recorded allocations: expected 0 but got %d", allocs)
+		}
+		if err := thread.AddAllocs(starlark.SafeInt(101)); !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := thread.AddAllocs(starlark.InvalidSafeInt); !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		const maxAllocs = 1 << 30
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(maxAllocs)
+		thread.SetMaxSingleAlloc(1 << 20)
+
+		const src = `
+small = ["x" * 1000 for _ in range(1000)]
+huge = "x" * (1 << 24)
+`
+		_, err := starlark.ExecFile(thread, "single_alloc_test", src, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		expected := &starlark.SingleAllocSafetyError{}
+		if !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Error("alloc count invalidated")
+		} else if allocs >= maxAllocs {
+			t.Errorf("allocation byte budget unexpectedly exhausted: %d bytes", allocs)
+		}
+	})
+}
+
+func TestValueCount(t *testing.T) {
+	t.Run("counting", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxValues(3)
+
+		for i := 0; i < 3; i++ {
+			if err := thread.AddValues(1); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if count := thread.Values(); count != 3 {
+			t.Errorf("unexpected value count: expected 3 but got %d", count)
+		}
+
+		expected := &starlark.ValuesSafetyError{}
+		if err := thread.AddValues(1); !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("error does not wrap ErrSafety: %v", err)
+		}
+	})
+
+	const n = 100
+	// The comprehension creates a list, a range and n strings. Once a
+	// limit is set, the n ints yielded by the range are counted too.
+	const src = `
+values = [str(i) for i in range(100)]
+`
+	const expectedValues = n + 2
+	const expectedLimitedValues = expectedValues + n
+
+	t.Run("interpreter", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		if _, err := starlark.ExecFile(thread, "value_count_test", src, nil); err != nil {
+			t.Fatal(err)
+		}
+		if count := thread.Values(); count != expectedValues {
+			t.Errorf("unexpected value count: expected %d but got %d", expectedValues, count)
+		}
+	})
+
+	t.Run("within-limit", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxValues(expectedLimitedValues)
+		if _, err := starlark.ExecFile(thread, "value_count_test", src, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxValues(expectedLimitedValues - 1)
+		_, err := starlark.ExecFile(thread, "value_count_test", src, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		expected := &starlark.ValuesSafetyError{}
+		if !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if count := thread.Values(); count != expectedLimitedValues {
+			t.Errorf("unexpected value count: expected %d but got %d", expectedLimitedValues, count)
+		}
+	})
+
+	t.Run("builtin", func(t *testing.T) {
+		// A single call to a built-in may materialise many values.
+		thread := &starlark.Thread{}
+		thread.SetMaxValues(10)
+		_, err := starlark.ExecFile(thread, "value_count_test", "list(range(1000))", nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		expected := &starlark.ValuesSafetyError{}
+		if !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestStringConcatenationInLoop(t *testing.T) {
+	// Each concatenation allocates the whole of its result, so building
+	// a string piecewise costs quadratically in its final length.
+	const pieces = 100
+	const piece = "abcd"
+	const minAllocs = int64(len(piece) * pieces * (pieces + 1) / 2)
+
+	for _, stmt := range []string{"s = s + piece", "s += piece"} {
+		src := "def build(n):\n\ts = ''\n\tfor _ in range(n):\n\t\t" + stmt + "\n\treturn s\n"
+
+		t.Run(stmt, func(t *testing.T) {
+			t.Run("cumulative", func(t *testing.T) {
+				thread := &starlark.Thread{}
+				predeclared := starlark.StringDict{"piece": starlark.String(piece)}
+				globals, err := starlark.ExecFile(thread, "concat.star", src, predeclared)
+				if err != nil {
+					t.Fatal(err)
+				}
+				before, _ := thread.Allocs()
+				result, err := starlark.Call(thread, globals["build"], starlark.Tuple{starlark.MakeInt(pieces)}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := len(result.(starlark.String)); n != len(piece)*pieces {
+					t.Errorf("unexpected result length: got %d, want %d", n, len(piece)*pieces)
+				}
+				if after, _ := thread.Allocs(); after-before < minAllocs {
+					t.Errorf("concatenation under-accounted: got %d, want at least %d", after-before, minAllocs)
+				}
+			})
+
+			t.Run("budget", func(t *testing.T) {
+				thread := &starlark.Thread{}
+				thread.SetMaxAllocs(minAllocs)
+				predeclared := starlark.StringDict{"piece": starlark.String(piece)}
+				globals, err := starlark.ExecFile(thread, "concat.star", src, predeclared)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Ten times as many pieces would need a hundred times the memory.
+				_, err = starlark.Call(thread, globals["build"], starlark.Tuple{starlark.MakeInt(10 * pieces)}, nil)
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				expected := &starlark.AllocsSafetyError{}
+				if !errors.As(err, &expected) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			})
+		})
+	}
+}
+
+func TestGlobalsAllocs(t *testing.T) {
+	const numGlobals = 2000
+	var src strings.Builder
+	for i := 0; i < numGlobals; i++ {
+		fmt.Fprintf(&src, "g%d = None\n", i)
+	}
+
+	t.Run("accounted", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		globals, err := starlark.ExecFile(thread, "globals.star", src.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(globals) != numGlobals {
+			t.Errorf("unexpected globals count: got %d, want %d", len(globals), numGlobals)
+		}
+		minAllocs := mustInt64(starlark.SafeAdd(
+			starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(numGlobals)),
+			starlark.EstimateMakeSize(starlark.StringDict{}, starlark.SafeInt(numGlobals)),
+		))
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Error("alloc count invalidated")
+		} else if allocs < minAllocs {
+			t.Errorf("globals under-accounted: got %d, want at least %d", allocs, minAllocs)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(numGlobals)
+		_, err := starlark.ExecFile(thread, "globals.star", src.String(), nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		expected := &starlark.AllocsSafetyError{}
+		if !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
 func TestConcurrentCheckAllocsUsage(t *testing.T) {
 	const allocPeak = 1 << 62
 	const maxAllocs = allocPeak + 1
@@ -39,6 +39,8 @@ type Thread struct {
 	cancelCleanup func()
 	cancelReason  error
 	done          chan struct{}
+	deadline      time.Time
+	deadlineTimer *time.Timer
 
 	// stack is the stack of (internal) call frames.
 	stack []*frame
@@ -72,6 +74,47 @@ type Thread struct {
 	maxAllocs  int64
 	allocsLock sync.Mutex
 
+	// allocCount counts the calls to AddAllocs which claimed memory,
+	// approximating the number of objects created. It is guarded by
+	// allocsLock.
+	allocCount    uint64
+	maxAllocCount uint64
+
+	// maxSingleAlloc limits the size of each allocation reported via
+	// AddAllocs, independently of the total. Zero means no limit.
+	maxSingleAlloc uintptr
+
+	// values counts the values created by the operations of the
+	// interpreter and reported via AddValues. It is guarded by allocsLock.
+	values    uint64
+	maxValues uint64
+
+	// resourceTrace, if non-nil, receives a line for each call to
+	// AddSteps and AddAllocs. Writes to it are guarded by traceLock.
+	// traceCallee, also guarded by traceLock, names the innermost
+	// function on the call stack, so that the stack itself need not be
+	// read from other goroutines.
+	resourceTrace        io.Writer
+	resourceTraceEntries int
+	traceCallee          string
+	traceLock            sync.Mutex
+
+	// maxArgs limits the number of arguments of a single call, once any
+	// *args and **kwargs have been spread. Zero means no limit.
+	maxArgs int
+
+	// maxJoinBytes limits the bytes which string.join and bytes may
+	// gather from an iterable. Zero means no limit.
+	maxJoinBytes uint64
+
+	// maxDepth limits the depth to which recursive operations on values,
+	// such as SafeDeepMerge, may descend. Zero means defaultMaxDepth.
+	maxDepth int
+
+	// errorTransformer, if non-nil, is applied to each error leaving the
+	// outermost call of this thread.
+	errorTransformer func(error) error
+
 	// locals holds arbitrary "thread-local" Go values belonging to the client.
 	// They are accessible to the client but not to any Starlark program.
 	locals map[string]interface{}
@@ -79,6 +122,9 @@ type Thread struct {
 	// proftime holds the accumulated execution time since the last profile event.
 	proftime time.Duration
 
+	// stepProfile holds the samples of the step profiler, if enabled.
+	stepProfile *stepProfile
+
 	// requiredSafety holds the set of safety conditions which must be
 	// satisfied by any builtin which is called when running this thread.
 	requiredSafety SafetyFlags
@@ -102,7 +148,15 @@ var _ context.Context = &threadContext{}
 
 func (tc *threadContext) Deadline() (deadline time.Time, ok bool) {
 	thread := (*Thread)(tc)
-	return thread.parentContext.Deadline()
+
+	thread.contextLock.Lock()
+	defer thread.contextLock.Unlock()
+
+	deadline, ok = thread.parentContext.Deadline()
+	if !thread.deadline.IsZero() && (!ok || thread.deadline.Before(deadline)) {
+		return thread.deadline, true
+	}
+	return deadline, ok
 }
 
 var closedChannel chan struct{}
@@ -192,6 +246,40 @@ func (thread *Thread) Context() context.Context {
 	return (*threadContext)(thread)
 }
 
+// SetDeadline sets a wall-clock time after which the thread is cancelled,
+// independently of its step budget. Once the deadline passes, execution
+// fails promptly with an error wrapping context.DeadlineExceeded.
+//
+// Calling SetDeadline again replaces any previous deadline, and calling it
+// with the zero time clears it. It has no effect if the thread has already
+// been cancelled.
+//
+// The deadline is enforced by a timer which keeps the thread reachable
+// until the deadline passes, even once the thread's work is done. Callers
+// which finish with the thread before then should release it by clearing
+// the deadline or cancelling the thread.
+func (thread *Thread) SetDeadline(deadline time.Time) {
+	thread.contextLock.Lock()
+	defer thread.contextLock.Unlock()
+
+	if thread.cancelReason != nil {
+		return
+	}
+	if thread.deadlineTimer != nil {
+		thread.deadlineTimer.Stop()
+		thread.deadlineTimer = nil
+	}
+	thread.deadline = deadline
+	if deadline.IsZero() {
+		return
+	}
+	thread.deadlineTimer = time.AfterFunc(time.Until(deadline), func() {
+		thread.cancel(errDeadlineExceeded)
+	})
+}
+
+var errDeadlineExceeded = fmt.Errorf("thread deadline exceeded: %w", context.DeadlineExceeded)
+
 // Steps returns the current value of Steps.
 func (thread *Thread) Steps() (int64, bool) {
 	thread.stepsLock.Lock()
@@ -228,6 +316,10 @@ func (thread *Thread) CheckSteps(delta SafeInteger) error {
 // It is safe to call AddSteps from any goroutine, even if the thread
 // is actively executing.
 func (thread *Thread) AddSteps(delta SafeInteger) error {
+	if thread.resourceTrace != nil {
+		thread.traceResource("steps", delta)
+	}
+
 	thread.stepsLock.Lock()
 	defer thread.stepsLock.Unlock()
 
@@ -287,6 +379,155 @@ func (thread *Thread) SetMaxAllocs(max int64) {
 	thread.maxAllocs = max
 }
 
+// limitsAllocs reports whether SetMaxAllocs has set an effective limit.
+func (thread *Thread) limitsAllocs() bool {
+	return thread.maxAllocs > 0 && thread.maxAllocs != math.MaxInt64
+}
+
+// AllocCount returns the number of allocations reported to this thread via
+// AddAllocs. Only calls which claim memory are counted.
+func (thread *Thread) AllocCount() uint64 {
+	thread.allocsLock.Lock()
+	defer thread.allocsLock.Unlock()
+
+	return thread.allocCount
+}
+
+// SetMaxAllocCount sets the maximum number of allocations that may be
+// reported to this thread via AddAllocs before Cancel is internally called,
+// regardless of their size. If max is zero, the thread will not be cancelled.
+func (thread *Thread) SetMaxAllocCount(max uint64) {
+	thread.maxAllocCount = max
+}
+
+// SetMaxSingleAlloc sets the maximum size of any one allocation that may be
+// reported to this thread via AddAllocs before Cancel is internally called.
+// This rejects a single oversized operation, such as a huge string repeat,
+// even when the limit set via SetMaxAllocs would allow it. If max is zero,
+// the size of individual allocations is not limited.
+func (thread *Thread) SetMaxSingleAlloc(max uintptr) {
+	thread.maxSingleAlloc = max
+}
+
+// Values returns the number of values reported to this thread via
+// AddValues. The interpreter reports each value created by a literal,
+// an operator, a slice, a function definition or a call to a built-in.
+// Once a limit is set with SetMaxValues, each element yielded by an
+// iterator obtained through SafeIterate is also reported, so that values
+// materialised within built-ins, such as the elements of list(range(n)),
+// are counted.
+func (thread *Thread) Values() uint64 {
+	thread.allocsLock.Lock()
+	defer thread.allocsLock.Unlock()
+
+	return thread.values
+}
+
+// SetMaxValues sets the maximum number of values that may be reported to
+// this thread via AddValues before Cancel is internally called. Unlike the
+// limits on allocations, this bounds the number of values regardless of
+// their size or representation. If max is zero, the thread will not be
+// cancelled.
+func (thread *Thread) SetMaxValues(max uint64) {
+	thread.maxValues = max
+}
+
+// AddValues reports the creation of delta values by this thread. If the
+// total exceeds the limit defined via SetMaxValues, the thread is cancelled
+// and an error is returned.
+//
+// It is safe to call AddValues from any goroutine, even if the thread is
+// actively executing.
+func (thread *Thread) AddValues(delta uint64) error {
+	thread.allocsLock.Lock()
+	defer thread.allocsLock.Unlock()
+
+	next := thread.values + delta
+	if next < thread.values {
+		next = math.MaxUint64
+	}
+	if thread.maxValues > 0 && next > thread.maxValues {
+		err := &ValuesSafetyError{
+			Current: thread.values,
+			Max:     thread.maxValues,
+		}
+		thread.values = next
+		thread.cancel(err)
+		return err
+	}
+	thread.values = next
+	return nil
+}
+
+// SetMaxArgs sets a limit on the number of arguments, positional and named,
+// which may be passed by a single call, once any *args and **kwargs have been
+// spread. If max is zero or negative, the number of arguments is not limited.
+func (thread *Thread) SetMaxArgs(max int) {
+	thread.maxArgs = max
+}
+
+// SetMaxJoinBytes sets a limit on the combined length of the strings which
+// string.join, and the number of ints which bytes, may gather from a single
+// iterable. Once it is exceeded, the thread is cancelled. If max is zero,
+// the length is not limited.
+func (thread *Thread) SetMaxJoinBytes(max uint64) {
+	thread.maxJoinBytes = max
+}
+
+// joinBudget applies the limit set by SetMaxJoinBytes, if any, to an
+// iterator obtained through SafeIterate.
+func (thread *Thread) joinBudget(iter Iterator) Iterator {
+	if thread == nil || thread.maxJoinBytes == 0 {
+		return iter
+	}
+	if safeIter, ok := iter.(SafeIterator); ok {
+		return SafeByteBudgetIterator(thread, safeIter, thread.maxJoinBytes)
+	}
+	return SafeByteBudgetIterator(thread, unsafeIterator{iter}, thread.maxJoinBytes)
+}
+
+// checkArgs returns an error if passing n arguments to a call would exceed
+// the limit set by SetMaxArgs.
+func (thread *Thread) checkArgs(n int) error {
+	if thread.maxArgs > 0 && n > thread.maxArgs {
+		return fmt.Errorf("too many arguments: call exceeds the maximum of %d", thread.maxArgs)
+	}
+	return nil
+}
+
+// defaultMaxDepth is the depth limit of threads on which SetMaxDepth has not
+// been called.
+const defaultMaxDepth = 1000
+
+// SetMaxDepth sets a limit on the depth to which recursive operations on
+// nested values, such as SafeDeepMerge, SafeHash and SafeCompare, may
+// descend. If max is zero or negative, a default limit of 1000 applies.
+func (thread *Thread) SetMaxDepth(max int) {
+	thread.maxDepth = max
+}
+
+// SetErrorTransformer sets a function which is applied to each error
+// returned to the client from the outermost Call on this thread, and so
+// from ExecFile, Eval and Program.Init, before it is returned. Errors
+// reported by those functions before or after execution, such as syntax
+// and resolution errors and the accounting of module globals, are
+// transformed too. It may, for example, redact file names or add context.
+// Errors raised and handled within Starlark execution are not affected.
+//
+// A transformer which wraps rather than replaces its argument, as with
+// fmt.Errorf and %w, preserves errors.Is and errors.As relationships, such
+// as with ErrSafety. If f is nil, errors are returned unchanged.
+func (thread *Thread) SetErrorTransformer(f func(error) error) {
+	thread.errorTransformer = f
+}
+
+func (thread *Thread) depthLimit() int {
+	if thread == nil || thread.maxDepth <= 0 {
+		return defaultMaxDepth
+	}
+	return thread.maxDepth
+}
+
 // RequireSafety makes the thread only accept functions that declare at least
 // the provided safety.
 func (thread *Thread) RequireSafety(safety SafetyFlags) {
@@ -347,6 +588,11 @@ func (thread *Thread) cancel(err error) {
 		thread.cancelCleanup()
 		thread.cancelCleanup = nil
 	}
+
+	if thread.deadlineTimer != nil {
+		thread.deadlineTimer.Stop()
+		thread.deadlineTimer = nil
+	}
 }
 
 func (thread *Thread) cancelled() error {
@@ -356,6 +602,66 @@ func (thread *Thread) cancelled() error {
 	return thread.cancelReason
 }
 
+// maxResourceTraceEntries bounds the number of lines written to a resource
+// trace.
+const maxResourceTraceEntries = 100_000
+
+// SetResourceTrace causes a line to be written to w for each call to
+// AddSteps or AddAllocs, giving the kind of resource, the amount and the
+// name of the innermost function on the call stack. After 100,000 lines
+// the trace is truncated. If w is nil, no trace is written.
+//
+// This is intended for debugging unexpected accounting. It must not be
+// called after execution begins. Resources may be reported from any
+// goroutine, but w is only written by one at a time.
+func (thread *Thread) SetResourceTrace(w io.Writer) {
+	thread.resourceTrace = w
+	thread.resourceTraceEntries = 0
+}
+
+func (thread *Thread) traceResource(kind string, delta SafeInteger) {
+	thread.traceLock.Lock()
+	defer thread.traceLock.Unlock()
+
+	if thread.resourceTraceEntries > maxResourceTraceEntries {
+		return
+	}
+	thread.resourceTraceEntries++
+	if thread.resourceTraceEntries > maxResourceTraceEntries {
+		fmt.Fprintln(thread.resourceTrace, "resource trace truncated")
+		return
+	}
+
+	name := thread.traceCallee
+	if name == "" {
+		name = "<none>"
+	}
+	if delta64, ok := delta.Int64(); ok {
+		fmt.Fprintf(thread.resourceTrace, "%s %d %s\n", kind, delta64, name)
+	} else {
+		fmt.Fprintf(thread.resourceTrace, "%s invalid %s\n", kind, name)
+	}
+}
+
+// updateTraceCallee records the name of the innermost function on the call
+// stack for traceResource. It must be called by the goroutine executing the
+// thread, as that alone may read the stack.
+func (thread *Thread) updateTraceCallee() {
+	// The innermost frame may not yet be initialised while a call is
+	// being set up.
+	name := ""
+	for i := len(thread.stack) - 1; i >= 0; i-- {
+		if c := thread.stack[i].callable; c != nil {
+			name = c.Name()
+			break
+		}
+	}
+
+	thread.traceLock.Lock()
+	defer thread.traceLock.Unlock()
+	thread.traceCallee = name
+}
+
 // SetLocal sets the thread-local value associated with the specified key.
 // It must not be called after execution begins.
 func (thread *Thread) SetLocal(key string, value interface{}) {
@@ -753,7 +1059,23 @@ func (fr *frame) asCallFrame() CallFrame {
 	}
 }
 
+// evalError wraps err with a copy of the thread's call stack. It is done
+// once, where the error arises: enclosing calls propagate the resulting
+// EvalError unchanged. The error message is that of err, so only the
+// EvalError and its call stack are charged to the thread. Should this
+// exceed the thread's allocation limit, the thread is cancelled and the
+// resulting safety error is reported in place of err, without a call
+// stack.
 func (thread *Thread) evalError(err error) *EvalError {
+	size := SafeAdd(
+		EstimateSize(&EvalError{}),
+		EstimateMakeSize([]CallFrame{}, SafeInt(len(thread.stack))),
+	)
+	if err2 := thread.AddAllocs(size); err2 != nil {
+		// The thread is now cancelled. Report why, without the copy of
+		// the call stack which could not be afforded.
+		return &EvalError{Msg: err2.Error(), cause: err2}
+	}
 	return &EvalError{
 		Msg:       err.Error(),
 		CallStack: thread.CallStack(),
@@ -846,7 +1168,7 @@ func ExecFileOptions(opts *syntax.FileOptions, thread *Thread, filename string,
 	// Parse, resolve, and compile a Starlark source file.
 	_, mod, err := SourceProgramOptions(opts, filename, src, predeclared.Has)
 	if err != nil {
-		return nil, err
+		return nil, thread.transformError(err)
 	}
 
 	g, err := mod.Init(thread, predeclared)
@@ -926,14 +1248,29 @@ func CompiledProgram(in io.Reader) (*Program, error) {
 // Init creates a set of global variables for the program,
 // executes the toplevel code of the specified program,
 // and returns a new, unfrozen dictionary of the globals.
+//
+// The space for the globals and the dictionary which holds them
+// are accounted to thread.
 func (prog *Program) Init(thread *Thread, predeclared StringDict) (StringDict, error) {
+	if thread != nil {
+		globalsSize := EstimateMakeSize([]Value{}, SafeInt(len(prog.compiled.Globals)))
+		if err := thread.AddAllocs(globalsSize); err != nil {
+			return nil, thread.transformError(err)
+		}
+	}
 	toplevel := makeToplevelFunction(prog.compiled, predeclared)
 
 	_, err := Call(thread, toplevel, nil, nil)
 
 	// Convert the global environment to a map.
 	// We return a (partial) map even in case of error.
-	return toplevel.Globals(), err
+	globals := toplevel.Globals()
+	if thread != nil && len(globals) > 0 {
+		if err2 := thread.AddAllocs(EstimateMakeSize(StringDict{}, SafeInt(len(globals)))); err2 != nil && err == nil {
+			err = thread.transformError(err2)
+		}
+	}
+	return globals, err
 }
 
 // ExecREPLChunk compiles and executes file f in the specified thread
@@ -950,7 +1287,7 @@ func ExecREPLChunk(f *syntax.File, thread *Thread, globals StringDict) error {
 	// -- variant of FileProgram --
 
 	if err := resolve.REPLChunk(f, globals.Has, predeclared.Has, Universe.Has); err != nil {
-		return err
+		return thread.transformError(err)
 	}
 
 	var pos syntax.Position
@@ -1041,11 +1378,11 @@ func Eval(thread *Thread, filename string, src interface{}, env StringDict) (Val
 func EvalOptions(opts *syntax.FileOptions, thread *Thread, filename string, src interface{}, env StringDict) (Value, error) {
 	expr, err := opts.ParseExpr(filename, src, 0)
 	if err != nil {
-		return nil, err
+		return nil, thread.transformError(err)
 	}
 	f, err := makeExprFunc(opts, expr, env)
 	if err != nil {
-		return nil, err
+		return nil, thread.transformError(err)
 	}
 	return Call(thread, f, nil, nil)
 }
@@ -1073,7 +1410,7 @@ func EvalExpr(thread *Thread, expr syntax.Expr, env StringDict) (Value, error) {
 func EvalExprOptions(opts *syntax.FileOptions, thread *Thread, expr syntax.Expr, env StringDict) (Value, error) {
 	fn, err := makeExprFunc(opts, expr, env)
 	if err != nil {
-		return nil, err
+		return nil, thread.transformError(err)
 	}
 	return Call(thread, fn, nil, nil)
 }
@@ -1170,7 +1507,16 @@ func getAttr(thread *Thread, x Value, name string, hint bool) (Value, error) {
 
 			// add spelling hint
 			if hint {
-				if n := spell.Nearest(name, x.AttrNames()); n != "" {
+				names, err := safeAttrNames(thread, x)
+				if err != nil {
+					return nil, err
+				}
+				if thread != nil {
+					if err := thread.AddSteps(SafeInt(len(names))); err != nil {
+						return nil, err
+					}
+				}
+				if n := spell.Nearest(name, names); n != "" {
 					errmsg = fmt.Sprintf("%s (did you mean .%s?)", errmsg, n)
 				}
 			}
@@ -1194,7 +1540,16 @@ func setField(thread *Thread, x Value, name string, y Value) error {
 
 		if _, ok := err.(NoSuchAttrError); ok {
 			// No such field: check spelling.
-			if n := spell.Nearest(name, x.AttrNames()); n != "" {
+			names, err2 := safeAttrNames(thread, x)
+			if err2 != nil {
+				return err2
+			}
+			if thread != nil {
+				if err2 := thread.AddSteps(SafeInt(len(names))); err2 != nil {
+					return err2
+				}
+			}
+			if n := spell.Nearest(name, names); n != "" {
 				err = fmt.Errorf("%s (did you mean .%s?)", err, n)
 			}
 		}
@@ -1222,7 +1577,7 @@ func getIndex(thread *Thread, x, y Value) (Value, error) {
 			return nil, err
 		}
 		if !found {
-			return nil, fmt.Errorf("key %v not in %s", y, x.Type())
+			return nil, fmt.Errorf("key %s not in %s", safeReprForError(thread, y), x.Type())
 		}
 		return z, nil
 
@@ -1594,18 +1949,8 @@ func safeBinary(thread *Thread, op syntax.Token, x, y Value) (Value, error) {
 				}
 				return xf * y, nil
 			case String:
-				if thread != nil {
-					if err := thread.AddAllocs(StringTypeOverhead); err != nil {
-						return nil, err
-					}
-				}
 				return stringRepeat(thread, y, x)
 			case Bytes:
-				if thread != nil {
-					if err := thread.AddAllocs(StringTypeOverhead); err != nil {
-						return nil, err
-					}
-				}
 				return bytesRepeat(thread, y, x)
 			case *List:
 				elems, err := tupleRepeat(thread, Tuple(y.elems), x)
@@ -1619,12 +1964,16 @@ func safeBinary(thread *Thread, op syntax.Token, x, y Value) (Value, error) {
 				}
 				return NewList(elems), nil
 			case Tuple:
-				if thread != nil {
+				result, err := tupleRepeat(thread, y, x)
+				if err != nil {
+					return nil, err
+				}
+				if thread != nil && len(result) > 0 {
 					if err := thread.AddAllocs(SliceTypeOverhead); err != nil {
 						return nil, err
 					}
 				}
-				return tupleRepeat(thread, y, x)
+				return result, nil
 			}
 		case Float:
 			switch y := y.(type) {
@@ -1649,20 +1998,10 @@ func safeBinary(thread *Thread, op syntax.Token, x, y Value) (Value, error) {
 			}
 		case String:
 			if y, ok := y.(Int); ok {
-				if thread != nil {
-					if err := thread.AddAllocs(StringTypeOverhead); err != nil {
-						return nil, err
-					}
-				}
 				return stringRepeat(thread, x, y)
 			}
 		case Bytes:
 			if y, ok := y.(Int); ok {
-				if thread != nil {
-					if err := thread.AddAllocs(StringTypeOverhead); err != nil {
-						return nil, err
-					}
-				}
 				return bytesRepeat(thread, x, y)
 			}
 		case *List:
@@ -1680,12 +2019,16 @@ func safeBinary(thread *Thread, op syntax.Token, x, y Value) (Value, error) {
 			}
 		case Tuple:
 			if y, ok := y.(Int); ok {
-				if thread != nil {
+				result, err := tupleRepeat(thread, x, y)
+				if err != nil {
+					return nil, err
+				}
+				if thread != nil && len(result) > 0 {
 					if err := thread.AddAllocs(SliceTypeOverhead); err != nil {
 						return nil, err
 					}
 				}
-				return tupleRepeat(thread, x, y)
+				return result, nil
 			}
 
 		}
@@ -1898,7 +2241,9 @@ func safeBinary(thread *Thread, op syntax.Token, x, y Value) (Value, error) {
 				return x.Mod(yf), nil
 			}
 		case String:
-			return interpolate(thread, string(x), y)
+			return interpolate(thread, string(x), y, false)
+		case Bytes:
+			return interpolate(thread, string(x), y, true)
 		}
 
 	case syntax.NOT_IN:
@@ -1911,33 +2256,17 @@ func safeBinary(thread *Thread, op syntax.Token, x, y Value) (Value, error) {
 	case syntax.IN:
 		switch y := y.(type) {
 		case *List:
-			for _, elem := range y.elems {
-				if thread != nil {
-					if err := thread.AddSteps(SafeInt(1)); err != nil {
-						return nil, err
-					}
-				}
-				if eq, err := Equal(elem, x); err != nil {
-					return nil, err
-				} else if eq {
-					return True, nil
-				}
+			found, err := safeContains(thread, y.elems, x)
+			if err != nil {
+				return nil, err
 			}
-			return False, nil
+			return Bool(found), nil
 		case Tuple:
-			for _, elem := range y {
-				if thread != nil {
-					if err := thread.AddSteps(SafeInt(1)); err != nil {
-						return nil, err
-					}
-				}
-				if eq, err := Equal(elem, x); err != nil {
-					return nil, err
-				} else if eq {
-					return True, nil
-				}
+			found, err := safeContains(thread, y, x)
+			if err != nil {
+				return nil, err
 			}
-			return False, nil
+			return Bool(found), nil
 		case Mapping: // e.g. dict
 			if y, ok := y.(SafeMapping); ok {
 				_, found, err := y.SafeGet(thread, x)
@@ -2188,6 +2517,25 @@ unknown:
 	return nil, fmt.Errorf("unknown binary op: %s %s %s", x.Type(), op, y.Type())
 }
 
+// safeContains reports whether x is equal to any of elems. Each element
+// examined costs a step, and comparisons of composite values are
+// accounted element by element.
+func safeContains(thread *Thread, elems []Value, x Value) (bool, error) {
+	for _, elem := range elems {
+		if thread != nil {
+			if err := thread.AddSteps(SafeInt(1)); err != nil {
+				return false, err
+			}
+		}
+		if eq, err := SafeCompare(thread, syntax.EQL, elem, x); err != nil {
+			return false, err
+		} else if eq {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // It's always possible to overeat in small bites but we'll
 // try to stop someone swallowing the world in one gulp.
 const maxAlloc = 1 << 30
@@ -2253,7 +2601,8 @@ func stringRepeat(thread *Thread, s String, n Int) (String, error) {
 		if err := thread.AddSteps(SafeInt(sz)); err != nil {
 			return "", err
 		}
-		if err := thread.AddAllocs(EstimateMakeSize([]byte{}, SafeInt(sz))); err != nil {
+		resultSize := SafeAdd(EstimateMakeSize([]byte{}, SafeInt(sz)), StringTypeOverhead)
+		if err := thread.AddAllocs(resultSize); err != nil {
 			return "", err
 		}
 	}
@@ -2266,6 +2615,20 @@ const maxStackDepth = 110_000
 
 // Call calls the function fn with the specified positional and keyword arguments.
 func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
+	result, err := call(thread, fn, args, kwargs)
+	return result, thread.transformError(err)
+}
+
+// transformError applies the thread's error transformer, if any, to an
+// error which is about to be returned to the client.
+func (thread *Thread) transformError(err error) error {
+	if err != nil && thread != nil && thread.errorTransformer != nil && len(thread.stack) == 0 {
+		return thread.errorTransformer(err)
+	}
+	return err
+}
+
+func call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 	c, ok := fn.(Callable)
 	if !ok {
 		return nil, fmt.Errorf("invalid call of non-function (%s)", fn.Type())
@@ -2323,6 +2686,9 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 	}
 
 	fr.callable = c
+	if thread.resourceTrace != nil {
+		thread.updateTraceCallee()
+	}
 
 	thread.beginProfSpan()
 
@@ -2338,6 +2704,9 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 		*fr = frame{}
 
 		thread.stack = thread.stack[:len(thread.stack)-1] // pop
+		if thread.resourceTrace != nil {
+			thread.updateTraceCallee()
+		}
 	}()
 
 	result, err := c.CallInternal(thread, args, kwargs)
@@ -2357,7 +2726,7 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return result, err
 }
 
-func slice(x, lo, hi, step_ Value) (Value, error) {
+func slice(thread *Thread, x, lo, hi, step_ Value) (Value, error) {
 	sliceable, ok := x.(Sliceable)
 	if !ok {
 		return nil, fmt.Errorf("invalid slice operand %s", x.Type())
@@ -2376,8 +2745,6 @@ func slice(x, lo, hi, step_ Value) (Value, error) {
 		}
 	}
 
-	// TODO(adonovan): opt: preallocate result array.
-
 	var start, end int
 	if step > 0 {
 		// positive stride
@@ -2417,6 +2784,12 @@ func slice(x, lo, hi, step_ Value) (Value, error) {
 		}
 	}
 
+	if sliceable, ok := sliceable.(SafeSliceable); ok {
+		return sliceable.SafeSlice(thread, start, end, step)
+	}
+	if err := CheckSafety(thread, NotSafe); err != nil {
+		return nil, err
+	}
 	return sliceable.Slice(start, end, step), nil
 }
 
@@ -2473,8 +2846,9 @@ func asIndex(v Value, len int, result *int) error {
 }
 
 // setArgs sets the values of the formal parameters of function fn in
-// based on the actual parameter values in args and kwargs.
-func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
+// based on the actual parameter values in args and kwargs. The residual
+// *args tuple and **kwargs dict are accounted to thread.
+func setArgs(thread *Thread, locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 
 	// This is the general schema of a function:
 	//
@@ -2514,7 +2888,11 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 	var kwdict *Dict
 	if fn.HasKwargs() {
 		nparams--
-		kwdict = new(Dict)
+		var err error
+		kwdict, err = SafeNewDict(thread, 0)
+		if err != nil {
+			return err
+		}
 		locals[nparams] = kwdict
 	}
 	if fn.HasVarargs() {
@@ -2545,6 +2923,10 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 
 	// Bind surplus positional arguments to *args parameter.
 	if fn.HasVarargs() {
+		tupleSize := SafeAdd(EstimateMakeSize(Tuple{}, SafeInt(len(args)-n)), SliceTypeOverhead)
+		if err := thread.AddAllocs(tupleSize); err != nil {
+			return err
+		}
 		tuple := make(Tuple, len(args)-n)
 		for i := n; i < len(args); i++ {
 			tuple[i-n] = args[i]
@@ -2567,7 +2949,9 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 			return fmt.Errorf("function %s got an unexpected keyword argument %s", fn.Name(), k)
 		}
 		oldlen := kwdict.Len()
-		kwdict.SetKey(k, v)
+		if err := kwdict.SafeSetKey(thread, k, v); err != nil {
+			return err
+		}
 		if kwdict.Len() == oldlen {
 			return fmt.Errorf("function %s got multiple values for parameter %s", fn.Name(), k)
 		}
@@ -2616,7 +3000,11 @@ func findParam(params []compile.Binding, name string) int {
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string-interpolation
-func interpolate(thread *Thread, format string, x Value) (Value, error) {
+//
+// If isBytes is set, the format is a bytes value: the result is a Bytes,
+// mapping keys are looked up as Bytes, and %s and %c accept bytes rather
+// than strings.
+func interpolate(thread *Thread, format string, x Value, isBytes bool) (Value, error) {
 	buf := NewSafeStringBuilder(thread)
 	index := 0
 	nargs := 1
@@ -2653,12 +3041,16 @@ func interpolate(thread *Thread, format string, x Value) (Value, error) {
 				return nil, fmt.Errorf("incomplete format key")
 			}
 			key := format[:j]
+			var k Value = String(key)
+			if isBytes {
+				k = Bytes(key)
+			}
 			var v Value
 			var found bool
 			switch x := x.(type) {
 			case SafeMapping:
 				var err error
-				v, found, err = x.SafeGet(thread, String(key))
+				v, found, err = x.SafeGet(thread, k)
 				if errors.Is(err, ErrSafety) {
 					return nil, err
 				}
@@ -2666,12 +3058,12 @@ func interpolate(thread *Thread, format string, x Value) (Value, error) {
 				if err := CheckSafety(thread, NotSafe); err != nil {
 					return nil, err
 				}
-				v, found, _ = x.Get(String(key))
+				v, found, _ = x.Get(k)
 			default:
 				return nil, fmt.Errorf("format requires a mapping")
 			}
 			if !found {
-				return nil, fmt.Errorf("key not found: %s", key)
+				return nil, fmt.Errorf("key not found: %s", safeReprForError(thread, k))
 			}
 			arg = v
 			format = format[j+1:]
@@ -2698,7 +3090,19 @@ func interpolate(thread *Thread, format string, x Value) (Value, error) {
 			return nil, fmt.Errorf("incomplete format")
 		}
 		switch c := format[0]; c {
-		case 's', 'r':
+		case 's':
+			if isBytes {
+				b, ok := arg.(Bytes)
+				if !ok {
+					return nil, fmt.Errorf("%%s format requires bytes, not %s", arg.Type())
+				}
+				if _, err := buf.WriteString(string(b)); err != nil {
+					return nil, err
+				}
+				break
+			}
+			fallthrough
+		case 'r':
 			if str, ok := AsString(arg); ok && c == 's' {
 				if _, err := buf.WriteString(str); err != nil {
 					return nil, err
@@ -2740,12 +3144,34 @@ func interpolate(thread *Thread, format string, x Value) (Value, error) {
 				return nil, err
 			}
 		case 'c':
+			if isBytes {
+				switch arg := arg.(type) {
+				case Int:
+					b, err := AsInt32(arg)
+					if err != nil || b < 0 || b > 0xff {
+						return nil, fmt.Errorf("%%c format requires an integer in range(256), got %s", safeReprForError(thread, arg))
+					}
+					if err := buf.WriteByte(byte(b)); err != nil {
+						return nil, err
+					}
+				case Bytes:
+					if len(arg) != 1 {
+						return nil, fmt.Errorf("%%c format requires a single byte")
+					}
+					if err := buf.WriteByte(arg[0]); err != nil {
+						return nil, err
+					}
+				default:
+					return nil, fmt.Errorf("%%c format requires int or single byte, not %s", arg.Type())
+				}
+				break
+			}
 			switch arg := arg.(type) {
 			case Int:
 				// chr(int)
 				r, err := AsInt32(arg)
 				if err != nil || r < 0 || r > unicode.MaxRune {
-					return nil, fmt.Errorf("%%c format requires a valid Unicode code point, got %s", arg)
+					return nil, fmt.Errorf("%%c format requires a valid Unicode code point, got %s", safeReprForError(thread, arg))
 				}
 				if _, err := buf.WriteRune(rune(r)); err != nil {
 					return nil, err
@@ -2786,6 +3212,9 @@ func interpolate(thread *Thread, format string, x Value) (Value, error) {
 			return nil, err
 		}
 	}
+	if isBytes {
+		return Bytes(buf.String()), nil
+	}
 	return String(buf.String()), nil
 }
 
@@ -2802,6 +3231,45 @@ func (e *AllocsSafetyError) Is(err error) bool {
 	return err == ErrSafety
 }
 
+type SingleAllocSafetyError struct {
+	Size SafeInteger
+	Max  uintptr
+}
+
+func (e *SingleAllocSafetyError) Error() string {
+	return "exceeded single allocation limit"
+}
+
+func (e *SingleAllocSafetyError) Is(err error) bool {
+	return err == ErrSafety
+}
+
+type AllocCountSafetyError struct {
+	Current uint64
+	Max     uint64
+}
+
+func (e *AllocCountSafetyError) Error() string {
+	return "exceeded allocation count limits"
+}
+
+func (e *AllocCountSafetyError) Is(err error) bool {
+	return err == ErrSafety
+}
+
+type ValuesSafetyError struct {
+	Current uint64
+	Max     uint64
+}
+
+func (e *ValuesSafetyError) Error() string {
+	return "exceeded value count limits"
+}
+
+func (e *ValuesSafetyError) Is(err error) bool {
+	return err == ErrSafety
+}
+
 type StepsSafetyError struct {
 	Current SafeInteger
 	Max     int64
@@ -2824,22 +3292,33 @@ func (thread *Thread) CheckAllocs(delta SafeInteger) error {
 	thread.allocsLock.Lock()
 	defer thread.allocsLock.Unlock()
 
-	_, err := thread.simulateAllocs(delta)
+	if _, err := thread.simulateAllocs(delta); err != nil {
+		return err
+	}
+	_, err := thread.simulateAllocCount(delta)
 	return err
 }
 
 // AddAllocs reports a change in allocations associated with this thread. If
-// the total allocations exceed the limit defined via SetMaxAllocs, the thread
-// is cancelled and an error is returned.
+// the total allocations exceed the limit defined via SetMaxAllocs, or delta
+// exceeds that defined via SetMaxSingleAlloc, the thread is cancelled and an
+// error is returned.
 //
 // It is safe to call AddAllocs from any goroutine, even if the thread is
 // actively executing.
 func (thread *Thread) AddAllocs(delta SafeInteger) error {
+	if thread.resourceTrace != nil {
+		thread.traceResource("allocs", delta)
+	}
+
 	thread.allocsLock.Lock()
 	defer thread.allocsLock.Unlock()
 
 	next, err := thread.simulateAllocs(delta)
 	thread.allocs = next
+	if err == nil {
+		thread.allocCount, err = thread.simulateAllocCount(delta)
+	}
 	if err != nil {
 		thread.cancel(err)
 	}
@@ -2854,6 +3333,14 @@ var errAllocCountInvalidated = errors.New("alloc count invalidated")
 // change is recorded.
 func (thread *Thread) simulateAllocs(delta SafeInteger) (SafeInteger, error) {
 	nextAllocs := SafeAdd(thread.allocs, delta)
+	if thread.maxSingleAlloc > 0 {
+		if delta64, ok := delta.Int64(); !ok || (delta64 > 0 && uint64(delta64) > uint64(thread.maxSingleAlloc)) {
+			return nextAllocs, &SingleAllocSafetyError{
+				Size: delta,
+				Max:  thread.maxSingleAlloc,
+			}
+		}
+	}
 	nextAllocs64, ok := nextAllocs.Int64()
 	if !ok {
 		if thread.maxAllocs > 0 {
@@ -2874,3 +3361,21 @@ func (thread *Thread) simulateAllocs(delta SafeInteger) (SafeInteger, error) {
 	}
 	return nextAllocs, nil
 }
+
+// simulateAllocCount simulates the effect of a call to AddAllocs on the
+// number of allocations associated with this thread, returning the new count
+// and any error this would entail. No change is recorded.
+func (thread *Thread) simulateAllocCount(delta SafeInteger) (uint64, error) {
+	if delta64, ok := delta.Int64(); !ok || delta64 <= 0 {
+		return thread.allocCount, nil
+	}
+
+	nextCount := thread.allocCount + 1
+	if thread.maxAllocCount > 0 && nextCount > thread.maxAllocCount {
+		return nextCount, &AllocCountSafetyError{
+			Current: thread.allocCount,
+			Max:     thread.maxAllocCount,
+		}
+	}
+	return nextCount, nil
+}
@@ -13,11 +13,14 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	gotime "time"
+	"unicode/utf8"
 
 	"github.com/canonical/starlark/internal/chunkedfile"
 	"github.com/canonical/starlark/lib/json"
@@ -177,6 +180,107 @@ func TestExecFile(t *testing.T) {
 	}
 }
 
+// assertRecorder is a starlarktest.Reporter which records the errors
+// reported to it.
+type assertRecorder struct {
+	errors []string
+}
+
+func (ar *assertRecorder) Error(args ...interface{}) {
+	ar.errors = append(ar.errors, fmt.Sprint(args...))
+}
+
+func TestAssertModuleLimits(t *testing.T) {
+	const elems = 10000
+
+	run := func(maxSteps int64, src string) (*starlark.Thread, *assertRecorder, error) {
+		thread := &starlark.Thread{Load: load}
+		thread.SetMaxSteps(maxSteps)
+		recorder := &assertRecorder{}
+		starlarktest.SetReporter(thread, recorder)
+		makeList := func() *starlark.List {
+			list := make([]starlark.Value, elems)
+			for i := range list {
+				list[i] = starlark.MakeInt(i)
+			}
+			return starlark.NewList(list)
+		}
+		predeclared := starlark.StringDict{
+			"a": makeList(),
+			"b": makeList(),
+		}
+		src = "load('assert.star', 'assert')\n" + src
+		_, err := starlark.ExecFile(thread, "limits.star", src, predeclared)
+		return thread, recorder, err
+	}
+
+	t.Run("eq-accounted", func(t *testing.T) {
+		thread, recorder, err := run(0, "assert.eq(a, b)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recorder.errors) != 0 {
+			t.Errorf("unexpected assertion failures: %v", recorder.errors)
+		}
+		if steps, _ := thread.Steps(); steps < elems {
+			t.Errorf("comparison was not accounted: got %d steps, want at least %d", steps, elems)
+		}
+	})
+
+	t.Run("eq-limited", func(t *testing.T) {
+		_, _, err := run(elems/2, "assert.eq(a, b)")
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("fails-surfaces-safety", func(t *testing.T) {
+		_, recorder, err := run(elems/2, "assert.fails(lambda: a == b, '.*')")
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(recorder.errors) != 0 {
+			t.Errorf("safety error reported as an assertion failure: %v", recorder.errors)
+		}
+	})
+
+	t.Run("fails-surfaces-unsafe", func(t *testing.T) {
+		thread := &starlark.Thread{Load: load}
+		thread.RequireSafety(starlark.CPUSafe)
+		recorder := &assertRecorder{}
+		starlarktest.SetReporter(thread, recorder)
+		predeclared := starlark.StringDict{
+			"unsafe": starlark.NewBuiltin("unsafe", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+				return starlark.None, nil
+			}),
+		}
+		const src = "load('assert.star', 'assert')\nassert.fails(unsafe, '.*')"
+		_, err := starlark.ExecFile(thread, "limits.star", src, predeclared)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(recorder.errors) != 0 {
+			t.Errorf("safety error reported as an assertion failure: %v", recorder.errors)
+		}
+	})
+
+	t.Run("fails-catches-errors", func(t *testing.T) {
+		_, recorder, err := run(elems/2, "assert.fails(lambda: fail('oops'), 'oops')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recorder.errors) != 0 {
+			t.Errorf("unexpected assertion failures: %v", recorder.errors)
+		}
+	})
+}
+
 // A fib is an iterable value representing the infinite Fibonacci sequence.
 type fib struct{}
 
@@ -577,6 +681,92 @@ Error in join: join: in list, want string, got int`,
 	}
 }
 
+func TestEvalErrorAllocs(t *testing.T) {
+	// An error is wrapped in an EvalError once, where it arises, and
+	// then propagates through the enclosing frames unchanged.
+	const src = `
+def f(): fail(msg)
+def g(): f()
+def h(): g()
+def i(): h()
+`
+	const depth = 5 // i, h, g, f and fail
+
+	testFail := func(t *testing.T, msg string, maxAllocs int64) {
+		predeclared := starlark.StringDict{"msg": starlark.String(msg)}
+		globals, err := starlark.ExecFile(&starlark.Thread{}, "fail.star", src, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		if maxAllocs > 0 {
+			st.SetMaxAllocs(maxAllocs)
+		}
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, globals["i"], nil, nil)
+				var evalErr *starlark.EvalError
+				if !errors.As(err, &evalErr) {
+					st.Fatalf("expected EvalError, got %v", err)
+				}
+				if n := len(evalErr.CallStack); n != depth {
+					st.Errorf("unexpected call stack depth: got %d, want %d", n, depth)
+				}
+				st.KeepAlive(evalErr)
+			}
+		})
+	}
+
+	t.Run("small", func(t *testing.T) {
+		testFail(t, "x", 0)
+	})
+
+	t.Run("large", func(t *testing.T) {
+		// Were the message copied for each frame, depth times its
+		// length would be needed.
+		msg := strings.Repeat("x", 1000)
+		testFail(t, msg, 2*int64(len(msg)))
+	})
+
+	t.Run("unaffordable", func(t *testing.T) {
+		// A builtin which exhausts the allocation budget before failing
+		// leaves no room for the EvalError's copy of the call stack.
+		const maxAllocs = 1 << 20
+		exhaust := starlark.NewBuiltin("exhaust", func(thread *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+			allocs, _ := thread.Allocs()
+			if err := thread.AddAllocs(starlark.SafeInt(maxAllocs - allocs)); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("failed")
+		})
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(maxAllocs)
+		_, err := starlark.ExecFile(thread, "fail.star", "exhaust()", starlark.StringDict{"exhaust": exhaust})
+		if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("expected a safety error, got %v", err)
+		}
+		var evalErr *starlark.EvalError
+		if !errors.As(err, &evalErr) {
+			t.Errorf("expected EvalError, got %T", err)
+		} else if len(evalErr.CallStack) != 0 {
+			t.Errorf("unexpected call stack: %v", evalErr.CallStack)
+		}
+
+		// The accounting failure is reported in place of the original error.
+		var allocsErr *starlark.AllocsSafetyError
+		if !errors.As(err, &allocsErr) {
+			t.Errorf("expected AllocsSafetyError, got %v", err)
+		} else if msg := err.Error(); msg != allocsErr.Error() {
+			t.Errorf("unexpected error message: got %q, want %q", msg, allocsErr.Error())
+		}
+		if strings.Contains(err.Error(), "failed") {
+			t.Errorf("original error reported: %v", err)
+		}
+	})
+}
+
 func TestLoadBacktrace(t *testing.T) {
 	// This test ensures that load() does NOT preserve stack traces,
 	// but that API callers can get them with Unwrap().
@@ -869,6 +1059,46 @@ g(z=7)
 	}
 }
 
+func TestCallStack(t *testing.T) {
+	var got starlark.CallStack
+	builtin := func(thread *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		got = thread.CallStack()
+		return starlark.None, nil
+	}
+	predeclared := starlark.StringDict{
+		"builtin": starlark.NewBuiltin("builtin", builtin),
+	}
+	thread := &starlark.Thread{}
+	_, err := starlark.ExecFile(thread, "foo.star", `
+def f(): builtin()
+def g():
+	f()
+g()
+`, predeclared)
+	if err != nil {
+		t.Fatalf("ExecFile failed: %v", err)
+	}
+
+	want := `
+Traceback (most recent call last):
+  foo.star:5:2: in <toplevel>
+  foo.star:4:3: in g
+  foo.star:2:17: in f
+  <builtin>: in builtin
+`[1:]
+	if s := got.String(); s != want {
+		t.Errorf("got <<%s>>, want <<%s>>", s, want)
+	}
+
+	// The result is a snapshot, unaffected by later execution.
+	if depth := thread.CallStackDepth(); depth != 0 {
+		t.Errorf("unexpected call stack depth after execution: %d", depth)
+	}
+	if got.At(0).Name != "builtin" || len(got) != 4 {
+		t.Errorf("call stack changed after execution: %v", got)
+	}
+}
+
 type badType string
 
 func (b *badType) String() string        { return "badType" }
@@ -1408,6 +1638,277 @@ func TestMaxStackDepth(t *testing.T) {
 	})
 }
 
+func TestMaxLiteralBytes(t *testing.T) {
+	const maxLiteralBytes = 1 << 20
+	src := "x = 1\ns = \"" + strings.Repeat("a", 4*maxLiteralBytes) + "\"\n"
+	isPredeclared := func(string) bool { return false }
+
+	t.Run("unlimited", func(t *testing.T) {
+		opts := &syntax.FileOptions{}
+		_, prog, err := starlark.SourceProgramOptions(opts, "big.star", src, isPredeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		globals, err := prog.Init(&starlark.Thread{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, ok := globals["s"].(starlark.String); !ok || len(s) != 4*maxLiteralBytes {
+			t.Errorf("unexpected value for s")
+		}
+	})
+
+	t.Run("within-limits", func(t *testing.T) {
+		opts := &syntax.FileOptions{MaxLiteralBytes: 5 * maxLiteralBytes}
+		_, _, err := starlark.SourceProgramOptions(opts, "big.star", src, isPredeclared)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("exceeding-limits", func(t *testing.T) {
+		const expected = "big.star:2:5: literals exceed the limit of 1048576 bytes"
+
+		opts := &syntax.FileOptions{MaxLiteralBytes: maxLiteralBytes}
+		_, prog, err := starlark.SourceProgramOptions(opts, "big.star", src, isPredeclared)
+		if err == nil {
+			t.Error("expected excessive literals to result in an error")
+		} else if err.Error() != expected {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if prog != nil {
+			t.Error("expected no program to be compiled")
+		}
+	})
+
+	t.Run("many-literals", func(t *testing.T) {
+		var sb strings.Builder
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(&sb, "s%d = %q\n", i, strings.Repeat("a", maxLiteralBytes/2))
+		}
+		opts := &syntax.FileOptions{MaxLiteralBytes: maxLiteralBytes}
+		_, _, err := starlark.SourceProgramOptions(opts, "many.star", sb.String(), isPredeclared)
+		if err == nil {
+			t.Error("expected excessive literals to result in an error")
+		} else if !strings.HasPrefix(err.Error(), "many.star:3:") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestErrorTransformer(t *testing.T) {
+	var calls int
+	annotate := func(err error) error {
+		calls++
+		return fmt.Errorf("in sandbox: %w", err)
+	}
+
+	t.Run("annotation", func(t *testing.T) {
+		calls = 0
+		thread := &starlark.Thread{}
+		thread.SetErrorTransformer(annotate)
+		_, err := starlark.ExecFile(thread, "transform.star", `
+def f():
+    return 1 // 0
+
+def g():
+    return f()
+
+g()
+`, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		const want = "in sandbox: floored division by zero"
+		if msg := err.Error(); msg != want {
+			t.Errorf("unexpected error: got %q, want %q", msg, want)
+		}
+		if calls != 1 {
+			t.Errorf("transformer called %d times, want 1", calls)
+		}
+		var evalErr *starlark.EvalError
+		if !errors.As(err, &evalErr) {
+			t.Errorf("expected wrapped EvalError, got %T", err)
+		} else if len(evalErr.CallStack) != 3 {
+			t.Errorf("unexpected backtrace: %s", evalErr.Backtrace())
+		}
+	})
+
+	t.Run("safety", func(t *testing.T) {
+		calls = 0
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(100)
+		thread.SetErrorTransformer(annotate)
+		_, err := starlark.ExecFileOptions(&syntax.FileOptions{While: true, TopLevelControl: true},
+			thread, "transform.star", "while True: pass", nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("expected a safety error, got %v", err)
+		}
+		if !strings.HasPrefix(err.Error(), "in sandbox: ") {
+			t.Errorf("error not annotated: %v", err)
+		}
+	})
+
+	t.Run("static-errors", func(t *testing.T) {
+		for _, src := range []string{"1 +", "undefined"} {
+			calls = 0
+			thread := &starlark.Thread{}
+			thread.SetErrorTransformer(annotate)
+			if _, err := starlark.ExecFile(thread, "transform.star", src, nil); err == nil {
+				t.Errorf("%q: expected error", src)
+			} else if !strings.HasPrefix(err.Error(), "in sandbox: ") {
+				t.Errorf("%q: error not annotated: %v", src, err)
+			}
+			if _, err := starlark.Eval(thread, "transform.star", src, nil); err == nil {
+				t.Errorf("%q: expected error", src)
+			} else if !strings.HasPrefix(err.Error(), "in sandbox: ") {
+				t.Errorf("%q: error not annotated: %v", src, err)
+			}
+			if calls != 2 {
+				t.Errorf("%q: transformer called %d times, want 2", src, calls)
+			}
+		}
+	})
+
+	t.Run("globals-accounting", func(t *testing.T) {
+		calls = 0
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(1)
+		thread.SetErrorTransformer(annotate)
+		_, err := starlark.ExecFile(thread, "transform.star", "x = 1", nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("expected a safety error, got %v", err)
+		}
+		if !strings.HasPrefix(err.Error(), "in sandbox: ") {
+			t.Errorf("error not annotated: %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("transformer called %d times, want 1", calls)
+		}
+	})
+
+	t.Run("handled-errors", func(t *testing.T) {
+		calls = 0
+		catch := starlark.NewBuiltin("catch", func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if _, err := starlark.Call(thread, args[0], nil, nil); err != nil {
+				return starlark.String(err.Error()), nil
+			}
+			return starlark.None, nil
+		})
+		thread := &starlark.Thread{}
+		thread.SetErrorTransformer(annotate)
+		globals, err := starlark.ExecFile(thread, "transform.star", `msg = catch(lambda: 1 // 0)`, starlark.StringDict{"catch": catch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 0 {
+			t.Errorf("transformer called %d times for a handled error", calls)
+		}
+		if msg := globals["msg"].(starlark.String); strings.HasPrefix(string(msg), "in sandbox") {
+			t.Errorf("handled error was transformed: %s", msg)
+		}
+	})
+
+	t.Run("direct-call", func(t *testing.T) {
+		calls = 0
+		fail := starlark.NewBuiltin("fail", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			return nil, errors.New("failed")
+		})
+		thread := &starlark.Thread{}
+		thread.SetErrorTransformer(annotate)
+		if _, err := starlark.Call(thread, fail, nil, nil); err == nil {
+			t.Error("expected error")
+		} else if msg := err.Error(); msg != "in sandbox: failed" {
+			t.Errorf("unexpected error: %q", msg)
+		}
+
+		thread.SetErrorTransformer(nil)
+		if _, err := starlark.Call(thread, fail, nil, nil); err == nil {
+			t.Error("expected error")
+		} else if msg := err.Error(); msg != "failed" {
+			t.Errorf("unexpected error: %q", msg)
+		}
+	})
+}
+
+func TestErrorReprBounded(t *testing.T) {
+	const maxMsgLen = 512
+	tests := []struct {
+		name   string
+		src    string
+		prefix string
+	}{{
+		name:   "missing-string-key",
+		src:    `{}["x" * 1000000]`,
+		prefix: `key "xxxx`,
+	}, {
+		name:   "missing-tuple-key",
+		src:    `{}[tuple(range(1000000))]`,
+		prefix: `key (0, 1, 2, `,
+	}, {
+		name:   "duplicate-key",
+		src:    `{"y" * 1000000: 1, "y" * 1000000: 2}`,
+		prefix: `duplicate key: "yyyy`,
+	}, {
+		name:   "int-out-of-range",
+		src:    `"abc"[int("9" * 100000)]`,
+		prefix: `string index: <int of 332193 bits> out of range`,
+	}, {
+		name:   "code-point",
+		src:    `"%c" % (1 << 500)`,
+		prefix: `%c format requires a valid Unicode code point, got 32733906078961418700`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			thread := &starlark.Thread{}
+			_, err := starlark.Eval(thread, "bounded.star", test.src, nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			msg := err.(*starlark.EvalError).Msg
+			if len(msg) > maxMsgLen {
+				t.Errorf("error message too long: got %d bytes, want at most %d", len(msg), maxMsgLen)
+			}
+			if !strings.HasPrefix(msg, test.prefix) {
+				t.Errorf("unexpected error: %.100s", msg)
+			}
+		})
+	}
+
+	t.Run("truncation", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		_, err := starlark.Eval(thread, "bounded.star", `{}["é" * 1000]`, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		msg := err.(*starlark.EvalError).Msg
+		const suffix = "... not in dict"
+		if !strings.HasSuffix(msg, suffix) {
+			t.Errorf("expected truncated repr, got %q", msg)
+		} else if repr := strings.TrimSuffix(strings.TrimPrefix(msg, "key "), suffix); !utf8.ValidString(repr) {
+			t.Errorf("truncated repr is not valid UTF-8: %q", repr)
+		}
+	})
+
+	t.Run("small", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		_, err := starlark.Eval(thread, "bounded.star", `{}[("a", 1)]`, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		const want = `key ("a", 1) not in dict`
+		if msg := err.(*starlark.EvalError).Msg; msg != want {
+			t.Errorf("unexpected error: got %q, want %q", msg, want)
+		}
+	})
+}
+
 func TestCancelConsistency(t *testing.T) {
 	thread := &starlark.Thread{}
 	ctx := thread.Context()
@@ -1442,6 +1943,94 @@ func TestCancelConsistency(t *testing.T) {
 	}
 }
 
+func TestThreadDeadline(t *testing.T) {
+	t.Run("busy-loop", func(t *testing.T) {
+		const timeout = 50 * gotime.Millisecond
+
+		thread := &starlark.Thread{}
+		start := gotime.Now()
+		thread.SetDeadline(start.Add(timeout))
+		opts := &syntax.FileOptions{While: true, TopLevelControl: true}
+		_, err := starlark.ExecFileOptions(opts, thread, "deadline.star", `while True: pass`, nil)
+		elapsed := gotime.Since(start)
+		if err == nil {
+			t.Fatal("expected deadline to be exceeded")
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if elapsed < timeout {
+			t.Errorf("execution aborted before deadline: %v < %v", elapsed, timeout)
+		} else if elapsed > timeout+gotime.Second {
+			t.Errorf("execution not aborted near deadline: took %v", elapsed)
+		}
+
+		if err := thread.Context().Err(); err != context.DeadlineExceeded {
+			t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("context-deadline", func(t *testing.T) {
+		expectedDeadline := gotime.Now().Add(gotime.Hour)
+		thread := &starlark.Thread{}
+		thread.SetDeadline(expectedDeadline)
+		defer thread.Cancel("done")
+
+		if deadline, ok := thread.Context().Deadline(); !ok {
+			t.Error("thread context has no deadline")
+		} else if !deadline.Equal(expectedDeadline) {
+			t.Errorf("incorrect deadline: expected %v but got %v", expectedDeadline, deadline)
+		}
+	})
+
+	t.Run("not-exceeded", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetDeadline(gotime.Now().Add(gotime.Hour))
+		defer thread.Cancel("done")
+
+		_, err := starlark.ExecFile(thread, "deadline.star", `x = [i for i in range(1000)]`, nil)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetDeadline(gotime.Time{})
+
+		if _, ok := thread.Context().Deadline(); ok {
+			t.Error("thread context has a deadline")
+		}
+		_, err := starlark.ExecFile(thread, "deadline.star", `x = [i for i in range(1000)]`, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := thread.Context().Err(); err != nil {
+			t.Errorf("thread cancelled: %v", err)
+		}
+	})
+
+	t.Run("cleared", func(t *testing.T) {
+		const timeout = 10 * gotime.Millisecond
+
+		thread := &starlark.Thread{}
+		thread.SetDeadline(gotime.Now().Add(timeout))
+		thread.SetDeadline(gotime.Time{})
+
+		if _, ok := thread.Context().Deadline(); ok {
+			t.Error("thread context has a deadline")
+		}
+		select {
+		case <-thread.Context().Done():
+			t.Errorf("thread cancelled: %v", thread.Context().Err())
+		case <-gotime.After(5 * timeout):
+		}
+		_, err := starlark.ExecFile(thread, "deadline.star", `x = [i for i in range(1000)]`, nil)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 func TestOverflowingPositiveDeltaStep(t *testing.T) {
 	thread := &starlark.Thread{}
 	thread.SetMaxSteps(math.MaxInt64)
@@ -1927,6 +2516,119 @@ func (uv unsafeTestValue) String() string       { return "unsafeTestValue" }
 func (uv unsafeTestValue) Truth() starlark.Bool { return starlark.False }
 func (uv unsafeTestValue) Type() string         { return "unsafeTestValue" }
 
+func TestResourceTrace(t *testing.T) {
+	t.Run("attribution", func(t *testing.T) {
+		var trace bytes.Buffer
+		thread := &starlark.Thread{}
+		thread.SetResourceTrace(&trace)
+		_, err := starlark.ExecFile(thread, "trace.star", "x = sorted([3, 1, 2] * 10)", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sortedSteps, sortedAllocs int64
+		for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				t.Fatalf("malformed trace line: %q", line)
+			}
+			amount, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				t.Fatalf("malformed trace line: %q", line)
+			}
+			if fields[2] != "sorted" {
+				continue
+			}
+			switch fields[0] {
+			case "steps":
+				sortedSteps += amount
+			case "allocs":
+				sortedAllocs += amount
+			default:
+				t.Errorf("unexpected resource kind: %q", line)
+			}
+		}
+		if sortedSteps < 30 {
+			t.Errorf("too few steps attributed to sorted: %d", sortedSteps)
+		}
+		if sortedAllocs < 30*8 {
+			t.Errorf("too few allocations attributed to sorted: %d", sortedAllocs)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		// Resources may be reported from other goroutines while the
+		// interpreter pushes and pops frames.
+		ticks := make(chan struct{}, 1)
+		var wg sync.WaitGroup
+		var thread *starlark.Thread
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range ticks {
+				thread.AddSteps(starlark.SafeInt(1))
+			}
+		}()
+		tick := starlark.NewBuiltin("tick", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			select {
+			case ticks <- struct{}{}:
+			default:
+			}
+			return starlark.None, nil
+		})
+		var trace bytes.Buffer
+		thread = &starlark.Thread{}
+		thread.SetResourceTrace(&trace)
+		const src = `
+def f(x):
+    tick()
+    return x + 1
+
+for i in range(1000):
+    f(i)
+`
+		predeclared := starlark.StringDict{"tick": tick}
+		_, err := starlark.ExecFileOptions(&syntax.FileOptions{TopLevelControl: true}, thread, "trace.star", src, predeclared)
+		close(ticks)
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var trace bytes.Buffer
+		thread := &starlark.Thread{}
+		thread.SetResourceTrace(&trace)
+		thread.SetResourceTrace(nil)
+		if _, err := starlark.ExecFile(thread, "trace.star", "x = sorted([3, 1, 2])", nil); err != nil {
+			t.Fatal(err)
+		}
+		if trace.Len() != 0 {
+			t.Errorf("unexpected trace: %s", trace.String())
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		var trace bytes.Buffer
+		thread := &starlark.Thread{}
+		thread.SetResourceTrace(&trace)
+		for i := 0; i < 200_000; i++ {
+			thread.AddSteps(starlark.SafeInt(1))
+		}
+		lines := strings.Split(strings.TrimSpace(trace.String()), "\n")
+		if len(lines) != 100_001 {
+			t.Errorf("unexpected trace length: got %d lines", len(lines))
+		}
+		if last := lines[len(lines)-1]; last != "resource trace truncated" {
+			t.Errorf("unexpected final line: %q", last)
+		}
+		if first := lines[0]; first != "steps 1 <none>" {
+			t.Errorf("unexpected first line: %q", first)
+		}
+	})
+}
+
 func TestSafeBinary(t *testing.T) {
 	testSafetyRespected := func(t *testing.T, op syntax.Token) {
 		t.Run("safety-respected", func(t *testing.T) {
@@ -2119,6 +2821,60 @@ func TestSafeBinary(t *testing.T) {
 		for _, test := range tests {
 			test.Run(t)
 		}
+
+		t.Run("repeated", func(t *testing.T) {
+			chunks := []starlark.Value{
+				starlark.String("chunk"),
+				starlark.Tuple{starlark.None},
+				starlark.NewList([]starlark.Value{starlark.None}),
+			}
+			for _, chunk := range chunks {
+				t.Run(chunk.Type(), func(t *testing.T) {
+					st := startest.From(t)
+					st.RequireSafety(starlark.MemSafe)
+					st.RunThread(func(thread *starlark.Thread) {
+						// Reset the accumulator periodically so the
+						// cost per iteration remains bounded.
+						acc := chunk
+						for i := 0; i < st.N; i++ {
+							if i%16 == 0 {
+								acc = chunk
+							}
+							result, err := starlark.SafeBinary(thread, syntax.PLUS, acc, chunk)
+							if err != nil {
+								st.Error(err)
+								return
+							}
+							acc = result
+							st.KeepAlive(result)
+						}
+					})
+				})
+			}
+		})
+
+		t.Run("budget", func(t *testing.T) {
+			const size = 1 << 20
+
+			operands := []starlark.Value{
+				starlark.String(strings.Repeat("x", size)),
+				starlark.Tuple(make([]starlark.Value, size/8)),
+				starlark.NewList(make([]starlark.Value, size/8)),
+			}
+			for _, operand := range operands {
+				t.Run(operand.Type(), func(t *testing.T) {
+					thread := &starlark.Thread{}
+					thread.SetMaxAllocs(size)
+					_, err := starlark.SafeBinary(thread, syntax.PLUS, operand, operand)
+					if err == nil {
+						t.Fatal("expected error")
+					}
+					if !errors.Is(err, starlark.ErrSafety) {
+						t.Errorf("unexpected error: %v", err)
+					}
+				})
+			}
+		})
 	})
 
 	t.Run("-", func(t *testing.T) {
@@ -2258,6 +3014,100 @@ func TestSafeBinary(t *testing.T) {
 		for _, test := range tests {
 			test.Run(t)
 		}
+
+		t.Run("non-positive-count", func(t *testing.T) {
+			sequences := []starlark.Value{
+				starlark.String("abc"),
+				starlark.Bytes("abc"),
+				starlark.Tuple{starlark.None, starlark.None},
+				starlark.NewList([]starlark.Value{starlark.None, starlark.None}),
+			}
+			for _, count := range []int{0, -3} {
+				for _, seq := range sequences {
+					// A new list must always be created, but its header is
+					// all that need be allocated.
+					var maxAllocs int64
+					if _, ok := seq.(*starlark.List); ok {
+						maxAllocs = mustInt64(starlark.EstimateSize(&starlark.List{}))
+					}
+					n := starlark.MakeInt(count)
+					for _, operands := range [][2]starlark.Value{{seq, n}, {n, seq}} {
+						name := fmt.Sprintf("%s * %s", operands[0].Type(), operands[1])
+						t.Run(name, func(t *testing.T) {
+							st := startest.From(t)
+							st.RequireSafety(starlark.MemSafe)
+							st.SetMaxAllocs(maxAllocs)
+							st.RunThread(func(thread *starlark.Thread) {
+								for i := 0; i < st.N; i++ {
+									result, err := starlark.SafeBinary(thread, syntax.STAR, operands[0], operands[1])
+									if err != nil {
+										st.Fatal(err)
+									}
+									if l := starlark.Len(result); l != 0 {
+										st.Errorf("expected empty result, got %s", result)
+									}
+									st.KeepAlive(result)
+								}
+							})
+						})
+					}
+				}
+			}
+		})
+
+		t.Run("scaling-count", func(t *testing.T) {
+			tests := []struct {
+				name string
+				expr string
+				size int
+			}{
+				{"string", `"ab" * st.n`, 2},
+				{"bytes", `b"ab" * st.n`, 2},
+				{"list", `[None] * st.n`, 1},
+				{"tuple", `(None,) * st.n`, 1},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					st := startest.From(t)
+					st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+					st.SetMinSteps(int64(test.size))
+					st.RunString(`st.keep_alive(` + test.expr + `)`)
+				})
+			}
+		})
+
+		t.Run("budget", func(t *testing.T) {
+			const maxAllocs = 1 << 20
+
+			sequences := []starlark.Value{
+				starlark.String("ab"),
+				starlark.Bytes("ab"),
+				starlark.Tuple{starlark.None},
+				starlark.NewList([]starlark.Value{starlark.None}),
+			}
+			count := starlark.MakeInt(1 << 28)
+			for _, seq := range sequences {
+				t.Run(seq.Type(), func(t *testing.T) {
+					thread := &starlark.Thread{}
+					thread.SetMaxAllocs(maxAllocs)
+
+					var before, after runtime.MemStats
+					runtime.ReadMemStats(&before)
+					_, err := starlark.SafeBinary(thread, syntax.STAR, seq, count)
+					runtime.ReadMemStats(&after)
+					if err == nil {
+						t.Fatal("expected error")
+					}
+					if !errors.Is(err, starlark.ErrSafety) {
+						t.Errorf("unexpected error: %v", err)
+					}
+					// The result must be rejected before it is built.
+					if allocated := after.TotalAlloc - before.TotalAlloc; allocated > maxAllocs {
+						t.Errorf("repetition allocated %d bytes before failing", allocated)
+					}
+				})
+			}
+		})
 	})
 
 	t.Run("/", func(t *testing.T) {
@@ -2433,10 +3283,40 @@ func TestSafeBinary(t *testing.T) {
 			},
 			minSteps: 2 * int64(len(`x`)),
 			maxSteps: int64(len(`["x", "x"]`)),
+		}, {
+			name:     "bytes % bytes",
+			op:       syntax.PERCENT,
+			left:     constant(starlark.Bytes("[%s]")),
+			right:    makeBytes,
+			minSteps: int64(len(`x`)),
+			maxSteps: int64(len(`[x]`)),
+		}, {
+			name:     "bytes % int",
+			op:       syntax.PERCENT,
+			left:     constant(starlark.Bytes("%d")),
+			right:    makeBigInt,
+			minSteps: 9,
+			maxSteps: 10,
 		}}
 		for _, test := range tests {
 			test.Run(t)
 		}
+
+		t.Run("bytes-invalid-conversion", func(t *testing.T) {
+			thread := &starlark.Thread{}
+			for _, verb := range []string{"%z", "%s", "%c"} {
+				_, err := starlark.SafeBinary(thread, syntax.PERCENT, starlark.Bytes(verb), starlark.String("xy"))
+				if err == nil {
+					t.Errorf("%s: expected error", verb)
+				}
+			}
+			_, err := starlark.SafeBinary(thread, syntax.PERCENT, starlark.Bytes("%z"), starlark.MakeInt(1))
+			if err == nil {
+				t.Error("expected error")
+			} else if err.Error() != "unknown conversion %z" {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
 	})
 
 	testContainmentOp := func(t *testing.T, op syntax.Token) {
@@ -2699,6 +3579,40 @@ func TestSafeBinary(t *testing.T) {
 	})
 }
 
+func TestIntMulSteps(t *testing.T) {
+	t.Run("var-size", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			// Squaring an n-word integer costs at least n**1.58 steps,
+			// so choose n such that this is at least st.N.
+			numBits := uint(math.Ceil(math.Pow(float64(st.N), 1/1.58))) * 32
+			x := starlark.Value(starlark.MakeInt(1).Lsh(numBits))
+			result, err := starlark.SafeBinary(thread, syntax.STAR, x, x)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
+
+	t.Run("repeated-squaring", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+		thread.SetMaxSteps(1000000)
+		src := "def square():\n\tx = 3\n\tfor _ in range(64):\n\t\tx = x * x\nsquare()\n"
+		_, err := starlark.ExecFile(thread, "mul.star", src, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		expected := &starlark.StepsSafetyError{}
+		if !errors.As(err, &expected) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
 func TestThreadEnsureStack(t *testing.T) {
 	t.Run("positive-size", func(t *testing.T) {
 		dummy := &testing.T{}
@@ -0,0 +1,283 @@
+package starlark
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// AsGoValue converts a Starlark value to a tree of native Go values:
+//
+//	None        nil
+//	Bool        bool
+//	Int         int64, or *big.Int if it does not fit
+//	Float       float64
+//	String      string
+//	Bytes       []byte
+//	List, Tuple []interface{}
+//	Dict        map[interface{}]interface{}
+//
+// Dict keys must convert to comparable Go values, so may not be bytes,
+// tuples or ints outside the range of int64. Values of any other type
+// cause an error.
+//
+// Each value converted costs a step, and the Go values created are
+// accounted as allocations. Nesting is limited to the depth set by
+// SetMaxDepth, and a list or dict which contains itself is rejected.
+func AsGoValue(thread *Thread, v Value) (interface{}, error) {
+	conv := goValueConverter{
+		thread:   thread,
+		visiting: make(map[Value]bool),
+	}
+	return conv.convert(v, thread.depthLimit())
+}
+
+type goValueConverter struct {
+	thread *Thread
+
+	// visiting holds the lists and dicts currently being converted.
+	visiting map[Value]bool
+}
+
+var (
+	goInt64Size   = EstimateSize(int64(0))
+	goFloat64Size = EstimateSize(float64(0))
+)
+
+func (gc *goValueConverter) addAllocs(size SafeInteger) error {
+	if gc.thread == nil {
+		return nil
+	}
+	return gc.thread.AddAllocs(size)
+}
+
+func (gc *goValueConverter) convert(v Value, depth int) (interface{}, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("AsGoValue: exceeded maximum depth")
+	}
+	if gc.thread != nil {
+		if err := gc.thread.AddSteps(SafeInt(1)); err != nil {
+			return nil, err
+		}
+	}
+
+	switch v := v.(type) {
+	case NoneType:
+		return nil, nil
+	case Bool:
+		return bool(v), nil
+	case Int:
+		if i, ok := v.Int64(); ok {
+			if err := gc.addAllocs(goInt64Size); err != nil {
+				return nil, err
+			}
+			return i, nil
+		}
+		if gc.thread != nil {
+			if err := gc.thread.CheckAllocs(EstimateSize(v.bigInt())); err != nil {
+				return nil, err
+			}
+		}
+		result := v.BigInt()
+		if err := gc.addAllocs(EstimateSize(result)); err != nil {
+			return nil, err
+		}
+		return result, nil
+	case Float:
+		if err := gc.addAllocs(goFloat64Size); err != nil {
+			return nil, err
+		}
+		return float64(v), nil
+	case String:
+		if err := gc.addAllocs(StringTypeOverhead); err != nil {
+			return nil, err
+		}
+		return string(v), nil
+	case Bytes:
+		resultSize := SafeAdd(EstimateMakeSize([]byte{}, SafeInt(len(v))), SliceTypeOverhead)
+		if err := gc.addAllocs(resultSize); err != nil {
+			return nil, err
+		}
+		return []byte(v), nil
+	case Tuple:
+		return gc.convertElems(v, depth)
+	case *List:
+		if gc.visiting[v] {
+			return nil, fmt.Errorf("AsGoValue: cycle detected in list")
+		}
+		gc.visiting[v] = true
+		defer delete(gc.visiting, v)
+		return gc.convertElems(v.elems, depth)
+	case *Dict:
+		if gc.visiting[v] {
+			return nil, fmt.Errorf("AsGoValue: cycle detected in dict")
+		}
+		gc.visiting[v] = true
+		defer delete(gc.visiting, v)
+		return gc.convertDict(v, depth)
+	}
+	return nil, fmt.Errorf("AsGoValue: cannot convert %s to a Go value", v.Type())
+}
+
+func (gc *goValueConverter) convertElems(elems []Value, depth int) (interface{}, error) {
+	resultSize := SafeAdd(EstimateMakeSize([]interface{}{}, SafeInt(len(elems))), SliceTypeOverhead)
+	if err := gc.addAllocs(resultSize); err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		x, err := gc.convert(elem, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = x
+	}
+	return result, nil
+}
+
+func (gc *goValueConverter) convertDict(d *Dict, depth int) (interface{}, error) {
+	if err := gc.addAllocs(EstimateMakeSize(map[interface{}]interface{}{}, SafeInt(d.Len()))); err != nil {
+		return nil, err
+	}
+	result := make(map[interface{}]interface{}, d.Len())
+	for e := d.ht.head; e != nil; e = e.next {
+		switch k := e.key.(type) {
+		case NoneType, Bool, Float, String:
+		case Int:
+			if _, ok := k.Int64(); !ok {
+				return nil, fmt.Errorf("AsGoValue: dict key %s does not fit in int64", k)
+			}
+		default:
+			return nil, fmt.Errorf("AsGoValue: cannot convert dict key of type %s to a Go map key", k.Type())
+		}
+		k, err := gc.convert(e.key, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := gc.convert(e.value, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = v
+	}
+	return result, nil
+}
+
+// FromSafeGoValue converts a tree of native Go values to a Starlark value:
+//
+//	nil                           None
+//	bool                          Bool
+//	int, int64, *big.Int          Int
+//	float64                       Float
+//	string                        String
+//	[]byte                        Bytes
+//	[]interface{}                 List
+//	map[string]interface{}        Dict, with keys inserted in sorted order
+//
+// Values of any other Go type cause an error.
+//
+// Each Go value converted costs a step, and the Starlark values created
+// are accounted as allocations. Nesting is limited to the depth set by
+// SetMaxDepth, so a map or slice which contains itself is rejected.
+func FromSafeGoValue(thread *Thread, x interface{}) (Value, error) {
+	return fromSafeGoValue(thread, x, thread.depthLimit())
+}
+
+func fromSafeGoValue(thread *Thread, x interface{}, depth int) (Value, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("FromSafeGoValue: exceeded maximum depth")
+	}
+	if thread != nil {
+		if err := thread.AddSteps(SafeInt(1)); err != nil {
+			return nil, err
+		}
+	}
+
+	var result Value
+	switch x := x.(type) {
+	case nil:
+		return None, nil
+	case bool:
+		return Bool(x), nil
+	case int:
+		result = MakeInt(x)
+	case int64:
+		result = MakeInt64(x)
+	case *big.Int:
+		if thread != nil {
+			if err := thread.CheckAllocs(EstimateSize(x)); err != nil {
+				return nil, err
+			}
+		}
+		result = MakeBigInt(x)
+	case float64:
+		result = Float(x)
+	case string:
+		result = String(x)
+	case []byte:
+		if thread != nil {
+			resultSize := SafeAdd(EstimateMakeSize([]byte{}, SafeInt(len(x))), StringTypeOverhead)
+			if err := thread.AddAllocs(resultSize); err != nil {
+				return nil, err
+			}
+		}
+		return Bytes(x), nil
+	case []interface{}:
+		if thread != nil {
+			resultSize := SafeAdd(EstimateSize(&List{}), EstimateMakeSize([]Value{}, SafeInt(len(x))))
+			if err := thread.AddAllocs(resultSize); err != nil {
+				return nil, err
+			}
+		}
+		elems := make([]Value, len(x))
+		for i, elem := range x {
+			v, err := fromSafeGoValue(thread, elem, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = v
+		}
+		return NewList(elems), nil
+	case map[string]interface{}:
+		return fromSafeGoMap(thread, x, depth)
+	default:
+		return nil, fmt.Errorf("FromSafeGoValue: cannot convert Go value of type %T", x)
+	}
+
+	if thread != nil {
+		if err := thread.AddAllocs(EstimateSize(result)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func fromSafeGoMap(thread *Thread, m map[string]interface{}, depth int) (Value, error) {
+	// Go maps are unordered: sort the keys so that the dict is the same
+	// whenever the same map is converted.
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	dict, err := SafeNewDict(thread, len(m))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if thread != nil {
+			if err := thread.AddAllocs(StringTypeOverhead); err != nil {
+				return nil, err
+			}
+		}
+		v, err := fromSafeGoValue(thread, m[k], depth-1)
+		if err != nil {
+			return nil, err
+		}
+		if err := dict.SafeSetKey(thread, String(k), v); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
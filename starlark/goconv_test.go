@@ -0,0 +1,339 @@
+package starlark_test
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/canonical/starlark/starlark"
+	"github.com/canonical/starlark/startest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAsGoValue(t *testing.T) {
+	t.Run("scalars", func(t *testing.T) {
+		huge := new(big.Int).Lsh(big.NewInt(1), 100)
+		tests := []struct {
+			value  starlark.Value
+			expect interface{}
+		}{
+			{starlark.None, nil},
+			{starlark.True, true},
+			{starlark.MakeInt(-7), int64(-7)},
+			{starlark.MakeBigInt(huge), huge},
+			{starlark.Float(1.5), 1.5},
+			{starlark.String("hello"), "hello"},
+			{starlark.Bytes("\x00\xff"), []byte("\x00\xff")},
+		}
+		for _, test := range tests {
+			result, err := starlark.AsGoValue(&starlark.Thread{}, test.value)
+			if err != nil {
+				t.Errorf("%v: %v", test.value, err)
+				continue
+			}
+			if r, ok := result.(*big.Int); ok {
+				if r.Cmp(huge) != 0 {
+					t.Errorf("%v: got %v", test.value, r)
+				}
+				continue
+			}
+			if diff := cmp.Diff(test.expect, result); diff != "" {
+				t.Errorf("%v: unexpected result (-want +got):\n%s", test.value, diff)
+			}
+		}
+	})
+
+	t.Run("containers", func(t *testing.T) {
+		inner := starlark.NewDict(2)
+		inner.SetKey(starlark.String("a"), starlark.NewList([]starlark.Value{starlark.MakeInt(1), starlark.Float(2)}))
+		inner.SetKey(starlark.MakeInt(3), starlark.Tuple{starlark.None, starlark.Bytes("b")})
+		outer := starlark.NewList([]starlark.Value{inner, starlark.Tuple{}, inner})
+
+		result, err := starlark.AsGoValue(&starlark.Thread{}, outer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		innerExpect := map[interface{}]interface{}{
+			"a":      []interface{}{int64(1), 2.0},
+			int64(3): []interface{}{nil, []byte("b")},
+		}
+		// Shared values which are not cyclic are converted each time.
+		expect := []interface{}{innerExpect, []interface{}{}, innerExpect}
+		if diff := cmp.Diff(expect, result); diff != "" {
+			t.Errorf("unexpected result (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cyclicList := starlark.NewList(nil)
+		cyclicList.Append(starlark.Tuple{cyclicList})
+		cyclicDict := starlark.NewDict(1)
+		cyclicDict.SetKey(starlark.String("self"), starlark.NewList([]starlark.Value{cyclicDict}))
+		tupleKey := starlark.NewDict(1)
+		tupleKey.SetKey(starlark.Tuple{}, starlark.None)
+		bigKey := starlark.NewDict(1)
+		bigKey.SetKey(starlark.MakeInt(1).Lsh(64), starlark.None)
+		deep := starlark.Value(starlark.None)
+		for i := 0; i < 20; i++ {
+			deep = starlark.Tuple{deep}
+		}
+
+		tests := []struct {
+			name  string
+			value starlark.Value
+			err   string
+		}{{
+			name:  "cyclic-list",
+			value: cyclicList,
+			err:   "cycle detected in list",
+		}, {
+			name:  "cyclic-dict",
+			value: cyclicDict,
+			err:   "cycle detected in dict",
+		}, {
+			name:  "unsupported",
+			value: starlark.NewSet(0),
+			err:   "cannot convert set to a Go value",
+		}, {
+			name:  "tuple-key",
+			value: tupleKey,
+			err:   "cannot convert dict key of type tuple to a Go map key",
+		}, {
+			name:  "big-key",
+			value: bigKey,
+			err:   "does not fit in int64",
+		}, {
+			name:  "depth",
+			value: deep,
+			err:   "exceeded maximum depth",
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				thread := &starlark.Thread{}
+				thread.SetMaxDepth(10)
+				_, err := starlark.AsGoValue(thread, test.value)
+				if err == nil {
+					t.Error("expected error")
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			elems := make([]starlark.Value, st.N)
+			for i := range elems {
+				elems[i] = starlark.String("x")
+			}
+			if _, err := starlark.AsGoValue(thread, starlark.NewList(elems)); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		values := map[string]starlark.Value{
+			"int":   starlark.MakeInt(1 << 20),
+			"big":   starlark.MakeInt(1).Lsh(200),
+			"float": starlark.Float(1.5),
+			"bytes": starlark.Bytes("0123456789abcdef"),
+			"list":  starlark.NewList([]starlark.Value{starlark.True, starlark.MakeInt(1 << 20)}),
+			"dict": func() *starlark.Dict {
+				d := starlark.NewDict(1)
+				d.SetKey(starlark.String("k"), starlark.Float(1.5))
+				return d
+			}(),
+		}
+		for name, value := range values {
+			t.Run(name, func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.MemSafe)
+				st.RunThread(func(thread *starlark.Thread) {
+					for i := 0; i < st.N; i++ {
+						result, err := starlark.AsGoValue(thread, value)
+						if err != nil {
+							st.Error(err)
+						}
+						st.KeepAlive(result)
+					}
+				})
+			})
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(10)
+		elems := make([]starlark.Value, 100)
+		for i := range elems {
+			elems[i] = starlark.None
+		}
+		_, err := starlark.AsGoValue(thread, starlark.NewList(elems))
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestFromSafeGoValue(t *testing.T) {
+	t.Run("scalars", func(t *testing.T) {
+		tests := []struct {
+			value  interface{}
+			expect starlark.Value
+		}{
+			{nil, starlark.None},
+			{true, starlark.True},
+			{7, starlark.MakeInt(7)},
+			{int64(-1 << 40), starlark.MakeInt64(-1 << 40)},
+			{new(big.Int).Lsh(big.NewInt(1), 100), starlark.MakeInt(1).Lsh(100)},
+			{1.5, starlark.Float(1.5)},
+			{"hello", starlark.String("hello")},
+			{[]byte("\x00\xff"), starlark.Bytes("\x00\xff")},
+		}
+		for _, test := range tests {
+			result, err := starlark.FromSafeGoValue(&starlark.Thread{}, test.value)
+			if err != nil {
+				t.Errorf("%v: %v", test.value, err)
+			} else if eq, err := starlark.Equal(result, test.expect); err != nil {
+				t.Errorf("%v: %v", test.value, err)
+			} else if !eq {
+				t.Errorf("%v: got %v, want %v", test.value, result, test.expect)
+			}
+		}
+	})
+
+	t.Run("containers", func(t *testing.T) {
+		value := map[string]interface{}{
+			"b": []interface{}{1, "x", nil},
+			"a": map[string]interface{}{
+				"nested": []interface{}{},
+			},
+		}
+		result, err := starlark.FromSafeGoValue(&starlark.Thread{}, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict, ok := result.(*starlark.Dict)
+		if !ok {
+			t.Fatalf("expected dict, got %s", result.Type())
+		}
+		// Keys are inserted in sorted order.
+		const expect = `{"a": {"nested": []}, "b": [1, "x", None]}`
+		if s := dict.String(); s != expect {
+			t.Errorf("unexpected result: got %s, want %s", s, expect)
+		}
+		b, _, _ := dict.Get(starlark.String("b"))
+		if _, ok := b.(*starlark.List); !ok {
+			t.Errorf("expected list, got %s", b.Type())
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cyclic := map[string]interface{}{}
+		cyclic["self"] = cyclic
+		var deep interface{}
+		for i := 0; i < 20; i++ {
+			deep = []interface{}{deep}
+		}
+
+		tests := []struct {
+			name  string
+			value interface{}
+			err   string
+		}{{
+			name:  "unsupported",
+			value: []interface{}{uint8(1)},
+			err:   "cannot convert Go value of type uint8",
+		}, {
+			name:  "unsupported-map",
+			value: map[int]interface{}{},
+			err:   "cannot convert Go value of type map[int]interface {}",
+		}, {
+			name:  "depth",
+			value: deep,
+			err:   "exceeded maximum depth",
+		}, {
+			name:  "cyclic",
+			value: cyclic,
+			err:   "exceeded maximum depth",
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				thread := &starlark.Thread{}
+				thread.SetMaxDepth(10)
+				_, err := starlark.FromSafeGoValue(thread, test.value)
+				if err == nil {
+					t.Error("expected error")
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			elems := make([]interface{}, st.N)
+			for i := range elems {
+				elems[i] = true
+			}
+			if _, err := starlark.FromSafeGoValue(thread, elems); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		values := map[string]interface{}{
+			"int":   1 << 40,
+			"big":   new(big.Int).Lsh(big.NewInt(1), 200),
+			"float": 1.5,
+			"bytes": []byte("0123456789abcdef"),
+			"list":  []interface{}{true, 1 << 40, "x"},
+			"map": map[string]interface{}{
+				"k": 1.5,
+				"l": []interface{}{nil},
+			},
+		}
+		for name, value := range values {
+			t.Run(name, func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.MemSafe)
+				st.RunThread(func(thread *starlark.Thread) {
+					for i := 0; i < st.N; i++ {
+						result, err := starlark.FromSafeGoValue(thread, value)
+						if err != nil {
+							st.Error(err)
+						}
+						st.KeepAlive(result)
+					}
+				})
+			})
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(1000)
+		elems := make([]interface{}, 1000)
+		_, err := starlark.FromSafeGoValue(thread, elems)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
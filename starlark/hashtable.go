@@ -8,6 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"github.com/canonical/starlark/syntax"
 )
 
 // hashtable is used to represent Starlark dict and set values.
@@ -99,7 +103,7 @@ func (ht *hashtable) insert(thread *Thread, k, v Value) error {
 	if ht.table == nil {
 		ht.init(thread, 1)
 	}
-	h, err := k.Hash()
+	h, err := SafeHash(thread, k)
 	if err != nil {
 		return err
 	}
@@ -127,7 +131,7 @@ retry:
 				}
 				continue
 			}
-			if eq, err := Equal(k, e.key); err != nil {
+			if eq, err := keysEqual(thread, k, e.key); err != nil {
 				return err // e.g. excessively recursive tuple
 			} else if !eq {
 				continue
@@ -226,7 +230,7 @@ func (ht *hashtable) lookup(thread *Thread, k Value) (v Value, found bool, err e
 	if err := CheckSafety(thread, CPUSafe|MemSafe|TimeSafe|IOSafe); err != nil {
 		return nil, false, err
 	}
-	h, err := k.Hash()
+	h, err := SafeHash(thread, k)
 	if err != nil {
 		return nil, false, err // unhashable
 	}
@@ -247,7 +251,7 @@ func (ht *hashtable) lookup(thread *Thread, k Value) (v Value, found bool, err e
 		for i := range p.entries {
 			e := &p.entries[i]
 			if e.hash == h {
-				if eq, err := Equal(k, e.key); err != nil {
+				if eq, err := keysEqual(thread, k, e.key); err != nil {
 					return nil, false, err // e.g. excessively recursive tuple
 				} else if eq {
 					return e.value, true, nil // found
@@ -288,7 +292,7 @@ func (ht *hashtable) count(thread *Thread, iter Iterator) (int, error) {
 		bitsets[i].SetBits(storage[i : i+1 : i+1])
 	}
 	for iter.Next(&k) && count != int(ht.len) {
-		h, err := k.Hash()
+		h, err := SafeHash(thread, k)
 		if err != nil {
 			return 0, err // unhashable
 		}
@@ -308,7 +312,7 @@ func (ht *hashtable) count(thread *Thread, iter Iterator) (int, error) {
 			for j := range p.entries {
 				e := &p.entries[j]
 				if e.hash == h {
-					if eq, err := Equal(k, e.key); err != nil {
+					if eq, err := keysEqual(thread, k, e.key); err != nil {
 						return 0, err
 					} else if eq {
 						bitIndex := i<<3 + j
@@ -373,7 +377,7 @@ func (ht *hashtable) delete(thread *Thread, k Value) (v Value, found bool, err e
 	if ht.table == nil {
 		return None, false, nil // empty
 	}
-	h, err := k.Hash()
+	h, err := SafeHash(thread, k)
 	if err != nil {
 		return nil, false, err // unhashable
 	}
@@ -391,7 +395,7 @@ func (ht *hashtable) delete(thread *Thread, k Value) (v Value, found bool, err e
 		for i := range p.entries {
 			e := &p.entries[i]
 			if e.hash == h {
-				if eq, err := Equal(k, e.key); err != nil {
+				if eq, err := keysEqual(thread, k, e.key); err != nil {
 					return nil, false, err
 				} else if eq {
 					// Remove e from doubly-linked list.
@@ -539,19 +543,93 @@ func (ht *hashtable) entries(yield func(k, v Value) bool) {
 	}
 }
 
+var (
+	// stringHashSeed perturbs the hashes of strings. See SetStringHashSeed.
+	// It is accessed atomically.
+	stringHashSeed uint64
+
+	// stringHashSeedFixed is non-zero once stringHashSeed may no longer
+	// change, as it has been set or used to hash a string. It is accessed
+	// atomically, and changed only while holding stringHashSeedMu.
+	stringHashSeedFixed uint32
+	stringHashSeedMu    sync.Mutex
+)
+
+// SetStringHashSeed sets the seed used to hash short strings. Embedders
+// which insert untrusted keys into dicts and sets may choose a random seed,
+// so that keys cannot be crafted in advance to collide. For a given seed,
+// hashes are deterministic. Longer strings are hashed by the Go runtime,
+// which also mixes in a key chosen randomly once per process; before Go
+// 1.19, it is given this seed as well.
+//
+// The seed is global, as dicts and sets populated under one seed cannot be
+// used under another. It may be set at most once, before any string is
+// hashed, typically during program initialization; SetStringHashSeed
+// panics otherwise.
+func SetStringHashSeed(seed uint64) {
+	stringHashSeedMu.Lock()
+	defer stringHashSeedMu.Unlock()
+	if atomic.LoadUint32(&stringHashSeedFixed) != 0 {
+		panic("SetStringHashSeed: seed already set or in use")
+	}
+	atomic.StoreUint64(&stringHashSeed, seed)
+	atomic.StoreUint32(&stringHashSeedFixed, 1)
+}
+
+// loadStringHashSeed returns the seed for hashing strings, which may no
+// longer change once this has been called.
+func loadStringHashSeed() uint64 {
+	if atomic.LoadUint32(&stringHashSeedFixed) == 0 {
+		stringHashSeedMu.Lock()
+		atomic.StoreUint32(&stringHashSeedFixed, 1)
+		stringHashSeedMu.Unlock()
+	}
+	return atomic.LoadUint64(&stringHashSeed)
+}
+
+// keysEqual reports whether the key k matches the key of an entry. A key
+// which is the very same value as k, as when a tuple is reused across
+// lookups, matches for a single step without being compared element by
+// element; other tuples are compared with SafeCompare, so that the cost of
+// a deep comparison is accounted for.
+func keysEqual(thread *Thread, k, key Value) (bool, error) {
+	if x, ok := k.(Tuple); ok {
+		if y, ok := key.(Tuple); ok {
+			if len(x) == len(y) && (len(x) == 0 || &x[0] == &y[0]) {
+				if thread != nil {
+					if err := thread.AddSteps(SafeInt(1)); err != nil {
+						return false, err
+					}
+				}
+				return true, nil
+			}
+			return SafeCompare(thread, syntax.EQL, x, y)
+		}
+	}
+	return Equal(k, key)
+}
+
 // hashString computes the hash of s.
 func hashString(s string) uint32 {
+	seed := loadStringHashSeed()
 	if len(s) >= 12 {
 		// Call the Go runtime's optimized hash implementation,
 		// which uses the AES instructions on amd64 and arm64 machines.
-		return maphash_string(s)
+		return maphash_string(s, seed)
 	}
-	return softHashString(s)
+	return softHashString(s, seed)
 }
 
-// softHashString computes the 32-bit FNV-1a hash of s in software.
-func softHashString(s string) uint32 {
+// softHashString computes the 32-bit FNV-1a hash of s in software,
+// starting from an offset basis perturbed by seed.
+func softHashString(s string, seed uint64) uint32 {
 	var h uint32 = 2166136261
+	if seed != 0 {
+		h ^= uint32(seed)
+		h *= 16777619
+		h ^= uint32(seed >> 32)
+		h *= 16777619
+	}
 	for i := 0; i < len(s); i++ {
 		h ^= uint32(s[i])
 		h *= 16777619
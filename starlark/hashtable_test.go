@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -29,7 +30,7 @@ func BenchmarkStringHash(b *testing.B) {
 		})
 		b.Run(fmt.Sprintf("soft-%d", len), func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				softHashString(s)
+				softHashString(s, 0)
 			}
 		})
 	}
@@ -137,3 +138,119 @@ func TestHashtableCount(t *testing.T) {
 		t.Errorf("count doesn't match: expected %d got %d", count, c)
 	}
 }
+
+// resetStringHashSeed returns the string hash seed to its initial, unset
+// state, and returns a function which reinstates the current one.
+func resetStringHashSeed() (restore func()) {
+	stringHashSeedMu.Lock()
+	defer stringHashSeedMu.Unlock()
+	seed := atomic.LoadUint64(&stringHashSeed)
+	fixed := atomic.LoadUint32(&stringHashSeedFixed)
+	atomic.StoreUint64(&stringHashSeed, 0)
+	atomic.StoreUint32(&stringHashSeedFixed, 0)
+	return func() {
+		stringHashSeedMu.Lock()
+		defer stringHashSeedMu.Unlock()
+		atomic.StoreUint64(&stringHashSeed, seed)
+		atomic.StoreUint32(&stringHashSeedFixed, fixed)
+	}
+}
+
+func TestStringHashSeed(t *testing.T) {
+	defer resetStringHashSeed()()
+
+	const nbuckets = 16
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+	buckets := func(seed uint64) []uint32 {
+		resetStringHashSeed()
+		SetStringHashSeed(seed)
+		result := make([]uint32, len(keys))
+		for i, key := range keys {
+			result[i] = hashString(key) % nbuckets
+		}
+		return result
+	}
+
+	first := buckets(0x0123456789abcdef)
+	if again := buckets(0x0123456789abcdef); fmt.Sprint(again) != fmt.Sprint(first) {
+		t.Errorf("hashes differ under the same seed")
+	}
+	if other := buckets(0xfedcba9876543210); fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Errorf("hashes unchanged by a different seed")
+	}
+
+	// A dict populated under one seed remains consistent under it.
+	resetStringHashSeed()
+	SetStringHashSeed(42)
+	dict := NewDict(len(keys))
+	for i, key := range keys {
+		if err := dict.SetKey(String(key), MakeInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, key := range keys {
+		v, found, err := dict.Get(String(key))
+		if err != nil {
+			t.Fatal(err)
+		} else if !found {
+			t.Errorf("key %q not found", key)
+		} else if v != MakeInt(i) {
+			t.Errorf("key %q: got %v, want %d", key, v, i)
+		}
+	}
+}
+
+func TestStringHashSeedFixed(t *testing.T) {
+	defer resetStringHashSeed()()
+
+	mustPanic := func(name string) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: SetStringHashSeed did not panic", name)
+			}
+		}()
+		SetStringHashSeed(7)
+	}
+
+	// The seed may be set only once.
+	resetStringHashSeed()
+	SetStringHashSeed(42)
+	mustPanic("set twice")
+	if seed := loadStringHashSeed(); seed != 42 {
+		t.Errorf("seed changed: got %d, want 42", seed)
+	}
+
+	// The seed may not be set once a string has been hashed.
+	resetStringHashSeed()
+	String("key").Hash()
+	mustPanic("set after hashing")
+	if seed := loadStringHashSeed(); seed != 0 {
+		t.Errorf("seed changed: got %d, want 0", seed)
+	}
+
+	// Hashing concurrently with setting the seed sees a single seed.
+	resetStringHashSeed()
+	var wg sync.WaitGroup
+	hashes := make([]uint32, 8)
+	for i := range hashes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hashes[i] = hashString("key")
+		}(i)
+	}
+	func() {
+		defer func() { recover() }()
+		SetStringHashSeed(42)
+	}()
+	wg.Wait()
+	for _, h := range hashes {
+		if h != hashString("key") {
+			t.Errorf("hashes differ: %d and %d", h, hashString("key"))
+		}
+	}
+}
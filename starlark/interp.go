@@ -13,6 +13,11 @@ import (
 
 const vmdebug = false // TODO(adonovan): use a bitfield of specific kinds of error.
 
+// maxUnlimitedPresize bounds the capacity which PRESIZE reserves for a
+// comprehension result when the thread has no allocation limit to check
+// the length of the source against. Longer results grow as usual.
+const maxUnlimitedPresize = 1 << 16
+
 // TODO(adonovan):
 // - optimize position table.
 // - opt: record MaxIterStack during compilation and preallocate the stack.
@@ -61,7 +66,7 @@ func (fn *Function) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (_
 	stack := space[nlocals:]          // operand stack
 
 	// Digest arguments and set parameters.
-	err = setArgs(locals, fn, args, kwargs)
+	err = setArgs(thread, locals, fn, args, kwargs)
 	if err != nil {
 		return nil, thread.evalError(err)
 	}
@@ -137,6 +142,9 @@ loop:
 			if err = thread.AddSteps(SafeInt(1)); err != nil {
 				break loop
 			}
+			if thread.stepProfile != nil {
+				thread.sampleSteps()
+			}
 		}
 		switch op {
 		case compile.NOP:
@@ -162,7 +170,7 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			ok, err2 := Compare(op, x, y)
+			ok, err2 := SafeCompare(thread, op, x, y)
 			if err2 != nil {
 				err = err2
 				break loop
@@ -195,6 +203,12 @@ loop:
 				err = err2
 				break loop
 			}
+			if binop != syntax.IN {
+				if err2 := thread.AddValues(1); err2 != nil {
+					err = err2
+					break loop
+				}
+			}
 			stack[sp] = z
 			sp++
 
@@ -211,6 +225,10 @@ loop:
 				err = err2
 				break loop
 			}
+			if err2 := thread.AddValues(1); err2 != nil {
+				err = err2
+				break loop
+			}
 			stack[sp-1] = y
 
 		case compile.INPLACE_ADD:
@@ -238,6 +256,9 @@ loop:
 				if err != nil {
 					break loop
 				}
+				if err = thread.AddValues(1); err != nil {
+					break loop
+				}
 			}
 
 			stack[sp] = z
@@ -257,7 +278,9 @@ loop:
 					if err = xdict.ht.checkMutable("apply |= to"); err != nil {
 						break loop
 					}
-					xdict.ht.addAll(thread, &ydict.ht) // can't fail
+					if err = xdict.ht.addAll(thread, &ydict.ht); err != nil {
+						break loop
+					}
 					z = xdict
 				}
 			}
@@ -266,6 +289,9 @@ loop:
 				if err != nil {
 					break loop
 				}
+				if err = thread.AddValues(1); err != nil {
+					break loop
+				}
 			}
 
 			stack[sp] = z
@@ -334,7 +360,23 @@ loop:
 					err = fmt.Errorf("argument after ** must be a mapping, not %s", kwargs.Type())
 					break loop
 				}
+				// Reject oversized mappings before copying their items.
+				if n := Len(dict); n >= 0 {
+					if err2 := thread.checkArgs(len(kvpairs) + n); err2 != nil {
+						err = err2
+						break loop
+					}
+				}
 				items := dict.Items()
+				if err2 := thread.checkArgs(len(kvpairs) + len(items)); err2 != nil {
+					err = err2
+					break loop
+				}
+				// Each item is copied, and its key checked, at the cost of a step.
+				if err2 := thread.AddSteps(SafeInt(len(items))); err2 != nil {
+					err = err2
+					break loop
+				}
 				tuplesSize := SafeMul(EstimateMakeSize([]Value{}, SafeInt(2)), len(items))
 				argsAllocs = SafeAdd(argsAllocs, tuplesSize)
 				if err2 := thread.AddAllocs(tuplesSize); err2 != nil {
@@ -398,6 +440,11 @@ loop:
 				}
 				var elem Value
 				for iter.Next(&elem) {
+					if err2 := thread.checkArgs(len(positional) + 1 + len(kvpairs)); err2 != nil {
+						iter.Done()
+						err = err2
+						break loop
+					}
 					if err2 := positionalAppender.Append(elem); err2 != nil {
 						err = err2
 						break loop
@@ -411,6 +458,11 @@ loop:
 				argsAllocs = SafeAdd(argsAllocs, positionalAppender.Allocs())
 			}
 
+			if err2 := thread.checkArgs(len(positional) + len(kvpairs)); err2 != nil {
+				err = err2
+				break loop
+			}
+
 			function := stack[sp-1]
 			if _, ok := function.(*Function); ok {
 				// When the function is a Starlark function, we can guarantee
@@ -432,6 +484,14 @@ loop:
 				err = err2
 				break loop
 			}
+			if _, ok := function.(*Function); !ok {
+				// Values returned by Starlark functions were counted
+				// as they were created.
+				if err2 := thread.AddValues(1); err2 != nil {
+					err = err2
+					break loop
+				}
+			}
 			if vmdebug {
 				fmt.Printf("Resuming %s @ %s\n", f.Name, f.Position(0))
 			}
@@ -469,7 +529,12 @@ loop:
 			iterstack = iterstack[:n]
 
 		case compile.NOT:
-			stack[sp-1] = !stack[sp-1].Truth()
+			truth, err2 := SafeTruth(thread, stack[sp-1])
+			if err2 != nil {
+				err = err2
+				break loop
+			}
+			stack[sp-1] = !truth
 
 		case compile.RETURN:
 			result = stack[sp-1]
@@ -522,6 +587,10 @@ loop:
 				err = err2
 				break loop
 			}
+			if err2 := thread.AddValues(1); err2 != nil {
+				err = err2
+				break loop
+			}
 			stack[sp] = new(Dict)
 			sp++
 
@@ -536,7 +605,7 @@ loop:
 				break loop
 			}
 			if op == compile.SETDICTUNIQ && dict.Len() == oldlen {
-				err = fmt.Errorf("duplicate key: %v", k)
+				err = fmt.Errorf("duplicate key: %s", safeReprForError(thread, k))
 				break loop
 			}
 
@@ -550,17 +619,34 @@ loop:
 				break loop
 			}
 
+		case compile.PRESIZE:
+			list := stack[sp-2].(*List)
+			if n := Len(stack[sp-1]); n > 0 && cap(list.elems) == 0 {
+				if !thread.limitsAllocs() && n > maxUnlimitedPresize {
+					n = maxUnlimitedPresize
+				}
+				if err2 := thread.AddAllocs(EstimateMakeSize([]Value{}, SafeInt(n))); err2 != nil {
+					err = err2
+					break loop
+				}
+				list.elems = make([]Value, 0, n)
+			}
+
 		case compile.SLICE:
 			x := stack[sp-4]
 			lo := stack[sp-3]
 			hi := stack[sp-2]
 			step := stack[sp-1]
 			sp -= 4
-			res, err2 := slice(x, lo, hi, step)
+			res, err2 := slice(thread, x, lo, hi, step)
 			if err2 != nil {
 				err = err2
 				break loop
 			}
+			if err2 := thread.AddValues(1); err2 != nil {
+				err = err2
+				break loop
+			}
 			stack[sp] = res
 			sp++
 
@@ -599,7 +685,12 @@ loop:
 			}
 
 		case compile.CJMP:
-			if stack[sp-1].Truth() {
+			truth, err2 := SafeTruth(thread, stack[sp-1])
+			if err2 != nil {
+				err = err2
+				break loop
+			}
+			if truth {
 				pc = arg
 			}
 			sp--
@@ -615,6 +706,10 @@ loop:
 				err = err2
 				break loop
 			}
+			if err2 := thread.AddValues(1); err2 != nil {
+				err = err2
+				break loop
+			}
 			tuple := make(Tuple, n)
 			sp -= n
 			copy(tuple, stack[sp:])
@@ -629,6 +724,10 @@ loop:
 				err = err2
 				break loop
 			}
+			if err2 := thread.AddValues(1); err2 != nil {
+				err = err2
+				break loop
+			}
 			elems := make([]Value, n)
 			sp -= n
 			copy(elems, stack[sp:])
@@ -646,6 +745,10 @@ loop:
 				err = err2
 				break loop
 			}
+			if err2 := thread.AddValues(1); err2 != nil {
+				err = err2
+				break loop
+			}
 			stack[sp-1] = &Function{
 				funcode:  funcode,
 				module:   fn.module,
@@ -1,11 +1,14 @@
 package starlark_test
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/canonical/starlark/starlark"
 	"github.com/canonical/starlark/startest"
+	"github.com/canonical/starlark/syntax"
 )
 
 func TestUnary(t *testing.T) {
@@ -209,6 +212,105 @@ func TestListComprehension(t *testing.T) {
 			st.keep_alive([v for v in range(st.n)])
 		`)
 	})
+
+	t.Run("filtered", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		// The step cost per N is at least 4:
+		// - For iterating, 1
+		// - For computing the predicate, 2
+		// - For testing the predicate, 1
+		st.SetMinSteps(4)
+		st.RunString(`
+			evens = [v for v in range(st.n) if v % 2 == 0]
+			assert.eq(len(evens), (st.n + 1) // 2)
+			if st.n > 4:
+				assert.eq(evens[:3], [0, 2, 4])
+			st.keep_alive(evens)
+		`)
+	})
+
+	t.Run("presized", func(t *testing.T) {
+		// A comprehension over a sized source reserves its result in one
+		// allocation rather than growing it element by element.
+		run := func(n int) (allocs int64, count uint64) {
+			source := make(starlark.Tuple, n)
+			for i := range source {
+				source[i] = starlark.None
+			}
+			predeclared := starlark.StringDict{"source": source}
+			thread := &starlark.Thread{}
+			thread.SetMaxAllocs(1 << 30)
+			src := "x = [v for v in source]"
+			if _, err := starlark.ExecFile(thread, "comprehension.star", src, predeclared); err != nil {
+				t.Fatal(err)
+			}
+			allocs, _ = thread.Allocs()
+			return allocs, thread.AllocCount()
+		}
+		const n = 100_000
+		emptyAllocs, emptyCount := run(0)
+		allocs, count := run(n)
+		if count != emptyCount+1 {
+			t.Errorf("unexpected allocation count: got %d, want %d", count, emptyCount+1)
+		}
+		want := mustInt64(starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(n)))
+		if allocs-emptyAllocs != want {
+			t.Errorf("unexpected result size: got %d, want %d", allocs-emptyAllocs, want)
+		}
+	})
+
+	t.Run("presized-resources", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		st.RunString(`
+			st.keep_alive([None for _ in range(st.n)])
+			st.keep_alive([v for v in list(range(st.n))])
+		`)
+	})
+
+	t.Run("presized-budget", func(t *testing.T) {
+		// The result is rejected before any element is computed.
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(1 << 20)
+		_, err := starlark.ExecFile(thread, "comprehension.star", "x = [None for v in range(1000000)]", nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if steps, _ := thread.Steps(); steps > 100 {
+			t.Errorf("too many steps taken before rejecting the comprehension: %d", steps)
+		}
+	})
+
+	t.Run("presized-steps-budget", func(t *testing.T) {
+		// Without an allocation limit, the length of the source is not
+		// trusted and the comprehension fails on its step budget.
+		for _, n := range []string{"1 << 40", "1 << 62"} {
+			thread := &starlark.Thread{}
+			thread.SetMaxSteps(1000)
+			src := fmt.Sprintf("x = [v for v in range(%s)]", n)
+			_, err := starlark.ExecFile(thread, "comprehension.star", src, nil)
+			if err == nil {
+				t.Errorf("%s: expected error", n)
+			} else if !errors.Is(err, starlark.ErrSafety) {
+				t.Errorf("%s: unexpected error: %v", n, err)
+			}
+		}
+	})
+
+	t.Run("filtered-budget", func(t *testing.T) {
+		// Elements which are filtered out are still charged for.
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(1000)
+		_, err := starlark.ExecFile(thread, "comprehension.star", "x = [v for v in range(1000000) if False]", nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
 }
 
 func TestDictCreation(t *testing.T) {
@@ -236,6 +338,36 @@ func TestDictCreation(t *testing.T) {
 				st.keep_alive({ 1: False, 2: "2", 3: 3.0 })
 		`)
 	})
+
+	const bigLiteralLen = 1000
+	var bigLiteral strings.Builder
+	bigLiteral.WriteString("{")
+	for i := 0; i < bigLiteralLen; i++ {
+		fmt.Fprintf(&bigLiteral, "%d: None, ", i)
+	}
+	bigLiteral.WriteString("}")
+
+	t.Run("big", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		// Each entry is loaded and inserted.
+		st.SetMinSteps(3 * bigLiteralLen)
+		st.RunString(`
+			for _ in st.ntimes():
+				st.keep_alive(` + bigLiteral.String() + `)
+		`)
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(1000)
+		_, err := starlark.ExecFile(thread, "dict_literal.star", "d = "+bigLiteral.String(), nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
 }
 
 func TestDictComprehension(t *testing.T) {
@@ -268,6 +400,30 @@ func TestDictComprehension(t *testing.T) {
 			st.keep_alive({i: None for i in range(st.n)})
 		`)
 	})
+
+	t.Run("colliding-keys", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		// The step cost per N is at least 10:
+		// - For iterating, 2
+		// - For assigning the loop variable, 1
+		// - For computing the key, 3
+		// - For loading the value, 1
+		// - For inserting or overwriting, 1
+		// - For probing the colliding key's bucket, 1
+		// - For looping back, 1
+		st.SetMinSteps(10)
+		st.RunString(`
+			d = {i % 3: i for i in range(st.n)}
+			st.keep_alive(d)
+
+			# The last value wins, but keys keep their first-seen position.
+			if st.n >= 3:
+				assert.eq(list(d.keys()), [0, 1, 2])
+				assert.eq(d[(st.n - 1) % 3], st.n - 1)
+				assert.eq(len(d), 3)
+		`)
+	})
 }
 
 func TestIterate(t *testing.T) {
@@ -292,6 +448,101 @@ func TestIterate(t *testing.T) {
 				pass
 		`)
 	})
+
+	t.Run("unsafe", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.AddValue("unsafe", &unsafeTestIterable{st})
+		st.AddBuiltin(starlark.NewBuiltinWithSafety("fails_safety", starlark.CPUSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				_, err := starlark.Call(thread, args[0], nil, nil)
+				return starlark.Bool(errors.Is(err, starlark.ErrSafety)), nil
+			}))
+		st.RunString(`
+			def loop():
+				for _ in unsafe:
+					pass
+
+			for _ in st.ntimes():
+				if not fails_safety(loop):
+					st.error("loop over unsafe iterable did not fail")
+		`)
+	})
+
+	t.Run("unsafe-position", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+		predeclared := starlark.StringDict{
+			"unsafe": &unsafeTestIterable{t},
+		}
+		_, err := starlark.ExecFileOptions(&syntax.FileOptions{TopLevelControl: true, GlobalReassign: true}, thread, "unsafe.star", `
+x = 1
+for _ in unsafe:
+    x += 1
+`, predeclared)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if evalErr, ok := err.(*starlark.EvalError); !ok {
+			t.Errorf("expected EvalError, got %T", err)
+		} else if pos := evalErr.CallStack.At(0).Pos; pos.Line != 3 {
+			t.Errorf("error reported at %s, want line 3", pos)
+		}
+	})
+}
+
+func TestLoopControlFlowSteps(t *testing.T) {
+	t.Run("break", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Each iteration, including the one which leaves the loop, executes
+		// seven instructions.
+		st.SetMinSteps(7)
+		st.SetMaxSteps(7)
+		st.RunString(`
+			for i in range(1 << 40):
+				if i == st.n:
+					break
+		`)
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The jump for continue replaces the back-edge of the loop.
+		st.SetMinSteps(7)
+		st.SetMaxSteps(7)
+		st.RunString(`
+			for i in range(st.n):
+				if i >= 0:
+					continue
+				st.error("continue did not skip the rest of the body")
+		`)
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		const maxSteps = 1000
+
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(maxSteps)
+		_, err := starlark.ExecFileOptions(&syntax.FileOptions{TopLevelControl: true}, thread, "loop.star", `
+for i in range(1 << 40):
+    if i < 0:
+        break
+`, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if steps, _ := thread.Steps(); steps > maxSteps+1 {
+			t.Errorf("loop ran past its budget: got %d steps, want at most %d", steps, maxSteps+1)
+		}
+	})
 }
 
 func TestSequenceAssignment(t *testing.T) {
@@ -327,6 +578,109 @@ func TestSequenceAssignment(t *testing.T) {
 				st.keep_alive(first, second)
 		`)
 	})
+
+	t.Run("length-mismatch", func(t *testing.T) {
+		tests := []struct {
+			src string
+			err string
+		}{{
+			src: "a, b, c = range(1000)",
+			err: "too many values to unpack (got 1000, want 3)",
+		}, {
+			src: "a, b, c = [1]",
+			err: "too few values to unpack (got 1, want 3)",
+		}}
+		for _, test := range tests {
+			_, err := starlark.ExecFile(&starlark.Thread{}, "unpack.star", test.src, nil)
+			if err == nil {
+				t.Errorf("%s: expected error", test.src)
+			} else if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: unexpected error: %v", test.src, err)
+			}
+		}
+	})
+
+	t.Run("starred-target", func(t *testing.T) {
+		// Starlark has no starred assignment, so no list is ever
+		// created to hold the remainder of the sequence.
+		_, err := starlark.ExecFile(&starlark.Thread{}, "unpack.star", "a, *rest = [1, 2, 3]", nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !strings.Contains(err.Error(), "got '*', want primary expression") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestAugmentedAssignment(t *testing.T) {
+	t.Run("string", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		st.SetMinSteps(1)
+		st.RunString(`
+			for _ in st.ntimes():
+				s = "x" * 16
+				s += "y" * 16
+				st.keep_alive(s)
+		`)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		// Extending a list costs a step per element.
+		st.SetMinSteps(8)
+		st.RunString(`
+			l = []
+			for _ in st.ntimes():
+				l += range(8)
+			st.keep_alive(l)
+		`)
+	})
+
+	t.Run("int", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		st.SetMinSteps(1)
+		st.RunString(`
+			for _ in st.ntimes():
+				i = 1 << 100
+				i += 1 << 100
+				st.keep_alive(i)
+		`)
+	})
+
+	t.Run("dict", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		st.SetMinSteps(1)
+		st.RunString(`
+			d = {}
+			for i in st.ntimes():
+				d |= {i: i}
+			st.keep_alive(d)
+		`)
+	})
+
+	t.Run("dict-budget", func(t *testing.T) {
+		other := starlark.NewDict(1000)
+		for i := 0; i < 1000; i++ {
+			other.SetKey(starlark.MakeInt(i), starlark.None)
+		}
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(1000)
+		predeclared := starlark.StringDict{"other": other}
+		_, err := starlark.ExecFile(thread, "augmented.star", "def f():\n    d = {}\n    d |= other\nf()", predeclared)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		} else if strings.Contains(err.Error(), "cancelled") {
+			// The failed insertion must report its own error rather
+			// than leave it to the next cancellation check.
+			t.Errorf("error from |= was dropped: %v", err)
+		}
+	})
 }
 
 func TestAttrAccessAllocs(t *testing.T) {
@@ -496,6 +850,32 @@ func (*unsafeTestIndexable) SetIndex(index int, v starlark.Value) error {
 	return fmt.Errorf("SetIndex called")
 }
 
+// costlyTestIndexable is a virtual sequence of squares, each of which is
+// charged a fixed number of steps to compute.
+type costlyTestIndexable struct {
+	len, cost int
+}
+
+var _ starlark.SafeIndexable = &costlyTestIndexable{}
+
+func (cti *costlyTestIndexable) Freeze()              {}
+func (cti *costlyTestIndexable) String() string       { return "costlyTestIndexable" }
+func (cti *costlyTestIndexable) Truth() starlark.Bool { return cti.len > 0 }
+func (cti *costlyTestIndexable) Type() string         { return "<costlyTestIndexable>" }
+func (cti *costlyTestIndexable) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", cti.Type())
+}
+func (cti *costlyTestIndexable) Len() int                   { return cti.len }
+func (cti *costlyTestIndexable) Index(i int) starlark.Value { return starlark.MakeInt(i * i) }
+func (cti *costlyTestIndexable) SafeIndex(thread *starlark.Thread, i int) (starlark.Value, error) {
+	if thread != nil {
+		if err := thread.AddSteps(starlark.SafeInt(cti.cost)); err != nil {
+			return nil, err
+		}
+	}
+	return cti.Index(i), nil
+}
+
 type unsafeTestMapping struct{}
 
 var _ starlark.Mapping = &unsafeTestMapping{}
@@ -661,6 +1041,201 @@ func TestIndexing(t *testing.T) {
 			})
 		})
 	})
+
+	t.Run("custom", func(t *testing.T) {
+		const cost = 10
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe)
+		// Each index is charged by the value's SafeIndex method.
+		st.SetMinSteps(cost)
+		st.AddValue("input", &costlyTestIndexable{len: 10, cost: cost})
+		st.RunString(`
+			for _ in st.ntimes():
+				st.keep_alive(input[-1])
+		`)
+	})
+}
+
+type unsafeTestSliceable struct {
+	unsafeTestIndexable
+}
+
+var _ starlark.Sliceable = &unsafeTestSliceable{}
+
+func (uts *unsafeTestSliceable) Slice(start, end, step int) starlark.Value {
+	return starlark.None
+}
+
+func TestSlicing(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		dummy := &testing.T{}
+		st := startest.From(dummy)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe)
+		st.AddValue("input", &unsafeTestSliceable{})
+		ok := st.RunString(`
+			input[::-1]
+		`)
+		if ok {
+			st.Error("expected error")
+		}
+	})
+
+	t.Run("results", func(t *testing.T) {
+		tests := []struct {
+			expr   string
+			expect string
+		}{
+			{`[1, 2, 3, 4][::-1]`, `[4, 3, 2, 1]`},
+			{`[1, 2, 3, 4][-2::-2]`, `[3, 1]`},
+			{`(1, 2, 3)[::-1]`, `(3, 2, 1)`},
+			{`"hello"[::-1]`, `"olleh"`},
+			{`"hello"[1:4]`, `"ell"`},
+			{`b"hello"[::2]`, `b"hlo"`},
+			{`b"hello"[3:0:-1]`, `b"lle"`},
+			{`range(10)[8::-3]`, `range(8, -1, -3)`},
+		}
+		for _, test := range tests {
+			result, err := starlark.Eval(&starlark.Thread{}, "slice.star", test.expr, nil)
+			if err != nil {
+				t.Errorf("%s: %v", test.expr, err)
+			} else if s := result.String(); s != test.expect {
+				t.Errorf("%s: got %s, want %s", test.expr, s, test.expect)
+			}
+		}
+	})
+
+	type sliceTest struct {
+		name  string
+		input func(n int) starlark.Value
+		step  int
+	}
+	tests := []sliceTest{{
+		name: "list",
+		input: func(n int) starlark.Value {
+			elems := make([]starlark.Value, n)
+			for i := range elems {
+				elems[i] = starlark.None
+			}
+			return starlark.NewList(elems)
+		},
+		step: -1,
+	}, {
+		name: "tuple",
+		input: func(n int) starlark.Value {
+			elems := make(starlark.Tuple, n)
+			for i := range elems {
+				elems[i] = starlark.None
+			}
+			return elems
+		},
+		step: -1,
+	}, {
+		name: "string",
+		input: func(n int) starlark.Value {
+			return starlark.String(strings.Repeat("x", n))
+		},
+		step: -1,
+	}, {
+		name: "bytes",
+		input: func(n int) starlark.Value {
+			return starlark.Bytes(strings.Repeat("x", 2*n))
+		},
+		step: 2,
+	}}
+
+	// sliceBounds returns the bounds of a whole-sequence slice of
+	// length n in the form passed to SafeSlice.
+	sliceBounds := func(n, step int) (start, end int) {
+		if step < 0 {
+			return n - 1, -1
+		}
+		return 0, n
+	}
+
+	t.Run("steps", func(t *testing.T) {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.CPUSafe)
+				// Each element produced costs a step.
+				st.SetMinSteps(1)
+				st.SetMaxSteps(1)
+				st.RunThread(func(thread *starlark.Thread) {
+					input := test.input(st.N).(starlark.SafeSliceable)
+					start, end := sliceBounds(input.Len(), test.step)
+					if _, err := input.SafeSlice(thread, start, end, test.step); err != nil {
+						st.Error(err)
+					}
+				})
+			})
+		}
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.MemSafe)
+				st.RunThread(func(thread *starlark.Thread) {
+					input := test.input(16).(starlark.SafeSliceable)
+					start, end := sliceBounds(input.Len(), test.step)
+					for i := 0; i < st.N; i++ {
+						result, err := input.SafeSlice(thread, start, end, test.step)
+						if err != nil {
+							st.Error(err)
+						}
+						st.KeepAlive(result)
+					}
+				})
+			})
+		}
+	})
+
+	t.Run("exact-allocs", func(t *testing.T) {
+		const n = 64
+		expected := map[string]int64{
+			"list":   mustInt64(starlark.SafeAdd(starlark.EstimateSize(&starlark.List{}), starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(n)))),
+			"tuple":  mustInt64(starlark.SafeAdd(starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(n)), starlark.SliceTypeOverhead)),
+			"string": mustInt64(starlark.SafeAdd(starlark.EstimateMakeSize([]byte{}, starlark.SafeInt(n)), starlark.StringTypeOverhead)),
+			"bytes":  mustInt64(starlark.SafeAdd(starlark.EstimateMakeSize([]byte{}, starlark.SafeInt(n)), starlark.StringTypeOverhead)),
+		}
+		for _, test := range tests {
+			thread := &starlark.Thread{}
+			input := test.input(n).(starlark.SafeSliceable)
+			start, end := sliceBounds(input.Len(), test.step)
+			result, err := input.SafeSlice(thread, start, end, test.step)
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+			if l := result.(starlark.Indexable).Len(); l != n {
+				t.Errorf("%s: got %d elements, want %d", test.name, l, n)
+			}
+			if allocs, _ := thread.Allocs(); allocs != expected[test.name] {
+				t.Errorf("%s: declared %d bytes, want %d", test.name, allocs, expected[test.name])
+			}
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		const n = 1_000_000
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				thread := &starlark.Thread{}
+				thread.SetMaxAllocs(1024)
+				input := test.input(n).(starlark.SafeSliceable)
+				start, end := sliceBounds(input.Len(), test.step)
+				_, err := input.SafeSlice(thread, start, end, test.step)
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				expected := &starlark.AllocsSafetyError{}
+				if !errors.As(err, &expected) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			})
+		}
+	})
 }
 
 func TestFunctionCall(t *testing.T) {
@@ -810,4 +1385,580 @@ func TestFunctionCall(t *testing.T) {
 			`)
 		})
 	})
+
+	t.Run("residual-args", func(t *testing.T) {
+		t.Run("varargs", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunString(`
+				def f(a, *args):
+					return args
+
+				for _ in st.ntimes():
+					st.keep_alive(f(1, 2, 3, 4, 5, 6, 7, 8))
+			`)
+		})
+
+		t.Run("kwargs", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunString(`
+				def f(a, **kwargs):
+					return kwargs
+
+				for _ in st.ntimes():
+					st.keep_alive(f(a=1, b=2, c=3, d=4, e=5))
+			`)
+		})
+
+		t.Run("kwonly", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunString(`
+				def f(a, *args, b, c=3, **kwargs):
+					return args, kwargs
+
+				for _ in st.ntimes():
+					st.keep_alive(f(1, 2, 3, b=2, d=4, e=5))
+			`)
+		})
+
+		t.Run("spread", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunString(`
+				def f(*args, **kwargs):
+					return args, kwargs
+
+				args = list(range(100))
+				kwargs = {"k%d" % i: i for i in range(100)}
+				for _ in st.ntimes():
+					st.keep_alive(f(*args, **kwargs))
+			`)
+		})
+
+		t.Run("budget", func(t *testing.T) {
+			thread := &starlark.Thread{}
+			thread.SetMaxAllocs(100000)
+			_, err := starlark.ExecFile(thread, "residual.star", `
+def f(*args, **kwargs):
+    return args, kwargs
+
+args = range(1000)
+kwargs = {"k%d" % i: i for i in range(200)}
+results = [f(*args, **kwargs) for _ in range(100)]
+`, nil)
+			if err == nil {
+				t.Error("expected error")
+			} else if !errors.Is(err, starlark.ErrSafety) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	})
+
+	t.Run("binding-errors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			src  string
+			want string
+		}{{
+			name: "too-many-positional",
+			src:  "f(1, 2, 3)",
+			want: "function f accepts 1 positional argument (3 given)",
+		}, {
+			name: "missing-kwonly",
+			src:  "f(1)",
+			want: "function f missing 1 argument (b)",
+		}, {
+			name: "unexpected-keyword",
+			src:  "f(1, b=2, d=4)",
+			want: `function f got an unexpected keyword argument "d"`,
+		}, {
+			name: "duplicate",
+			src:  "f(1, a=1, b=2)",
+			want: `function f got multiple values for parameter "a"`,
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				thread := &starlark.Thread{}
+				src := "def f(a, *, b, c=3):\n    pass\n" + test.src
+				_, err := starlark.ExecFile(thread, "binding.star", src, nil)
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if msg := err.(*starlark.EvalError).Msg; msg != test.want {
+					t.Errorf("unexpected error: got %q, want %q", msg, test.want)
+				}
+			})
+		}
+	})
+}
+
+func TestClosureCreation(t *testing.T) {
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunString(`
+			def capture(a, b, c):
+				return lambda: (a, b, c)
+
+			for i in st.ntimes():
+				st.keep_alive(capture(i, i, i))
+		`)
+	})
+
+	t.Run("shared-cells", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunString(`
+			def run():
+				a, b = 1, 2
+				return [lambda: a + b for _ in st.ntimes()]
+
+			st.keep_alive(run())
+		`)
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(10000)
+		_, err := starlark.ExecFile(thread, "closures.star", `
+def capture(a, b, c):
+    return lambda: (a, b, c)
+
+closures = [capture(i, i, i) for i in range(1000)]
+`, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestCallKwargsSpreading(t *testing.T) {
+	const nkwargs = 1000
+	kwargs := starlark.NewDict(nkwargs)
+	for i := 0; i < nkwargs; i++ {
+		kwargs.SetKey(starlark.String(fmt.Sprintf("k%d", i)), starlark.MakeInt(i))
+	}
+	kwargs.Freeze()
+
+	keep_alive_kwargs := func(st *startest.ST) *starlark.Builtin {
+		return starlark.NewBuiltinWithSafety("keep_alive_kwargs", starlark.CPUSafe|starlark.MemSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				st.KeepAlive(kwargs)
+				return starlark.None, nil
+			})
+	}
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.AddValue("kwargs", kwargs)
+		st.AddBuiltin(keep_alive_kwargs(st))
+		st.RequireSafety(starlark.CPUSafe)
+		// Each item costs a step, plus a few for the loop and call.
+		st.SetMinSteps(nkwargs)
+		st.SetMaxSteps(nkwargs + 10)
+		st.RunString(`
+			for _ in st.ntimes():
+				keep_alive_kwargs(**kwargs)
+		`)
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.AddValue("kwargs", kwargs)
+		st.AddBuiltin(keep_alive_kwargs(st))
+		st.RequireSafety(starlark.MemSafe)
+		st.RunString(`
+			for _ in st.ntimes():
+				keep_alive_kwargs(**kwargs)
+		`)
+	})
+
+	t.Run("max-args", func(t *testing.T) {
+		tests := []struct {
+			name string
+			src  string
+		}{{
+			name: "kwargs",
+			src:  "f(**kwargs)",
+		}, {
+			name: "mixed-kwargs",
+			src:  "f(a=1, **kwargs)",
+		}, {
+			name: "args",
+			src:  "f(*range(1000))",
+		}, {
+			name: "mixed",
+			src:  "f(1, 2, *range(7), **{'a': 1, 'b': 2})",
+		}, {
+			name: "plain",
+			src:  "f(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)",
+		}}
+		nop := starlark.NewBuiltin("f", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			return starlark.None, nil
+		})
+		predeclared := starlark.StringDict{
+			"f":      nop,
+			"kwargs": kwargs,
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				thread := &starlark.Thread{}
+				thread.SetMaxArgs(10)
+				_, err := starlark.ExecFile(thread, "max_args.star", test.src, predeclared)
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				const want = "too many arguments: call exceeds the maximum of 10"
+				if msg := err.Error(); msg != want {
+					t.Errorf("unexpected error: got %q, want %q", msg, want)
+				}
+				// The call is rejected before its arguments are spread.
+				if steps, _ := thread.Steps(); steps > 100 {
+					t.Errorf("too many steps taken before rejecting the call: %d", steps)
+				}
+			})
+		}
+
+		thread := &starlark.Thread{}
+		thread.SetMaxArgs(nkwargs)
+		if _, err := starlark.ExecFile(thread, "max_args.star", "f(**kwargs)", predeclared); err != nil {
+			t.Errorf("unexpected error at the limit: %v", err)
+		}
+	})
+}
+
+func TestComparison(t *testing.T) {
+	makeList := func(n int) *starlark.List {
+		elems := make([]starlark.Value, n)
+		for i := range elems {
+			elems[i] = starlark.None
+		}
+		return starlark.NewList(elems)
+	}
+
+	t.Run("lists", func(t *testing.T) {
+		for _, op := range []string{"==", "!=", "<", "<=", ">", ">="} {
+			t.Run(op, func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.CPUSafe)
+				// Each pair of elements compared costs a step.
+				st.SetMinSteps(1)
+				st.SetMaxSteps(1)
+				st.RunThread(func(thread *starlark.Thread) {
+					predeclared := starlark.StringDict{
+						"a": makeList(st.N),
+						"b": makeList(st.N),
+					}
+					_, err := starlark.ExecFile(thread, "compare.star", "x = a "+op+" b", predeclared)
+					if err != nil {
+						st.Error(err)
+					}
+				})
+			})
+		}
+
+		t.Run("exact", func(t *testing.T) {
+			const n = 10_000
+			thread := &starlark.Thread{}
+			if eq, err := starlark.SafeCompare(thread, syntax.EQL, makeList(n), makeList(n)); err != nil {
+				t.Fatal(err)
+			} else if !eq {
+				t.Error("equal lists compared unequal")
+			}
+			if steps, _ := thread.Steps(); steps != n {
+				t.Errorf("unexpected steps: got %d, want %d", steps, n)
+			}
+		})
+
+		t.Run("budget", func(t *testing.T) {
+			const n = 1 << 20
+			thread := &starlark.Thread{}
+			thread.SetMaxSteps(1000)
+			_, err := starlark.SafeCompare(thread, syntax.EQL, makeList(n), makeList(n))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			expected := &starlark.StepsSafetyError{}
+			if !errors.As(err, &expected) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			// The comparison must stop as soon as the budget is spent.
+			if steps, _ := thread.Steps(); steps > 1001 {
+				t.Errorf("comparison continued past its budget: %d steps", steps)
+			}
+		})
+	})
+
+	t.Run("strings", func(t *testing.T) {
+		// The operands share a prefix of N bytes, differing only
+		// in their final byte.
+		operands := map[string]func(s string) starlark.Value{
+			"string": func(s string) starlark.Value { return starlark.String(s) },
+			"bytes":  func(s string) starlark.Value { return starlark.Bytes(s) },
+		}
+		for name, makeOperand := range operands {
+			for _, op := range []string{"==", "!=", "<", "<=", ">", ">="} {
+				t.Run(name+op, func(t *testing.T) {
+					st := startest.From(t)
+					st.RequireSafety(starlark.CPUSafe)
+					// Each byte of the common prefix costs a step.
+					st.SetMinSteps(1)
+					st.SetMaxSteps(1)
+					st.RunThread(func(thread *starlark.Thread) {
+						prefix := strings.Repeat("x", st.N)
+						predeclared := starlark.StringDict{
+							"a": makeOperand(prefix + "a"),
+							"b": makeOperand(prefix + "b"),
+						}
+						_, err := starlark.ExecFile(thread, "compare.star", "x = a "+op+" b", predeclared)
+						if err != nil {
+							st.Error(err)
+						}
+					})
+				})
+			}
+		}
+
+		t.Run("early-difference", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.CPUSafe)
+			// Comparison stops within the chunk of bytes holding the
+			// first difference.
+			st.SetMaxSteps(64)
+			st.RunThread(func(thread *starlark.Thread) {
+				suffix := strings.Repeat("x", 1000)
+				predeclared := starlark.StringDict{
+					"a": starlark.String("a" + suffix),
+					"b": starlark.String("b" + suffix),
+				}
+				for i := 0; i < st.N; i++ {
+					if ok, err := starlark.SafeCompare(thread, syntax.LT, predeclared["a"], predeclared["b"]); err != nil {
+						st.Error(err)
+					} else if !ok {
+						st.Error("unexpected comparison result")
+					}
+				}
+			})
+		})
+
+		t.Run("budget", func(t *testing.T) {
+			thread := &starlark.Thread{}
+			thread.SetMaxSteps(1000)
+			prefix := strings.Repeat("x", 1<<20)
+			_, err := starlark.SafeCompare(thread, syntax.EQL, starlark.String(prefix+"a"), starlark.String(prefix+"b"))
+			if err == nil {
+				t.Error("expected error")
+			} else if !errors.Is(err, starlark.ErrSafety) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	})
+
+	t.Run("chained", func(t *testing.T) {
+		// Comparisons do not chain: the middle operand must be named
+		// explicitly, and is then evaluated once.
+		_, err := starlark.ExecFile(&starlark.Thread{}, "compare.star", "x = 1 < 2 < 3", nil)
+		if err == nil {
+			t.Fatal("expected error")
+		} else if !strings.Contains(err.Error(), "< does not associate with <") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Both comparisons are charged a step per element.
+		st.SetMinSteps(2)
+		st.SetMaxSteps(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			calls := 0
+			middle := starlark.NewBuiltinWithSafety("middle", starlark.CPUSafe, func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+				calls++
+				return makeList(st.N), nil
+			})
+			predeclared := starlark.StringDict{
+				"a":      makeList(st.N),
+				"c":      makeList(st.N),
+				"middle": middle,
+			}
+			const src = `
+b = middle()
+x = a <= b and b <= c
+`
+			globals, err := starlark.ExecFile(thread, "compare.star", src, predeclared)
+			if err != nil {
+				st.Fatal(err)
+			}
+			if globals["x"] != starlark.True {
+				st.Errorf("unexpected result: %v", globals["x"])
+			}
+			if calls != 1 {
+				st.Errorf("middle operand evaluated %d times", calls)
+			}
+		})
+	})
+}
+
+func TestMembership(t *testing.T) {
+	const width = 4
+	makeElems := func(n int) []starlark.Value {
+		elems := make([]starlark.Value, n)
+		for i := range elems {
+			elem := make(starlark.Tuple, width)
+			for j := range elem {
+				elem[j] = starlark.None
+			}
+			elem[width-1] = starlark.MakeInt(1)
+			elems[i] = elem
+		}
+		return elems
+	}
+	needle := func() starlark.Tuple {
+		elem := make(starlark.Tuple, width)
+		for j := range elem {
+			elem[j] = starlark.None
+		}
+		elem[width-1] = starlark.MakeInt(2)
+		return elem
+	}
+
+	for _, op := range []string{"in", "not in"} {
+		for _, container := range []string{"list", "tuple"} {
+			t.Run(container+"/"+op, func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.CPUSafe)
+				// Each element costs a step, plus a step for each pair of
+				// tuple elements compared.
+				st.SetMinSteps(1 + width)
+				st.SetMaxSteps(1 + width)
+				st.RunThread(func(thread *starlark.Thread) {
+					var haystack starlark.Value
+					if container == "list" {
+						haystack = starlark.NewList(makeElems(st.N))
+					} else {
+						haystack = starlark.Tuple(makeElems(st.N))
+					}
+					predeclared := starlark.StringDict{
+						"haystack": haystack,
+						"needle":   needle(),
+					}
+					_, err := starlark.ExecFile(thread, "membership.star", "x = needle "+op+" haystack", predeclared)
+					if err != nil {
+						st.Error(err)
+					}
+				})
+			})
+		}
+	}
+
+	t.Run("early-match", func(t *testing.T) {
+		elems := makeElems(1000)
+		elems[0] = needle()
+		thread := &starlark.Thread{}
+		predeclared := starlark.StringDict{
+			"haystack": starlark.NewList(elems),
+			"needle":   needle(),
+		}
+		globals, err := starlark.ExecFile(thread, "membership.star", "x = needle in haystack", predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if globals["x"] != starlark.True {
+			t.Errorf("unexpected result: %v", globals["x"])
+		}
+		if steps, _ := thread.Steps(); steps >= 1000 {
+			t.Errorf("membership test did not stop at first match: %d steps", steps)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(1000)
+		predeclared := starlark.StringDict{
+			"haystack": starlark.NewList(makeElems(1000)),
+			"needle":   needle(),
+		}
+		_, err := starlark.ExecFile(thread, "membership.star", "x = needle in haystack", predeclared)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+// costlyTruther is a value whose truth costs a fixed number of steps to
+// compute.
+type costlyTruther struct {
+	truth starlark.Bool
+	cost  int64
+}
+
+var _ starlark.SafeTruther = &costlyTruther{}
+
+func (ct *costlyTruther) Freeze()              {}
+func (ct *costlyTruther) String() string       { return "costlyTruther" }
+func (ct *costlyTruther) Type() string         { return "costlyTruther" }
+func (ct *costlyTruther) Truth() starlark.Bool { return ct.truth }
+func (ct *costlyTruther) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", ct.Type())
+}
+func (ct *costlyTruther) SafeTruth(thread *starlark.Thread) (starlark.Bool, error) {
+	if err := thread.AddSteps(starlark.SafeInt(ct.cost)); err != nil {
+		return false, err
+	}
+	return ct.truth, nil
+}
+
+func TestTruthSteps(t *testing.T) {
+	const cost = 100
+	tests := []struct {
+		name    string
+		expr    string
+		charged bool
+	}{
+		{"conditional", "1 if t else 2", true},
+		{"conditional-untested", "t if True else f", false},
+		{"and", "t and 1", true},
+		{"and-short-circuit", "False and (t or 1)", false},
+		{"or", "f or 1", true},
+		{"or-short-circuit", "True or (t or 1)", false},
+		{"not", "not t", true},
+		{"comprehension-filter", "[1 for _ in [0] if f]", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.CPUSafe)
+			if test.charged {
+				st.SetMinSteps(cost)
+				st.SetMaxSteps(cost + 20)
+			} else {
+				st.SetMaxSteps(10)
+			}
+			st.AddValue("t", &costlyTruther{truth: true, cost: cost})
+			st.AddValue("f", &costlyTruther{truth: false, cost: cost})
+			st.RunString(`
+				for _ in st.ntimes():
+					` + test.expr + `
+			`)
+		})
+	}
+
+	t.Run("cancellation", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(cost / 2)
+		predeclared := starlark.StringDict{
+			"t": &costlyTruther{truth: true, cost: cost},
+		}
+		_, err := starlark.ExecFile(thread, "truth.star", "x = 1 if t else 2", predeclared)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
 }
@@ -18,6 +18,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf16"
 	"unicode/utf8"
@@ -40,72 +41,80 @@ var ErrNoAttr = errors.New("no such attribute")
 func init() {
 	// https://github.com/google/starlark-go/blob/master/doc/spec.md#built-in-constants-and-functions
 	Universe = StringDict{
-		"None":      None,
-		"True":      True,
-		"False":     False,
-		"abs":       NewBuiltin("abs", abs),
-		"any":       NewBuiltin("any", any_),
-		"all":       NewBuiltin("all", all),
-		"bool":      NewBuiltin("bool", bool_),
-		"bytes":     NewBuiltin("bytes", bytes_),
-		"chr":       NewBuiltin("chr", chr),
-		"dict":      NewBuiltin("dict", dict),
-		"dir":       NewBuiltin("dir", dir),
-		"enumerate": NewBuiltin("enumerate", enumerate),
-		"fail":      NewBuiltin("fail", fail),
-		"float":     NewBuiltin("float", float),
-		"getattr":   NewBuiltin("getattr", getattr),
-		"hasattr":   NewBuiltin("hasattr", hasattr),
-		"hash":      NewBuiltin("hash", hash),
-		"int":       NewBuiltin("int", int_),
-		"len":       NewBuiltin("len", len_),
-		"list":      NewBuiltin("list", list),
-		"max":       NewBuiltin("max", minmax),
-		"min":       NewBuiltin("min", minmax),
-		"ord":       NewBuiltin("ord", ord),
-		"print":     NewBuiltin("print", print),
-		"range":     NewBuiltin("range", range_),
-		"repr":      NewBuiltin("repr", repr),
-		"reversed":  NewBuiltin("reversed", reversed),
-		"set":       NewBuiltin("set", set), // requires resolve.AllowSet
-		"sorted":    NewBuiltin("sorted", sorted),
-		"str":       NewBuiltin("str", str),
-		"tuple":     NewBuiltin("tuple", tuple),
-		"type":      NewBuiltin("type", type_),
-		"zip":       NewBuiltin("zip", zip),
+		"None":        None,
+		"True":        True,
+		"False":       False,
+		"abs":         NewBuiltin("abs", abs),
+		"any":         NewBuiltin("any", any_),
+		"all":         NewBuiltin("all", all),
+		"bool":        NewBuiltin("bool", bool_),
+		"bytes":       NewBuiltin("bytes", bytes_),
+		"chr":         NewBuiltin("chr", chr),
+		"dict":        NewBuiltin("dict", dict),
+		"dir":         NewBuiltin("dir", dir),
+		"enumerate":   NewBuiltin("enumerate", enumerate),
+		"fail":        NewBuiltin("fail", fail),
+		"float":       NewBuiltin("float", float),
+		"getattr":     NewBuiltin("getattr", getattr),
+		"groupby":     NewBuiltin("groupby", groupby),
+		"hasattr":     NewBuiltin("hasattr", hasattr),
+		"hash":        NewBuiltin("hash", hash),
+		"int":         NewBuiltin("int", int_),
+		"len":         NewBuiltin("len", len_),
+		"lines":       NewBuiltin("lines", lines),
+		"list":        NewBuiltin("list", list),
+		"max":         NewBuiltin("max", minmax),
+		"memoize":     NewBuiltin("memoize", memoize),
+		"min":         NewBuiltin("min", minmax),
+		"ord":         NewBuiltin("ord", ord),
+		"print":       NewBuiltin("print", print),
+		"range":       NewBuiltin("range", range_),
+		"repr":        NewBuiltin("repr", repr),
+		"reversed":    NewBuiltin("reversed", reversed),
+		"set":         NewBuiltin("set", set), // requires resolve.AllowSet
+		"sorted":      NewBuiltin("sorted", sorted),
+		"str":         NewBuiltin("str", str),
+		"tuple":       NewBuiltin("tuple", tuple),
+		"type":        NewBuiltin("type", type_),
+		"zip":         NewBuiltin("zip", zip),
+		"zip_longest": NewBuiltin("zip_longest", zip_longest),
 	}
 
 	universeSafeties = map[string]SafetyFlags{
-		"abs":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"any":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"all":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"bool":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"bytes":     CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"chr":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"dict":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"dir":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"enumerate": CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"fail":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"float":     CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"getattr":   CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"hasattr":   CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"hash":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"int":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"len":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"list":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"max":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"min":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"ord":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"print":     CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"range":     CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"repr":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"reversed":  CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"set":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"sorted":    CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"str":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"tuple":     CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"type":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"zip":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"abs":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"any":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"all":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"bool":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"bytes":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"chr":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"dict":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"dir":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"enumerate":   CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"fail":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"float":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"getattr":     CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"groupby":     CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"hasattr":     CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"hash":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"int":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"len":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"lines":       MemSafe | IOSafe,
+		"list":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"max":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"memoize":     CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"min":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"ord":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"print":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"range":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"repr":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"reversed":    CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"set":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"sorted":      CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"str":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"tuple":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"type":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"zip":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"zip_longest": CPUSafe | MemSafe | TimeSafe | IOSafe,
 	}
 
 	for name, flags := range universeSafeties {
@@ -119,33 +128,47 @@ func init() {
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#built-in-methods
 var (
 	bytesMethods = map[string]*Builtin{
-		"elems": NewBuiltin("elems", bytes_elems),
+		"count":      NewBuiltin("count", bytes_count),
+		"elems":      NewBuiltin("elems", bytes_elems),
+		"endswith":   NewBuiltin("endswith", bytes_startswith),
+		"find":       NewBuiltin("find", bytes_find),
+		"index":      NewBuiltin("index", bytes_index),
+		"replace":    NewBuiltin("replace", bytes_replace),
+		"startswith": NewBuiltin("startswith", bytes_startswith),
 	}
 	bytesMethodSafeties = map[string]SafetyFlags{
-		"elems": CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"count":      CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"elems":      CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"endswith":   CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"find":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"index":      CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"replace":    CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"startswith": CPUSafe | MemSafe | TimeSafe | IOSafe,
 	}
 
 	dictMethods = map[string]*Builtin{
-		"clear":      NewBuiltin("clear", dict_clear),
-		"get":        NewBuiltin("get", dict_get),
-		"items":      NewBuiltin("items", dict_items),
-		"keys":       NewBuiltin("keys", dict_keys),
-		"pop":        NewBuiltin("pop", dict_pop),
-		"popitem":    NewBuiltin("popitem", dict_popitem),
-		"setdefault": NewBuiltin("setdefault", dict_setdefault),
-		"update":     NewBuiltin("update", dict_update),
-		"values":     NewBuiltin("values", dict_values),
+		"clear":       NewBuiltin("clear", dict_clear),
+		"get":         NewBuiltin("get", dict_get),
+		"items":       NewBuiltin("items", dict_items),
+		"keys":        NewBuiltin("keys", dict_keys),
+		"pop":         NewBuiltin("pop", dict_pop),
+		"popitem":     NewBuiltin("popitem", dict_popitem),
+		"setdefault":  NewBuiltin("setdefault", dict_setdefault),
+		"sorted_keys": NewBuiltin("sorted_keys", dict_sorted_keys),
+		"update":      NewBuiltin("update", dict_update),
+		"values":      NewBuiltin("values", dict_values),
 	}
 	dictMethodSafeties = map[string]SafetyFlags{
-		"clear":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"get":        CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"items":      CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"keys":       CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"pop":        CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"popitem":    CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"setdefault": CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"update":     CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"values":     CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"clear":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"get":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"items":       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"keys":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"pop":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"popitem":     CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"setdefault":  CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"sorted_keys": CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"update":      CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"values":      CPUSafe | MemSafe | TimeSafe | IOSafe,
 	}
 
 	listMethods = map[string]*Builtin{
@@ -243,30 +266,36 @@ var (
 	}
 
 	setMethods = map[string]*Builtin{
-		"add":                  NewBuiltin("add", set_add),
-		"clear":                NewBuiltin("clear", set_clear),
-		"difference":           NewBuiltin("difference", set_difference),
-		"discard":              NewBuiltin("discard", set_discard),
-		"intersection":         NewBuiltin("intersection", set_intersection),
-		"issubset":             NewBuiltin("issubset", set_issubset),
-		"issuperset":           NewBuiltin("issuperset", set_issuperset),
-		"pop":                  NewBuiltin("pop", set_pop),
-		"remove":               NewBuiltin("remove", set_remove),
-		"symmetric_difference": NewBuiltin("symmetric_difference", set_symmetric_difference),
-		"union":                NewBuiltin("union", set_union),
+		"add":                         NewBuiltin("add", set_add),
+		"clear":                       NewBuiltin("clear", set_clear),
+		"difference":                  NewBuiltin("difference", set_difference),
+		"difference_update":           NewBuiltin("difference_update", set_difference_update),
+		"discard":                     NewBuiltin("discard", set_discard),
+		"intersection":                NewBuiltin("intersection", set_intersection),
+		"intersection_update":         NewBuiltin("intersection_update", set_intersection_update),
+		"issubset":                    NewBuiltin("issubset", set_issubset),
+		"issuperset":                  NewBuiltin("issuperset", set_issuperset),
+		"pop":                         NewBuiltin("pop", set_pop),
+		"remove":                      NewBuiltin("remove", set_remove),
+		"symmetric_difference":        NewBuiltin("symmetric_difference", set_symmetric_difference),
+		"symmetric_difference_update": NewBuiltin("symmetric_difference_update", set_symmetric_difference_update),
+		"union":                       NewBuiltin("union", set_union),
 	}
 	setMethodSafeties = map[string]SafetyFlags{
-		"add":                  CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"clear":                CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"difference":           CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"discard":              CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"intersection":         CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"issubset":             CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"issuperset":           CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"pop":                  CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"remove":               CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"symmetric_difference": CPUSafe | MemSafe | TimeSafe | IOSafe,
-		"union":                CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"add":                         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"clear":                       CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"difference":                  CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"difference_update":           CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"discard":                     CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"intersection":                CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"intersection_update":         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"issubset":                    CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"issuperset":                  CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"pop":                         CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"remove":                      CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"symmetric_difference":        CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"symmetric_difference_update": CPUSafe | MemSafe | TimeSafe | IOSafe,
+		"union":                       CPUSafe | MemSafe | TimeSafe | IOSafe,
 	}
 )
 
@@ -463,6 +492,7 @@ func bytes_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		if err != nil {
 			return nil, err
 		}
+		iter = thread.joinBudget(iter)
 		defer iter.Done()
 		var elem Value
 		var b byte
@@ -542,7 +572,10 @@ func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 	var names []string
 	if x, ok := args[0].(HasAttrs); ok {
-		names = x.AttrNames()
+		var err error
+		if names, err = safeAttrNames(thread, x); err != nil {
+			return nil, err
+		}
 	}
 	if err := thread.AddSteps(SafeInt(len(names))); err != nil {
 		return nil, err
@@ -563,10 +596,19 @@ func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
 	var start int
-	if err := UnpackPositionalArgs("enumerate", args, kwargs, 1, &iterable, &start); err != nil {
+	var lazy bool
+	if err := UnpackArgs("enumerate", args, kwargs, "x", &iterable, "start?", &start, "lazy?", &lazy); err != nil {
 		return nil, err
 	}
 
+	if lazy {
+		result := Value(&enumerateValue{iterable: iterable, start: start})
+		if err := thread.AddAllocs(EstimateSize(result)); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
 	iter, err := SafeIterate(thread, iterable)
 	if err != nil {
 		return nil, err
@@ -574,9 +616,8 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 	defer iter.Done()
 
 	var pairs []Value
-	var x Value
-
-	if n := Len(iterable); n >= 0 {
+	var array Tuple
+	if n := remainingHint(iterable, iter); n > 0 {
 		// common case: known length
 		if err := thread.AddSteps(SafeInt(n)); err != nil {
 			return nil, err
@@ -588,28 +629,26 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 		if err := thread.AddAllocs(overhead); err != nil {
 			return nil, err
 		}
-
 		pairs = make([]Value, 0, n)
-		array := make(Tuple, 2*n) // allocate a single backing array
-		for i := 0; iter.Next(&x); i++ {
-			pair := array[:2:2]
-			array = array[2:]
-			pair[0] = MakeInt(start + i)
-			pair[1] = x
-			pairs = append(pairs, pair)
+		array = make(Tuple, 0, 2*n) // allocate a single backing array
+	}
+
+	// The hint is advisory, so pairs beyond it are allocated separately.
+	pairCost := EstimateSize(Tuple{MakeInt(0), nil})
+	pairsAppender := NewSafeAppender(thread, &pairs)
+	var x Value
+	for i := 0; iter.Next(&x); i++ {
+		if len(array)+2 <= cap(array) {
+			array = append(array, MakeInt(start+i), x)
+			pairs = append(pairs, array[len(array)-2:len(array):len(array)])
+			continue
 		}
-	} else {
-		// non-sequence (unknown length)
-		pairCost := EstimateSize(Tuple{MakeInt(0), nil})
-		pairsAppender := NewSafeAppender(thread, &pairs)
-		for i := 0; iter.Next(&x); i++ {
-			if err := thread.AddAllocs(pairCost); err != nil {
-				return nil, err
-			}
-			pair := Tuple{MakeInt(start + i), x}
-			if err := pairsAppender.Append(pair); err != nil {
-				return nil, err
-			}
+		if err := thread.AddAllocs(pairCost); err != nil {
+			return nil, err
+		}
+		pair := Tuple{MakeInt(start + i), x}
+		if err := pairsAppender.Append(pair); err != nil {
+			return nil, err
 		}
 	}
 	if err := iter.Err(); err != nil {
@@ -622,6 +661,106 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 	return NewList(pairs), nil
 }
 
+// An enumerateValue is an iterable whose iterator lazily yields the
+// (index, value) pairs of enumerate(x, start, lazy=True).
+type enumerateValue struct {
+	iterable Iterable
+	start    int
+}
+
+var _ Iterable = &enumerateValue{}
+
+func (ev *enumerateValue) SafeString(thread *Thread, sb StringBuilder) error {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return err
+	}
+	if _, err := sb.WriteString("enumerate("); err != nil {
+		return err
+	}
+	if err := writeValue(thread, sb, ev.iterable, nil); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(sb, ", %d, lazy=True)", ev.start)
+	return err
+}
+
+func (ev *enumerateValue) String() string        { return toString(ev) }
+func (ev *enumerateValue) Type() string          { return "enumerate" }
+func (ev *enumerateValue) Freeze()               { ev.iterable.Freeze() }
+func (ev *enumerateValue) Truth() Bool           { return True }
+func (ev *enumerateValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", ev.Type()) }
+func (ev *enumerateValue) Iterate() Iterator {
+	return &enumerateIterator{iterable: ev.iterable, index: ev.start}
+}
+
+type enumerateIterator struct {
+	iterable Iterable
+	iter     Iterator
+	index    int
+	thread   *Thread
+	err      error
+}
+
+var _ SafeIterator = &enumerateIterator{}
+
+func (it *enumerateIterator) BindThread(thread *Thread) {
+	it.thread = thread
+	it.iter, it.err = SafeIterate(thread, it.iterable)
+}
+
+func (it *enumerateIterator) Next(p *Value) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.iter == nil {
+		it.iter = it.iterable.Iterate()
+	}
+	var x Value
+	if !it.iter.Next(&x) {
+		return false
+	}
+	if it.thread != nil {
+		if err := it.thread.AddSteps(SafeInt(1)); err != nil {
+			it.err = err
+			return false
+		}
+		if err := it.thread.AddAllocs(EstimateSize(Tuple{MakeInt(0), nil})); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	*p = Tuple{MakeInt(it.index), x}
+	it.index++
+	return true
+}
+
+func (it *enumerateIterator) Done() {
+	if it.iter != nil {
+		it.iter.Done()
+	}
+}
+
+func (it *enumerateIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if iter, ok := it.iter.(SafeIterator); ok {
+		return iter.Err()
+	}
+	return nil
+}
+
+func (it *enumerateIterator) Safety() SafetyFlags {
+	if it.thread == nil || it.err != nil {
+		return NotSafe
+	}
+	if iter, ok := it.iter.(SafeIterator); ok {
+		return iter.Safety()
+	}
+	return NotSafe
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#fail
 func fail(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	sep := " "
@@ -672,6 +811,12 @@ func float(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error
 			return Float(0.0), nil
 		}
 	case Int:
+		if _, xBig := x.get(); xBig != nil {
+			// Conversion of a big int is linear in its length.
+			if err := thread.AddSteps(SafeDiv(xBig.BitLen(), 32)); err != nil {
+				return nil, err
+			}
+		}
 		var err error
 		var result Value
 		result, err = x.finiteFloat()
@@ -754,6 +899,272 @@ func getattr(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	return v, nil
 }
 
+// groupby(x, key=None) returns an iterable of (key, group) pairs, one for
+// each run of consecutive elements of x with equal keys.
+func groupby(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var iterable Iterable
+	var key Callable
+	if err := UnpackArgs("groupby", args, kwargs, "x", &iterable, "key?", &key); err != nil {
+		return nil, err
+	}
+	result := Value(&groupbyValue{iterable: iterable, key: key})
+	if err := thread.AddAllocs(EstimateSize(result)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// A groupbyValue is an iterable whose iterator lazily yields a
+// (key, group) pair for each run of consecutive elements of an
+// iterable which have equal keys.
+type groupbyValue struct {
+	iterable Iterable
+	key      Callable
+}
+
+var _ Iterable = &groupbyValue{}
+
+func (gv *groupbyValue) SafeString(thread *Thread, sb StringBuilder) error {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return err
+	}
+	if _, err := sb.WriteString("groupby("); err != nil {
+		return err
+	}
+	if err := writeValue(thread, sb, gv.iterable, nil); err != nil {
+		return err
+	}
+	if gv.key != nil {
+		if _, err := sb.WriteString(", key="); err != nil {
+			return err
+		}
+		if err := writeValue(thread, sb, gv.key, nil); err != nil {
+			return err
+		}
+	}
+	_, err := sb.WriteString(")")
+	return err
+}
+
+func (gv *groupbyValue) String() string { return toString(gv) }
+func (gv *groupbyValue) Type() string   { return "groupby" }
+func (gv *groupbyValue) Freeze() {
+	gv.iterable.Freeze()
+	if gv.key != nil {
+		gv.key.Freeze()
+	}
+}
+func (gv *groupbyValue) Truth() Bool           { return True }
+func (gv *groupbyValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", gv.Type()) }
+func (gv *groupbyValue) Iterate() Iterator {
+	return &groupbyIterator{iterable: gv.iterable, keyFunc: gv.key}
+}
+
+// A groupbyIterator yields the groups of a groupbyValue. The groups share
+// its underlying iterator, so at most one element is read ahead of the
+// group being iterated. Advancing to the next group skips the elements
+// remaining in the current one, after which the current group is empty.
+type groupbyIterator struct {
+	iterable Iterable
+	keyFunc  Callable
+	keyargs  Tuple
+	iter     Iterator
+	thread   *Thread
+	err      error
+	done     bool
+
+	// The element read ahead, if any, and its key.
+	pending       bool
+	next, nextKey Value
+
+	group *groupValue // the current group
+}
+
+var _ SafeIterator = &groupbyIterator{}
+
+func (it *groupbyIterator) BindThread(thread *Thread) {
+	it.thread = thread
+	it.iter, it.err = SafeIterate(thread, it.iterable)
+}
+
+// advance reads the next element ahead, unless one is already pending.
+func (it *groupbyIterator) advance() bool {
+	if it.pending {
+		return true
+	}
+	if it.err != nil || it.done {
+		return false
+	}
+	if it.iter == nil {
+		it.iter = it.iterable.Iterate()
+	}
+	var x Value
+	if !it.iter.Next(&x) {
+		it.done = true
+		return false
+	}
+	key := x
+	if it.thread != nil {
+		if err := it.thread.AddSteps(SafeInt(1)); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	if it.keyFunc != nil {
+		if it.thread == nil {
+			it.err = errors.New("groupby: cannot call key function without a thread")
+			return false
+		}
+		if it.keyargs == nil {
+			it.keyargs = make(Tuple, 1)
+		}
+		it.keyargs[0] = x
+		res, err := Call(it.thread, it.keyFunc, it.keyargs, nil)
+		if err != nil {
+			it.err = err // to preserve backtrace, don't modify error
+			return false
+		}
+		key = res
+	}
+	it.next, it.nextKey, it.pending = x, key, true
+	return true
+}
+
+// nextInGroup consumes the next element of g, if g is the current group
+// and the pending element belongs to it.
+func (it *groupbyIterator) nextInGroup(g *groupValue, p *Value) bool {
+	if it.group != g || !it.advance() {
+		return false
+	}
+	// The first element belongs to the group by construction, even
+	// if its key does not compare equal to itself.
+	if !g.first {
+		var eq bool
+		var err error
+		if it.thread != nil {
+			eq, err = SafeCompare(it.thread, syntax.EQL, it.nextKey, g.key)
+		} else {
+			eq, err = Equal(it.nextKey, g.key)
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !eq {
+			return false
+		}
+	}
+	g.first = false
+	*p = it.next
+	it.next, it.nextKey, it.pending = nil, nil, false
+	return true
+}
+
+func (it *groupbyIterator) Next(p *Value) bool {
+	if g := it.group; g != nil {
+		var x Value
+		for it.nextInGroup(g, &x) {
+			// Skip the remainder of the current group.
+		}
+		it.group = nil
+	}
+	if !it.advance() {
+		return false
+	}
+	if it.thread != nil {
+		size := SafeAdd(EstimateSize(&groupValue{}), EstimateSize(Tuple{nil, nil}))
+		if err := it.thread.AddAllocs(size); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	it.group = &groupValue{owner: it, key: it.nextKey, first: true}
+	*p = Tuple{it.group.key, it.group}
+	return true
+}
+
+func (it *groupbyIterator) Done() {
+	if it.iter != nil {
+		it.iter.Done()
+	}
+	it.done = true
+	it.group = nil
+	it.next, it.nextKey, it.pending = nil, nil, false
+}
+
+func (it *groupbyIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if iter, ok := it.iter.(SafeIterator); ok {
+		return iter.Err()
+	}
+	return nil
+}
+
+func (it *groupbyIterator) Safety() SafetyFlags {
+	if it.thread == nil || it.err != nil {
+		return NotSafe
+	}
+	if iter, ok := it.iter.(SafeIterator); ok {
+		return iter.Safety()
+	}
+	return NotSafe
+}
+
+// A groupValue is one of the groups yielded by a groupbyIterator. It may
+// only be iterated while it is the current group of its owner.
+type groupValue struct {
+	owner *groupbyIterator
+	key   Value
+	first bool // the owner's pending element is the first of this group
+}
+
+var _ Iterable = &groupValue{}
+
+func (g *groupValue) SafeString(thread *Thread, sb StringBuilder) error {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return err
+	}
+	if _, err := sb.WriteString("group("); err != nil {
+		return err
+	}
+	if err := writeValue(thread, sb, g.key, nil); err != nil {
+		return err
+	}
+	_, err := sb.WriteString(")")
+	return err
+}
+
+func (g *groupValue) String() string        { return toString(g) }
+func (g *groupValue) Type() string          { return "group" }
+func (g *groupValue) Freeze()               { g.key.Freeze() }
+func (g *groupValue) Truth() Bool           { return True }
+func (g *groupValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", g.Type()) }
+func (g *groupValue) Iterate() Iterator     { return &groupIterator{group: g} }
+
+type groupIterator struct {
+	group  *groupValue
+	thread *Thread
+}
+
+var _ SafeIterator = &groupIterator{}
+
+func (it *groupIterator) BindThread(thread *Thread) { it.thread = thread }
+func (it *groupIterator) Next(p *Value) bool {
+	return it.group.owner.nextInGroup(it.group, p)
+}
+func (*groupIterator) Done()         {}
+func (it *groupIterator) Err() error { return it.group.owner.Err() }
+func (it *groupIterator) Safety() SafetyFlags {
+	if it.thread == nil {
+		return NotSafe
+	}
+	return it.group.owner.Safety()
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#hasattr
 func hasattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var object Value
@@ -764,7 +1175,9 @@ func hasattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, err
 
 	if object, ok := object.(HasAttrs); ok {
 		if object2, ok := object.(HasSafeAttrs); ok {
-			if _, err := object2.SafeAttr(thread, name); err == ErrNoAttr {
+			if v, err := object2.SafeAttr(thread, name); err == nil {
+				return Bool(v != nil), nil
+			} else if err == ErrNoAttr {
 				return False, nil
 			} else if _, ok := err.(NoSuchAttrError); ok {
 				return False, nil
@@ -784,7 +1197,14 @@ func hasattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, err
 		// absence of a field: it could occur while computing
 		// the value of a present attribute, or it could be a
 		// "no such attribute" error with details.
-		for _, x := range object.AttrNames() {
+		names, err := safeAttrNames(thread, object)
+		if err != nil {
+			return nil, err
+		}
+		if err := thread.AddSteps(SafeInt(len(names))); err != nil {
+			return nil, err
+		}
+		for _, x := range names {
 			if x == name {
 				return True, nil
 			}
@@ -817,7 +1237,7 @@ func hash(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		if err := thread.AddSteps(SafeInt(len(x))); err != nil {
 			return nil, err
 		}
-		h = int64(softHashString(string(x))) // FNV32
+		h = int64(softHashString(string(x), 0)) // FNV32, unseeded
 	default:
 		return nil, fmt.Errorf("hash: got %s, want string or bytes", x.Type())
 	}
@@ -884,9 +1304,9 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (res Value, er
 				return nil, fmt.Errorf("int: base must be an integer >= 2 && <= 36")
 			}
 		}
-		res := parseInt(s, b)
-		if res == nil {
-			return nil, fmt.Errorf("int: invalid literal with base %d: %s", b, s)
+		res, err := parseInt(s, b)
+		if err != nil {
+			return nil, fmt.Errorf("int: %v with base %d: %s", err, b, s)
 		}
 		return res, nil
 	}
@@ -911,11 +1331,22 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (res Value, er
 	if err != nil {
 		return nil, fmt.Errorf("int: %s", err)
 	}
+	if _, iBig := i.get(); iBig != nil {
+		// Building a big int from a float is linear in its length.
+		if err := thread.AddSteps(SafeDiv(iBig.BitLen(), 32)); err != nil {
+			return nil, err
+		}
+	}
 	return i, nil
 }
 
-// parseInt defines the behavior of int(string, base=int). It returns nil on error.
-func parseInt(s string, base int) Value {
+var (
+	errIntLiteral    = errors.New("invalid literal")
+	errIntUnderscore = errors.New("invalid underscore in literal")
+)
+
+// parseInt defines the behavior of int(string, base=int).
+func parseInt(s string, base int) (Value, error) {
 	// remove sign
 	var neg bool
 	if s != "" {
@@ -929,6 +1360,7 @@ func parseInt(s string, base int) Value {
 
 	// remove optional base prefix
 	baseprefix := 0
+	prefixed := false
 	if len(s) > 1 && s[0] == '0' {
 		if len(s) > 2 {
 			switch s[1] {
@@ -946,21 +1378,28 @@ func parseInt(s string, base int) Value {
 			if base == 0 || baseprefix == base {
 				base = baseprefix
 				s = s[2:]
+				prefixed = true
 			}
-		} else {
-			// For automatic base detection,
-			// a string starting with zero
-			// must be all zeros.
-			// Thus we reject int("0755", 0).
-			if base == 0 {
-				for i := 1; i < len(s); i++ {
-					if s[i] != '0' {
-						return nil
-					}
-				}
-				return zero
+		}
+	}
+
+	// remove digit separators
+	s, ok := removeUnderscores(s, prefixed)
+	if !ok {
+		return nil, errIntUnderscore
+	}
+
+	if !prefixed && base == 0 && len(s) > 1 && s[0] == '0' {
+		// For automatic base detection,
+		// a string starting with zero
+		// must be all zeros.
+		// Thus we reject int("0755", 0).
+		for i := 1; i < len(s); i++ {
+			if s[i] != '0' {
+				return nil, errIntLiteral
 			}
 		}
+		return zero, nil
 	}
 	if base == 0 {
 		base = 10
@@ -969,19 +1408,36 @@ func parseInt(s string, base int) Value {
 	// we explicitly handled sign above.
 	// if a sign remains, it is invalid.
 	if s != "" && (s[0] == '-' || s[0] == '+') {
-		return nil
+		return nil, errIntLiteral
 	}
 
-	// s has no sign or base prefix.
+	// s has no sign, base prefix or underscores.
 	if i, ok := new(big.Int).SetString(s, base); ok {
 		res := MakeBigInt(i)
 		if neg {
 			res = zero.Sub(res)
 		}
-		return res
+		return res, nil
 	}
 
-	return nil
+	return nil, errIntLiteral
+}
+
+// removeUnderscores returns s without the underscores which separate its
+// digits, as in "1_000_000". It reports false if an underscore does not
+// fall between two digits, except that, if prefixed, one may immediately
+// follow the base prefix, as in "0x_ff".
+func removeUnderscores(s string, prefixed bool) (string, bool) {
+	if strings.IndexByte(s, '_') < 0 {
+		return s, true
+	}
+	if prefixed && s[0] == '_' {
+		s = s[1:]
+	}
+	if s == "" || s[0] == '_' || s[len(s)-1] == '_' || strings.Contains(s, "__") {
+		return "", false
+	}
+	return strings.ReplaceAll(s, "_", ""), true
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#len
@@ -990,7 +1446,10 @@ func len_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := UnpackPositionalArgs("len", args, kwargs, 1, &x); err != nil {
 		return nil, err
 	}
-	len := Len(x)
+	len, err := SafeLen(thread, x)
+	if err != nil {
+		return nil, err
+	}
 	if len < 0 {
 		return nil, fmt.Errorf("len: value of type %s has no len", x.Type())
 	}
@@ -1001,12 +1460,107 @@ func len_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return result, nil
 }
 
+// lines(s) returns an iterable over the lines of s, without their trailing
+// newlines. Unlike s.splitlines(), lines are produced one at a time.
+func lines(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var s String
+	if err := UnpackPositionalArgs("lines", args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	if err := thread.AddAllocs(EstimateSize(linesValue{})); err != nil {
+		return nil, err
+	}
+	return linesValue{s}, nil
+}
+
+// A linesValue is an iterable whose iterator lazily yields the lines of a
+// string, as would be returned by splitlines.
+type linesValue struct {
+	s String
+}
+
+var _ Iterable = linesValue{}
+
+func (lv linesValue) SafeString(thread *Thread, sb StringBuilder) error {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return err
+	}
+	if _, err := sb.WriteString("lines("); err != nil {
+		return err
+	}
+	if err := lv.s.SafeString(thread, sb); err != nil {
+		return err
+	}
+	_, err := sb.WriteString(")")
+	return err
+}
+
+func (lv linesValue) String() string        { return toString(lv) }
+func (lv linesValue) Type() string          { return "lines" }
+func (lv linesValue) Freeze()               {} // immutable
+func (lv linesValue) Truth() Bool           { return True }
+func (lv linesValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", lv.Type()) }
+func (lv linesValue) Iterate() Iterator     { return &linesIterator{s: string(lv.s)} }
+
+type linesIterator struct {
+	s      string
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &linesIterator{}
+
+func (it *linesIterator) BindThread(thread *Thread) {
+	it.thread = thread
+}
+
+func (it *linesIterator) Next(p *Value) bool {
+	if it.err != nil || it.s == "" {
+		return false
+	}
+	line, rest := it.s, ""
+	if i := strings.IndexByte(it.s, '\n'); i >= 0 {
+		line, rest = it.s[:i], it.s[i+1:]
+	}
+	if it.thread != nil {
+		if err := it.thread.AddSteps(SafeInt(len(it.s) - len(rest))); err != nil {
+			it.err = err
+			return false
+		}
+		if err := it.thread.AddAllocs(StringTypeOverhead); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	*p = String(line)
+	it.s = rest
+	return true
+}
+
+func (*linesIterator) Done() {}
+
+func (it *linesIterator) Err() error { return it.err }
+func (it *linesIterator) Safety() SafetyFlags {
+	if it.thread == nil {
+		return NotSafe
+	}
+	return MemSafe | IOSafe
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#list
 func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
 	if err := UnpackPositionalArgs("list", args, kwargs, 0, &iterable); err != nil {
 		return nil, err
 	}
+	if t, ok := iterable.(Tuple); ok {
+		l, err := t.SafeToList(thread)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
 	var elems []Value
 	if iterable != nil {
 		iter, err := SafeIterate(thread, iterable)
@@ -1014,7 +1568,7 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			return nil, err
 		}
 		defer iter.Done()
-		if n := Len(iterable); n > 0 {
+		if n := remainingHint(iterable, iter); n > 0 {
 			if err := thread.AddAllocs(EstimateMakeSize([]Value{}, SafeInt(n))); err != nil {
 				return nil, err
 			}
@@ -1037,15 +1591,135 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return NewList(elems), nil
 }
 
+// defaultMemoizeSize is the number of results cached by memoize unless
+// another size is given.
+const defaultMemoizeSize = 128
+
+// memoize(fn, maxsize=128) returns a function which calls fn, caching the
+// results of the most recent distinct calls.
+func memoize(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var fn Callable
+	maxsize := defaultMemoizeSize
+	if err := UnpackArgs(b.Name(), args, kwargs, "fn", &fn, "maxsize?", &maxsize); err != nil {
+		return nil, err
+	}
+	if maxsize < 1 {
+		return nil, fmt.Errorf("%s: maxsize must be positive, got %d", b.Name(), maxsize)
+	}
+
+	if err := thread.AddAllocs(SafeAdd(EstimateSize(&memoizer{}), EstimateSize(&Builtin{}))); err != nil {
+		return nil, err
+	}
+	cache, err := SafeNewDict(thread, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := &memoizer{
+		fn:      fn,
+		maxsize: maxsize,
+		cache:   cache,
+	}
+	safety := NotSafe
+	if fn, ok := fn.(SafetyAware); ok {
+		safety = fn.Safety() & (CPUSafe | MemSafe | TimeSafe | IOSafe)
+	}
+	return NewBuiltinWithSafety(fn.Name(), safety, m.call), nil
+}
+
+// A memoizer holds the results of previous calls to a function.
+//
+// Its cache is not reachable from Starlark, so is never frozen and may be
+// used by several threads at once: mu guards it. Results are frozen before
+// they are cached, so that they may be shared between callers. The memory
+// of each entry is charged to the thread which inserts it. Hits are not
+// free: every call, whether or not its result is cached, is charged for
+// building its key tuple and for the steps taken to hash it and compare it
+// with the keys already cached.
+type memoizer struct {
+	fn      Callable
+	maxsize int
+
+	mu    sync.Mutex
+	cache *Dict
+}
+
+func (m *memoizer) call(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	// The key holds the number of positional arguments, so that
+	// f(x, "k", v) and f(x, k=v) are distinguished, followed by the
+	// keyword arguments in name order, so that f(a=1, b=2) and
+	// f(b=2, a=1) are not.
+	n := 1 + len(args) + 2*len(kwargs)
+	if err := thread.AddAllocs(SafeAdd(EstimateMakeSize(Tuple{}, SafeInt(n)), SliceTypeOverhead)); err != nil {
+		return nil, err
+	}
+	key := make(Tuple, 0, n)
+	key = append(key, MakeInt(len(args)))
+	key = append(key, args...)
+	for _, kwarg := range kwargs {
+		key = append(key, kwarg[0], kwarg[1])
+	}
+	sort.Sort(kwargPairs(key[1+len(args):]))
+
+	m.mu.Lock()
+	result, found, err := m.cache.SafeGet(thread, key)
+	m.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, ErrSafety) {
+			return nil, err
+		}
+		// The arguments are unhashable, so the result cannot be cached.
+		return Call(thread, m.fn, args, kwargs)
+	}
+	if found {
+		return result, nil
+	}
+
+	result, err = Call(thread, m.fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	result.Freeze()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cache.Len() >= m.maxsize {
+		// Discard the oldest result.
+		if _, _, err := m.cache.ht.delete(thread, m.cache.ht.head.key); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.cache.SafeSetKey(thread, key, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// kwargPairs sorts flattened keyword arguments, name followed by value,
+// by name.
+type kwargPairs Tuple
+
+func (p kwargPairs) Len() int { return len(p) / 2 }
+func (p kwargPairs) Less(i, j int) bool {
+	return p[2*i].(String) < p[2*j].(String)
+}
+func (p kwargPairs) Swap(i, j int) {
+	p[2*i], p[2*j] = p[2*j], p[2*i]
+	p[2*i+1], p[2*j+1] = p[2*j+1], p[2*i+1]
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#min
 func minmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) == 0 {
 		return nil, fmt.Errorf("%s requires at least one positional argument", b.Name())
 	}
 	var keyFunc Callable
-	if err := UnpackArgs(b.Name(), nil, kwargs, "key?", &keyFunc); err != nil {
+	var dflt Value
+	if err := UnpackArgs(b.Name(), nil, kwargs, "key?", &keyFunc, "default?", &dflt); err != nil {
 		return nil, err
 	}
+	if dflt != nil && len(args) > 1 {
+		return nil, fmt.Errorf("%s: cannot specify a default with multiple positional arguments", b.Name())
+	}
 	var op syntax.Token
 	if b.Name() == "max" {
 		op = syntax.GT
@@ -1071,6 +1745,9 @@ func minmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		if err := iter.Err(); err != nil {
 			return nil, err
 		}
+		if dflt != nil {
+			return dflt, nil
+		}
 		return nil, nameErr(b, "argument is an empty sequence")
 	}
 
@@ -1101,7 +1778,9 @@ func minmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 			key = res
 		}
 
-		if ok, err := Compare(op, key, extremeKey); err != nil {
+		// NaN is the greatest float (see floatCmp), so the result
+		// does not depend on the position of any NaN.
+		if ok, err := SafeCompare(thread, op, key, extremeKey); err != nil {
 			return nil, nameErr(b, err)
 		} else if ok {
 			extremum = x
@@ -1157,8 +1836,8 @@ func ord(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#print
 func print(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	sep := " "
-	if err := UnpackArgs("print", nil, kwargs, "sep?", &sep); err != nil {
+	sep, end := " ", "\n"
+	if err := UnpackArgs("print", nil, kwargs, "sep?", &sep, "end?", &end); err != nil {
 		return nil, err
 	}
 
@@ -1183,6 +1862,11 @@ func print(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error
 			}
 		}
 	}
+	// Every message is printed as a line, so a final newline in end is
+	// left for thread.Print, or the default printer, to supply.
+	if _, err := buf.WriteString(strings.TrimSuffix(end, "\n")); err != nil {
+		return nil, err
+	}
 
 	s := buf.String()
 	if thread.Print != nil {
@@ -1224,10 +1908,11 @@ func range_(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 type rangeValue struct{ start, stop, step, len int }
 
 var (
-	_ Indexable  = rangeValue{}
-	_ Sequence   = rangeValue{}
-	_ Comparable = rangeValue{}
-	_ Sliceable  = rangeValue{}
+	_ Indexable     = rangeValue{}
+	_ Sequence      = rangeValue{}
+	_ Comparable    = rangeValue{}
+	_ Sliceable     = rangeValue{}
+	_ SafeSliceable = rangeValue{}
 )
 
 func (r rangeValue) Len() int          { return r.len }
@@ -1278,6 +1963,20 @@ func (r rangeValue) Slice(start, end, step int) Value {
 	}
 }
 
+func (r rangeValue) SafeSlice(thread *Thread, start, end, step int) (Value, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	result := r.Slice(start, end, step)
+	if thread != nil {
+		if err := thread.AddAllocs(EstimateSize(result)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
 func (r rangeValue) Freeze() {} // immutable
 
 func (r rangeValue) SafeString(thread *Thread, sb StringBuilder) error {
@@ -1352,7 +2051,7 @@ type rangeIterator struct {
 	err    error
 }
 
-var _ SafeIterator = &rangeIterator{}
+var _ SafeSizedIterator = &rangeIterator{}
 
 func (it *rangeIterator) BindThread(thread *Thread) {
 	it.thread = thread
@@ -1376,6 +2075,8 @@ func (it *rangeIterator) Next(p *Value) bool {
 }
 func (*rangeIterator) Done() {}
 
+func (it *rangeIterator) RemainingHint() (int, bool) { return it.r.len - it.i, true }
+
 func (it *rangeIterator) Err() error { return it.err }
 func (it *rangeIterator) Safety() SafetyFlags {
 	if it.thread == nil {
@@ -1509,6 +2210,9 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (l Value, er
 	// Derive keys from values by applying key function.
 	var keys []Value
 	if key != nil {
+		if err := thread.AddAllocs(EstimateMakeSize([]Value{}, SafeInt(len(values)))); err != nil {
+			return nil, err
+		}
 		keys = make([]Value, len(values))
 		for i, v := range values {
 			k, err := Call(thread, key, Tuple{v}, nil)
@@ -1559,7 +2263,7 @@ func (s *sortSlice) Less(i, j int) bool {
 	if s.keys == nil {
 		keys = s.values
 	}
-	ok, err := Compare(syntax.LT, keys[i], keys[j])
+	ok, err := SafeCompare(s.thread, syntax.LT, keys[i], keys[j])
 	if err != nil {
 		panic(sortError{err})
 	}
@@ -1646,13 +2350,20 @@ func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	if len(args) == 0 {
 		return Tuple(nil), nil
 	}
+	if l, ok := iterable.(*List); ok {
+		elems, err := l.SafeToTuple(thread)
+		if err != nil {
+			return nil, err
+		}
+		return elems, nil
+	}
 	iter, err := SafeIterate(thread, iterable)
 	if err != nil {
 		return nil, err
 	}
 	defer iter.Done()
 	var elems Tuple
-	if n := Len(iterable); n > 0 {
+	if n := remainingHint(iterable, iter); n > 0 {
 		if err := thread.AddAllocs(EstimateMakeSize(Tuple{}, SafeInt(n))); err != nil {
 			return nil, err
 		}
@@ -1780,6 +2491,149 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return NewList(result), nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#zip_longest
+func zip_longest(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var fillvalue Value = None
+	if err := UnpackArgs(b.Name(), nil, kwargs, "fillvalue?", &fillvalue); err != nil {
+		return nil, err
+	}
+	for i, seq := range args {
+		if _, ok := seq.(Iterable); !ok {
+			return nil, fmt.Errorf("%s: argument #%d is not iterable: %s", b.Name(), i+1, seq.Type())
+		}
+	}
+	result := Value(&zipLongestValue{iterables: args, fillvalue: fillvalue})
+	if err := thread.AddAllocs(EstimateSize(result)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// A zipLongestValue is an iterable whose iterator lazily yields the rows
+// of zip_longest(*iterables, fillvalue=fillvalue).
+type zipLongestValue struct {
+	iterables Tuple
+	fillvalue Value
+}
+
+var _ Iterable = &zipLongestValue{}
+
+func (zv *zipLongestValue) SafeString(thread *Thread, sb StringBuilder) error {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return err
+	}
+	if _, err := sb.WriteString("zip_longest("); err != nil {
+		return err
+	}
+	for _, iterable := range zv.iterables {
+		if err := writeValue(thread, sb, iterable, nil); err != nil {
+			return err
+		}
+		if _, err := sb.WriteString(", "); err != nil {
+			return err
+		}
+	}
+	if _, err := sb.WriteString("fillvalue="); err != nil {
+		return err
+	}
+	if err := writeValue(thread, sb, zv.fillvalue, nil); err != nil {
+		return err
+	}
+	_, err := sb.WriteString(")")
+	return err
+}
+
+func (zv *zipLongestValue) String() string        { return toString(zv) }
+func (zv *zipLongestValue) Type() string          { return "zip_longest" }
+func (zv *zipLongestValue) Truth() Bool           { return True }
+func (zv *zipLongestValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", zv.Type()) }
+func (zv *zipLongestValue) Freeze() {
+	zv.iterables.Freeze()
+	zv.fillvalue.Freeze()
+}
+func (zv *zipLongestValue) Iterate() Iterator { return &zipLongestValueIterator{zv: zv} }
+
+// zipLongest returns a SafeZipLongest iterator over zv's sources, bound
+// to thread if it is non-nil.
+func (zv *zipLongestValue) zipLongest(thread *Thread) (SafeIterator, error) {
+	iters := make([]SafeIterator, 0, len(zv.iterables))
+	for _, seq := range zv.iterables {
+		it, err := SafeIterate(thread, seq)
+		if err != nil {
+			for _, iter := range iters {
+				iter.Done()
+			}
+			return nil, err
+		}
+		if safeIter, ok := it.(SafeIterator); ok {
+			iters = append(iters, safeIter)
+		} else {
+			iters = append(iters, unsafeIterator{it})
+		}
+	}
+	return SafeZipLongest(thread, zv.fillvalue, iters...), nil
+}
+
+type zipLongestValueIterator struct {
+	zv     *zipLongestValue
+	iter   SafeIterator
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &zipLongestValueIterator{}
+
+func (it *zipLongestValueIterator) BindThread(thread *Thread) {
+	it.thread = thread
+	it.iter, it.err = it.zv.zipLongest(thread)
+}
+
+func (it *zipLongestValueIterator) Next(p *Value) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.iter == nil {
+		if it.iter, it.err = it.zv.zipLongest(nil); it.err != nil {
+			return false
+		}
+	}
+	return it.iter.Next(p)
+}
+
+func (it *zipLongestValueIterator) Done() {
+	if it.iter != nil {
+		it.iter.Done()
+	}
+}
+
+func (it *zipLongestValueIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.iter != nil {
+		return it.iter.Err()
+	}
+	return nil
+}
+
+func (it *zipLongestValueIterator) Safety() SafetyFlags {
+	if it.thread == nil || it.err != nil {
+		return NotSafe
+	}
+	return it.iter.Safety()
+}
+
+// unsafeIterator adapts an iterator which does not abide by safety
+// constraints, as SafeIterate returns when they are not required, for
+// use where a SafeIterator is expected.
+type unsafeIterator struct {
+	Iterator
+}
+
+func (unsafeIterator) BindThread(*Thread)  {}
+func (unsafeIterator) Safety() SafetyFlags { return NotSafe }
+
 // ---- methods of built-in types ---
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#dict·get
@@ -1920,6 +2774,35 @@ func dict_setdefault(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Va
 	}
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#dict·sorted_keys
+func dict_sorted_keys(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (_ Value, err error) {
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	recv := b.Receiver().(*Dict)
+	len := recv.Len()
+	if err := thread.AddSteps(SafeInt(len)); err != nil {
+		return nil, err
+	}
+	keysSize := EstimateMakeSize([]Value{}, SafeInt(len))
+	resultSize := EstimateSize(&List{})
+	if err := thread.AddAllocs(SafeAdd(resultSize, keysSize)); err != nil {
+		return nil, err
+	}
+	slice := &sortSlice{values: recv.Keys(), thread: thread}
+	defer func() {
+		if v := recover(); v != nil {
+			if sortErr, ok := v.(sortError); ok {
+				err = nameErr(b, sortErr.err)
+			} else {
+				panic(v)
+			}
+		}
+	}()
+	sort.Stable(slice)
+	return NewList(slice.values), nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#dict·update
 func dict_update(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) > 1 {
@@ -2016,7 +2899,7 @@ func list_index(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value,
 	}
 
 	for i := start; i < end; i++ {
-		if eq, err := Equal(recv.elems[i], value); err != nil {
+		if eq, err := SafeCompare(thread, syntax.EQL, recv.elems[i], value); err != nil {
 			return nil, nameErr(b, err)
 		} else if eq {
 			res := Value(MakeInt(i))
@@ -2086,8 +2969,8 @@ func list_remove(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value,
 		return nil, err
 	}
 	for i, elem := range recv.elems {
-		if eq, err := Equal(elem, value); err != nil {
-			return nil, fmt.Errorf("remove: %v", err)
+		if eq, err := SafeCompare(thread, syntax.EQL, elem, value); err != nil {
+			return nil, nameErr(b, err)
 		} else if eq {
 			recv.elems = append(recv.elems[:i], recv.elems[i+1:]...)
 			return None, nil
@@ -2219,7 +3102,7 @@ type bytesIterator struct {
 	err    error
 }
 
-var _ SafeIterator = &bytesIterator{}
+var _ SafeSizedIterator = &bytesIterator{}
 
 func (it *bytesIterator) BindThread(thread *Thread) {
 	it.thread = thread
@@ -2240,31 +3123,101 @@ func (it *bytesIterator) Next(p *Value) bool {
 			return false
 		}
 	}
-	*p = value
-
-	it.bytes = it.bytes[1:]
-	return true
+	*p = value
+
+	it.bytes = it.bytes[1:]
+	return true
+}
+
+func (*bytesIterator) Done() {}
+
+func (it *bytesIterator) Err() error { return it.err }
+func (it *bytesIterator) Safety() SafetyFlags {
+	if it.thread == nil {
+		return NotSafe
+	}
+	return CPUSafe | MemSafe | TimeSafe | IOSafe
+}
+func (it *bytesIterator) RemainingHint() (int, bool) { return len(it.bytes), true }
+
+// bytes_count returns the number of non-overlapping occurrences of a
+// subsequence within the bytes, as string.count does.
+func bytes_count(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var sub Bytes
+	var start_, end_ Value
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &sub, &start_, &end_); err != nil {
+		return nil, err
+	}
+	return countImpl(thread, b, string(b.Receiver().(Bytes)), string(sub), start_, end_, false, true)
+}
+
+// bytes_find returns the index of the first occurrence of a subsequence
+// within the bytes, or -1, as string.find does.
+func bytes_find(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	return bytes_find_impl(thread, b, args, kwargs, true)
+}
+
+// bytes_index is like bytes_find, but fails if the subsequence is absent.
+func bytes_index(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	return bytes_find_impl(thread, b, args, kwargs, false)
+}
+
+func bytes_find_impl(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple, allowError bool) (Value, error) {
+	var sub Bytes
+	var start_, end_ Value
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &sub, &start_, &end_); err != nil {
+		return nil, err
+	}
+	return findImpl(thread, b, string(b.Receiver().(Bytes)), string(sub), start_, end_, allowError, false)
+}
+
+// bytes_replace returns a copy of the bytes in which occurrences of one
+// subsequence are replaced by another, as string.replace does.
+func bytes_replace(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	recv := string(b.Receiver().(Bytes))
+	var old, new Bytes
+	count := -1
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 2, &old, &new, &count); err != nil {
+		return nil, err
+	}
+	result, replaced, err := replaceImpl(thread, recv, string(old), string(new), count, true)
+	if err != nil {
+		return nil, err
+	}
+	if !replaced {
+		return b.Receiver(), nil
+	}
+	return Bytes(result), nil
 }
 
-func (*bytesIterator) Done() {}
-
-func (it *bytesIterator) Err() error { return it.err }
-func (it *bytesIterator) Safety() SafetyFlags {
-	if it.thread == nil {
-		return NotSafe
+// bytes_startswith reports whether the bytes start (or, for endswith, end)
+// with the given bytes or any of a tuple of them, as string.startswith does.
+func bytes_startswith(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	var start, end Value = None, None
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x, &start, &end); err != nil {
+		return nil, err
 	}
-	return CPUSafe | MemSafe | TimeSafe | IOSafe
+	return hasAffixImpl(thread, b, string(b.Receiver().(Bytes)), x, start, end)
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·count
 func string_count(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var sub string
 	var start_, end_ Value
-	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &sub, &start_, &end_); err != nil {
+	var overlapping bool
+	if err := UnpackArgs(b.Name(), nil, kwargs, "overlapping?", &overlapping); err != nil {
+		return nil, err
+	}
+	if err := UnpackPositionalArgs(b.Name(), args, nil, 1, &sub, &start_, &end_); err != nil {
 		return nil, err
 	}
+	return countImpl(thread, b, string(b.Receiver().(String)), sub, start_, end_, overlapping, false)
+}
 
-	recv := string(b.Receiver().(String))
+// Common implementation of string_count and bytes_count. If byteWise is
+// set, an empty sub occurs around each byte rather than each rune.
+func countImpl(thread *Thread, b *Builtin, recv, sub string, start_, end_ Value, overlapping, byteWise bool) (Value, error) {
 	start, end, err := indices(start_, end_, len(recv))
 	if err != nil {
 		return nil, nameErr(b, err)
@@ -2278,13 +3231,61 @@ func string_count(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value
 	if err := thread.AddSteps(SafeInt(len(slice))); err != nil {
 		return nil, err
 	}
-	result := Value(MakeInt(strings.Count(slice, sub)))
+	var n int
+	if byteWise && sub == "" {
+		n = len(slice) + 1
+	} else if overlapping && sub != "" {
+		if len(sub) <= len(slice) {
+			// The cost of the search is linear in the length of the
+			// slice, as sub is no longer.
+			if err := thread.AddAllocs(EstimateMakeSize([]int{}, SafeInt(len(sub)))); err != nil {
+				return nil, err
+			}
+			n = overlappingCount(slice, sub)
+		}
+	} else {
+		n = strings.Count(slice, sub)
+	}
+	result := Value(MakeInt(n))
 	if err := thread.AddAllocs(EstimateSize(result)); err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
+// overlappingCount returns the number of possibly-overlapping occurrences
+// of the non-empty sub in s, in time linear in their lengths, using the
+// Knuth-Morris-Pratt algorithm.
+func overlappingCount(s, sub string) int {
+	// prefix[i] is the length of the longest proper prefix of sub[:i+1]
+	// which is also a suffix of it.
+	prefix := make([]int, len(sub))
+	for i, k := 1, 0; i < len(sub); i++ {
+		for k > 0 && sub[i] != sub[k] {
+			k = prefix[k-1]
+		}
+		if sub[i] == sub[k] {
+			k++
+		}
+		prefix[i] = k
+	}
+
+	n := 0
+	for i, k := 0, 0; i < len(s); i++ {
+		for k > 0 && s[i] != sub[k] {
+			k = prefix[k-1]
+		}
+		if s[i] == sub[k] {
+			k++
+		}
+		if k == len(sub) {
+			n++
+			k = prefix[k-1]
+		}
+	}
+	return n
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·isalnum
 func string_isalnum(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
@@ -2514,6 +3515,7 @@ func string_format(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Valu
 		var arg Value
 		conv := "s"
 		var spec string
+		var explicitConv bool
 
 		field := format[:i]
 		format = format[i+1:]
@@ -2531,6 +3533,7 @@ func string_format(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Valu
 			// "name!conv" or "name!conv:spec"
 			name = field[:i]
 			field = field[i+1:]
+			explicitConv = true
 			// "conv" or "conv:spec"
 			if i := strings.IndexByte(field, ':'); i < 0 {
 				conv = field
@@ -2547,7 +3550,7 @@ func string_format(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Valu
 			}
 			auto = true
 			if index >= len(args) {
-				return nil, fmt.Errorf("format: tuple index out of range")
+				return nil, fmt.Errorf("format: tuple index out of range: field %d of %d positional arguments", index, len(args))
 			}
 			arg = args[index]
 			index++
@@ -2558,7 +3561,7 @@ func string_format(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Valu
 			}
 			manual = true
 			if num >= len(args) {
-				return nil, fmt.Errorf("format: tuple index out of range")
+				return nil, fmt.Errorf("format: tuple index out of range: field %d of %d positional arguments", num, len(args))
 			} else {
 				arg = args[num]
 			}
@@ -2587,8 +3590,13 @@ func string_format(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Valu
 		}
 
 		if spec != "" {
-			// Starlark does not support Python's format_spec features.
-			return nil, fmt.Errorf("format spec features not supported in replacement fields: %s", spec)
+			if conv != "s" && conv != "r" {
+				return nil, fmt.Errorf("format: unknown conversion %q", conv)
+			}
+			if err := formatField(thread, buf, arg, conv, explicitConv, spec); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
 		switch conv {
@@ -2633,6 +3641,266 @@ func decimal(s string) (x int, ok bool) {
 	return x, true
 }
 
+// A formatSpec is a parsed format specifier of a string.format
+// replacement field, of the form [[fill]align][sign][0][width][.precision][type].
+type formatSpec struct {
+	fill      rune
+	align     byte // one of "<>^=", or 0 if unspecified
+	sign      byte // one of "+- ", or 0 if unspecified
+	width     int
+	precision int  // -1 if unspecified
+	verb      byte // one of "sdeEfFgG%", or 0 if unspecified
+}
+
+func parseFormatSpec(spec string) (formatSpec, error) {
+	fs := formatSpec{fill: ' ', precision: -1}
+	isAlign := func(c byte) bool { return c == '<' || c == '>' || c == '^' || c == '=' }
+
+	rest := spec
+	if r, size := utf8.DecodeRuneInString(rest); size < len(rest) && isAlign(rest[size]) {
+		fs.fill, fs.align = r, rest[size]
+		rest = rest[size+1:]
+	} else if rest != "" && isAlign(rest[0]) {
+		fs.align = rest[0]
+		rest = rest[1:]
+	}
+	if rest != "" && (rest[0] == '+' || rest[0] == '-' || rest[0] == ' ') {
+		fs.sign = rest[0]
+		rest = rest[1:]
+	}
+	if rest != "" && rest[0] == '0' && fs.align == 0 {
+		// "0" before the width means zero-padding after the sign.
+		fs.fill, fs.align = '0', '='
+		rest = rest[1:]
+	}
+
+	digits := func() (int, bool) {
+		i := 0
+		for i < len(rest) && '0' <= rest[i] && rest[i] <= '9' {
+			i++
+		}
+		n, ok := decimal(rest[:i])
+		rest = rest[i:]
+		return n, ok && i > 0 && n < maxAlloc
+	}
+	if rest != "" && '0' <= rest[0] && rest[0] <= '9' {
+		width, ok := digits()
+		if !ok {
+			return formatSpec{}, fmt.Errorf("format: width too large in format spec %q", spec)
+		}
+		fs.width = width
+	}
+	if rest != "" && rest[0] == '.' {
+		rest = rest[1:]
+		if rest == "" || rest[0] < '0' || '9' < rest[0] {
+			return formatSpec{}, fmt.Errorf("format: missing precision in format spec %q", spec)
+		}
+		precision, ok := digits()
+		if !ok {
+			return formatSpec{}, fmt.Errorf("format: precision too large in format spec %q", spec)
+		}
+		fs.precision = precision
+	}
+	if len(rest) == 1 && strings.IndexByte("sdeEfFgG%", rest[0]) >= 0 {
+		fs.verb = rest[0]
+	} else if rest != "" {
+		return formatSpec{}, fmt.Errorf("format: invalid format spec %q", spec)
+	}
+	return fs, nil
+}
+
+// formatField writes arg to buf as directed by the format specifier spec
+// of a string.format replacement field. Unless a conversion is given
+// explicitly, ints and floats are formatted as numbers.
+func formatField(thread *Thread, buf StringBuilder, arg Value, conv string, explicitConv bool, spec string) error {
+	fs, err := parseFormatSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	var sign, body string
+	_, isInt := arg.(Int)
+	_, isFloat := arg.(Float)
+	numeric := (isInt || isFloat) && !explicitConv
+	align := byte('>')
+	if numeric {
+		if fs.verb == 's' {
+			return fmt.Errorf("format: unknown format code 's' for value of type %s", arg.Type())
+		}
+		var neg bool
+		if i, ok := arg.(Int); ok && (fs.verb == 0 || fs.verb == 'd') {
+			if fs.precision >= 0 {
+				return fmt.Errorf("format: precision not allowed in integer format specifier")
+			}
+			digits := NewSafeStringBuilder(thread)
+			if err := writeValue(thread, digits, i, nil); err != nil {
+				return err
+			}
+			body = digits.String()
+			neg = i.Sign() < 0
+		} else {
+			if fs.verb == 'd' {
+				return fmt.Errorf("format: unknown format code 'd' for value of type %s", arg.Type())
+			}
+			f, ok := arg.(Float)
+			if !ok {
+				if f, err = arg.(Int).finiteFloat(); err != nil {
+					return fmt.Errorf("format: %w", err)
+				}
+			}
+			if body, err = formatFloat(thread, f, fs); err != nil {
+				return err
+			}
+			neg = strings.HasPrefix(body, "-")
+		}
+		if neg {
+			sign, body = "-", body[1:]
+		} else if fs.sign == '+' || fs.sign == ' ' {
+			sign = string(fs.sign)
+		}
+	} else {
+		if fs.verb != 0 && fs.verb != 's' {
+			return fmt.Errorf("format: unknown format code '%c' for value of type %s", fs.verb, arg.Type())
+		}
+		if fs.sign != 0 {
+			return fmt.Errorf("format: sign not allowed in string format specifier")
+		}
+		if fs.align == '=' {
+			return fmt.Errorf("format: '=' alignment not allowed in string format specifier")
+		}
+		if str, ok := AsString(arg); ok && conv == "s" {
+			body = str
+		} else {
+			repr := NewSafeStringBuilder(thread)
+			if err := writeValue(thread, repr, arg, nil); err != nil {
+				return err
+			}
+			body = repr.String()
+		}
+		if fs.precision >= 0 {
+			// Truncate to at most precision characters.
+			for i := range body {
+				if fs.precision == 0 {
+					body = body[:i]
+					break
+				}
+				fs.precision--
+			}
+		}
+		align = '<'
+	}
+	if fs.align != 0 {
+		align = fs.align
+	}
+
+	var before, after int
+	if pad := fs.width - utf8.RuneCountInString(sign) - utf8.RuneCountInString(body); pad > 0 {
+		switch align {
+		case '<':
+			after = pad
+		case '^':
+			before, after = pad/2, pad-pad/2
+		default:
+			before = pad
+		}
+	}
+	buf.Grow(len(sign) + len(body) + (before+after)*utf8.RuneLen(fs.fill))
+	if align != '=' {
+		if err := writeFill(buf, fs.fill, before); err != nil {
+			return err
+		}
+	}
+	if _, err := buf.WriteString(sign); err != nil {
+		return err
+	}
+	if align == '=' {
+		if err := writeFill(buf, fs.fill, before); err != nil {
+			return err
+		}
+	}
+	if _, err := buf.WriteString(body); err != nil {
+		return err
+	}
+	return writeFill(buf, fs.fill, after)
+}
+
+// formatFloat returns the text of f formatted according to the
+// type and precision of fs.
+func formatFloat(thread *Thread, f Float, fs formatSpec) (string, error) {
+	verb, precision := fs.verb, fs.precision
+	if verb == 0 {
+		if precision < 0 {
+			sb := NewSafeStringBuilder(thread)
+			if err := writeValue(thread, sb, f, nil); err != nil {
+				return "", err
+			}
+			return sb.String(), nil
+		}
+		verb = 'g'
+	}
+	if precision < 0 {
+		precision = 6
+	}
+	ff := float64(f)
+	if verb == '%' {
+		ff *= 100
+	}
+
+	if !isFinite(ff) {
+		var s string
+		switch {
+		case math.IsInf(ff, +1):
+			s = "inf"
+		case math.IsInf(ff, -1):
+			s = "-inf"
+		default:
+			s = "nan"
+		}
+		if 'A' <= verb && verb <= 'Z' {
+			s = strings.ToUpper(s)
+		}
+		return s, nil
+	}
+
+	// The integer part of a finite float has at most 309 digits.
+	const maxFloatOverhead = 320
+	maxSize := SafeAdd(precision, maxFloatOverhead)
+	if err := thread.CheckSteps(maxSize); err != nil {
+		return "", err
+	}
+	if err := thread.CheckAllocs(EstimateMakeSize([]byte{}, maxSize)); err != nil {
+		return "", err
+	}
+	var s string
+	switch verb {
+	case '%':
+		s = strconv.FormatFloat(ff, 'f', precision, 64) + "%"
+	case 'F':
+		s = strconv.FormatFloat(ff, 'f', precision, 64)
+	case 'g', 'G':
+		if precision == 0 {
+			precision = 1
+		}
+		s = strconv.FormatFloat(ff, verb, precision, 64)
+	default:
+		s = strconv.FormatFloat(ff, verb, precision, 64)
+	}
+	if err := thread.AddSteps(SafeInt(len(s))); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// writeFill writes n copies of fill to buf.
+func writeFill(buf StringBuilder, fill rune, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := buf.WriteRune(fill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·index
 func string_index(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(thread, b, args, kwargs, false, false)
@@ -2650,6 +3918,7 @@ func string_join(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value,
 	if err != nil {
 		return nil, err
 	}
+	iter = thread.joinBudget(iter)
 	defer iter.Done()
 	buf := NewSafeStringBuilder(thread)
 	var x Value
@@ -2689,6 +3958,9 @@ func string_lower(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value
 	if err := thread.AddSteps(SafeInt(len(recv))); err != nil {
 		return nil, err
 	}
+	if isASCII(recv) {
+		return safeASCIIConvertCase(thread, recv, 'A', 'Z', 'a'-'A')
+	}
 	// There could be actually a difference between the size of the encoded
 	// upper and the size of the encoded lower. The maximum difference among
 	// them (according to unicode.ToLower implementation) is only 1 byte,
@@ -2701,6 +3973,36 @@ func string_lower(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value
 	return String(strings.ToLower(recv)), nil
 }
 
+// isASCII reports whether s consists only of ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// safeASCIIConvertCase returns a copy of the ASCII string s in which each
+// byte in the range [lo, hi] is shifted by delta. As the result has
+// exactly the same length as s, a single exact allocation is charged.
+func safeASCIIConvertCase(thread *Thread, s string, lo, hi byte, delta int) (Value, error) {
+	resultSize := SafeAdd(EstimateMakeSize([]byte{}, SafeInt(len(s))), StringTypeOverhead)
+	if err := thread.AddAllocs(resultSize); err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	buf.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if lo <= c && c <= hi {
+			c = byte(int(c) + delta)
+		}
+		buf.WriteByte(c)
+	}
+	return String(buf.String()), nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·partition
 func string_partition(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(b.Receiver().(String))
@@ -2777,23 +4079,64 @@ func string_replace(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Val
 	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 2, &old, &new, &count); err != nil {
 		return nil, err
 	}
-
-	maxResultSize := SafeDiv(SafeMul(len(recv)+1, len(new)), SafeMax(len(old), 1))
-	if err := thread.CheckSteps(maxResultSize); err != nil {
+	result, replaced, err := replaceImpl(thread, recv, old, new, count, false)
+	if err != nil {
 		return nil, err
 	}
-	if err := thread.CheckAllocs(maxResultSize); err != nil {
-		return nil, err
+	if !replaced {
+		return b.Receiver(), nil
 	}
-	replaced := strings.Replace(recv, old, new, count)
-	if err := thread.AddSteps(SafeMax(len(replaced), len(recv))); err != nil {
-		return nil, err
+	return String(result), nil
+}
+
+// Common implementation of string_replace and bytes_replace. It reports
+// whether any replacement was made. If byteWise is set, an empty old
+// occurs around each byte rather than each rune.
+func replaceImpl(thread *Thread, recv, old, new string, count int, byteWise bool) (string, bool, error) {
+	// Count the replacements first so that the result can be
+	// accounted for exactly before it is built.
+	if err := thread.AddSteps(SafeInt(len(recv))); err != nil {
+		return "", false, err
 	}
-	result := Value(String(replaced)) // Avoid allocation.
-	if err := thread.AddAllocs(EstimateSize(result)); err != nil {
-		return nil, err
+	var n int
+	if byteWise && old == "" {
+		n = len(recv) + 1
+	} else {
+		n = strings.Count(recv, old)
 	}
-	return result, nil
+	if count >= 0 && count < n {
+		n = count
+	}
+	if n == 0 {
+		return recv, false, nil
+	}
+	resultLen := SafeAdd(len(recv), SafeMul(n, len(new)-len(old)))
+	if err := thread.AddSteps(resultLen); err != nil {
+		return "", false, err
+	}
+	resultSize := SafeAdd(EstimateMakeSize([]byte{}, resultLen), StringTypeOverhead)
+	if err := thread.AddAllocs(resultSize); err != nil {
+		return "", false, err
+	}
+	if byteWise && old == "" {
+		return insertBetweenBytes(recv, new, n), true, nil
+	}
+	return strings.Replace(recv, old, new, n), true, nil
+}
+
+// insertBetweenBytes returns s with sep inserted before each of its first
+// n bytes, and after its last if n exceeds its length.
+func insertBetweenBytes(s, sep string, n int) string {
+	var b strings.Builder
+	b.Grow(len(s) + n*len(sep))
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteByte(s[i-1])
+		}
+		b.WriteString(sep)
+	}
+	b.WriteString(s[n-1:])
+	return b.String()
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·rfind
@@ -2815,8 +4158,13 @@ func string_startswith(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (
 		return nil, err
 	}
 
+	return hasAffixImpl(thread, b, string(b.Receiver().(String)), x, start, end)
+}
+
+// Common implementation of {string,bytes}_{starts,ends}with. The affixes in
+// x must be of the same type as the receiver of b.
+func hasAffixImpl(thread *Thread, b *Builtin, s string, x, start, end Value) (Value, error) {
 	// compute effective substring.
-	s := string(b.Receiver().(String))
 	if start, end, err := indices(start, end, len(s)); err != nil {
 		return nil, nameErr(b, err)
 	} else {
@@ -2831,13 +4179,23 @@ func string_startswith(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (
 		f = strings.HasSuffix
 	}
 
-	switch x := x.(type) {
-	case Tuple:
+	recvType := b.Receiver().Type()
+	asAffix := func(x Value) (string, bool) {
+		switch x := x.(type) {
+		case String:
+			return string(x), recvType == "string"
+		case Bytes:
+			return string(x), recvType == "bytes"
+		}
+		return "", false
+	}
+
+	if x, ok := x.(Tuple); ok {
 		for i, x := range x {
-			prefix, ok := AsString(x)
+			prefix, ok := asAffix(x)
 			if !ok {
-				return nil, fmt.Errorf("%s: want string, got %s, for element %d",
-					b.Name(), x.Type(), i)
+				return nil, fmt.Errorf("%s: want %s, got %s, for element %d",
+					b.Name(), recvType, x.Type(), i)
 			}
 			if err := thread.AddSteps(SafeInt(len(prefix))); err != nil {
 				return False, err
@@ -2847,13 +4205,14 @@ func string_startswith(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (
 			}
 		}
 		return False, nil
-	case String:
-		if err := thread.AddSteps(SafeInt(len(x))); err != nil {
+	}
+	if affix, ok := asAffix(x); ok {
+		if err := thread.AddSteps(SafeInt(len(affix))); err != nil {
 			return False, err
 		}
-		return Bool(f(s, string(x))), nil
+		return Bool(f(s, affix)), nil
 	}
-	return nil, fmt.Errorf("%s: got %s, want string or tuple of string", b.Name(), x.Type())
+	return nil, fmt.Errorf("%s: got %s, want %s or tuple of %s", b.Name(), x.Type(), recvType, recvType)
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·strip
@@ -2942,15 +4301,18 @@ func string_upper(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value
 	}
 
 	recv := string(b.Receiver().(String))
+	if err := thread.AddSteps(SafeInt(len(recv))); err != nil {
+		return nil, err
+	}
+	if isASCII(recv) {
+		return safeASCIIConvertCase(thread, recv, 'a', 'z', 'A'-'a')
+	}
 
 	// see string_lower
 	bufferSize := EstimateMakeSize([]byte{}, SafeAdd(SafeMul(len(recv), 2), utf8.UTFMax))
 	if err := thread.AddAllocs(SafeAdd(bufferSize, StringTypeOverhead)); err != nil {
 		return nil, err
 	}
-	if err := thread.AddSteps(SafeInt(len(recv))); err != nil {
-		return nil, err
-	}
 	return String(strings.ToUpper(recv)), nil
 }
 
@@ -3176,6 +4538,33 @@ func set_difference(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Val
 	return diff, nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#set·difference_update.
+func set_difference_update(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var other Iterable
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &other); err != nil {
+		return nil, err
+	}
+	recv := b.Receiver().(*Set)
+	if other == Iterable(recv) {
+		if err := recv.ht.clear(thread); err != nil {
+			return nil, nameErr(b, err)
+		}
+		return None, nil
+	}
+	iter, err := SafeIterate(thread, other)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Done()
+	if err := recv.safeDifferenceUpdate(thread, iter); err != nil {
+		return nil, nameErr(b, err)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return None, nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#set_intersection.
 func set_intersection(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	// TODO: support multiple others: s.difference(*others)
@@ -3198,6 +4587,33 @@ func set_intersection(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (V
 	return diff, nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#set·intersection_update.
+func set_intersection_update(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var other Iterable
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &other); err != nil {
+		return nil, err
+	}
+	recv := b.Receiver().(*Set)
+	if other == Iterable(recv) {
+		if err := recv.ht.checkMutable("delete from"); err != nil {
+			return nil, nameErr(b, err)
+		}
+		return None, nil
+	}
+	iter, err := SafeIterate(thread, other)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Done()
+	if err := recv.safeIntersectionUpdate(thread, iter); err != nil {
+		return nil, nameErr(b, err)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return None, nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#set_issubset.
 func set_issubset(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var other Iterable
@@ -3313,6 +4729,33 @@ func set_symmetric_difference(thread *Thread, b *Builtin, args Tuple, kwargs []T
 	return diff, nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#set·symmetric_difference_update.
+func set_symmetric_difference_update(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var other Iterable
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &other); err != nil {
+		return nil, err
+	}
+	recv := b.Receiver().(*Set)
+	if other == Iterable(recv) {
+		if err := recv.ht.clear(thread); err != nil {
+			return nil, nameErr(b, err)
+		}
+		return None, nil
+	}
+	iter, err := SafeIterate(thread, other)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Done()
+	if err := recv.safeSymmetricDifferenceUpdate(thread, iter); err != nil {
+		return nil, nameErr(b, err)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return None, nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#set·union.
 func set_union(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
@@ -3341,8 +4784,11 @@ func string_find_impl(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple, al
 	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &sub, &start_, &end_); err != nil {
 		return nil, err
 	}
+	return findImpl(thread, b, string(b.Receiver().(String)), sub, start_, end_, allowError, last)
+}
 
-	s := string(b.Receiver().(String))
+// Common implementation of string_{r}{find,index} and bytes_{find,index}.
+func findImpl(thread *Thread, b *Builtin, s, sub string, start_, end_ Value, allowError, last bool) (Value, error) {
 	start, end, err := indices(start_, end_, len(s))
 	if err != nil {
 		return nil, nameErr(b, err)
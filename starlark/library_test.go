@@ -1,6 +1,7 @@
 package starlark_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -195,6 +196,65 @@ func (iter *testSequenceIterator) Next(p *starlark.Value) bool {
 	return iter.testIterator.Next(p)
 }
 
+// testSizedIterable is an iterable of unknown length whose iterators
+// report how many elements remain.
+type testSizedIterable struct {
+	testIterable
+}
+
+var _ starlark.Iterable = &testSizedIterable{}
+
+func (tsi *testSizedIterable) String() string { return "testSizedIterable" }
+func (tsi *testSizedIterable) Type() string   { return "testSizedIterable" }
+func (tsi *testSizedIterable) Iterate() starlark.Iterator {
+	return &testSizedIterator{
+		testIterator{
+			maxN: tsi.maxN,
+			nth:  tsi.nth,
+		},
+	}
+}
+
+type testSizedIterator struct {
+	testIterator
+}
+
+var _ starlark.SafeSizedIterator = &testSizedIterator{}
+
+func (it *testSizedIterator) RemainingHint() (int, bool) {
+	if it.n >= it.maxN {
+		return 0, true
+	}
+	return it.maxN - it.n, true
+}
+
+// underReportingIterable is an iterable whose iterators always claim to
+// have a single element remaining, however many they yield.
+type underReportingIterable struct {
+	testIterable
+}
+
+var _ starlark.Iterable = &underReportingIterable{}
+
+func (uri *underReportingIterable) String() string { return "underReportingIterable" }
+func (uri *underReportingIterable) Type() string   { return "underReportingIterable" }
+func (uri *underReportingIterable) Iterate() starlark.Iterator {
+	return &underReportingIterator{
+		testIterator{
+			maxN: uri.maxN,
+			nth:  uri.nth,
+		},
+	}
+}
+
+type underReportingIterator struct {
+	testIterator
+}
+
+var _ starlark.SafeSizedIterator = &underReportingIterator{}
+
+func (it *underReportingIterator) RemainingHint() (int, bool) { return 1, true }
+
 type unsafeTestIterable struct {
 	// Allows test errors to be declared in methods without error returns.
 	testBase startest.TestBase
@@ -1151,6 +1211,46 @@ func TestBytesCancellation(t *testing.T) {
 	})
 }
 
+func TestBytesByteBudget(t *testing.T) {
+	bytes, ok := starlark.Universe["bytes"]
+	if !ok {
+		t.Fatal("no such builtin: bytes")
+	}
+	ints := func(n int) starlark.Value {
+		elems := make([]starlark.Value, n)
+		for i := range elems {
+			elems[i] = starlark.MakeInt(i)
+		}
+		return starlark.NewList(elems)
+	}
+
+	t.Run("within-budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxJoinBytes(10)
+		result, err := starlark.Call(thread, bytes, starlark.Tuple{ints(10)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := starlark.Bytes("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09"); result != expected {
+			t.Errorf("unexpected result: got %v, want %v", result, expected)
+		}
+	})
+
+	t.Run("over-budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxJoinBytes(10)
+		_, err := starlark.Call(thread, bytes, starlark.Tuple{ints(11)}, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := thread.Context().Err(); err != context.Canceled {
+			t.Errorf("expected thread to be cancelled, got %v", err)
+		}
+	})
+}
+
 func TestChrSteps(t *testing.T) {
 	chr, ok := starlark.Universe["chr"]
 	if !ok {
@@ -1247,6 +1347,37 @@ func TestDictSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("colliding-duplicates", func(t *testing.T) {
+		// Int hash only uses the least 32 bits, so these keys all
+		// share a bucket list, of which each bucket holds 8 entries.
+		const occupancy = 64
+		item := func(i int) starlark.Value {
+			return starlark.Tuple{starlark.MakeInt64(int64(i) << 32), starlark.None}
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Detecting each duplicate of the last key inserted probes every
+		// bucket in the list, on top of the steps for iteration.
+		st.SetMinSteps(3 + occupancy/8)
+		st.SetMaxSteps(3 + occupancy/8 + 1)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					if n < occupancy {
+						return item(n), nil
+					}
+					return item(occupancy - 1), nil
+				},
+				maxN: occupancy + st.N,
+			}
+			_, err := starlark.Call(thread, dict, starlark.Tuple{iter}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
 }
 
 func TestDictAllocs(t *testing.T) {
@@ -1306,6 +1437,33 @@ func TestDictAllocs(t *testing.T) {
 			st.KeepAlive(result)
 		})
 	})
+
+	t.Run("early-termination", func(t *testing.T) {
+		// Each element retained costs at least a word, so the budget
+		// admits only a bounded number of them.
+		const maxAllocs = 2000
+		const maxElems = maxAllocs / 8
+
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(maxAllocs)
+
+		var nReached int
+		iter := &testIterable{
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				nReached = n
+				return starlark.Tuple{starlark.MakeInt(n), starlark.None}, nil
+			},
+		}
+		_, err := starlark.Call(thread, dict, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if nReached > maxElems {
+			t.Errorf("iteration was not terminated early enough: reached %d", nReached)
+		}
+	})
 }
 
 func TestDictCancellation(t *testing.T) {
@@ -1421,6 +1579,55 @@ func TestDirSteps(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("safe-attr-names", func(t *testing.T) {
+		input := newManyAttrs(10_000)
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(int64(len(input.names)))
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, dir, starlark.Tuple{input}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+// manyAttrs is a value whose attribute names are copied each time they
+// are listed.
+type manyAttrs struct {
+	names []string
+}
+
+var _ starlark.HasSafeAttrNames = &manyAttrs{}
+
+func newManyAttrs(n int) *manyAttrs {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("attr%d", i)
+	}
+	return &manyAttrs{names}
+}
+
+func (ma *manyAttrs) Freeze()              {}
+func (ma *manyAttrs) String() string       { return "<manyAttrs>" }
+func (ma *manyAttrs) Truth() starlark.Bool { return true }
+func (ma *manyAttrs) Type() string         { return "manyAttrs" }
+func (ma *manyAttrs) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", ma.Type())
+}
+func (ma *manyAttrs) Attr(name string) (starlark.Value, error) { return nil, nil }
+func (ma *manyAttrs) AttrNames() []string                      { return append([]string(nil), ma.names...) }
+func (ma *manyAttrs) SafeAttrNames(thread *starlark.Thread) ([]string, error) {
+	if thread != nil {
+		if err := thread.AddAllocs(starlark.EstimateMakeSize([]string{}, starlark.SafeInt(len(ma.names)))); err != nil {
+			return nil, err
+		}
+	}
+	return ma.AttrNames(), nil
 }
 
 func TestDirAllocs(t *testing.T) {
@@ -1451,6 +1658,37 @@ func TestDirAllocs(t *testing.T) {
 			st.KeepAlive(result)
 		})
 	}
+
+	t.Run("safe-attr-names", func(t *testing.T) {
+		input := newManyAttrs(10_000)
+
+		t.Run("accounting", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunThread(func(thread *starlark.Thread) {
+				for i := 0; i < st.N; i++ {
+					result, err := starlark.Call(thread, dir, starlark.Tuple{input}, nil)
+					if err != nil {
+						st.Error(err)
+					}
+					st.KeepAlive(result)
+				}
+			})
+		})
+
+		t.Run("budget", func(t *testing.T) {
+			thread := &starlark.Thread{}
+			thread.SetMaxAllocs(1024)
+			_, err := starlark.Call(thread, dir, starlark.Tuple{input}, nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			expected := &starlark.AllocsSafetyError{}
+			if !errors.As(err, &expected) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	})
 }
 
 func TestEnumerateSteps(t *testing.T) {
@@ -1509,6 +1747,37 @@ func TestEnumerateSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("lazy", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(3)
+		st.SetMaxSteps(3)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					return starlark.None, nil
+				},
+				maxN: st.N,
+			}
+			kwargs := []starlark.Tuple{{starlark.String("lazy"), starlark.True}}
+			result, err := starlark.Call(thread, enumerate, starlark.Tuple{iter}, kwargs)
+			if err != nil {
+				st.Fatal(err)
+			}
+			pairs, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer pairs.Done()
+			var pair starlark.Value
+			for pairs.Next(&pair) {
+			}
+			if err := pairs.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
 }
 
 func TestEnumerateAllocs(t *testing.T) {
@@ -1669,6 +1938,81 @@ func TestEnumerateAllocs(t *testing.T) {
 			})
 		})
 	})
+
+	t.Run("lazy", func(t *testing.T) {
+		// Each pair is allocated as it is yielded, so iterating without
+		// keeping the pairs alive never materializes the whole list.
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.SetMaxAllocs(mustInt64(starlark.EstimateSize(starlark.Tuple{starlark.MakeInt(0), nil})))
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				maxN: st.N,
+				nth: func(thread *starlark.Thread, _ int) (starlark.Value, error) {
+					return starlark.None, nil
+				},
+			}
+			kwargs := []starlark.Tuple{{starlark.String("lazy"), starlark.True}}
+			result, err := starlark.Call(thread, enumerate, starlark.Tuple{iter}, kwargs)
+			if err != nil {
+				st.Fatal(err)
+			}
+			pairs, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer pairs.Done()
+			var pair starlark.Value
+			for i := 0; pairs.Next(&pair); i++ {
+				if index := pair.(starlark.Tuple)[0]; index != starlark.MakeInt(i) {
+					st.Errorf("unexpected index: got %v, want %d", index, i)
+				}
+			}
+			if err := pairs.Err(); err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
+}
+
+func TestEnumerateUnderReportedLength(t *testing.T) {
+	enumerate, ok := starlark.Universe["enumerate"]
+	if !ok {
+		t.Fatal("no such builtin: enumerate")
+	}
+
+	const numElems = 5
+	iterable := &underReportingIterable{testIterable{
+		maxN: numElems,
+		nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+			return starlark.MakeInt(n), nil
+		},
+	}}
+
+	st := startest.From(t)
+	st.RequireSafety(starlark.MemSafe)
+	st.RunThread(func(thread *starlark.Thread) {
+		for i := 0; i < st.N; i++ {
+			result, err := starlark.Call(thread, enumerate, starlark.Tuple{iterable}, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			pairs := result.(*starlark.List)
+			if pairs.Len() != numElems {
+				st.Fatalf("unexpected length: got %d, want %d", pairs.Len(), numElems)
+			}
+			for j := 0; j < numElems; j++ {
+				want := starlark.Tuple{starlark.MakeInt(j), starlark.MakeInt(j + 1)}
+				if eq, err := starlark.Equal(pairs.Index(j), want); err != nil {
+					st.Fatal(err)
+				} else if !eq {
+					st.Errorf("unexpected pair: got %v, want %v", pairs.Index(j), want)
+				}
+			}
+			st.KeepAlive(result)
+		}
+	})
 }
 
 func TestEnumerateCancellation(t *testing.T) {
@@ -2153,6 +2497,84 @@ func TestFailCancellation(t *testing.T) {
 	testWriteValueCancellation(t, "fail")
 }
 
+func TestFailSep(t *testing.T) {
+	fail, ok := starlark.Universe["fail"]
+	if !ok {
+		t.Fatal("no such builtin: fail")
+	}
+
+	t.Run("message", func(t *testing.T) {
+		tests := []struct {
+			kwargs []starlark.Tuple
+			expect string
+		}{
+			{nil, "fail: a 1 None"},
+			{[]starlark.Tuple{{starlark.String("sep"), starlark.String("/")}}, "fail: a/1/None"},
+			{[]starlark.Tuple{{starlark.String("sep"), starlark.String("")}}, "fail: a1None"},
+		}
+		args := starlark.Tuple{starlark.String("a"), starlark.MakeInt(1), starlark.None}
+		for _, test := range tests {
+			_, err := starlark.Call(&starlark.Thread{}, fail, args, test.kwargs)
+			if err == nil {
+				t.Errorf("%v: expected error", test.kwargs)
+			} else if msg := err.(*starlark.EvalError).Msg; msg != test.expect {
+				t.Errorf("%v: got %q, want %q", test.kwargs, msg, test.expect)
+			}
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Each byte of the message costs a step.
+		st.SetMinSteps(3)
+		st.SetMaxSteps(3)
+		st.RunThread(func(thread *starlark.Thread) {
+			args := make(starlark.Tuple, st.N+1)
+			for i := range args {
+				args[i] = starlark.String("x")
+			}
+			// Each of the N trailing arguments is preceded by a separator.
+			args[0] = starlark.String("")
+			kwargs := []starlark.Tuple{{starlark.String("sep"), starlark.String("--")}}
+			if _, err := starlark.Call(thread, fail, args, kwargs); err == nil {
+				st.Error("expected error")
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			kwargs := []starlark.Tuple{{starlark.String("sep"), starlark.String(strings.Repeat("-", 16))}}
+			for i := 0; i < st.N; i++ {
+				args := starlark.Tuple{starlark.String("hello"), starlark.MakeInt(1), starlark.String("world")}
+				_, err := starlark.Call(thread, fail, args, kwargs)
+				if err == nil {
+					st.Error("expected error")
+					continue
+				}
+				st.KeepAlive(err.Error())
+				thread.AddAllocs(starlark.StringTypeOverhead)
+			}
+		})
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(1000)
+		args := starlark.Tuple{starlark.String("x"), starlark.String("y")}
+		kwargs := []starlark.Tuple{{starlark.String("sep"), starlark.String(strings.Repeat("-", 1000))}}
+		_, err := starlark.Call(thread, fail, args, kwargs)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
 func TestFloatSteps(t *testing.T) {
 	float, ok := starlark.Universe["float"]
 	if !ok {
@@ -2198,6 +2620,26 @@ func TestFloatSteps(t *testing.T) {
 			})
 		})
 
+		t.Run("big-int", func(t *testing.T) {
+			const bits = 5000
+
+			st := startest.From(t)
+			st.RequireSafety(starlark.CPUSafe)
+			st.SetMinSteps((bits + 1) / 32)
+			st.SetMaxSteps((bits + 1) / 32)
+			st.RunThread(func(thread *starlark.Thread) {
+				input := starlark.Value(starlark.MakeInt(1).Lsh(bits))
+				for i := 0; i < st.N; i++ {
+					_, err := starlark.Call(thread, float, starlark.Tuple{input}, nil)
+					if err == nil {
+						st.Error("expected error")
+					} else if err.Error() != "int too large to convert to float" {
+						st.Errorf("unexpected error: %v", err)
+					}
+				}
+			})
+		})
+
 		t.Run("string-number", func(t *testing.T) {
 			st := startest.From(t)
 			st.RequireSafety(starlark.CPUSafe)
@@ -2485,15 +2927,256 @@ func TestGetattrAllocs(t *testing.T) {
 	})
 }
 
-func TestHasattrSteps(t *testing.T) {
-	hasattr, ok := starlark.Universe["hasattr"]
+func TestGroupbySteps(t *testing.T) {
+	groupby, ok := starlark.Universe["groupby"]
 	if !ok {
-		t.Fatal("no such builtin: hasattr")
+		t.Fatal("no such builtin: groupby")
 	}
 
-	t.Run("missing", func(t *testing.T) {
-		missing := starlark.String("solve_non_polynomial")
-		tests := []struct {
+	t.Run("safety-respected", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+
+		result, err := starlark.Call(thread, groupby, starlark.Tuple{&unsafeTestIterable{t}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := starlark.SafeIterate(thread, result); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("drained", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The step cost per N, with one element per group, is:
+		// - For iterating the source, 1
+		// - For reading the element, 1
+		// - For iterating its group, 1
+		// - For iterating the groups, 1
+		st.SetMinSteps(4)
+		st.SetMaxSteps(4)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					return starlark.MakeInt(n), nil
+				},
+				maxN: st.N,
+			}
+			result, err := starlark.Call(thread, groupby, starlark.Tuple{iter}, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			groups, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer groups.Done()
+			var pair starlark.Value
+			for groups.Next(&pair) {
+				group, err := starlark.SafeIterate(thread, pair.(starlark.Tuple)[1])
+				if err != nil {
+					st.Fatal(err)
+				}
+				var x starlark.Value
+				for group.Next(&x) {
+				}
+				group.Done()
+				if err := group.Err(); err != nil {
+					st.Error(err)
+				}
+			}
+			if err := groups.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("undrained", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The step cost per N of elements skipped with their group is:
+		// - For iterating the source, 1
+		// - For reading the element, 1
+		st.SetMinSteps(2)
+		st.SetMaxSteps(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					return starlark.None, nil
+				},
+				maxN: st.N,
+			}
+			result, err := starlark.Call(thread, groupby, starlark.Tuple{iter}, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			groups, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer groups.Done()
+			var pair starlark.Value
+			for groups.Next(&pair) {
+			}
+			if err := groups.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+}
+
+func TestGroupbyAllocs(t *testing.T) {
+	groupby, ok := starlark.Universe["groupby"]
+	if !ok {
+		t.Fatal("no such builtin: groupby")
+	}
+
+	t.Run("safety-respected", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.MemSafe)
+
+		result, err := starlark.Call(thread, groupby, starlark.Tuple{&unsafeTestIterable{t}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := starlark.SafeIterate(thread, result); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					return starlark.MakeInt(n), nil
+				},
+				maxN: st.N,
+			}
+			result, err := starlark.Call(thread, groupby, starlark.Tuple{iter}, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			groups, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer groups.Done()
+			var pair starlark.Value
+			for groups.Next(&pair) {
+				st.KeepAlive(pair)
+			}
+			if err := groups.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		// A single group is never buffered, however large.
+		st.SetMaxAllocs(0)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					return starlark.None, nil
+				},
+				maxN: st.N,
+			}
+			result, err := starlark.Call(thread, groupby, starlark.Tuple{iter}, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			groups, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer groups.Done()
+			var pair starlark.Value
+			for groups.Next(&pair) {
+				group, err := starlark.SafeIterate(thread, pair.(starlark.Tuple)[1])
+				if err != nil {
+					st.Fatal(err)
+				}
+				var x starlark.Value
+				for group.Next(&x) {
+				}
+				group.Done()
+				if err := group.Err(); err != nil {
+					st.Error(err)
+				}
+			}
+			if err := groups.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+}
+
+func TestGroupbyKey(t *testing.T) {
+	groupby, ok := starlark.Universe["groupby"]
+	if !ok {
+		t.Fatal("no such builtin: groupby")
+	}
+
+	st := startest.From(t)
+	st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+	st.SetMaxAllocs(0)
+	st.RunThread(func(thread *starlark.Thread) {
+		calls := 0
+		key := starlark.NewBuiltinWithSafety("key", starlark.CPUSafe|starlark.MemSafe, func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			calls++
+			return starlark.None, nil
+		})
+		iter := &testIterable{
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+			maxN: st.N,
+		}
+		kwargs := []starlark.Tuple{{starlark.String("key"), key}}
+		result, err := starlark.Call(thread, groupby, starlark.Tuple{iter}, kwargs)
+		if err != nil {
+			st.Fatal(err)
+		}
+		groups, err := starlark.SafeIterate(thread, result)
+		if err != nil {
+			st.Fatal(err)
+		}
+		defer groups.Done()
+		var pair starlark.Value
+		n := 0
+		for groups.Next(&pair) {
+			n++
+		}
+		if err := groups.Err(); err != nil {
+			st.Error(err)
+		}
+		if n != 1 {
+			st.Errorf("expected a single group, got %d", n)
+		}
+		if calls != st.N {
+			st.Errorf("key called %d times, want %d", calls, st.N)
+		}
+	})
+}
+
+func TestHasattrSteps(t *testing.T) {
+	hasattr, ok := starlark.Universe["hasattr"]
+	if !ok {
+		t.Fatal("no such builtin: hasattr")
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		missing := starlark.String("solve_non_polynomial")
+		tests := []struct {
 			name  string
 			input starlark.Value
 		}{{
@@ -2583,6 +3266,38 @@ func TestHasattrSteps(t *testing.T) {
 	})
 }
 
+// nilSafeAttrs is a value which reports every attribute absent by
+// returning neither a value nor an error.
+type nilSafeAttrs struct{}
+
+var _ starlark.HasSafeAttrs = nilSafeAttrs{}
+
+func (nilSafeAttrs) Freeze()              {}
+func (nilSafeAttrs) String() string       { return "nilSafeAttrs" }
+func (nilSafeAttrs) Truth() starlark.Bool { return true }
+func (nilSafeAttrs) Type() string         { return "nilSafeAttrs" }
+func (nilSafeAttrs) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: nilSafeAttrs")
+}
+func (nilSafeAttrs) Attr(string) (starlark.Value, error) { return nil, nil }
+func (nilSafeAttrs) AttrNames() []string                 { return nil }
+func (nilSafeAttrs) SafeAttr(*starlark.Thread, string) (starlark.Value, error) {
+	return nil, nil
+}
+
+func TestHasattrNilSafeAttr(t *testing.T) {
+	hasattr, ok := starlark.Universe["hasattr"]
+	if !ok {
+		t.Fatal("no such builtin: hasattr")
+	}
+	args := starlark.Tuple{nilSafeAttrs{}, starlark.String("x")}
+	if result, err := starlark.Call(&starlark.Thread{}, hasattr, args, nil); err != nil {
+		t.Error(err)
+	} else if result != starlark.False {
+		t.Errorf("absent attribute is present: got %v", result)
+	}
+}
+
 func TestHasattrAllocs(t *testing.T) {
 	hasattr, ok := starlark.Universe["hasattr"]
 	if !ok {
@@ -2794,6 +3509,24 @@ func TestIntSteps(t *testing.T) {
 		})
 	})
 
+	t.Run("big-float", func(t *testing.T) {
+		const bits = 997 // 2**996 < 1e300 < 2**997
+		input := starlark.Float(1e300)
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(bits / 32)
+		st.SetMaxSteps(bits / 32)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, int_, starlark.Tuple{input}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+
 	t.Run("int", func(t *testing.T) {
 		st := startest.From(t)
 		st.RequireSafety(starlark.CPUSafe)
@@ -2820,6 +3553,20 @@ func TestIntSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("underscores", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(2)
+		st.SetMaxSteps(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			n := starlark.String(strings.Repeat("1_", st.N) + "1")
+			_, err := starlark.Call(thread, int_, starlark.Tuple{n}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
 }
 
 func TestIntAllocs(t *testing.T) {
@@ -2844,6 +3591,21 @@ func TestIntAllocs(t *testing.T) {
 		})
 	})
 
+	t.Run("big-float", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(th *starlark.Thread) {
+			input := starlark.Float(1e300)
+			for i := 0; i < st.N; i++ {
+				result, err := starlark.Call(th, int_, starlark.Tuple{input}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			}
+		})
+	})
+
 	t.Run("big", func(t *testing.T) {
 		st := startest.From(t)
 		st.RequireSafety(starlark.MemSafe)
@@ -2857,6 +3619,20 @@ func TestIntAllocs(t *testing.T) {
 			st.KeepAlive(result)
 		})
 	})
+
+	t.Run("underscores", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(th *starlark.Thread) {
+			inputString := starlark.String("0x" + strings.Repeat("_dead_beef", st.N))
+			args := []starlark.Value{inputString, starlark.MakeInt(0)}
+			result, err := starlark.Call(th, int_, args, nil)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
 }
 
 func TestLenSteps(t *testing.T) {
@@ -2923,27 +3699,204 @@ func TestLenSteps(t *testing.T) {
 				if err != nil {
 					st.Error(err)
 				}
-			})
+			})
+		})
+	}
+
+	t.Run("safe-len", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			input := &lazyLenSequence{make(starlark.Tuple, st.N)}
+			result, err := starlark.Call(thread, len_, starlark.Tuple{input}, nil)
+			if err != nil {
+				st.Error(err)
+			} else if result != starlark.MakeInt(st.N) {
+				st.Errorf("unexpected result: got %v, want %d", result, st.N)
+			}
+		})
+	})
+}
+
+// lazyLenSequence is a sequence which counts its elements each time its
+// length is requested.
+type lazyLenSequence struct {
+	elems starlark.Tuple
+}
+
+var _ starlark.HasSafeLen = &lazyLenSequence{}
+
+func (s *lazyLenSequence) String() string       { return "lazyLenSequence" }
+func (s *lazyLenSequence) Type() string         { return "lazyLenSequence" }
+func (s *lazyLenSequence) Freeze()              {}
+func (s *lazyLenSequence) Truth() starlark.Bool { return len(s.elems) > 0 }
+func (s *lazyLenSequence) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: lazyLenSequence")
+}
+func (s *lazyLenSequence) Iterate() starlark.Iterator { return s.elems.Iterate() }
+func (s *lazyLenSequence) Len() int                   { return len(s.elems) }
+
+func (s *lazyLenSequence) SafeLen(thread *starlark.Thread) (int, error) {
+	n := 0
+	for range s.elems {
+		if thread != nil {
+			if err := thread.AddSteps(starlark.SafeInt(1)); err != nil {
+				return 0, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+func TestLenAllocs(t *testing.T) {
+	len_, ok := starlark.Universe["len"]
+	if !ok {
+		t.Fatal("no such builtin: len")
+	}
+
+	st := startest.From(t)
+	st.RequireSafety(starlark.MemSafe)
+	st.RunThread(func(thread *starlark.Thread) {
+		for i := 0; i < st.N; i++ {
+			result, err := starlark.Call(thread, len_, starlark.Tuple{starlark.String("test")}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		}
+	})
+}
+
+func TestLinesSteps(t *testing.T) {
+	lines, ok := starlark.Universe["lines"]
+	if !ok {
+		t.Fatal("no such builtin: lines")
+	}
+
+	const line = "abcdefg\n"
+
+	t.Run("scan", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		// The step cost per N is:
+		// - For scanning the line, len(line)
+		// - For iteration, 1
+		st.SetMinSteps(int64(len(line)) + 1)
+		st.SetMaxSteps(int64(len(line)) + 1)
+		st.RunThread(func(thread *starlark.Thread) {
+			str := starlark.String(strings.Repeat(line, st.N))
+			result, err := starlark.Call(thread, lines, starlark.Tuple{str}, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			iter, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer iter.Done()
+			var v starlark.Value
+			for iter.Next(&v) {
+				// Do nothing.
+			}
+			if err := iter.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("early-termination", func(t *testing.T) {
+		str := starlark.String(line + strings.Repeat("x", 10_000))
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.SetMinSteps(int64(len(line)) + 1)
+		st.SetMaxSteps(int64(len(line)) + 1)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				result, err := starlark.Call(thread, lines, starlark.Tuple{str}, nil)
+				if err != nil {
+					st.Fatal(err)
+				}
+				iter, err := starlark.SafeIterate(thread, result)
+				if err != nil {
+					st.Fatal(err)
+				}
+				var v starlark.Value
+				if !iter.Next(&v) {
+					st.Errorf("expected a line")
+				}
+				iter.Done()
+				if err := iter.Err(); err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestLinesAllocs(t *testing.T) {
+	lines, ok := starlark.Universe["lines"]
+	if !ok {
+		t.Fatal("no such builtin: lines")
+	}
+
+	t.Run("all", func(t *testing.T) {
+		str := starlark.String(strings.Repeat("abcdefg\n", 1000))
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				result, err := starlark.Call(thread, lines, starlark.Tuple{str}, nil)
+				if err != nil {
+					st.Fatal(err)
+				}
+				st.KeepAlive(result)
+				iter, err := starlark.SafeIterate(thread, result)
+				if err != nil {
+					st.Fatal(err)
+				}
+				var v starlark.Value
+				for iter.Next(&v) {
+					st.KeepAlive(v)
+				}
+				iter.Done()
+				if err := iter.Err(); err != nil {
+					st.Error(err)
+				}
+			}
 		})
-	}
-}
+	})
 
-func TestLenAllocs(t *testing.T) {
-	len_, ok := starlark.Universe["len"]
-	if !ok {
-		t.Fatal("no such builtin: len")
-	}
+	t.Run("early-termination", func(t *testing.T) {
+		str := starlark.String("abcdefg\n" + strings.Repeat("x", 10_000))
 
-	st := startest.From(t)
-	st.RequireSafety(starlark.MemSafe)
-	st.RunThread(func(thread *starlark.Thread) {
-		for i := 0; i < st.N; i++ {
-			result, err := starlark.Call(thread, len_, starlark.Tuple{starlark.String("test")}, nil)
-			if err != nil {
-				st.Error(err)
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.SetMaxAllocs(64) // Independent of the length of the rest of the string
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				result, err := starlark.Call(thread, lines, starlark.Tuple{str}, nil)
+				if err != nil {
+					st.Fatal(err)
+				}
+				iter, err := starlark.SafeIterate(thread, result)
+				if err != nil {
+					st.Fatal(err)
+				}
+				var v starlark.Value
+				if iter.Next(&v) {
+					st.KeepAlive(v)
+				}
+				iter.Done()
+				if err := iter.Err(); err != nil {
+					st.Error(err)
+				}
 			}
-			st.KeepAlive(result)
-		}
+		})
 	})
 }
 
@@ -3002,6 +3955,20 @@ func TestListSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("tuple", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			tuple := make(starlark.Tuple, st.N)
+			_, err := starlark.Call(thread, list, starlark.Tuple{tuple}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
 }
 
 func TestListAllocs(t *testing.T) {
@@ -3070,6 +4037,39 @@ func TestListAllocs(t *testing.T) {
 		})
 	})
 
+	t.Run("sized-iterator", func(t *testing.T) {
+		const numTestElems = 1000
+
+		nth := func(_ *starlark.Thread, _ int) (starlark.Value, error) {
+			return starlark.None, nil
+		}
+		listAllocs := func(args starlark.Tuple) int64 {
+			thread := &starlark.Thread{}
+			if _, err := starlark.Call(thread, list, args, nil); err != nil {
+				t.Fatal(err)
+			}
+			allocs, ok := thread.Allocs()
+			if !ok {
+				t.Fatal("alloc count invalidated")
+			}
+			return allocs
+		}
+		emptyListAllocs := listAllocs(nil)
+		presized := mustInt64(starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(numTestElems)))
+
+		// A sized iterator allows the result to be reserved in one go.
+		sized := &testSizedIterable{testIterable{nth: nth, maxN: numTestElems}}
+		if allocs := listAllocs(starlark.Tuple{sized}) - emptyListAllocs; allocs != presized {
+			t.Errorf("sized iterator: expected single reservation of %d bytes, got %d", presized, allocs)
+		}
+
+		// Without a hint, the result grows as elements are appended.
+		unsized := &testIterable{nth: nth, maxN: numTestElems}
+		if allocs := listAllocs(starlark.Tuple{unsized}) - emptyListAllocs; allocs <= presized {
+			t.Errorf("unsized iterator: expected growth beyond %d bytes, got %d", presized, allocs)
+		}
+	})
+
 	t.Run("small-sequence", func(t *testing.T) {
 		const numTestElems = 10
 
@@ -3328,6 +4328,155 @@ func TestMinCancellation(t *testing.T) {
 	testMinMaxCancellation(t, "min")
 }
 
+func TestMemoizeCalls(t *testing.T) {
+	memoize, ok := starlark.Universe["memoize"]
+	if !ok {
+		t.Fatal("no such builtin: memoize")
+	}
+
+	calls := map[int]int{}
+	count := starlark.NewBuiltinWithSafety("count", starlark.CPUSafe|starlark.MemSafe|starlark.TimeSafe|starlark.IOSafe,
+		func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x int
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+				return nil, err
+			}
+			calls[x]++
+			return starlark.MakeInt(x), nil
+		},
+	)
+
+	thread := &starlark.Thread{}
+	thread.RequireSafety(starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe)
+	memoized, err := starlark.Call(thread, memoize, starlark.Tuple{count}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if safety := memoized.(starlark.SafetyAware).Safety(); safety != count.Safety() {
+		t.Errorf("unexpected safety: got %v, want %v", safety, count.Safety())
+	}
+	for _, x := range []int{1, 2, 1, 3, 2, 1} {
+		result, err := starlark.Call(thread, memoized, starlark.Tuple{starlark.MakeInt(x)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != starlark.MakeInt(x) {
+			t.Errorf("unexpected result: got %v, want %d", result, x)
+		}
+	}
+	for x, n := range calls {
+		if n != 1 {
+			t.Errorf("count(%d) called %d times", x, n)
+		}
+	}
+	if len(calls) != 3 {
+		t.Errorf("unexpected number of distinct calls: got %d, want 3", len(calls))
+	}
+
+	t.Run("unsafe", func(t *testing.T) {
+		unsafe := starlark.NewBuiltin("unsafe", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			return starlark.None, nil
+		})
+		memoized, err := starlark.Call(&starlark.Thread{}, memoize, starlark.Tuple{unsafe}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+		_, err = starlark.Call(thread, memoized, nil, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestMemoizeAllocs(t *testing.T) {
+	memoize, ok := starlark.Universe["memoize"]
+	if !ok {
+		t.Fatal("no such builtin: memoize")
+	}
+	identity := starlark.NewBuiltinWithSafety("identity", starlark.CPUSafe|starlark.MemSafe|starlark.TimeSafe|starlark.IOSafe,
+		func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return args[0], nil
+		},
+	)
+
+	t.Run("cached", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			maxsize := starlark.Tuple{starlark.String("maxsize"), starlark.MakeInt(st.N + 1)}
+			memoized, err := starlark.Call(thread, memoize, starlark.Tuple{identity}, []starlark.Tuple{maxsize})
+			if err != nil {
+				st.Fatal(err)
+			}
+			for i := 0; i < st.N; i++ {
+				arg := starlark.Value(starlark.MakeInt(i))
+				if _, err := starlark.Call(thread, memoized, starlark.Tuple{arg, arg}, nil); err != nil {
+					st.Error(err)
+				}
+			}
+			st.KeepAlive(memoized)
+		})
+	})
+
+	t.Run("hit", func(t *testing.T) {
+		// A hit is charged for its key, which holds the number of
+		// positional arguments followed by the arguments, and for the
+		// steps taken to look it up.
+		const hits = 10
+		thread := &starlark.Thread{}
+		memoized, err := starlark.Call(thread, memoize, starlark.Tuple{identity}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := starlark.Tuple{starlark.MakeInt(1)}
+		if _, err := starlark.Call(thread, memoized, args, nil); err != nil {
+			t.Fatal(err)
+		}
+		allocsBefore, _ := thread.Allocs()
+		stepsBefore, _ := thread.Steps()
+		for i := 0; i < hits; i++ {
+			if _, err := starlark.Call(thread, memoized, args, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		allocsAfter, _ := thread.Allocs()
+		stepsAfter, _ := thread.Steps()
+
+		keySize := starlark.SafeAdd(starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(2)), starlark.SliceTypeOverhead)
+		if want := mustInt64(starlark.SafeMul(keySize, hits)); allocsAfter-allocsBefore != want {
+			t.Errorf("unexpected allocations for %d hits: got %d, want %d", hits, allocsAfter-allocsBefore, want)
+		}
+		if steps := stepsAfter - stepsBefore; steps < hits {
+			t.Errorf("hits not charged for lookup: %d steps for %d hits", steps, hits)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(10000)
+		memoized, err := starlark.Call(thread, memoize, starlark.Tuple{identity}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			if i > 10000 {
+				t.Fatal("cache memory was not accounted")
+			}
+			_, err := starlark.Call(thread, memoized, starlark.Tuple{starlark.MakeInt(i)}, nil)
+			if err != nil {
+				if !errors.Is(err, starlark.ErrSafety) {
+					t.Errorf("unexpected error: %v", err)
+				}
+				break
+			}
+		}
+	})
+}
+
 func TestOrdSteps(t *testing.T) {
 	ord, ok := starlark.Universe["ord"]
 	if !ok {
@@ -3505,6 +4654,93 @@ func TestPrintCancellation(t *testing.T) {
 	testWriteValueCancellation(t, "print")
 }
 
+func TestPrintSepEnd(t *testing.T) {
+	print, ok := starlark.Universe["print"]
+	if !ok {
+		t.Fatal("no such builtin: print")
+	}
+
+	t.Run("output", func(t *testing.T) {
+		var got []string
+		thread := &starlark.Thread{
+			Print: func(_ *starlark.Thread, msg string) {
+				got = append(got, msg)
+			},
+		}
+		tests := []struct {
+			kwargs []starlark.Tuple
+			expect string
+		}{
+			{nil, "a 1 None"},
+			{[]starlark.Tuple{{starlark.String("sep"), starlark.String(", ")}}, "a, 1, None"},
+			{[]starlark.Tuple{{starlark.String("end"), starlark.String("!")}}, "a 1 None!"},
+			{[]starlark.Tuple{{starlark.String("end"), starlark.String("!\n")}}, "a 1 None!"},
+			{[]starlark.Tuple{{starlark.String("end"), starlark.String("\n")}}, "a 1 None"},
+			{[]starlark.Tuple{{starlark.String("end"), starlark.String("")}}, "a 1 None"},
+			{[]starlark.Tuple{{starlark.String("end"), starlark.String("\n\n")}}, "a 1 None\n"},
+			{[]starlark.Tuple{
+				{starlark.String("sep"), starlark.String("")},
+				{starlark.String("end"), starlark.String(".")},
+			}, "a1None."},
+		}
+		args := starlark.Tuple{starlark.String("a"), starlark.MakeInt(1), starlark.None}
+		for _, test := range tests {
+			got = nil
+			if _, err := starlark.Call(thread, print, args, test.kwargs); err != nil {
+				t.Errorf("%v: %v", test.kwargs, err)
+			} else if len(got) != 1 || got[0] != test.expect {
+				t.Errorf("%v: got %q, want %q", test.kwargs, got, test.expect)
+			}
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Each byte of the message costs a step: every argument is
+		// followed by either the separator or the end.
+		st.SetMinSteps(3)
+		st.SetMaxSteps(3)
+		st.RunThread(func(thread *starlark.Thread) {
+			thread.Print = func(*starlark.Thread, string) {}
+			args := make(starlark.Tuple, st.N)
+			for i := range args {
+				args[i] = starlark.String("x")
+			}
+			kwargs := []starlark.Tuple{
+				{starlark.String("sep"), starlark.String("--")},
+				{starlark.String("end"), starlark.String("--")},
+			}
+			if _, err := starlark.Call(thread, print, args, kwargs); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			thread.Print = func(thread *starlark.Thread, msg string) {
+				if err := thread.AddAllocs(starlark.StringTypeOverhead); err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(msg)
+			}
+			kwargs := []starlark.Tuple{
+				{starlark.String("sep"), starlark.String(", ")},
+				{starlark.String("end"), starlark.String(strings.Repeat("!", 16))},
+			}
+			for i := 0; i < st.N; i++ {
+				args := starlark.Tuple{starlark.String("hello"), starlark.String("world")}
+				if _, err := starlark.Call(thread, print, args, kwargs); err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
 func TestRangeSteps(t *testing.T) {
 	range_, ok := starlark.Universe["range"]
 	if !ok {
@@ -3613,6 +4849,91 @@ func TestRangeAllocs(t *testing.T) {
 	})
 }
 
+func TestRangeCompare(t *testing.T) {
+	range_, ok := starlark.Universe["range"]
+	if !ok {
+		t.Fatal("no such builtin: range")
+	}
+	makeRange := func(thread *starlark.Thread, start, stop, step int) starlark.Value {
+		args := starlark.Tuple{starlark.MakeInt(start), starlark.MakeInt(stop), starlark.MakeInt(step)}
+		r, err := starlark.Call(thread, range_, args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	t.Run("equality", func(t *testing.T) {
+		const maxInt32 = 1<<31 - 1
+		tests := []struct {
+			name string
+			x, y [3]int
+			eq   bool
+		}{{
+			name: "same",
+			x:    [3]int{0, maxInt32, 1},
+			y:    [3]int{0, maxInt32, 1},
+			eq:   true,
+		}, {
+			name: "same-elements",
+			x:    [3]int{0, maxInt32 - 1, 2},
+			y:    [3]int{0, maxInt32 - 2, 2},
+			eq:   true,
+		}, {
+			name: "different-start",
+			x:    [3]int{0, maxInt32, 1},
+			y:    [3]int{1, maxInt32, 1},
+		}, {
+			name: "different-step",
+			x:    [3]int{0, maxInt32, 1},
+			y:    [3]int{0, maxInt32, 3},
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+				// Ranges are compared without enumerating their elements.
+				st.SetMaxSteps(0)
+				st.SetMaxAllocs(0)
+				st.RunThread(func(thread *starlark.Thread) {
+					x := makeRange(thread, test.x[0], test.x[1], test.x[2])
+					y := makeRange(thread, test.y[0], test.y[1], test.y[2])
+					for i := 0; i < st.N; i++ {
+						for _, op := range []syntax.Token{syntax.EQL, syntax.NEQ} {
+							ok, err := starlark.SafeCompare(thread, op, x, y)
+							if err != nil {
+								st.Fatal(err)
+							}
+							if want := test.eq == (op == syntax.EQL); ok != want {
+								st.Errorf("%v %v %v: got %t, want %t", x, op, y, ok, want)
+							}
+						}
+					}
+				})
+			})
+		}
+	})
+
+	t.Run("ordering", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		x := makeRange(thread, 0, 10, 1)
+		others := []starlark.Value{x, makeRange(thread, 0, 20, 1), starlark.NewList(nil)}
+		for _, y := range others {
+			for _, op := range []syntax.Token{syntax.LT, syntax.LE, syntax.GT, syntax.GE} {
+				_, err := starlark.SafeCompare(thread, op, x, y)
+				if err == nil {
+					t.Errorf("%v %v %v: expected error", x, op, y)
+					continue
+				}
+				want := fmt.Sprintf("range %s %s not implemented", op, y.Type())
+				if err.Error() != want {
+					t.Errorf("%v %v %v: unexpected error: got %q, want %q", x, op, y, err, want)
+				}
+			}
+		}
+	})
+}
+
 func TestReprSteps(t *testing.T) {
 	testWriteValueSteps(t, "repr", 0, false, []writeValueStepTest{{
 		name:  "String",
@@ -3626,6 +4947,14 @@ func TestReprSteps(t *testing.T) {
 		name:  "Bytes (invalid utf8)",
 		input: starlark.Bytes(string([]byte{0x80, 0x80, 0x80, 0x80})),
 		steps: int64(len(`b"\x80\x80\x80\x80"`)),
+	}, {
+		name:  "String (control characters)",
+		input: starlark.String("\x00\t\x1b\x7f"),
+		steps: int64(len(`"\x00\t\x1b\x7f"`)),
+	}, {
+		name:  "String (astral)",
+		input: starlark.String("\U0001F600\U000E0001"),
+		steps: int64(len("\"\U0001F600\\U000e0001\"")),
 	}})
 }
 
@@ -3665,6 +4994,49 @@ func TestReprAllocs(t *testing.T) {
 	})
 }
 
+func TestReprEscaping(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{"a\x00b", `"a\x00b"`},
+		{"\t\n\r\v\f\a\b", `"\t\n\r\v\f\a\b"`},
+		{"\x01\x1f\x7f", `"\x01\x1f\x7f"`},
+		{"\"\\'", `"\"\\'"`},
+		{"\u0085\u00a0\u2028", `"\u0085\u00a0\u2028"`},
+		{"\ud7ff\ue000\ufffd", `"\ud7ff\ue000�"`},
+		{"é世\U0001F600", "\"é世\U0001F600\""},
+		{"\U000E0001\U0010FFFF", `"\U000e0001\U0010ffff"`},
+	}
+
+	repr, ok := starlark.Universe["repr"]
+	if !ok {
+		t.Fatal("no such builtin: repr")
+	}
+	for _, test := range tests {
+		thread := &starlark.Thread{}
+		result, err := starlark.Call(thread, repr, starlark.Tuple{starlark.String(test.input)}, nil)
+		if err != nil {
+			t.Errorf("repr(%q): %v", test.input, err)
+			continue
+		}
+		got := string(result.(starlark.String))
+		if got != test.expect {
+			t.Errorf("repr(%q): got %s, want %s", test.input, got, test.expect)
+		}
+		if steps, _ := thread.Steps(); steps != int64(len(got)) {
+			t.Errorf("repr(%q): unexpected steps: got %d, want %d", test.input, steps, len(got))
+		}
+
+		// The result is a literal for the original string.
+		if v, err := starlark.Eval(&starlark.Thread{}, "repr.star", got, nil); err != nil {
+			t.Errorf("repr(%q): cannot parse %s: %v", test.input, got, err)
+		} else if v != starlark.String(test.input) {
+			t.Errorf("repr(%q): %s does not round-trip: got %q", test.input, got, v)
+		}
+	}
+}
+
 func TestReprCancellation(t *testing.T) {
 	testWriteValueCancellation(t, "repr")
 }
@@ -3992,9 +5364,40 @@ func TestSetSteps(t *testing.T) {
 		st.RunThread(func(thread *starlark.Thread) {
 			iter := &testIterable{
 				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
-					return starlark.MakeInt(n), nil
+					return starlark.MakeInt(n), nil
+				},
+				maxN: st.N,
+			}
+			_, err := starlark.Call(thread, set, starlark.Tuple{iter}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("colliding-duplicates", func(t *testing.T) {
+		// Int hash only uses the least 32 bits, so these keys all
+		// share a bucket list, of which each bucket holds 8 entries.
+		const occupancy = 64
+		key := func(i int) starlark.Value {
+			return starlark.MakeInt64(int64(i) << 32)
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Detecting each duplicate of the last key inserted probes every
+		// bucket in the list, on top of the step for iteration.
+		st.SetMinSteps(1 + occupancy/8)
+		st.SetMaxSteps(1 + occupancy/8 + 1)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					if n < occupancy {
+						return key(n), nil
+					}
+					return key(occupancy - 1), nil
 				},
-				maxN: st.N,
+				maxN: occupancy + st.N,
 			}
 			_, err := starlark.Call(thread, set, starlark.Tuple{iter}, nil)
 			if err != nil {
@@ -4044,6 +5447,33 @@ func TestSetAllocs(t *testing.T) {
 			st.KeepAlive(result)
 		})
 	})
+
+	t.Run("early-termination", func(t *testing.T) {
+		// Each element retained costs at least a word, so the budget
+		// admits only a bounded number of them.
+		const maxAllocs = 2000
+		const maxElems = maxAllocs / 8
+
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(maxAllocs)
+
+		var nReached int
+		iter := &testIterable{
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				nReached = n
+				return starlark.MakeInt(n), nil
+			},
+		}
+		_, err := starlark.Call(thread, set, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if nReached > maxElems {
+			t.Errorf("iteration was not terminated early enough: reached %d", nReached)
+		}
+	})
 }
 
 func TestSetCancellation(t *testing.T) {
@@ -4148,6 +5578,29 @@ func TestSortedSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("set", func(t *testing.T) {
+		const setSize = 100
+		set := starlark.NewSet(setSize)
+		for i := 0; i < setSize; i++ {
+			if err := set.Insert(starlark.MakeInt(-i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		set.Freeze()
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(setSize)               // Each element is visited.
+		st.SetMaxSteps(setSize + setSize*7*2) // Comparisons are O(n log n).
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				if _, err := starlark.Call(thread, sorted, starlark.Tuple{set}, nil); err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
 }
 
 func TestSortedAllocs(t *testing.T) {
@@ -4242,6 +5695,75 @@ func TestSortedAllocs(t *testing.T) {
 		})
 	})
 
+	t.Run("set", func(t *testing.T) {
+		const n = 1000
+		set := starlark.NewSet(n)
+		for i := 0; i < n; i++ {
+			if err := set.Insert(starlark.MakeInt(-i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		set.Freeze()
+
+		t.Run("resources", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunThread(func(thread *starlark.Thread) {
+				for i := 0; i < st.N; i++ {
+					result, err := starlark.Call(thread, sorted, starlark.Tuple{set}, nil)
+					if err != nil {
+						st.Error(err)
+					}
+					st.KeepAlive(result)
+				}
+			})
+		})
+
+		t.Run("single-list", func(t *testing.T) {
+			// The elements are gathered directly into the result, sized
+			// from the length of the set, without an intermediate copy.
+			thread := &starlark.Thread{}
+			if _, err := starlark.Call(thread, sorted, starlark.Tuple{set}, nil); err != nil {
+				t.Fatal(err)
+			}
+			allocs, _ := thread.Allocs()
+			listSize := mustInt64(starlark.SafeAdd(
+				starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(n)),
+				starlark.EstimateSize(starlark.List{}),
+			))
+			if allocs > listSize+128 {
+				t.Errorf("too many bytes allocated: got %d, want at most %d", allocs, listSize+128)
+			}
+		})
+	})
+
+	t.Run("key", func(t *testing.T) {
+		identity := starlark.NewBuiltinWithSafety("identity", starlark.MemSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				return args[0], nil
+			})
+
+		const n = 100
+		elems := make(starlark.Tuple, n)
+		for i := range elems {
+			elems[i] = starlark.MakeInt(i)
+		}
+		allocs := func(kwargs []starlark.Tuple) int64 {
+			thread := &starlark.Thread{}
+			if _, err := starlark.Call(thread, sorted, starlark.Tuple{elems}, kwargs); err != nil {
+				t.Fatal(err)
+			}
+			allocs, _ := thread.Allocs()
+			return allocs
+		}
+		// The keys derived from the values are accounted for.
+		keyed := allocs([]starlark.Tuple{{starlark.String("key"), identity}})
+		unkeyed := allocs(nil)
+		if minKeysSize := mustInt64(starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(n))); keyed-unkeyed < minKeysSize {
+			t.Errorf("keys not accounted for: got %d bytes, want at least %d", keyed-unkeyed, minKeysSize)
+		}
+	})
+
 	t.Run("early-termination", func(t *testing.T) {
 		maxAllocs := int64(16)
 
@@ -4310,6 +5832,33 @@ func TestSortedAllocs(t *testing.T) {
 			})
 		})
 	})
+
+	t.Run("early-termination", func(t *testing.T) {
+		// Each element retained costs at least a word, so the budget
+		// admits only a bounded number of them.
+		const maxAllocs = 2000
+		const maxElems = maxAllocs / 8
+
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(maxAllocs)
+
+		var nReached int
+		iter := &testIterable{
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				nReached = n
+				return starlark.MakeInt(n), nil
+			},
+		}
+		_, err := starlark.Call(thread, sorted, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if nReached > maxElems {
+			t.Errorf("iteration was not terminated early enough: reached %d", nReached)
+		}
+	})
 }
 
 func TestSortedCancellation(t *testing.T) {
@@ -4353,6 +5902,51 @@ func TestSortedCancellation(t *testing.T) {
 	})
 }
 
+func TestSortedUnorderable(t *testing.T) {
+	t.Run("error", func(t *testing.T) {
+		tests := []struct {
+			src string
+			err string
+		}{
+			{`sorted([1, "a", 2])`, "string < int not implemented"},
+			{`sorted([(1, 1), (1, "a")])`, "string < int not implemented"},
+			{`max([1, "a", 2])`, "max: string > int not implemented"},
+			{`min([1, "a", 2])`, "min: string < int not implemented"},
+		}
+		for _, test := range tests {
+			_, err := starlark.Eval(&starlark.Thread{}, "unorderable.star", test.src, nil)
+			if err == nil {
+				t.Errorf("%s: expected error", test.src)
+			} else if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: unexpected error: %v", test.src, err)
+			}
+		}
+	})
+
+	t.Run("prompt", func(t *testing.T) {
+		// The sort stops at the first comparison of incompatible
+		// elements, however many elements remain to be sorted.
+		elems := make([]starlark.Value, 100_000)
+		for i := range elems {
+			elems[i] = starlark.MakeInt(i)
+		}
+		elems[1] = starlark.String("a")
+		thread := &starlark.Thread{}
+		predeclared := starlark.StringDict{"elems": starlark.NewList(elems)}
+		_, err := starlark.Eval(thread, "unorderable.star", "sorted(elems)", predeclared)
+		if err == nil {
+			t.Fatal("expected error")
+		} else if !strings.Contains(err.Error(), "string < int not implemented") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// Collecting the elements costs a step each, but sorting stops
+		// almost immediately.
+		if steps, _ := thread.Steps(); steps > int64(len(elems))+100 {
+			t.Errorf("sort did not stop promptly: %d steps", steps)
+		}
+	})
+}
+
 func TestStrSteps(t *testing.T) {
 	testWriteValueSteps(t, "str", 0, false, []writeValueStepTest{{
 		name:  "String",
@@ -4482,6 +6076,20 @@ func TestTupleSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("list", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			list := starlark.NewList(make([]starlark.Value, st.N))
+			_, err := starlark.Call(thread, tuple, starlark.Tuple{list}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
 }
 
 func TestTupleAllocs(t *testing.T) {
@@ -5038,56 +6646,255 @@ func TestZipCancellation(t *testing.T) {
 		})
 	})
 
-	t.Run("many-columns", func(t *testing.T) {
-		t.Run("iterable", func(t *testing.T) {
-			st := startest.From(t)
-			st.RequireSafety(starlark.TimeSafe)
-			st.SetMaxSteps(0)
-			st.RunThread(func(thread *starlark.Thread) {
-				thread.Cancel("done")
-				iter := &testIterable{
-					nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
-						return starlark.None, nil
-					},
-					maxN: st.N,
-				}
-				cols := make(starlark.Tuple, st.N)
-				for i := 0; i < st.N; i++ {
-					cols[i] = iter
-				}
-				_, err := starlark.Call(thread, zip, cols, nil)
-				if err == nil {
-					st.Error("expected cancellation")
-				} else if !isStarlarkCancellation(err) {
-					st.Errorf("expected cancellation, got: %v", err)
-				}
-			})
-		})
+	t.Run("many-columns", func(t *testing.T) {
+		t.Run("iterable", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.TimeSafe)
+			st.SetMaxSteps(0)
+			st.RunThread(func(thread *starlark.Thread) {
+				thread.Cancel("done")
+				iter := &testIterable{
+					nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+						return starlark.None, nil
+					},
+					maxN: st.N,
+				}
+				cols := make(starlark.Tuple, st.N)
+				for i := 0; i < st.N; i++ {
+					cols[i] = iter
+				}
+				_, err := starlark.Call(thread, zip, cols, nil)
+				if err == nil {
+					st.Error("expected cancellation")
+				} else if !isStarlarkCancellation(err) {
+					st.Errorf("expected cancellation, got: %v", err)
+				}
+			})
+		})
+
+		t.Run("sequence", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.TimeSafe)
+			st.SetMaxSteps(0)
+			st.RunThread(func(thread *starlark.Thread) {
+				thread.Cancel("done")
+				iter := &testSequence{
+					nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+						return starlark.None, nil
+					},
+					maxN: st.N,
+				}
+				cols := make(starlark.Tuple, st.N)
+				for i := 0; i < st.N; i++ {
+					cols[i] = iter
+				}
+				_, err := starlark.Call(thread, zip, cols, nil)
+				if err == nil {
+					st.Error("expected cancellation")
+				} else if !isStarlarkCancellation(err) {
+					st.Errorf("expected cancellation, got: %v", err)
+				}
+			})
+		})
+	})
+}
+
+func TestZipLongestSteps(t *testing.T) {
+	zip_longest, ok := starlark.Universe["zip_longest"]
+	if !ok {
+		t.Fatal("no such builtin: zip_longest")
+	}
+
+	t.Run("safety-respected", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+
+		iter := &unsafeTestIterable{t}
+		result, err := starlark.Call(thread, zip_longest, starlark.Tuple{iter}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := starlark.SafeIterate(thread, result); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		// Nothing is iterated until the result is.
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMaxSteps(0)
+		st.RunThread(func(thread *starlark.Thread) {
+			nth := func(*starlark.Thread, int) (starlark.Value, error) {
+				return starlark.None, nil
+			}
+			iter := &testIterable{maxN: st.N, nth: nth}
+			if _, err := starlark.Call(thread, zip_longest, starlark.Tuple{iter}, nil); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("uneven", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Each row costs a step per column and one to yield it, and
+		// each element taken from a source costs one more.
+		st.SetMinSteps(4)
+		st.SetMaxSteps(5)
+		st.RunThread(func(thread *starlark.Thread) {
+			nth := func(_ *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.None, nil
+			}
+			long := &testIterable{maxN: st.N, nth: nth}
+			short := &testIterable{maxN: (st.N + 1) / 2, nth: nth}
+			result, err := starlark.Call(thread, zip_longest, starlark.Tuple{long, short}, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			rows, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer rows.Done()
+			var row starlark.Value
+			for rows.Next(&row) {
+			}
+			if err := rows.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("unbounded", func(t *testing.T) {
+		// An unbounded source can be zipped, as only the rows which
+		// are taken are computed.
+		const n = 10
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(1000)
+		nth := func(_ *starlark.Thread, i int) (starlark.Value, error) {
+			return starlark.MakeInt(i), nil
+		}
+		unbounded := &testIterable{maxN: 0, nth: nth}
+		result, err := starlark.Call(thread, zip_longest, starlark.Tuple{unbounded, starlark.NewList(nil)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := starlark.SafeIterate(thread, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Done()
+		var row starlark.Value
+		for i := 0; i < n; i++ {
+			if !rows.Next(&row) {
+				t.Fatalf("iteration stopped early: %v", rows.Err())
+			}
+			want := starlark.Tuple{starlark.MakeInt(i + 1), starlark.None}
+			if eq, err := starlark.Equal(row, want); err != nil {
+				t.Fatal(err)
+			} else if !eq {
+				t.Errorf("row %d: got %v, want %v", i, row, want)
+			}
+		}
+	})
+}
+
+func TestZipLongestAllocs(t *testing.T) {
+	zip_longest, ok := starlark.Universe["zip_longest"]
+	if !ok {
+		t.Fatal("no such builtin: zip_longest")
+	}
+
+	t.Run("safety-respected", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.MemSafe)
+
+		iter := &unsafeTestIterable{t}
+		result, err := starlark.Call(thread, zip_longest, starlark.Tuple{iter}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := starlark.SafeIterate(thread, result); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("uneven", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			nth := func(*starlark.Thread, int) (starlark.Value, error) {
+				return starlark.True, nil
+			}
+			long := &testIterable{st.N, nth}
+			short := &testSequence{(st.N + 1) / 2, nth}
+			fillvalue := []starlark.Tuple{{starlark.String("fillvalue"), starlark.False}}
+			result, err := starlark.Call(thread, zip_longest, starlark.Tuple{long, short}, fillvalue)
+			if err != nil {
+				st.Fatal(err)
+			}
+			rows, err := starlark.SafeIterate(thread, result)
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer rows.Done()
+			var row starlark.Value
+			for rows.Next(&row) {
+				st.KeepAlive(row)
+			}
+			if err := rows.Err(); err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
+}
+
+func TestBytesCountSteps(t *testing.T) {
+	st := startest.From(t)
+	st.RequireSafety(starlark.CPUSafe)
+	st.SetMinSteps(int64(len("a🍖")))
+	st.SetMaxSteps(int64(len("a🍖")))
+	st.RunThread(func(thread *starlark.Thread) {
+		bytes := starlark.Bytes(strings.Repeat("a🍖", st.N))
+		bytes_count, _ := bytes.Attr("count")
+		if bytes_count == nil {
+			st.Fatal("no such method: bytes.count")
+		}
 
-		t.Run("sequence", func(t *testing.T) {
-			st := startest.From(t)
-			st.RequireSafety(starlark.TimeSafe)
-			st.SetMaxSteps(0)
-			st.RunThread(func(thread *starlark.Thread) {
-				thread.Cancel("done")
-				iter := &testSequence{
-					nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
-						return starlark.None, nil
-					},
-					maxN: st.N,
-				}
-				cols := make(starlark.Tuple, st.N)
-				for i := 0; i < st.N; i++ {
-					cols[i] = iter
-				}
-				_, err := starlark.Call(thread, zip, cols, nil)
-				if err == nil {
-					st.Error("expected cancellation")
-				} else if !isStarlarkCancellation(err) {
-					st.Errorf("expected cancellation, got: %v", err)
-				}
-			})
-		})
+		arg := starlark.Bytes("a")
+		_, err := starlark.Call(thread, bytes_count, starlark.Tuple{arg}, nil)
+		if err != nil {
+			st.Error(err)
+		}
+	})
+}
+
+func TestBytesCountAllocs(t *testing.T) {
+	base := starlark.Bytes(strings.Repeat("aab", 1000))
+	arg := starlark.Bytes("a")
+
+	bytes_count, _ := base.Attr("count")
+	if bytes_count == nil {
+		t.Fatal("no such method: bytes.count")
+	}
+
+	st := startest.From(t)
+	st.RequireSafety(starlark.MemSafe)
+	st.RunThread(func(thread *starlark.Thread) {
+		for i := 0; i < st.N; i++ {
+			result, err := starlark.Call(thread, bytes_count, starlark.Tuple{arg}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+
+			st.KeepAlive(result)
+		}
 	})
 }
 
@@ -5199,6 +7006,239 @@ func TestBytesElemsAllocs(t *testing.T) {
 	})
 }
 
+// testBytesFixSteps tests bytes.startswith and bytes.endswith CPUSafety
+func testBytesFixSteps(t *testing.T, method_name string) {
+	method, _ := starlark.Bytes("foo-bar-foo").Attr(method_name)
+	if method == nil {
+		t.Fatalf("no such method: bytes.%s", method_name)
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(3)
+		st.SetMaxSteps(3)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				args := starlark.Tuple{starlark.Bytes("foo")}
+				_, err := starlark.Call(thread, method, args, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+
+	t.Run("tuple", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(9)
+		st.SetMaxSteps(9)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				needles := starlark.Tuple{
+					starlark.Bytes("absent"),
+					starlark.Bytes("foo"),
+					starlark.Bytes("not present"),
+				}
+				_, err := starlark.Call(thread, method, starlark.Tuple{needles}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func testBytesFixAllocs(t *testing.T, method_name string) {
+	method, _ := starlark.Bytes("foo-bar-foo").Attr(method_name)
+	if method == nil {
+		t.Fatalf("no such method: bytes.%s", method_name)
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.SetMaxAllocs(0)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				args := starlark.Tuple{starlark.Bytes("foo")}
+				result, err := starlark.Call(thread, method, args, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			}
+		})
+	})
+
+	t.Run("tuple", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.SetMaxAllocs(0)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				fixesToCheck := starlark.Tuple{
+					starlark.Bytes("absent"),
+					starlark.Bytes("foo"),
+					starlark.Bytes("not present"),
+				}
+				result, err := starlark.Call(thread, method, starlark.Tuple{fixesToCheck}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			}
+		})
+	})
+}
+
+func TestBytesEndswithSteps(t *testing.T) {
+	testBytesFixSteps(t, "endswith")
+}
+
+func TestBytesEndswithAllocs(t *testing.T) {
+	testBytesFixAllocs(t, "endswith")
+}
+
+func testBytesFindMethodSteps(t *testing.T, name string) {
+	t.Run("small", func(t *testing.T) {
+		haystack := starlark.Bytes("Was it a car or a cat I saw?")
+		needle := starlark.Bytes("or")
+		method, _ := haystack.Attr(name)
+		if method == nil {
+			t.Fatalf("no such method: bytes.%s", name)
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(15)
+		st.SetMaxSteps(15)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, method, starlark.Tuple{needle}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+
+	t.Run("big", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			haystack := starlark.Bytes("a" + strings.Repeat(" ", st.N) + "b")
+			method, _ := haystack.Attr(name)
+			if method == nil {
+				t.Fatalf("no such method: bytes.%s", name)
+			}
+
+			needle := starlark.Bytes("a")
+			_, err := starlark.Call(thread, method, starlark.Tuple{needle}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+
+			needle = starlark.Bytes("b")
+			_, err = starlark.Call(thread, method, starlark.Tuple{needle}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
+}
+
+func testBytesFindMethodAllocs(t *testing.T, name string) {
+	haystack := starlark.Bytes("Better safe than sorry")
+	needle := starlark.Bytes("safe")
+
+	bytes_find, _ := haystack.Attr(name)
+	if bytes_find == nil {
+		t.Fatalf("no such method: bytes.%s", name)
+	}
+
+	st := startest.From(t)
+	st.RequireSafety(starlark.MemSafe)
+	st.RunThread(func(thread *starlark.Thread) {
+		for i := 0; i < st.N; i++ {
+			result, err := starlark.Call(thread, bytes_find, starlark.Tuple{needle}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		}
+	})
+}
+
+func TestBytesFindSteps(t *testing.T) {
+	testBytesFindMethodSteps(t, "find")
+}
+
+func TestBytesFindAllocs(t *testing.T) {
+	testBytesFindMethodAllocs(t, "find")
+}
+
+func TestBytesIndexSteps(t *testing.T) {
+	testBytesFindMethodSteps(t, "index")
+}
+
+func TestBytesIndexAllocs(t *testing.T) {
+	testBytesFindMethodAllocs(t, "index")
+}
+
+func TestBytesReplaceSteps(t *testing.T) {
+	st := startest.From(t)
+	st.RequireSafety(starlark.CPUSafe)
+	st.SetMinSteps(int64(len("deadbeef") + len("dead🍖🍖")))
+	st.SetMaxSteps(int64(len("deadbeef") + len("dead🍖🍖")))
+	st.RunThread(func(thread *starlark.Thread) {
+		bytes := starlark.Bytes(strings.Repeat("deadbeef", st.N))
+		bytes_replace, _ := bytes.Attr("replace")
+		if bytes_replace == nil {
+			st.Fatal("no such method: bytes.replace")
+		}
+
+		toReplace := starlark.Bytes("beef")
+		replacement := starlark.Bytes("🍖🍖")
+		_, err := starlark.Call(thread, bytes_replace, starlark.Tuple{toReplace, replacement}, nil)
+		if err != nil {
+			st.Error(err)
+		}
+	})
+}
+
+func TestBytesReplaceAllocs(t *testing.T) {
+	st := startest.From(t)
+	st.RequireSafety(starlark.MemSafe)
+	st.RunThread(func(thread *starlark.Thread) {
+		bytes := starlark.Bytes(strings.Repeat("deadbeef", st.N))
+		toReplace := starlark.Bytes("beef")
+		replacement := starlark.Bytes("🍖")
+
+		fn, _ := bytes.Attr("replace")
+		if fn == nil {
+			st.Fatal("no such method: bytes.replace")
+		}
+
+		result, err := starlark.Call(thread, fn, starlark.Tuple{toReplace, replacement}, nil)
+		if err != nil {
+			st.Error(err)
+		}
+		st.KeepAlive(result)
+	})
+}
+
+func TestBytesStartswithSteps(t *testing.T) {
+	testBytesFixSteps(t, "startswith")
+}
+
+func TestBytesStartswithAllocs(t *testing.T) {
+	testBytesFixAllocs(t, "startswith")
+}
+
 func TestDictClearSteps(t *testing.T) {
 	const dictSize = 200
 
@@ -5813,6 +7853,21 @@ func TestDictPopSteps(t *testing.T) {
 				}
 			})
 		})
+
+		t.Run("script", func(t *testing.T) {
+			st := startest.From(t)
+			st.RequireSafety(starlark.CPUSafe)
+			// Both the removal and the reinsertion probe every bucket.
+			st.SetMinSteps(2 * (dictSize / 8))
+			st.SetMaxSteps(2*(dictSize/8) + 20)
+			st.AddValue("d", dict)
+			st.AddValue("key", starlark.MakeInt64((dictSize-1)<<32))
+			st.RunString(`
+				for _ in st.ntimes():
+					d.pop(key)
+					d[key] = None
+			`)
+		})
 	})
 }
 
@@ -6183,6 +8238,131 @@ func TestDictSetdefaultCancellation(t *testing.T) {
 	})
 }
 
+func TestDictSortedKeysSteps(t *testing.T) {
+	t.Run("sorted", func(t *testing.T) {
+		dict := starlark.NewDict(0)
+		dict_sorted_keys, _ := dict.Attr("sorted_keys")
+		if dict_sorted_keys == nil {
+			t.Fatal("no such method: dict.sorted_keys")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := dict.Len(); i < st.N; i++ {
+				dict.SetKey(starlark.MakeInt(i), starlark.None)
+			}
+			_, err := starlark.Call(thread, dict_sorted_keys, nil, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("unsorted", func(t *testing.T) {
+		const dictSize = 100
+
+		dict := starlark.NewDict(dictSize)
+		for i := 0; i < dictSize; i++ {
+			dict.SetKey(starlark.MakeInt(-i), starlark.None)
+		}
+		dict_sorted_keys, _ := dict.Attr("sorted_keys")
+		if dict_sorted_keys == nil {
+			t.Fatal("no such method: dict.sorted_keys")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(dictSize * 2)            // Each key is visited and moved.
+		st.SetMaxSteps(dictSize + dictSize*7*2) // Comparisons are O(n log n).
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, dict_sorted_keys, nil, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestDictSortedKeysAllocs(t *testing.T) {
+	const dictSize = 100
+
+	dict := starlark.NewDict(dictSize)
+	for i := 0; i < dictSize; i++ {
+		dict.SetKey(starlark.MakeInt(-i), starlark.None)
+	}
+	dict_sorted_keys, _ := dict.Attr("sorted_keys")
+	if dict_sorted_keys == nil {
+		t.Fatal("no such method: dict.sorted_keys")
+	}
+
+	t.Run("resources", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				result, err := starlark.Call(thread, dict_sorted_keys, nil, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			}
+		})
+	})
+
+	t.Run("single-allocation", func(t *testing.T) {
+		// Sorting happens in place, so the result costs the same as dict.keys.
+		run := func(method string) (allocs int64, count uint64) {
+			fn, _ := dict.Attr(method)
+			if fn == nil {
+				t.Fatalf("no such method: dict.%s", method)
+			}
+			thread := &starlark.Thread{}
+			if _, err := starlark.Call(thread, fn, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			allocs, _ = thread.Allocs()
+			return allocs, thread.AllocCount()
+		}
+		keysAllocs, keysCount := run("keys")
+		allocs, count := run("sorted_keys")
+		if count != keysCount {
+			t.Errorf("unexpected allocation count: got %d, want %d", count, keysCount)
+		}
+		if allocs != keysAllocs {
+			t.Errorf("unexpected allocation size: got %d, want %d", allocs, keysAllocs)
+		}
+	})
+}
+
+func TestDictSortedKeysCancellation(t *testing.T) {
+	dict := starlark.NewDict(0)
+	dict_sorted_keys, _ := dict.Attr("sorted_keys")
+	if dict_sorted_keys == nil {
+		t.Fatal("no such method: dict.sorted_keys")
+	}
+
+	st := startest.From(t)
+	st.RequireSafety(starlark.TimeSafe)
+	st.SetMaxSteps(0)
+	st.RunThread(func(thread *starlark.Thread) {
+		thread.Cancel("done")
+		for i := dict.Len(); i < st.N; i++ {
+			dict.SetKey(starlark.MakeInt(-i), starlark.None)
+		}
+		_, err := starlark.Call(thread, dict_sorted_keys, nil, nil)
+		if err == nil {
+			st.Error("expected cancellation")
+		} else if !isStarlarkCancellation(err) {
+			st.Errorf("expected cancellation, got: %v", err)
+		}
+	})
+}
+
 func TestDictUpdateSteps(t *testing.T) {
 	t.Run("safety-respected", func(t *testing.T) {
 		dict := starlark.NewDict(0)
@@ -6511,6 +8691,60 @@ func TestListAppendAllocs(t *testing.T) {
 	})
 }
 
+func TestListAppendFromScript(t *testing.T) {
+	t.Run("resources", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		st.SetMinSteps(1)
+		lst := starlark.NewList(nil)
+		st.AddValue("lst", lst)
+		st.RunString(`
+			for _ in st.ntimes():
+				lst.append(None)
+		`)
+		st.KeepAlive(lst)
+	})
+
+	t.Run("consistency", func(t *testing.T) {
+		// Appending from a script costs what calling the bound method
+		// does, plus the copy of the arguments made by the interpreter.
+		scriptAllocs := func(n int) int64 {
+			src := starlark.NewList(make([]starlark.Value, n))
+			thread := &starlark.Thread{}
+			predeclared := starlark.StringDict{"src": src, "lst": starlark.NewList(nil)}
+			_, err := starlark.ExecFile(thread, "append.star", "def f():\n\tfor _ in src:\n\t\tlst.append(None)\nf()\n", predeclared)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allocs, _ := thread.Allocs()
+			return allocs
+		}
+		directAllocs := func(n int) int64 {
+			thread := &starlark.Thread{}
+			lst := starlark.NewList(nil)
+			for i := 0; i < n; i++ {
+				list_append, err := lst.SafeAttr(thread, "append")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := starlark.Call(thread, list_append, starlark.Tuple{starlark.None}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			allocs, _ := thread.Allocs()
+			return allocs
+		}
+
+		const n = 1000
+		scriptCost := scriptAllocs(2*n) - scriptAllocs(n)
+		directCost := directAllocs(2*n) - directAllocs(n)
+		argsCost := mustInt64(starlark.SafeMul(starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(1)), n))
+		if scriptCost != directCost+argsCost {
+			t.Errorf("unexpected cost of %d appends from a script: got %d, want %d", n, scriptCost, directCost+argsCost)
+		}
+	})
+}
+
 func TestListClearSteps(t *testing.T) {
 	st := startest.From(t)
 	st.RequireSafety(starlark.CPUSafe)
@@ -6923,6 +9157,38 @@ func TestListIndexSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("composite", func(t *testing.T) {
+		const tupleSize = 100
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The step cost per N is:
+		// - For the top-level scan, 1
+		// - For comparing tuple contents, tupleSize
+		st.SetMinSteps(tupleSize + 1)
+		st.SetMaxSteps(tupleSize + 1)
+		st.RunThread(func(thread *starlark.Thread) {
+			listElems := make([]starlark.Value, st.N)
+			for i := range listElems {
+				tuple := make(starlark.Tuple, tupleSize)
+				for j := 0; j < tupleSize-1; j++ {
+					tuple[j] = starlark.MakeInt(j)
+				}
+				tuple[tupleSize-1] = starlark.MakeInt(i) // Differ only in last element
+				listElems[i] = tuple
+			}
+			list := starlark.NewList(listElems)
+			list_index, _ := list.Attr("index")
+			if list_index == nil {
+				st.Fatal("no such method: list.index")
+			}
+			_, err := starlark.Call(thread, list_index, starlark.Tuple{listElems[st.N-1]}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
 }
 
 func TestListIndexAllocs(t *testing.T) {
@@ -7085,6 +9351,24 @@ func TestListPopSteps(t *testing.T) {
 		})
 	})
 
+	t.Run("leading-script", func(t *testing.T) {
+		list := starlark.NewList(make([]starlark.Value, 0, listSize))
+		for i := 0; i < listSize; i++ {
+			list.Append(starlark.None)
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(listSize)
+		st.SetMaxSteps(listSize + 20)
+		st.AddValue("lst", list)
+		st.RunString(`
+			for _ in st.ntimes():
+				lst.pop(0)
+				lst.append(None)
+		`)
+	})
+
 	t.Run("trailing", func(t *testing.T) {
 		list := starlark.NewList(make([]starlark.Value, 0, listSize))
 		for i := 0; i < listSize; i++ {
@@ -7398,6 +9682,104 @@ func TestStringCodepointsAllocs(t *testing.T) {
 	testStringIterableAllocs(t, "codepoints")
 }
 
+func TestListOfCodepoints(t *testing.T) {
+	list, ok := starlark.Universe["list"]
+	if !ok {
+		t.Fatal("no such builtin: list")
+	}
+	const text = "añ🍖\xff"
+
+	t.Run("elements", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		codepoints, _ := starlark.String(text).Attr("codepoints")
+		iterable, err := starlark.Call(thread, codepoints, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := starlark.Call(thread, list, starlark.Tuple{iterable}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const expect = "[\"a\", \"ñ\", \"🍖\", \"\ufffd\"]"
+		if s := result.String(); s != expect {
+			t.Errorf("unexpected result: got %s, want %s", s, expect)
+		}
+		if n := result.(*starlark.List).Len(); n != 4 {
+			t.Errorf("unexpected length: got %d, want 4", n)
+		}
+
+		// Strings themselves are not iterable.
+		if _, err := starlark.Call(thread, list, starlark.Tuple{starlark.String(text)}, nil); err == nil {
+			t.Error("expected error")
+		} else if !strings.Contains(err.Error(), "got string, want iterable") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Each code point, however many bytes encode it, costs a step
+		// to yield and another to append. Sizing the list up front
+		// costs a step per byte.
+		st.SetMinSteps(2*4 + int64(len(text)))
+		st.SetMaxSteps(2*4 + int64(len(text)))
+		st.RunThread(func(thread *starlark.Thread) {
+			codepoints, _ := starlark.String(strings.Repeat(text, st.N)).Attr("codepoints")
+			iterable, err := starlark.Call(thread, codepoints, nil, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			if _, err := starlark.Call(thread, list, starlark.Tuple{iterable}, nil); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			codepoints, _ := starlark.String(strings.Repeat(text, st.N)).Attr("codepoints")
+			iterable, err := starlark.Call(thread, codepoints, nil, nil)
+			if err != nil {
+				st.Fatal(err)
+			}
+			result, err := starlark.Call(thread, list, starlark.Tuple{iterable}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
+
+	t.Run("presized", func(t *testing.T) {
+		// The elements array is allocated once, to fit the code points.
+		const n = 100
+		thread := &starlark.Thread{}
+		codepoints, _ := starlark.String(strings.Repeat(text, n)).Attr("codepoints")
+		iterable, err := starlark.Call(thread, codepoints, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before, _ := thread.Allocs()
+		if _, err := starlark.Call(thread, list, starlark.Tuple{iterable}, nil); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := thread.Allocs()
+		expected := starlark.SafeAdd(
+			starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(4*n)),
+			starlark.SafeAdd(
+				starlark.SafeMul(starlark.StringTypeOverhead, 4*n),
+				starlark.EstimateSize(&starlark.List{}),
+			),
+		)
+		if want := mustInt64(expected); after-before != want {
+			t.Errorf("unexpected allocations: got %d, want %d", after-before, want)
+		}
+	})
+}
+
 func TestStringCountSteps(t *testing.T) {
 	st := startest.From(t)
 	st.RequireSafety(starlark.CPUSafe)
@@ -7418,6 +9800,86 @@ func TestStringCountSteps(t *testing.T) {
 	})
 }
 
+func TestStringCountOverlapping(t *testing.T) {
+	t.Run("counts", func(t *testing.T) {
+		str := starlark.String(strings.Repeat("ab", 10) + "a")
+		string_count, _ := str.Attr("count")
+		if string_count == nil {
+			t.Fatal("no such method: string.count")
+		}
+		tests := []struct {
+			sub         string
+			overlapping bool
+			want        int
+		}{
+			{"aba", false, 5},
+			{"aba", true, 10},
+			{"a", false, 11},
+			{"a", true, 11},
+			{"", false, 22},
+			{"", true, 22},
+		}
+		for _, test := range tests {
+			kwargs := []starlark.Tuple{{starlark.String("overlapping"), starlark.Bool(test.overlapping)}}
+			result, err := starlark.Call(&starlark.Thread{}, string_count, starlark.Tuple{starlark.String(test.sub)}, kwargs)
+			if err != nil {
+				t.Errorf("count(%q, overlapping=%t): %v", test.sub, test.overlapping, err)
+				continue
+			}
+			if n, err := starlark.AsInt32(result); err != nil {
+				t.Error(err)
+			} else if n != test.want {
+				t.Errorf("count(%q, overlapping=%t): got %d, want %d", test.sub, test.overlapping, n, test.want)
+			}
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(int64(len("ab")))
+		st.SetMaxSteps(int64(len("ab")))
+		st.RunThread(func(thread *starlark.Thread) {
+			str := starlark.String(strings.Repeat("ab", st.N))
+			string_count, _ := str.Attr("count")
+			if string_count == nil {
+				st.Fatal("no such method: string.count")
+			}
+
+			kwargs := []starlark.Tuple{{starlark.String("overlapping"), starlark.True}}
+			_, err := starlark.Call(thread, string_count, starlark.Tuple{starlark.String("abab")}, kwargs)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("long-sub", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The search is linear, so the length of sub does not add to
+		// the cost of scanning the receiver.
+		st.SetMinSteps(2)
+		st.SetMaxSteps(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			str := starlark.String(strings.Repeat("a", 2*st.N))
+			string_count, _ := str.Attr("count")
+			if string_count == nil {
+				st.Fatal("no such method: string.count")
+			}
+
+			sub := starlark.String(strings.Repeat("a", st.N))
+			kwargs := []starlark.Tuple{{starlark.String("overlapping"), starlark.True}}
+			result, err := starlark.Call(thread, string_count, starlark.Tuple{sub}, kwargs)
+			if err != nil {
+				st.Error(err)
+			} else if result != starlark.MakeInt(st.N+1) {
+				st.Errorf("unexpected count: got %v, want %d", result, st.N+1)
+			}
+		})
+	})
+}
+
 func TestStringCountAllocs(t *testing.T) {
 	base := starlark.String(strings.Repeat("aab", 1000))
 	arg := starlark.String("a")
@@ -7832,6 +10294,44 @@ func TestStringFormatSteps(t *testing.T) {
 		})
 	})
 
+	t.Run("width", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			format := starlark.String(fmt.Sprintf("{:>%d}", st.N))
+			string_format, _ := format.Attr("format")
+			if string_format == nil {
+				st.Fatal("no such method: string.format")
+			}
+			result, err := starlark.Call(thread, string_format, starlark.Tuple{starlark.String("a")}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
+
+	t.Run("precision", func(t *testing.T) {
+		// The digits are charged once when formatted and once when written.
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(2)
+		st.SetMaxSteps(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			format := starlark.String(fmt.Sprintf("{:.%df}", st.N))
+			string_format, _ := format.Attr("format")
+			if string_format == nil {
+				st.Fatal("no such method: string.format")
+			}
+			result, err := starlark.Call(thread, string_format, starlark.Tuple{starlark.Float(1)}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
 }
 
 func TestStringFormatAllocs(t *testing.T) {
@@ -7894,7 +10394,71 @@ func TestStringFormatAllocs(t *testing.T) {
 				}
 				st.KeepAlive(result)
 			}
-		})
+		})
+	})
+
+	t.Run("spec", func(t *testing.T) {
+		for _, template := range []string{"{:>%d}", "{:^%d}", "{:<%d}", "{:0%d.2f}", "{:.%d%%}"} {
+			st := startest.From(t)
+			st.RequireSafety(starlark.MemSafe)
+			st.RunThread(func(thread *starlark.Thread) {
+				format := starlark.String(fmt.Sprintf(template, st.N))
+				fn, _ := format.Attr("format")
+				if fn == nil {
+					st.Fatal("no such method: string.format")
+				}
+				result, err := starlark.Call(thread, fn, starlark.Tuple{starlark.Float(1.5)}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			})
+		}
+	})
+
+	t.Run("huge-width", func(t *testing.T) {
+		const maxAllocs = 1 << 20
+
+		for _, format := range []starlark.String{"{:>1000000000}", "{:.1000000000f}"} {
+			thread := &starlark.Thread{}
+			thread.SetMaxAllocs(maxAllocs)
+			fn, _ := format.Attr("format")
+			if fn == nil {
+				t.Fatal("no such method: string.format")
+			}
+			_, err := starlark.Call(thread, fn, starlark.Tuple{starlark.Float(1)}, nil)
+			if err == nil {
+				t.Errorf("%s: expected error", format)
+			} else if !errors.Is(err, starlark.ErrSafety) {
+				t.Errorf("%s: unexpected error: %v", format, err)
+			}
+			if allocs, _ := thread.Allocs(); allocs > maxAllocs {
+				t.Errorf("%s: allocations exceeded the limit: %d > %d", format, allocs, maxAllocs)
+			}
+			// The padding is rejected before it is written.
+			if steps, _ := thread.Steps(); steps > maxAllocs {
+				t.Errorf("%s: too many steps taken before aborting: %d", format, steps)
+			}
+		}
+	})
+
+	t.Run("huge-width-single-alloc", func(t *testing.T) {
+		const maxSingleAlloc = 1 << 20
+
+		for _, format := range []starlark.String{"{:1000000000}", "{:*^1000000000}"} {
+			thread := &starlark.Thread{}
+			thread.SetMaxSingleAlloc(maxSingleAlloc)
+			fn, _ := format.Attr("format")
+			if fn == nil {
+				t.Fatal("no such method: string.format")
+			}
+			_, err := starlark.Call(thread, fn, starlark.Tuple{starlark.MakeInt(1)}, nil)
+			if err == nil {
+				t.Errorf("%s: expected error", format)
+			} else if !errors.Is(err, starlark.ErrSafety) {
+				t.Errorf("%s: unexpected error: %v", format, err)
+			}
+		}
 	})
 }
 
@@ -8356,6 +10920,32 @@ func TestStringJoinSteps(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("multibyte-separator", func(t *testing.T) {
+		const sep = "→·→"
+		string_join, _ := starlark.String(sep).Attr("join")
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The step cost per N is:
+		// - For iterating over the receiver, 1
+		// - For writing the separator, 1 for each of its bytes
+		// - For writing the element, 1 for each of its bytes
+		st.SetMinSteps(int64(1 + len(sep) + len("bé")))
+		st.SetMaxSteps(int64(1 + len(sep) + len("bé")))
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := &testIterable{
+				maxN: st.N,
+				nth: func(_ *starlark.Thread, _ int) (starlark.Value, error) {
+					return starlark.String("bé"), nil
+				},
+			}
+			_, err := starlark.Call(thread, string_join, starlark.Tuple{iter}, nil)
+			if err != nil {
+				st.Error(err)
+			}
+		})
+	})
 }
 
 func TestStringJoinAllocs(t *testing.T) {
@@ -8415,6 +11005,29 @@ func TestStringJoinAllocs(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("large-separator", func(t *testing.T) {
+		// Copies of the separator are charged as output, so a large
+		// separator joining many small elements is bounded.
+		const sepSize = 1 << 20
+		string_join, _ := starlark.String(strings.Repeat("-", sepSize)).Attr("join")
+		elems := make(starlark.Tuple, 1000)
+		for i := range elems {
+			elems[i] = starlark.String("")
+		}
+
+		thread := &starlark.Thread{}
+		thread.SetMaxAllocs(16 * sepSize)
+		_, err := starlark.Call(thread, string_join, starlark.Tuple{elems}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if steps, _ := thread.Steps(); steps > 32*sepSize {
+			t.Errorf("too many steps taken before rejecting the join: %d", steps)
+		}
+	})
 }
 
 func TestStringJoinCancellation(t *testing.T) {
@@ -8458,6 +11071,46 @@ func TestStringJoinCancellation(t *testing.T) {
 	})
 }
 
+func TestStringJoinByteBudget(t *testing.T) {
+	string_join, _ := starlark.String(",").Attr("join")
+	if string_join == nil {
+		t.Fatal("no such method: string.join")
+	}
+	strs := func(n int) starlark.Value {
+		elems := make([]starlark.Value, n)
+		for i := range elems {
+			elems[i] = starlark.String("ab")
+		}
+		return starlark.NewList(elems)
+	}
+
+	t.Run("within-budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxJoinBytes(20)
+		result, err := starlark.Call(thread, string_join, starlark.Tuple{strs(10)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := strings.Repeat("ab,", 9) + "ab"; result != starlark.String(expected) {
+			t.Errorf("unexpected result: got %v, want %q", result, expected)
+		}
+	})
+
+	t.Run("over-budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxJoinBytes(20)
+		_, err := starlark.Call(thread, string_join, starlark.Tuple{strs(11)}, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := thread.Context().Err(); err != context.Canceled {
+			t.Errorf("expected thread to be cancelled, got %v", err)
+		}
+	})
+}
+
 func TestStringLowerSteps(t *testing.T) {
 	t.Run("short", func(t *testing.T) {
 		str := starlark.String("δηαδβηηφ")
@@ -8517,6 +11170,36 @@ func TestStringLowerAllocs(t *testing.T) {
 		})
 	})
 
+	t.Run("ASCII-exact", func(t *testing.T) {
+		const size = 1 << 20
+		str := starlark.String(strings.Repeat("dEaDbEeF", size/8))
+		string_lower, _ := str.Attr("lower")
+		if string_lower == nil {
+			t.Fatalf("no such method: string.lower")
+		}
+
+		// Warm up the thread so that the frame it allocates is not counted.
+		thread := &starlark.Thread{}
+		if _, err := starlark.Call(thread, string_lower, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		allocs0, _ := thread.Allocs()
+		result, err := starlark.Call(thread, string_lower, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := starlark.String(strings.ToLower(string(str))); result != expected {
+			t.Errorf("unexpected result: got %.20s..., want %.20s...", result, expected)
+		}
+
+		expected := starlark.SafeAdd(starlark.EstimateMakeSize([]byte{}, starlark.SafeInt(size)), starlark.StringTypeOverhead)
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Error("alloc count invalidated")
+		} else if expected64, _ := expected.Int64(); allocs-allocs0 != expected64 {
+			t.Errorf("unexpected allocs: got %d, want %d", allocs-allocs0, expected64)
+		}
+	})
+
 	t.Run("Unicode", func(t *testing.T) {
 		st := startest.From(t)
 		st.RequireSafety(starlark.MemSafe)
@@ -8829,8 +11512,8 @@ func TestStringRemovesuffixAllocs(t *testing.T) {
 func TestStringReplaceSteps(t *testing.T) {
 	st := startest.From(t)
 	st.RequireSafety(starlark.CPUSafe)
-	st.SetMinSteps(int64(len("dead🍖🍖")))
-	st.SetMaxSteps(int64(len("dead🍖🍖")))
+	st.SetMinSteps(int64(len("deadbeef") + len("dead🍖🍖")))
+	st.SetMaxSteps(int64(len("deadbeef") + len("dead🍖🍖")))
 	st.RunThread(func(thread *starlark.Thread) {
 		str := starlark.String(strings.Repeat("deadbeef", st.N))
 		string_replace, _ := str.Attr("replace")
@@ -8868,6 +11551,39 @@ func TestStringReplaceAllocs(t *testing.T) {
 	})
 }
 
+func TestStringReplaceCount(t *testing.T) {
+	const repeats = 1000
+	const count = 10
+	str := starlark.String(strings.Repeat("deadbeef", repeats))
+	string_replace, _ := str.Attr("replace")
+	if string_replace == nil {
+		t.Fatal("no such method: string.replace")
+	}
+	args := starlark.Tuple{starlark.String("beef"), starlark.String("🍖🍖"), starlark.MakeInt(count)}
+
+	// Warm up the thread so that the frame it allocates is not counted.
+	thread := &starlark.Thread{}
+	if _, err := starlark.Call(thread, string_replace, args, nil); err != nil {
+		t.Fatal(err)
+	}
+	allocs0, _ := thread.Allocs()
+	result, err := starlark.Call(thread, string_replace, args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced := strings.Count(string(result.(starlark.String)), "🍖🍖"); replaced != count {
+		t.Errorf("unexpected number of replacements: got %d, want %d", replaced, count)
+	}
+
+	resultLen := len(str) + count*(len("🍖🍖")-len("beef"))
+	expected := starlark.SafeAdd(starlark.EstimateMakeSize([]byte{}, starlark.SafeInt(resultLen)), starlark.StringTypeOverhead)
+	if allocs, ok := thread.Allocs(); !ok {
+		t.Error("alloc count invalidated")
+	} else if expected64, _ := expected.Int64(); allocs-allocs0 != expected64 {
+		t.Errorf("unexpected allocs: got %d, want %d", allocs-allocs0, expected64)
+	}
+}
+
 func TestStringRfindSteps(t *testing.T) {
 	testStringFindMethodSteps(t, "rfind")
 }
@@ -9043,6 +11759,55 @@ func testStringSplitCancellation(t *testing.T, methodName string) {
 	})
 }
 
+// testStringSplitMaxsplitAllocs checks that the results of split and rsplit
+// share the bytes of the receiver, so that only the list is ever allocated.
+func testStringSplitMaxsplitAllocs(t *testing.T, methodName string) {
+	const size = 1 << 16
+
+	tests := []struct {
+		name     string
+		sep      starlark.Value
+		maxsplit int
+		len      int
+	}{
+		{"zero", starlark.String(","), 0, 1},
+		{"zero-whitespace", starlark.None, 0, 1},
+		{"one", starlark.String(","), 1, 2},
+		{"one-whitespace", starlark.None, 1, 2},
+		{"few", starlark.String(","), 3, 4},
+		{"few-whitespace", starlark.None, 3, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			run := func(str starlark.String) int64 {
+				method, _ := str.Attr(methodName)
+				if method == nil {
+					t.Fatalf("no such method: string.%s", methodName)
+				}
+
+				thread := &starlark.Thread{}
+				args := starlark.Tuple{test.sep, starlark.MakeInt(test.maxsplit)}
+				result, err := starlark.Call(thread, method, args, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				list := result.(*starlark.List)
+				if list.Len() != test.len {
+					t.Fatalf("unexpected result length: got %d, want %d", list.Len(), test.len)
+				}
+				allocs, _ := thread.Allocs()
+				return allocs
+			}
+
+			small := run(starlark.String(strings.Repeat("a,b ", test.len)))
+			large := run(starlark.String(strings.Repeat("a,b ", size/4)))
+			if large != small {
+				t.Errorf("result copied the receiver: got %d bytes, want %d", large, small)
+			}
+		})
+	}
+}
+
 func TestStringRsplitSteps(t *testing.T) {
 	testStringSplitSteps(t, "rsplit")
 }
@@ -9094,6 +11859,10 @@ func TestStringRsplitAllocs(t *testing.T) {
 			st.KeepAlive(result)
 		})
 	})
+
+	t.Run("maxsplit", func(t *testing.T) {
+		testStringSplitMaxsplitAllocs(t, "rsplit")
+	})
 }
 
 func TestStringRsplitCancellation(t *testing.T) {
@@ -9179,6 +11948,10 @@ func TestStringSplitAllocs(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("maxsplit", func(t *testing.T) {
+		testStringSplitMaxsplitAllocs(t, "split")
+	})
 }
 
 func TestStringSplitCancellation(t *testing.T) {
@@ -9557,6 +12330,36 @@ func TestStringUpperAllocs(t *testing.T) {
 		})
 	})
 
+	t.Run("ASCII-exact", func(t *testing.T) {
+		const size = 1 << 20
+		str := starlark.String(strings.Repeat("dEaDbEeF", size/8))
+		string_upper, _ := str.Attr("upper")
+		if string_upper == nil {
+			t.Fatalf("no such method: string.upper")
+		}
+
+		// Warm up the thread so that the frame it allocates is not counted.
+		thread := &starlark.Thread{}
+		if _, err := starlark.Call(thread, string_upper, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		allocs0, _ := thread.Allocs()
+		result, err := starlark.Call(thread, string_upper, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := starlark.String(strings.ToUpper(string(str))); result != expected {
+			t.Errorf("unexpected result: got %.20s..., want %.20s...", result, expected)
+		}
+
+		expected := starlark.SafeAdd(starlark.EstimateMakeSize([]byte{}, starlark.SafeInt(size)), starlark.StringTypeOverhead)
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Error("alloc count invalidated")
+		} else if expected64, _ := expected.Int64(); allocs-allocs0 != expected64 {
+			t.Errorf("unexpected allocs: got %d, want %d", allocs-allocs0, expected64)
+		}
+	})
+
 	t.Run("Unicode", func(t *testing.T) {
 		st := startest.From(t)
 		st.RequireSafety(starlark.MemSafe)
@@ -10035,7 +12838,167 @@ func TestSetDifferenceCancellation(t *testing.T) {
 					}
 				},
 			}
-			_, err := starlark.Call(thread, set_difference, starlark.Tuple{iter}, nil)
+			_, err := starlark.Call(thread, set_difference, starlark.Tuple{iter}, nil)
+			if err == nil {
+				st.Error("expected cancellation")
+			} else if !isStarlarkCancellation(err) {
+				st.Errorf("expected cancellation, got: %v", err)
+			}
+		})
+	})
+}
+
+func TestSetDifferenceUpdateSteps(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_difference_update, _ := set.Attr("difference_update")
+		if set_difference_update == nil {
+			t.Fatal("no such method: set.difference_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_difference_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("iterable", func(t *testing.T) {
+		const elems = 100
+
+		iter := &testIterable{
+			maxN: elems,
+			nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+				if n%2 == 0 {
+					return starlark.MakeInt(n), nil // in set
+				} else {
+					return starlark.MakeInt(-n), nil // not in set
+				}
+			},
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The step cost per N is:
+		// - For iteration, elems
+		// - For removal, on average elems
+		st.SetMinSteps(2 * elems)
+		st.SetMaxSteps(2 * elems)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				set := starlark.NewSet(elems)
+				for j := 0; j < elems; j++ {
+					set.Insert(starlark.MakeInt(j))
+				}
+				set_difference_update, _ := set.Attr("difference_update")
+				if set_difference_update == nil {
+					st.Fatal("no such method: set.difference_update")
+				}
+				_, err := starlark.Call(thread, set_difference_update, starlark.Tuple{iter}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestSetDifferenceUpdateAllocs(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_difference_update, _ := set.Attr("difference_update")
+		if set_difference_update == nil {
+			t.Fatal("no such method: set.difference_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.MemSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_difference_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("allocation", func(t *testing.T) {
+		const elems = 100
+
+		set := starlark.NewSet(elems)
+		list := starlark.NewList(make([]starlark.Value, 0, elems))
+		for i := 0; i < elems; i++ {
+			set.Insert(starlark.MakeInt(i))
+			list.Append(starlark.MakeInt(-i - 1))
+		}
+		set_difference_update, _ := set.Attr("difference_update")
+		if set_difference_update == nil {
+			t.Fatal("no such method: set.difference_update")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, set_difference_update, starlark.Tuple{list}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestSetDifferenceUpdateCancellation(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_difference_update, _ := set.Attr("difference_update")
+		if set_difference_update == nil {
+			t.Fatal("no such method: set.difference_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.TimeSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_difference_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("iterable", func(t *testing.T) {
+		const elems = 100
+		set := starlark.NewSet(elems)
+		for i := 0; i < elems; i++ {
+			set.Insert(starlark.MakeInt(i))
+		}
+		set_difference_update, _ := set.Attr("difference_update")
+		if set_difference_update == nil {
+			t.Fatal("no such method: set.difference_update")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.TimeSafe)
+		st.SetMaxSteps(0)
+		st.RunThread(func(thread *starlark.Thread) {
+			thread.Cancel("done")
+			iter := &testIterable{
+				maxN: st.N,
+				nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+					if n%2 == 0 {
+						return starlark.MakeInt(n), nil // in set
+					} else {
+						return starlark.MakeInt(-n), nil // not in set
+					}
+				},
+			}
+			_, err := starlark.Call(thread, set_difference_update, starlark.Tuple{iter}, nil)
 			if err == nil {
 				st.Error("expected cancellation")
 			} else if !isStarlarkCancellation(err) {
@@ -10428,6 +13391,169 @@ func TestSetIntersectionCancellation(t *testing.T) {
 	})
 }
 
+func TestSetIntersectionUpdateSteps(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_intersection_update, _ := set.Attr("intersection_update")
+		if set_intersection_update == nil {
+			t.Fatal("no such method: set.intersection_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_intersection_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("iterable", func(t *testing.T) {
+		const elems = 100
+
+		iter := &testIterable{
+			maxN: elems,
+			nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+				if n%2 == 0 {
+					return starlark.MakeInt(n), nil // in set
+				} else {
+					return starlark.MakeInt(-n), nil // not in set
+				}
+			},
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The step cost per N is:
+		// - For iteration, elems
+		// - For probing the receiver, on average elems
+		// - For recording the kept half, on average elems/2 plus rehashing
+		// - For probing the kept elements, on average elems
+		// - For removal of the other half, on average elems/2
+		st.SetMinSteps(4 * elems)
+		st.SetMaxSteps(6 * elems)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				set := starlark.NewSet(elems)
+				for j := 0; j < elems; j++ {
+					set.Insert(starlark.MakeInt(j))
+				}
+				set_intersection_update, _ := set.Attr("intersection_update")
+				if set_intersection_update == nil {
+					st.Fatal("no such method: set.intersection_update")
+				}
+				_, err := starlark.Call(thread, set_intersection_update, starlark.Tuple{iter}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestSetIntersectionUpdateAllocs(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_intersection_update, _ := set.Attr("intersection_update")
+		if set_intersection_update == nil {
+			t.Fatal("no such method: set.intersection_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.MemSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_intersection_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("allocation", func(t *testing.T) {
+		const elems = 100
+
+		set := starlark.NewSet(elems)
+		list := starlark.NewList(make([]starlark.Value, 0, elems))
+		for i := 0; i < elems; i++ {
+			set.Insert(starlark.MakeInt(i))
+			list.Append(starlark.MakeInt(i))
+		}
+		set_intersection_update, _ := set.Attr("intersection_update")
+		if set_intersection_update == nil {
+			t.Fatal("no such method: set.intersection_update")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, set_intersection_update, starlark.Tuple{list}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestSetIntersectionUpdateCancellation(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_intersection_update, _ := set.Attr("intersection_update")
+		if set_intersection_update == nil {
+			t.Fatal("no such method: set.intersection_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.TimeSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_intersection_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("iterable", func(t *testing.T) {
+		const elems = 100
+		set := starlark.NewSet(elems)
+		for i := 0; i < elems; i++ {
+			set.Insert(starlark.MakeInt(i))
+		}
+		set_intersection_update, _ := set.Attr("intersection_update")
+		if set_intersection_update == nil {
+			t.Fatal("no such method: set.intersection_update")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.TimeSafe)
+		st.SetMaxSteps(0)
+		st.RunThread(func(thread *starlark.Thread) {
+			thread.Cancel("done")
+			iter := &testIterable{
+				maxN: st.N,
+				nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+					if n%2 == 0 {
+						return starlark.MakeInt(n), nil // in set
+					} else {
+						return starlark.MakeInt(-n), nil // not in set
+					}
+				},
+			}
+			_, err := starlark.Call(thread, set_intersection_update, starlark.Tuple{iter}, nil)
+			if err == nil {
+				st.Error("expected cancellation")
+			} else if !isStarlarkCancellation(err) {
+				st.Errorf("expected cancellation, got: %v", err)
+			}
+		})
+	})
+}
+
 func TestSetIsSubsetSteps(t *testing.T) {
 	const setSize = 1000
 	set := starlark.NewSet(setSize)
@@ -11186,6 +14312,168 @@ func TestSetSymmetricDifferenceCancellation(t *testing.T) {
 	})
 }
 
+func TestSetSymmetricDifferenceUpdateSteps(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_symmetric_difference_update, _ := set.Attr("symmetric_difference_update")
+		if set_symmetric_difference_update == nil {
+			t.Fatal("no such method: set.symmetric_difference_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_symmetric_difference_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("iterable", func(t *testing.T) {
+		const elems = 100
+
+		iter := &testIterable{
+			maxN: elems,
+			nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+				if n%2 == 0 {
+					return starlark.MakeInt(n), nil // in set
+				} else {
+					return starlark.MakeInt(-n), nil // not in set
+				}
+			},
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// The step cost per N is:
+		// - For iteration, elems
+		// - For deduplicating the iterable, on average elems plus rehashing
+		// - For removal, on average elems
+		// - For insertion of the missing half, on average elems/2
+		st.SetMinSteps(7 * elems / 2)
+		st.SetMaxSteps(6 * elems)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				set := starlark.NewSet(elems)
+				for j := 0; j < elems; j++ {
+					set.Insert(starlark.MakeInt(j))
+				}
+				set_symmetric_difference_update, _ := set.Attr("symmetric_difference_update")
+				if set_symmetric_difference_update == nil {
+					st.Fatal("no such method: set.symmetric_difference_update")
+				}
+				_, err := starlark.Call(thread, set_symmetric_difference_update, starlark.Tuple{iter}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestSetSymmetricDifferenceUpdateAllocs(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_symmetric_difference_update, _ := set.Attr("symmetric_difference_update")
+		if set_symmetric_difference_update == nil {
+			t.Fatal("no such method: set.symmetric_difference_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.MemSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_symmetric_difference_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("allocation", func(t *testing.T) {
+		const elems = 100
+
+		set := starlark.NewSet(elems)
+		list := starlark.NewList(make([]starlark.Value, 0, elems))
+		for i := 0; i < elems; i++ {
+			set.Insert(starlark.MakeInt(i))
+			list.Append(starlark.MakeInt(i))
+		}
+		set_symmetric_difference_update, _ := set.Attr("symmetric_difference_update")
+		if set_symmetric_difference_update == nil {
+			t.Fatal("no such method: set.symmetric_difference_update")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				_, err := starlark.Call(thread, set_symmetric_difference_update, starlark.Tuple{list}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+}
+
+func TestSetSymmetricDifferenceUpdateCancellation(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		set := starlark.NewSet(0)
+		set_symmetric_difference_update, _ := set.Attr("symmetric_difference_update")
+		if set_symmetric_difference_update == nil {
+			t.Fatal("no such method: set.symmetric_difference_update")
+		}
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.TimeSafe)
+		iter := &unsafeTestIterable{t}
+		_, err := starlark.Call(thread, set_symmetric_difference_update, starlark.Tuple{iter}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("iterable", func(t *testing.T) {
+		const elems = 100
+		set := starlark.NewSet(elems)
+		for i := 0; i < elems; i++ {
+			set.Insert(starlark.MakeInt(i))
+		}
+		set_symmetric_difference_update, _ := set.Attr("symmetric_difference_update")
+		if set_symmetric_difference_update == nil {
+			t.Fatal("no such method: set.symmetric_difference_update")
+		}
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.TimeSafe)
+		st.SetMaxSteps(0)
+		st.RunThread(func(thread *starlark.Thread) {
+			thread.Cancel("done")
+			iter := &testIterable{
+				maxN: st.N,
+				nth: func(_ *starlark.Thread, n int) (starlark.Value, error) {
+					if n%2 == 0 {
+						return starlark.MakeInt(n), nil // in set
+					} else {
+						return starlark.MakeInt(-n), nil // not in set
+					}
+				},
+			}
+			_, err := starlark.Call(thread, set_symmetric_difference_update, starlark.Tuple{iter}, nil)
+			if err == nil {
+				st.Error("expected cancellation")
+			} else if !isStarlarkCancellation(err) {
+				st.Errorf("expected cancellation, got: %v", err)
+			}
+		})
+	})
+}
+
 func TestSetUnionSteps(t *testing.T) {
 	t.Run("safety-respected", func(t *testing.T) {
 		thread := &starlark.Thread{}
@@ -7,7 +7,9 @@ import "hash/maphash"
 
 var seed = maphash.MakeSeed()
 
-func maphash_string(s string) uint32 {
+// maphash_string hashes s with a seed chosen randomly once per process,
+// regardless of the string hash seed.
+func maphash_string(s string, _ uint64) uint32 {
 	h := maphash.String(seed, s)
 	return uint32(h>>32) | uint32(h)
 }
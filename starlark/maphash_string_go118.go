@@ -8,6 +8,6 @@ import _ "unsafe"
 //go:linkname runtime_stringhash runtime.stringHash
 func runtime_stringhash(s string, seed uintptr) uintptr
 
-func maphash_string(s string) uint32 {
-	return uint32(runtime_stringhash(s, 0))
+func maphash_string(s string, seed uint64) uint32 {
+	return uint32(runtime_stringhash(s, uintptr(seed)))
 }
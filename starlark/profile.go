@@ -67,6 +67,8 @@ import (
 	"io"
 	"log"
 	"reflect"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -456,3 +458,99 @@ func (e *protoEncoder) int(field uint, x int64) {
 	e.tag(field, 0) // varint
 	e.uvarint(uint64(x))
 }
+
+// The remainder of this file defines a per-thread profiler driven by the
+// step counter rather than by wall time. Every stepProfileInterval steps,
+// the interpreter records the current call stack of the thread; builtins
+// which charge many steps at once cause proportionately many samples to
+// be attributed to their caller. Samples are taken on the thread's own
+// goroutine and aggregated in memory, so the profile's size is bounded by
+// the number of distinct call stacks.
+
+// stepProfileInterval is the number of steps between two samples
+// taken by a thread's step profiler.
+const stepProfileInterval = 1000
+
+// A stepProfile holds the call stacks sampled by a thread's step profiler.
+type stepProfile struct {
+	w       io.Writer
+	next    int64            // step count at which to take the next sample
+	samples map[string]int64 // sample counts keyed by folded call stack
+}
+
+// StartProfile enables step profiling of this thread. Every
+// stepProfileInterval steps, the current Starlark call stack is sampled.
+// When StopProfile is called, the samples are written to w as text with
+// one line per distinct call stack, of the form
+//
+//	<toplevel>;f;g 42
+//
+// which lists function names outermost first, followed by the number of
+// samples attributed to that stack. Lines are sorted by decreasing number
+// of samples.
+//
+// StartProfile returns an error if the thread is already being profiled.
+// It must not be called concurrently with execution of the thread.
+func (thread *Thread) StartProfile(w io.Writer) error {
+	if thread.stepProfile != nil {
+		return fmt.Errorf("thread profiler already running")
+	}
+	steps, _ := thread.Steps()
+	thread.stepProfile = &stepProfile{
+		w:       w,
+		next:    steps + stepProfileInterval,
+		samples: make(map[string]int64),
+	}
+	return nil
+}
+
+// StopProfile stops the profiler started by a prior call to
+// thread.StartProfile and writes the profile. It returns an error
+// if the thread was not being profiled or if the profile could not
+// be written.
+//
+// StopProfile must not be called concurrently with execution of the thread.
+func (thread *Thread) StopProfile() error {
+	prof := thread.stepProfile
+	if prof == nil {
+		return fmt.Errorf("thread profiler not running")
+	}
+	thread.stepProfile = nil
+
+	stacks := make([]string, 0, len(prof.samples))
+	for stack := range prof.samples {
+		stacks = append(stacks, stack)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		if ci, cj := prof.samples[stacks[i]], prof.samples[stacks[j]]; ci != cj {
+			return ci > cj
+		}
+		return stacks[i] < stacks[j]
+	})
+	out := bufio.NewWriter(prof.w)
+	for _, stack := range stacks {
+		fmt.Fprintf(out, "%s %d\n", stack, prof.samples[stack])
+	}
+	return out.Flush()
+}
+
+// sampleSteps records the current call stack once for each sampling
+// interval which has elapsed since the last sample.
+func (thread *Thread) sampleSteps() {
+	prof := thread.stepProfile
+	steps, ok := thread.Steps()
+	if !ok || steps < prof.next {
+		return
+	}
+	n := (steps-prof.next)/stepProfileInterval + 1
+	prof.next += n * stepProfileInterval
+
+	var stack strings.Builder
+	for i, fr := range thread.stack {
+		if i > 0 {
+			stack.WriteByte(';')
+		}
+		stack.WriteString(fr.callable.Name())
+	}
+	prof.samples[stack.String()] += n
+}
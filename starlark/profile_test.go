@@ -79,3 +79,61 @@ fibonacci(100000)
 		t.Logf("stdout=%v", cmd.Stdout)
 	}
 }
+
+func TestThreadProfile(t *testing.T) {
+	const src = `
+def hot():
+	x = 0
+	for i in range(20000):
+		x += i
+	return x
+
+def cold():
+	x = 0
+	for i in range(2000):
+		x += i
+	return x
+
+def main():
+	hot()
+	cold()
+
+main()
+`
+
+	thread := new(starlark.Thread)
+	out := new(bytes.Buffer)
+	if err := thread.StartProfile(out); err != nil {
+		t.Fatal(err)
+	}
+	if err := thread.StartProfile(out); err == nil {
+		t.Error("expected error starting profiler twice")
+	}
+	if _, err := starlark.ExecFile(thread, "foo.star", src, nil); err != nil {
+		_ = thread.StopProfile()
+		t.Fatal(err)
+	}
+	if err := thread.StopProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := thread.StopProfile(); err == nil {
+		t.Error("expected error stopping stopped profiler")
+	}
+
+	samples := make(map[string]int64)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var stack string
+		var n int64
+		if _, err := fmt.Sscanf(line, "%s %d", &stack, &n); err != nil {
+			t.Fatalf("malformed profile line %q: %v", line, err)
+		}
+		frames := strings.Split(stack, ";")
+		samples[frames[len(frames)-1]] += n
+	}
+	if hot, cold := samples["hot"], samples["cold"]; hot <= 5*cold {
+		t.Errorf("expected most samples in hot: hot=%d, cold=%d", hot, cold)
+	}
+	if !strings.Contains(out.String(), "main;hot") {
+		t.Errorf("profile does not record callers:\n%s", out)
+	}
+}
@@ -0,0 +1,177 @@
+package starlark
+
+// This file defines a bounded cache of compiled programs, for embedders
+// which repeatedly execute the same source.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/canonical/starlark/syntax"
+)
+
+// DefaultProgramCacheSize is the capacity of the cache used by CompileCached.
+const DefaultProgramCacheSize = 64
+
+var defaultProgramCache = NewProgramCache(DefaultProgramCacheSize)
+
+// CompileCached is like SourceProgramOptions, but returns a compiled program
+// from a process-wide cache of DefaultProgramCacheSize programs when the same
+// source has already been compiled with the same options, filename and
+// predeclared names.
+func CompileCached(opts *syntax.FileOptions, filename string, src interface{}, predeclared StringDict) (*Program, error) {
+	return defaultProgramCache.Compile(opts, filename, src, predeclared)
+}
+
+// A ProgramCache is a bounded cache of compiled programs, from which the
+// least recently used program is evicted first. It is safe for concurrent
+// use.
+//
+// As a Program is immutable, a cached program may be initialized any
+// number of times, by any number of threads.
+type ProgramCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[programCacheKey]*programCacheEntry
+
+	// The entries form a circular list in order of use, through root,
+	// from the most to the least recently used.
+	root programCacheEntry
+}
+
+type programCacheKey struct {
+	opts        syntax.FileOptions
+	filename    string
+	src         [sha256.Size]byte
+	predeclared [sha256.Size]byte
+}
+
+type programCacheEntry struct {
+	key        programCacheKey
+	prog       *Program
+	prev, next *programCacheEntry
+}
+
+// NewProgramCache returns a new cache which holds at most capacity programs.
+func NewProgramCache(capacity int) *ProgramCache {
+	if capacity < 1 {
+		panic(fmt.Sprintf("NewProgramCache: invalid capacity %d", capacity))
+	}
+	pc := &ProgramCache{
+		capacity: capacity,
+		entries:  make(map[programCacheKey]*programCacheEntry),
+	}
+	pc.root.prev, pc.root.next = &pc.root, &pc.root
+	return pc
+}
+
+// Compile returns the program obtained by compiling src, as SourceProgramOptions
+// would, resolving the names in predeclared as predeclared identifiers. The
+// program is cached, keyed by everything which affects its compilation.
+// Programs which fail to compile are not cached. If opts is nil,
+// syntax.LegacyFileOptions is used.
+func (pc *ProgramCache) Compile(opts *syntax.FileOptions, filename string, src interface{}, predeclared StringDict) (*Program, error) {
+	if opts == nil {
+		opts = syntax.LegacyFileOptions()
+	}
+	data, err := readProgramSource(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	key := programCacheKey{
+		opts:        *opts,
+		filename:    filename,
+		src:         sha256.Sum256(data),
+		predeclared: hashNames(predeclared),
+	}
+
+	pc.mu.Lock()
+	if e, ok := pc.entries[key]; ok {
+		pc.use(e)
+		pc.mu.Unlock()
+		return e.prog, nil
+	}
+	pc.mu.Unlock()
+
+	// Compile without holding the lock; should another goroutine
+	// compile the same program concurrently, either result will do.
+	_, prog, err := SourceProgramOptions(opts, filename, data, predeclared.Has)
+	if err != nil {
+		return nil, err
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if e, ok := pc.entries[key]; ok {
+		pc.use(e)
+		return e.prog, nil
+	}
+	e := &programCacheEntry{key: key, prog: prog}
+	pc.entries[key] = e
+	pc.use(e)
+	if len(pc.entries) > pc.capacity {
+		oldest := pc.root.prev
+		oldest.unlink()
+		delete(pc.entries, oldest.key)
+	}
+	return prog, nil
+}
+
+// Len returns the number of programs in the cache.
+func (pc *ProgramCache) Len() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.entries)
+}
+
+// use marks e as the most recently used entry.
+func (pc *ProgramCache) use(e *programCacheEntry) {
+	if e.next != nil {
+		e.unlink()
+	}
+	e.prev, e.next = &pc.root, pc.root.next
+	e.prev.next = e
+	e.next.prev = e
+}
+
+func (e *programCacheEntry) unlink() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
+}
+
+// readProgramSource returns the source text described by filename and src,
+// which are as for syntax.Parse.
+func readProgramSource(filename string, src interface{}) ([]byte, error) {
+	switch src := src.(type) {
+	case string:
+		return []byte(src), nil
+	case []byte:
+		return src, nil
+	case io.Reader:
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", filename, err)
+		}
+		return data, nil
+	case nil:
+		return os.ReadFile(filename)
+	default:
+		return nil, fmt.Errorf("invalid source: %T", src)
+	}
+}
+
+// hashNames returns a digest of the set of names in d.
+func hashNames(d StringDict) [sha256.Size]byte {
+	h := sha256.New()
+	for _, name := range d.Keys() {
+		io.WriteString(h, name)
+		h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
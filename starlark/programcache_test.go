@@ -0,0 +1,181 @@
+package starlark_test
+
+import (
+	"testing"
+
+	"github.com/canonical/starlark/starlark"
+	"github.com/canonical/starlark/syntax"
+)
+
+func TestProgramCacheHit(t *testing.T) {
+	pc := starlark.NewProgramCache(4)
+	predeclared := starlark.StringDict{"x": starlark.MakeInt(1)}
+
+	first, err := pc.Compile(&syntax.FileOptions{}, "a.star", "y = x + 1", predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pc.Compile(&syntax.FileOptions{}, "a.star", []byte("y = x + 1"), predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("identical source was compiled twice")
+	}
+	if n := pc.Len(); n != 1 {
+		t.Errorf("unexpected cache length: got %d, want 1", n)
+	}
+
+	// The values of predeclared names do not affect compilation.
+	third, err := pc.Compile(&syntax.FileOptions{}, "a.star", "y = x + 1", starlark.StringDict{"x": starlark.None})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != third {
+		t.Error("program was recompiled for different predeclared values")
+	}
+}
+
+func TestProgramCacheMiss(t *testing.T) {
+	const src = "def f():\n    while True:\n        pass\n"
+	pc := starlark.NewProgramCache(8)
+	opts := &syntax.FileOptions{While: true}
+
+	base, err := pc.Compile(opts, "a.star", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		opts        *syntax.FileOptions
+		filename    string
+		src         string
+		predeclared starlark.StringDict
+	}{{
+		name:     "filename",
+		opts:     opts,
+		filename: "b.star",
+		src:      src,
+	}, {
+		name:     "source",
+		opts:     opts,
+		filename: "a.star",
+		src:      src + "x = 1\n",
+	}, {
+		name:        "predeclared",
+		opts:        opts,
+		filename:    "a.star",
+		src:         src,
+		predeclared: starlark.StringDict{"x": starlark.None},
+	}, {
+		name:     "options",
+		opts:     &syntax.FileOptions{While: true, Recursion: true},
+		filename: "a.star",
+		src:      src,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prog, err := pc.Compile(test.opts, test.filename, test.src, test.predeclared)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prog == base {
+				t.Error("unexpected cache hit")
+			}
+		})
+	}
+
+	if _, err := pc.Compile(&syntax.FileOptions{}, "a.star", src, nil); err == nil {
+		t.Error("expected while statement to be rejected without FileOptions.While")
+	}
+}
+
+func TestProgramCacheEviction(t *testing.T) {
+	pc := starlark.NewProgramCache(2)
+	compile := func(src string) *starlark.Program {
+		prog, err := pc.Compile(&syntax.FileOptions{}, "a.star", src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prog
+	}
+
+	a := compile("a = 1")
+	b := compile("b = 1")
+	if compile("a = 1") != a {
+		t.Error("program a was evicted early")
+	}
+	compile("c = 1") // evicts b, the least recently used
+	if n := pc.Len(); n != 2 {
+		t.Errorf("unexpected cache length: got %d, want 2", n)
+	}
+	if compile("a = 1") != a {
+		t.Error("program a was evicted instead of b")
+	}
+	if compile("b = 1") == b {
+		t.Error("program b was not evicted")
+	}
+}
+
+func TestProgramCacheErrors(t *testing.T) {
+	pc := starlark.NewProgramCache(2)
+	if _, err := pc.Compile(&syntax.FileOptions{}, "a.star", "x = ", nil); err == nil {
+		t.Error("expected syntax error")
+	}
+	if _, err := pc.Compile(&syntax.FileOptions{}, "a.star", "y = z", nil); err == nil {
+		t.Error("expected resolve error")
+	}
+	if n := pc.Len(); n != 0 {
+		t.Errorf("failed compilations were cached: got length %d", n)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for zero capacity")
+			}
+		}()
+		starlark.NewProgramCache(0)
+	}()
+}
+
+func TestProgramCacheNilOptions(t *testing.T) {
+	pc := starlark.NewProgramCache(2)
+	prog, err := pc.Compile(nil, "a.star", "x = 1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := pc.Compile(syntax.LegacyFileOptions(), "a.star", "x = 1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog != again {
+		t.Error("nil options were not treated as the legacy options")
+	}
+}
+
+func TestCompileCached(t *testing.T) {
+	const src = "greeting = 'hello, ' + name"
+	predeclared := starlark.StringDict{"name": starlark.String("world")}
+
+	prog, err := starlark.CompileCached(&syntax.FileOptions{}, "greet.star", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := starlark.CompileCached(&syntax.FileOptions{}, "greet.star", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog != again {
+		t.Error("identical source was compiled twice")
+	}
+
+	thread := &starlark.Thread{}
+	globals, err := prog.Init(thread, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["greeting"], starlark.String("hello, world"); got != want {
+		t.Errorf("unexpected greeting: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,400 @@
+package starlark
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/canonical/starlark/syntax"
+)
+
+// ReadOnly returns a view of v through which Starlark code may read v, but
+// not modify it. Unlike Freeze, which makes a value immutable for every
+// holder, ReadOnly leaves v itself untouched, so the host may keep updating
+// it while sharing it with scripts.
+//
+// Each access made through the view (an attribute lookup, an index, a key
+// lookup or an iteration step) costs one step of the calling thread.
+// Assignments through the view fail, as do lookups of the methods which
+// mutate the built-in lists, dicts and sets. Lists, dicts and sets obtained
+// through the view, including those returned by its methods, are
+// themselves read-only, and tuples holding them are copied so that their
+// elements are too; other values are returned as-is.
+//
+// The type of the view is that of v, prefixed by "readonly".
+func ReadOnly(v Value) Value {
+	if _, ok := v.(readOnlyView); ok {
+		return v
+	}
+	ro := readOnlyValue{v: v}
+	switch v := v.(type) {
+	case SequenceMapping:
+		return &readOnlyMapping{readOnlySequence{readOnlyIterable{ro}}}
+	case Indexable:
+		if _, ok := v.(Iterable); ok {
+			return &readOnlyIndexable{readOnlySequence{readOnlyIterable{ro}}}
+		}
+	case Sequence:
+		return &readOnlySequence{readOnlyIterable{ro}}
+	case Iterable:
+		return &readOnlyIterable{ro}
+	}
+	return &ro
+}
+
+// readOnlyElem wraps the mutable built-in values reached through a
+// read-only view, so that they may not be modified either. Tuples which
+// hold such values are copied, with their elements wrapped in turn.
+func readOnlyElem(thread *Thread, v Value) (Value, error) {
+	switch v := v.(type) {
+	case *List, *Dict, *Set:
+		return ReadOnly(v), nil
+	case Tuple:
+		if !readOnlyNeedsWrap(v) {
+			return v, nil
+		}
+		if thread != nil {
+			if err := thread.AddSteps(SafeInt(len(v))); err != nil {
+				return nil, err
+			}
+			resultSize := SafeAdd(EstimateMakeSize(Tuple{}, SafeInt(len(v))), SliceTypeOverhead)
+			if err := thread.AddAllocs(resultSize); err != nil {
+				return nil, err
+			}
+		}
+		result := make(Tuple, len(v))
+		for i, elem := range v {
+			var err error
+			if result[i], err = readOnlyElem(thread, elem); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	return v, nil
+}
+
+// readOnlyNeedsWrap reports whether v is, or is a tuple which holds, a
+// mutable built-in value.
+func readOnlyNeedsWrap(v Value) bool {
+	switch v := v.(type) {
+	case *List, *Dict, *Set:
+		return true
+	case Tuple:
+		for _, elem := range v {
+			if readOnlyNeedsWrap(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readOnlyMethod wraps a method of the value behind a read-only view so
+// that its results are read-only too.
+func readOnlyMethod(ro *readOnlyValue, attr Value) Value {
+	method, ok := attr.(*Builtin)
+	if !ok {
+		return attr
+	}
+	fn := func(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+		result, err := method.CallInternal(thread, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return readOnlyElem(thread, result)
+	}
+	return &Builtin{name: method.name, fn: fn, recv: ro, safety: method.safety}
+}
+
+// readOnlyMutators holds the names of the methods of the built-in list,
+// dict and set types which modify their receiver.
+var readOnlyMutators = map[string]bool{
+	"add":                         true,
+	"append":                      true,
+	"clear":                       true,
+	"difference_update":           true,
+	"discard":                     true,
+	"extend":                      true,
+	"insert":                      true,
+	"intersection_update":         true,
+	"pop":                         true,
+	"popitem":                     true,
+	"remove":                      true,
+	"setdefault":                  true,
+	"symmetric_difference_update": true,
+	"update":                      true,
+}
+
+type readOnlyView interface {
+	Value
+	underlying() Value
+}
+
+type readOnlyValue struct {
+	v Value
+}
+
+var (
+	_ readOnlyView = &readOnlyValue{}
+	_ HasSafeAttrs = &readOnlyValue{}
+	_ Comparable   = &readOnlyValue{}
+	_ SafeStringer = &readOnlyValue{}
+)
+
+func (ro *readOnlyValue) underlying() Value { return ro.v }
+
+func (ro *readOnlyValue) String() string        { return ro.v.String() }
+func (ro *readOnlyValue) Type() string          { return "readonly " + ro.v.Type() }
+func (ro *readOnlyValue) Freeze()               {} // the view is already immutable
+func (ro *readOnlyValue) Truth() Bool           { return ro.v.Truth() }
+func (ro *readOnlyValue) Hash() (uint32, error) { return ro.v.Hash() }
+
+func (ro *readOnlyValue) SafeString(thread *Thread, sb StringBuilder) error {
+	return writeValue(thread, sb, ro.v, nil)
+}
+
+func (ro *readOnlyValue) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	if y, ok := y.(readOnlyView); ok {
+		return CompareDepth(op, ro.v, y.underlying(), depth)
+	}
+	return CompareDepth(op, ro.v, y, depth)
+}
+
+func (ro *readOnlyValue) Attr(name string) (Value, error) {
+	if readOnlyMutators[name] {
+		return nil, ro.mutationError(name)
+	}
+	if x, ok := ro.v.(HasAttrs); ok {
+		attr, err := x.Attr(name)
+		if attr == nil || err != nil {
+			return attr, err
+		}
+		return readOnlyMethod(ro, attr), nil
+	}
+	return nil, nil
+}
+
+func (ro *readOnlyValue) SafeAttr(thread *Thread, name string) (Value, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	if thread != nil {
+		if err := thread.AddSteps(SafeInt(1)); err != nil {
+			return nil, err
+		}
+	}
+	if readOnlyMutators[name] {
+		return nil, ro.mutationError(name)
+	}
+	var attr Value
+	var err error
+	switch x := ro.v.(type) {
+	case HasSafeAttrs:
+		attr, err = x.SafeAttr(thread, name)
+	case HasAttrs:
+		if err := CheckSafety(thread, NotSafe); err != nil {
+			return nil, err
+		}
+		attr, err = x.Attr(name)
+		if attr == nil && err == nil {
+			err = ErrNoAttr
+		}
+	default:
+		err = ErrNoAttr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attr.(*Builtin); ok && thread != nil {
+		if err := thread.AddAllocs(EstimateSize(&Builtin{})); err != nil {
+			return nil, err
+		}
+	}
+	return readOnlyMethod(ro, attr), nil
+}
+
+func (ro *readOnlyValue) AttrNames() []string {
+	x, ok := ro.v.(HasAttrs)
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, name := range x.AttrNames() {
+		if !readOnlyMutators[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ro *readOnlyValue) mutationError(name string) error {
+	return fmt.Errorf("cannot access .%s of read-only %s", name, ro.v.Type())
+}
+
+type readOnlyIterable struct {
+	readOnlyValue
+}
+
+var _ Iterable = &readOnlyIterable{}
+
+func (ro *readOnlyIterable) Iterate() Iterator {
+	return &readOnlyIterator{iter: ro.v.(Iterable).Iterate()}
+}
+
+type readOnlySequence struct {
+	readOnlyIterable
+}
+
+var _ Sequence = &readOnlySequence{}
+
+func (ro *readOnlySequence) Len() int { return Len(ro.v) }
+
+type readOnlyIndexable struct {
+	readOnlySequence
+}
+
+var (
+	_ SafeIndexable   = &readOnlyIndexable{}
+	_ HasSafeSetIndex = &readOnlyIndexable{}
+)
+
+func (ro *readOnlyIndexable) Index(i int) Value {
+	elem, _ := readOnlyElem(nil, ro.v.(Indexable).Index(i))
+	return elem
+}
+
+func (ro *readOnlyIndexable) SafeIndex(thread *Thread, i int) (Value, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	if thread != nil {
+		if err := thread.AddSteps(SafeInt(1)); err != nil {
+			return nil, err
+		}
+	}
+	var elem Value
+	if x, ok := ro.v.(SafeIndexable); ok {
+		var err error
+		if elem, err = x.SafeIndex(thread, i); err != nil {
+			return nil, err
+		}
+	} else if err := CheckSafety(thread, NotSafe); err != nil {
+		return nil, err
+	} else {
+		elem = ro.v.(Indexable).Index(i)
+	}
+	return readOnlyElem(thread, elem)
+}
+
+func (ro *readOnlyIndexable) SafeSetIndex(thread *Thread, i int, v Value) error {
+	return fmt.Errorf("cannot assign to element of read-only %s", ro.v.Type())
+}
+
+type readOnlyMapping struct {
+	readOnlySequence
+}
+
+var (
+	_ SafeMapping   = &readOnlyMapping{}
+	_ HasSafeSetKey = &readOnlyMapping{}
+)
+
+func (ro *readOnlyMapping) Get(k Value) (Value, bool, error) {
+	v, found, err := ro.v.(Mapping).Get(k)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	if v, err = readOnlyElem(nil, v); err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (ro *readOnlyMapping) SafeGet(thread *Thread, k Value) (Value, bool, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, false, err
+	}
+	if thread != nil {
+		if err := thread.AddSteps(SafeInt(1)); err != nil {
+			return nil, false, err
+		}
+	}
+	var v Value
+	var found bool
+	var err error
+	if x, ok := ro.v.(SafeMapping); ok {
+		v, found, err = x.SafeGet(thread, k)
+	} else if err = CheckSafety(thread, NotSafe); err == nil {
+		v, found, err = ro.v.(Mapping).Get(k)
+	}
+	if err != nil || !found {
+		return nil, found, err
+	}
+	if v, err = readOnlyElem(thread, v); err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (ro *readOnlyMapping) SafeSetKey(thread *Thread, k, v Value) error {
+	return fmt.Errorf("cannot insert into read-only %s", ro.v.Type())
+}
+
+type readOnlyIterator struct {
+	iter   Iterator
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &readOnlyIterator{}
+
+func (it *readOnlyIterator) BindThread(thread *Thread) {
+	it.thread = thread
+	if iter, ok := it.iter.(SafeIterator); ok {
+		iter.BindThread(thread)
+	}
+}
+
+func (it *readOnlyIterator) Safety() SafetyFlags {
+	iter, ok := it.iter.(SafeIterator)
+	if it.thread == nil || !ok {
+		return NotSafe
+	}
+	const wrapperSafety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	return wrapperSafety & iter.Safety()
+}
+
+func (it *readOnlyIterator) Next(p *Value) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.thread != nil {
+		if err := it.thread.AddSteps(SafeInt(1)); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	if !it.iter.Next(p) {
+		return false
+	}
+	elem, err := readOnlyElem(it.thread, *p)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	*p = elem
+	return true
+}
+
+func (it *readOnlyIterator) Done() { it.iter.Done() }
+
+func (it *readOnlyIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.iter.Err()
+}
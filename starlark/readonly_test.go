@@ -0,0 +1,169 @@
+package starlark_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/canonical/starlark/starlark"
+	"github.com/canonical/starlark/startest"
+)
+
+func TestReadOnly(t *testing.T) {
+	makeValue := func() *starlark.List {
+		dict := starlark.NewDict(1)
+		dict.SetKey(starlark.String("k"), starlark.NewList([]starlark.Value{starlark.MakeInt(3)}))
+		return starlark.NewList([]starlark.Value{
+			starlark.MakeInt(1),
+			starlark.NewList([]starlark.Value{starlark.MakeInt(2)}),
+			dict,
+		})
+	}
+
+	t.Run("reads", func(t *testing.T) {
+		const src = `
+def test():
+	if len(ro) != 3:
+		fail("bad len: %d" % len(ro))
+	if ro[0] != 1 or ro[-1]["k"][0] != 3:
+		fail("bad elements: %s" % ro)
+	if [x for x in ro[1]] != [2]:
+		fail("bad iteration: %s" % ro[1])
+	if ro.index(1) != 0:
+		fail("bad index")
+	if ro[2].get("k")[0] != 3:
+		fail("bad get")
+	if type(ro) != "readonly list" or type(ro[2]) != "readonly dict":
+		fail("bad types: %s, %s" % (type(ro), type(ro[2])))
+	if str(ro) != '[1, [2], {"k": [3]}]':
+		fail("bad str: %s" % str(ro))
+	if "append" in dir(ro) or "index" not in dir(ro):
+		fail("bad dir: %s" % dir(ro))
+test()
+`
+		predeclared := starlark.StringDict{"ro": starlark.ReadOnly(makeValue())}
+		if _, err := starlark.ExecFile(&starlark.Thread{}, "readonly.star", src, predeclared); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("mutations", func(t *testing.T) {
+		tests := []struct {
+			src string
+			err string
+		}{
+			{"ro.append(1)", "cannot access .append of read-only list"},
+			{"ro.clear()", "cannot access .clear of read-only list"},
+			{"ro[0] = 2", "cannot assign to element of read-only list"},
+			{"ro[1].append(3)", "cannot access .append of read-only list"},
+			{"ro[2]['k'] = 1", "cannot insert into read-only dict"},
+			{"ro[2].update(k=1)", "cannot access .update of read-only dict"},
+			{"ro[2]['k'].pop()", "cannot access .pop of read-only list"},
+			{"[x.append(1) for x in ro if type(x) == 'readonly list']", "cannot access .append of read-only list"},
+			{"ro[2].get('k').append(2)", "cannot access .append of read-only list"},
+			{"ro[2].values()[0].append(3)", "cannot access .append of read-only list"},
+			{"ro[2].items()[0][1].append(3)", "cannot access .append of read-only list"},
+			{"[v.append(3) for _, v in ro[2].items()]", "cannot access .append of read-only list"},
+			{"get = ro[2].get; get('k').clear()", "cannot access .clear of read-only list"},
+		}
+		for _, test := range tests {
+			value := makeValue()
+			before := value.String()
+			predeclared := starlark.StringDict{"ro": starlark.ReadOnly(value)}
+			_, err := starlark.ExecFile(&starlark.Thread{}, "readonly.star", test.src, predeclared)
+			if err == nil {
+				t.Errorf("%s: expected error", test.src)
+			} else if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: unexpected error: %v", test.src, err)
+			}
+			if after := value.String(); after != before {
+				t.Errorf("%s: value was modified: %s", test.src, after)
+			}
+		}
+	})
+
+	t.Run("compare-impostor", func(t *testing.T) {
+		// A value may claim the type of a view without being one.
+		view := starlark.ReadOnly(starlark.NewList(nil))
+		impostor := readOnlyImpostor{}
+		if eq, err := starlark.Equal(view, impostor); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if eq {
+			t.Error("view compared equal to impostor")
+		}
+	})
+
+	t.Run("original-unaffected", func(t *testing.T) {
+		value := makeValue()
+		view := starlark.ReadOnly(value)
+		view.Freeze()
+		if err := value.Append(starlark.None); err != nil {
+			t.Fatal(err)
+		}
+		if n := starlark.Len(view); n != 4 {
+			t.Errorf("view did not reflect update: got length %d, want 4", n)
+		}
+	})
+
+	t.Run("index-steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			view := starlark.ReadOnly(makeValue()).(starlark.SafeIndexable)
+			for i := 0; i < st.N; i++ {
+				if _, err := view.SafeIndex(thread, 0); err != nil {
+					st.Error(err)
+				}
+			}
+		})
+	})
+
+	t.Run("iteration-steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// Each element costs a step for the access through the view, on
+		// top of that of the iteration itself.
+		st.SetMinSteps(2)
+		st.SetMaxSteps(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			elems := make([]starlark.Value, st.N)
+			for i := range elems {
+				elems[i] = starlark.None
+			}
+			iter, err := starlark.SafeIterate(thread, starlark.ReadOnly(starlark.NewList(elems)))
+			if err != nil {
+				st.Fatal(err)
+			}
+			defer iter.Done()
+			var x starlark.Value
+			for iter.Next(&x) {
+			}
+			if err := iter.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("script-steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		// One step for each of the index and the attribute lookup, on
+		// top of those of the instructions executed.
+		st.SetMinSteps(2)
+		st.AddValue("ro", starlark.ReadOnly(makeValue()))
+		st.RunString(`
+			for _ in st.ntimes():
+				ro[2].get
+		`)
+	})
+}
+
+// readOnlyImpostor is a value whose type is that of a read-only list.
+type readOnlyImpostor struct{}
+
+func (readOnlyImpostor) String() string        { return "readOnlyImpostor" }
+func (readOnlyImpostor) Type() string          { return "readonly list" }
+func (readOnlyImpostor) Freeze()               {}
+func (readOnlyImpostor) Truth() starlark.Bool  { return true }
+func (readOnlyImpostor) Hash() (uint32, error) { return 0, nil }
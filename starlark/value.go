@@ -68,12 +68,15 @@ package starlark // import "github.com/canonical/starlark/starlark"
 // This file defines the data types of Starlark and their basic operations.
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/canonical/starlark/internal/compile"
@@ -116,6 +119,30 @@ type SafeStringer interface {
 	SafeString(thread *Thread, sb StringBuilder) error
 }
 
+// A SafeTruther is a value whose truth may be expensive to compute, and so
+// is computed while respecting the safety of the thread.
+type SafeTruther interface {
+	Value
+	SafeTruth(thread *Thread) (Bool, error)
+}
+
+// SafeTruth returns the truth value of x. If x is a SafeTruther, its
+// SafeTruth method is used; otherwise Truth is assumed to be cheap and is
+// called directly.
+func SafeTruth(thread *Thread, x Value) (Bool, error) {
+	if x, ok := x.(SafeTruther); ok {
+		return x.SafeTruth(thread)
+	}
+	return x.Truth(), nil
+}
+
+// A HasSafeHash is a value whose hash may be expensive to compute, and so
+// is computed while respecting the safety of the thread.
+type HasSafeHash interface {
+	Value
+	SafeHash(thread *Thread) (uint32, error)
+}
+
 // A Comparable is a value that defines its own equivalence relation and
 // perhaps ordered comparisons.
 type Comparable interface {
@@ -243,6 +270,14 @@ type Sliceable interface {
 	Slice(start, end, step int) Value
 }
 
+// A SafeSliceable is a Sliceable which can be sliced while respecting
+// the safety of the thread.
+type SafeSliceable interface {
+	Sliceable
+	// SafeSlice has the same requirements on its arguments as Slice.
+	SafeSlice(thread *Thread, start, end, step int) (Value, error)
+}
+
 // A HasSetIndex is an Indexable value whose elements may be assigned (x[i] = y).
 //
 // The implementation should not add Len to a negative index as the
@@ -268,6 +303,9 @@ var (
 	_ Sliceable       = Tuple(nil)
 	_ Sliceable       = String("")
 	_ Sliceable       = (*List)(nil)
+	_ SafeSliceable   = Tuple(nil)
+	_ SafeSliceable   = String("")
+	_ SafeSliceable   = (*List)(nil)
 )
 
 // An Iterator provides a sequence of values to the caller.
@@ -308,6 +346,16 @@ type SafeIterator interface {
 	BindThread(thread *Thread)
 }
 
+// A SafeSizedIterator is a SafeIterator which knows how many elements
+// it has left to yield, allowing consumers to pre-size their results.
+type SafeSizedIterator interface {
+	SafeIterator
+
+	// RemainingHint returns the number of elements which are yet to
+	// be yielded, if known.
+	RemainingHint() (int, bool)
+}
+
 // A Mapping is a mapping from keys to values, such as a dictionary.
 //
 // If a type satisfies both Mapping and Iterable, the iterator yields
@@ -427,6 +475,31 @@ type HasSafeAttrs interface {
 	SafeAttr(thread *Thread, name string) (Value, error)
 }
 
+// A HasSafeAttrNames value has attribute names which may be expensive to
+// list, and so are listed while respecting the safety of the thread. The
+// implementation is responsible for accounting for the returned slice.
+type HasSafeAttrNames interface {
+	HasAttrs
+	SafeAttrNames(thread *Thread) ([]string, error) // callers must not modify the result.
+}
+
+// safeAttrNames returns the attribute names of x. If x is a
+// HasSafeAttrNames, its SafeAttrNames method is used; otherwise AttrNames
+// is assumed to be cheap to call, and the slice it returns is accounted
+// for here.
+func safeAttrNames(thread *Thread, x HasAttrs) ([]string, error) {
+	if x, ok := x.(HasSafeAttrNames); ok {
+		return x.SafeAttrNames(thread)
+	}
+	names := x.AttrNames()
+	if thread != nil {
+		if err := thread.AddAllocs(EstimateMakeSize([]string{}, SafeInt(len(names)))); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
 var (
 	_ HasSafeAttrs = String("")
 	_ HasSafeAttrs = Bytes("")
@@ -725,13 +798,41 @@ func (s String) Slice(start, end, step int) Value {
 	}
 
 	sign := signum(step)
-	var str []byte
+	str := make([]byte, 0, rangeLen(start, end, step))
 	for i := start; signum(end-i) == sign; i += step {
 		str = append(str, s[i])
 	}
 	return String(str)
 }
 
+func (s String) SafeSlice(thread *Thread, start, end, step int) (Value, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	if thread != nil {
+		if err := accountStringSlice(thread, start, end, step); err != nil {
+			return nil, err
+		}
+	}
+	return s.Slice(start, end, step), nil
+}
+
+// accountStringSlice accounts for the result of slicing a string or
+// bytes value. A contiguous slice shares the memory of the original,
+// otherwise each byte must be copied.
+func accountStringSlice(thread *Thread, start, end, step int) error {
+	if step == 1 {
+		return thread.AddAllocs(StringTypeOverhead)
+	}
+	n := rangeLen(start, end, step)
+	if err := thread.AddSteps(SafeInt(n)); err != nil {
+		return err
+	}
+	resultSize := SafeAdd(EstimateMakeSize([]byte{}, SafeInt(n)), StringTypeOverhead)
+	return thread.AddAllocs(resultSize)
+}
+
 func (s String) Attr(name string) (Value, error) { return builtinAttr(s, name, stringMethods) }
 func (s String) AttrNames() []string             { return builtinAttrNames(stringMethods) }
 
@@ -822,7 +923,7 @@ type stringElemsIterator struct {
 	err    error
 }
 
-var _ SafeIterator = &stringElemsIterator{}
+var _ SafeSizedIterator = &stringElemsIterator{}
 
 func (it *stringElemsIterator) BindThread(thread *Thread) {
 	it.thread = thread
@@ -845,8 +946,9 @@ func (it *stringElemsIterator) Next(p *Value) bool {
 	}
 }
 
-func (it *stringElemsIterator) Done()      {}
-func (it *stringElemsIterator) Err() error { return it.err }
+func (it *stringElemsIterator) Done()                      {}
+func (it *stringElemsIterator) Err() error                 { return it.err }
+func (it *stringElemsIterator) RemainingHint() (int, bool) { return len(it.si.s) - it.i, true }
 func (it *stringElemsIterator) Safety() SafetyFlags {
 	if it.thread == nil {
 		return NotSafe
@@ -886,7 +988,7 @@ type stringCodepointsIterator struct {
 	err    error
 }
 
-var _ SafeIterator = &stringCodepointsIterator{}
+var _ SafeSizedIterator = &stringCodepointsIterator{}
 
 func (it *stringCodepointsIterator) BindThread(thread *Thread) {
 	it.thread = thread
@@ -927,6 +1029,24 @@ func (it *stringCodepointsIterator) Next(p *Value) bool {
 func (*stringCodepointsIterator) Done() {}
 
 func (it *stringCodepointsIterator) Err() error { return it.err }
+
+// RemainingHint counts the code points left to yield. As with Next, each
+// invalid byte counts as one. Counting scans the remaining bytes, so it
+// is charged as one step per byte.
+func (it *stringCodepointsIterator) RemainingHint() (int, bool) {
+	if it.err != nil {
+		return 0, false
+	}
+	s := string(it.si.s[it.i:])
+	if it.thread != nil {
+		if err := it.thread.AddSteps(SafeInt(len(s))); err != nil {
+			it.err = err
+			return 0, false
+		}
+	}
+	return utf8.RuneCountInString(s), true
+}
+
 func (it *stringCodepointsIterator) Safety() SafetyFlags {
 	if it.thread == nil {
 		return NotSafe
@@ -1212,6 +1332,68 @@ func (x *Dict) safeUnion(thread *Thread, y *Dict) (*Dict, error) {
 	return z, nil
 }
 
+// SafeDeepMerge merges the entries of src into dst, recursively. Where
+// both map a key to a dict, the dict in src is merged into that in dst;
+// otherwise, the value in src replaces any value in dst. Dicts in src which
+// have no counterpart in dst are copied rather than shared, so that later
+// merges into dst do not modify src.
+//
+// Dicts are merged up to the depth set by SetMaxDepth, beyond which an
+// error is returned, so merging a cyclic dict fails rather than recursing
+// indefinitely.
+func SafeDeepMerge(thread *Thread, dst, src *Dict) error {
+	return safeDeepMerge(thread, dst, src, thread.depthLimit())
+}
+
+func safeDeepMerge(thread *Thread, dst, src *Dict, depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("deep merge exceeded maximum depth")
+	}
+	// A snapshot of the items allows src to be nested within dst.
+	if thread != nil {
+		n := src.Len()
+		if err := thread.AddSteps(SafeInt(n)); err != nil {
+			return err
+		}
+		// The snapshot has a single backing array for its pairs.
+		snapshotSize := SafeAdd(
+			EstimateMakeSize([]Tuple{}, SafeInt(n)),
+			EstimateMakeSize([]Value{}, SafeMul(n, 2)),
+		)
+		if err := thread.AddAllocs(snapshotSize); err != nil {
+			return err
+		}
+	}
+	items := src.Items()
+	for _, item := range items {
+		k, v := item[0], item[1]
+		if srcDict, ok := v.(*Dict); ok {
+			old, found, err := dst.SafeGet(thread, k)
+			if err != nil {
+				return err
+			}
+			if dstDict, ok := old.(*Dict); found && ok {
+				if err := safeDeepMerge(thread, dstDict, srcDict, depth-1); err != nil {
+					return err
+				}
+				continue
+			}
+			clone, err := SafeNewDict(thread, srcDict.Len())
+			if err != nil {
+				return err
+			}
+			if err := safeDeepMerge(thread, clone, srcDict, depth-1); err != nil {
+				return err
+			}
+			v = clone
+		}
+		if err := dst.SafeSetKey(thread, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Dict) Attr(name string) (Value, error) { return builtinAttr(d, name, dictMethods) }
 func (d *Dict) AttrNames() []string             { return builtinAttrNames(dictMethods) }
 
@@ -1307,13 +1489,50 @@ func (l *List) Slice(start, end, step int) Value {
 	}
 
 	sign := signum(step)
-	var list []Value
+	list := make([]Value, 0, rangeLen(start, end, step))
 	for i := start; signum(end-i) == sign; i += step {
 		list = append(list, l.elems[i])
 	}
 	return NewList(list)
 }
 
+func (l *List) SafeSlice(thread *Thread, start, end, step int) (Value, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	if thread != nil {
+		n := SafeInt(rangeLen(start, end, step))
+		if err := thread.AddSteps(n); err != nil {
+			return nil, err
+		}
+		resultSize := SafeAdd(EstimateSize(&List{}), EstimateMakeSize([]Value{}, n))
+		if err := thread.AddAllocs(resultSize); err != nil {
+			return nil, err
+		}
+	}
+	return l.Slice(start, end, step), nil
+}
+
+// SafeToTuple returns a new tuple containing the elements of the list.
+func (l *List) SafeToTuple(thread *Thread) (Tuple, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	n := SafeInt(len(l.elems))
+	if thread != nil {
+		if err := thread.AddSteps(n); err != nil {
+			return nil, err
+		}
+		resultSize := SafeAdd(EstimateMakeSize(Tuple{}, n), SliceTypeOverhead)
+		if err := thread.AddAllocs(resultSize); err != nil {
+			return nil, err
+		}
+	}
+	return append(make(Tuple, 0, len(l.elems)), l.elems...), nil
+}
+
 func (l *List) Attr(name string) (Value, error) { return builtinAttr(l, name, listMethods) }
 func (l *List) AttrNames() []string             { return builtinAttrNames(listMethods) }
 
@@ -1365,7 +1584,7 @@ type listIterator struct {
 	i int
 }
 
-var _ SafeIterator = &listIterator{}
+var _ SafeSizedIterator = &listIterator{}
 
 func (it *listIterator) Next(p *Value) bool {
 	if it.i < it.l.Len() {
@@ -1382,9 +1601,10 @@ func (it *listIterator) Done() {
 	}
 }
 
-func (it *listIterator) Safety() SafetyFlags       { return CPUSafe | MemSafe | TimeSafe | IOSafe }
-func (it *listIterator) BindThread(thread *Thread) {}
-func (it *listIterator) Err() error                { return nil }
+func (it *listIterator) Safety() SafetyFlags        { return CPUSafe | MemSafe | TimeSafe | IOSafe }
+func (it *listIterator) BindThread(thread *Thread)  {}
+func (it *listIterator) Err() error                 { return nil }
+func (it *listIterator) RemainingHint() (int, bool) { return it.l.Len() - it.i, true }
 
 func (l *List) SetIndex(i int, v Value) error {
 	if err := l.checkMutable("assign to element of"); err != nil {
@@ -1440,13 +1660,57 @@ func (t Tuple) Slice(start, end, step int) Value {
 	}
 
 	sign := signum(step)
-	var tuple Tuple
+	tuple := make(Tuple, 0, rangeLen(start, end, step))
 	for i := start; signum(end-i) == sign; i += step {
 		tuple = append(tuple, t[i])
 	}
 	return tuple
 }
 
+func (t Tuple) SafeSlice(thread *Thread, start, end, step int) (Value, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	if thread != nil {
+		if step == 1 {
+			// A contiguous slice shares the elements of the original.
+			if err := thread.AddAllocs(SliceTypeOverhead); err != nil {
+				return nil, err
+			}
+		} else {
+			n := SafeInt(rangeLen(start, end, step))
+			if err := thread.AddSteps(n); err != nil {
+				return nil, err
+			}
+			resultSize := SafeAdd(EstimateMakeSize(Tuple{}, n), SliceTypeOverhead)
+			if err := thread.AddAllocs(resultSize); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.Slice(start, end, step), nil
+}
+
+// SafeToList returns a new list containing the elements of the tuple.
+func (t Tuple) SafeToList(thread *Thread) (*List, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	n := SafeInt(len(t))
+	if thread != nil {
+		if err := thread.AddSteps(n); err != nil {
+			return nil, err
+		}
+		resultSize := SafeAdd(EstimateSize(&List{}), EstimateMakeSize([]Value{}, n))
+		if err := thread.AddAllocs(resultSize); err != nil {
+			return nil, err
+		}
+	}
+	return NewList(append(make([]Value, 0, len(t)), t...)), nil
+}
+
 func (t Tuple) Iterate() Iterator { return &tupleIterator{elems: t} }
 
 func (t Tuple) Freeze() {
@@ -1472,23 +1736,50 @@ func (x Tuple) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, erro
 	return sliceCompare(op, x, y, depth)
 }
 
-func (t Tuple) Hash() (uint32, error) {
+func (t Tuple) Hash() (uint32, error) { return safeHashDepth(nil, t, defaultMaxDepth) }
+
+// SafeHash returns the hash of x, as x.Hash does, but charges thread a step
+// for each tuple whose elements are hashed. Tuples nested more deeply than
+// the limit set by SetMaxDepth are rejected with an error. If x, or any
+// element of a tuple, is a HasSafeHash, its SafeHash method is used;
+// otherwise Hash is assumed to be cheap and is called directly.
+func SafeHash(thread *Thread, x Value) (uint32, error) {
+	return safeHashDepth(thread, x, thread.depthLimit())
+}
+
+func safeHashDepth(thread *Thread, x Value, depth int) (uint32, error) {
+	t, ok := x.(Tuple)
+	if !ok {
+		if x, ok := x.(HasSafeHash); ok {
+			return x.SafeHash(thread)
+		}
+		return x.Hash()
+	}
+	if depth < 1 {
+		return 0, errors.New("hashing exceeded maximum depth")
+	}
+	if thread != nil {
+		if err := thread.AddSteps(SafeInt(1)); err != nil {
+			return 0, err
+		}
+	}
+
 	// Use same algorithm as Python.
-	var x, mult uint32 = 0x345678, 1000003
+	var h, mult uint32 = 0x345678, 1000003
 	for _, elem := range t {
-		y, err := elem.Hash()
+		y, err := safeHashDepth(thread, elem, depth-1)
 		if err != nil {
 			return 0, err
 		}
-		x = x ^ y*mult
+		h = h ^ y*mult
 		mult += 82520 + uint32(len(t)+len(t))
 	}
-	return x, nil
+	return h, nil
 }
 
 type tupleIterator struct{ elems Tuple }
 
-var _ SafeIterator = &tupleIterator{}
+var _ SafeSizedIterator = &tupleIterator{}
 
 func (it *tupleIterator) Next(p *Value) bool {
 	if len(it.elems) > 0 {
@@ -1501,9 +1792,10 @@ func (it *tupleIterator) Next(p *Value) bool {
 
 func (it *tupleIterator) Done() {}
 
-func (it *tupleIterator) BindThread(thread *Thread) {}
-func (it *tupleIterator) Err() error                { return nil }
-func (it *tupleIterator) Safety() SafetyFlags       { return CPUSafe | MemSafe | TimeSafe | IOSafe }
+func (it *tupleIterator) BindThread(thread *Thread)  {}
+func (it *tupleIterator) Err() error                 { return nil }
+func (it *tupleIterator) Safety() SafetyFlags        { return CPUSafe | MemSafe | TimeSafe | IOSafe }
+func (it *tupleIterator) RemainingHint() (int, bool) { return len(it.elems), true }
 
 // A Set represents a Starlark set value.
 // The zero value of Set is a valid empty set.
@@ -1521,6 +1813,26 @@ func NewSet(size int) *Set {
 	return set
 }
 
+// SafeNewSet returns a set with initial space for at least size insertions
+// before rehashing, charging the space to thread.
+func SafeNewSet(thread *Thread, size int) (*Set, error) {
+	if thread != nil {
+		if size > 0 {
+			if err := thread.AddSteps(SafeInt(size)); err != nil {
+				return nil, err
+			}
+		}
+		if err := thread.AddAllocs(EstimateSize(&Set{})); err != nil {
+			return nil, err
+		}
+	}
+	set := new(Set)
+	if err := set.ht.init(thread, size); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
 func (s *Set) Delete(k Value) (found bool, err error) { _, found, err = s.ht.delete(nil, k); return }
 func (s *Set) Clear() error                           { return s.ht.clear(nil) }
 func (s *Set) Has(k Value) (found bool, err error)    { _, found, err = s.ht.lookup(nil, k); return }
@@ -1626,7 +1938,9 @@ func (s *Set) clone(thread *Thread) (*Set, error) {
 			return nil, err
 		}
 	}
-	set.ht.init(thread, int(s.ht.len))
+	if err := set.ht.init(thread, int(s.ht.len)); err != nil {
+		return nil, err
+	}
 	for e := s.ht.head; e != nil; e = e.next {
 		if err := set.ht.insert(thread, e.key, None); err != nil {
 			return nil, err
@@ -1763,6 +2077,104 @@ func (s *Set) safeSymmetricDifference(thread *Thread, other Iterator) (Value, er
 	return diff, nil
 }
 
+// safeDifferenceUpdate removes from s every element yielded by other.
+func (s *Set) safeDifferenceUpdate(thread *Thread, other Iterator) error {
+	if err := CheckSafety(thread, CPUSafe|MemSafe|TimeSafe|IOSafe); err != nil {
+		return err
+	}
+	if err := s.ht.checkMutable("delete from"); err != nil {
+		return err
+	}
+
+	var x Value
+	for other.Next(&x) {
+		if _, _, err := s.ht.delete(thread, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// safeIntersectionUpdate removes from s every element not yielded by other.
+// The relative order of the remaining elements is preserved.
+func (s *Set) safeIntersectionUpdate(thread *Thread, other Iterator) error {
+	if err := CheckSafety(thread, CPUSafe|MemSafe|TimeSafe|IOSafe); err != nil {
+		return err
+	}
+	if err := s.ht.checkMutable("delete from"); err != nil {
+		return err
+	}
+
+	keep, err := s.safeIntersection(thread, other)
+	if err != nil {
+		return err
+	}
+	if keep.Len() != s.Len() {
+		var next *entry
+		for e := s.ht.head; e != nil; e = next {
+			next = e.next // e is cleared on deletion
+			if _, found, err := keep.ht.lookup(thread, e.key); err != nil {
+				return err
+			} else if found {
+				continue
+			}
+			if _, _, err := s.ht.delete(thread, e.key); err != nil {
+				return err
+			}
+		}
+	}
+	return releaseTransientSet(thread, keep)
+}
+
+// safeSymmetricDifferenceUpdate updates s to contain the elements of either
+// s or other, but not both.
+func (s *Set) safeSymmetricDifferenceUpdate(thread *Thread, other Iterator) error {
+	if err := CheckSafety(thread, CPUSafe|MemSafe|TimeSafe|IOSafe); err != nil {
+		return err
+	}
+	if err := s.ht.checkMutable("insert into"); err != nil {
+		return err
+	}
+
+	// Elements repeated in other must only be toggled once.
+	toggle := new(Set)
+	if thread != nil {
+		if err := thread.AddAllocs(EstimateSize(toggle)); err != nil {
+			return err
+		}
+	}
+	var x Value
+	for other.Next(&x) {
+		if err := toggle.ht.insert(thread, x, None); err != nil {
+			return err
+		}
+	}
+	for e := toggle.ht.head; e != nil; e = e.next {
+		if _, found, err := s.ht.delete(thread, e.key); err != nil {
+			return err
+		} else if found {
+			continue
+		}
+		if err := s.ht.insert(thread, e.key, None); err != nil {
+			return err
+		}
+	}
+	return releaseTransientSet(thread, toggle)
+}
+
+// releaseTransientSet returns the memory held by a set which was only needed
+// for the duration of an operation.
+func releaseTransientSet(thread *Thread, set *Set) error {
+	if thread == nil {
+		return nil
+	}
+	size := EstimateSize(&Set{})
+	if len(set.ht.table) > 1 {
+		size = SafeAdd(size, EstimateMakeSize([]bucket{}, SafeInt(len(set.ht.table))))
+	}
+	return thread.AddAllocs(SafeNeg(size))
+}
+
 // toString returns the string form of value v.
 // It may be more efficient than v.String() for larger values.
 func toString(v Value) string {
@@ -1779,6 +2191,97 @@ func safeToString(thread *Thread, v Value) (string, error) {
 	return buf.String(), nil
 }
 
+// maxErrorReprLen is the length beyond which the repr of a value embedded
+// in an error message is truncated.
+const maxErrorReprLen = 256
+
+// errReprTruncated stops the rendering of a repr once it is long enough.
+var errReprTruncated = errors.New("repr truncated")
+
+// safeReprForError returns the repr of v for use in an error message,
+// truncated to about maxErrorReprLen bytes so that the message stays small
+// however large v is. Rendering stops as soon as the limit is reached. If
+// v cannot be rendered within the limits of thread, a placeholder naming
+// its type is returned instead, as the caller is already reporting an error.
+func safeReprForError(thread *Thread, v Value) string {
+	if i, ok := v.(Int); ok {
+		// Formatting a big int is superlinear, and its leading
+		// digits cannot be found without formatting all of it.
+		if _, iBig := i.get(); iBig != nil && iBig.BitLen() > 3*maxErrorReprLen {
+			return fmt.Sprintf("<int of %d bits>", iBig.BitLen())
+		}
+	}
+	out := &truncatingBuilder{max: maxErrorReprLen}
+	err := writeValue(thread, out, v, nil)
+	if err != nil && !errors.Is(err, errReprTruncated) {
+		return fmt.Sprintf("<%s>", v.Type())
+	}
+	if thread != nil {
+		if err := thread.AddSteps(SafeInt(out.Len())); err != nil {
+			return fmt.Sprintf("<%s>", v.Type())
+		}
+		if err := thread.AddAllocs(EstimateMakeSize([]byte{}, SafeInt(out.Cap()))); err != nil {
+			return fmt.Sprintf("<%s>", v.Type())
+		}
+	}
+	if errors.Is(err, errReprTruncated) {
+		return out.String() + "..."
+	}
+	return out.String()
+}
+
+// truncatingBuilder is a StringBuilder which holds at most max bytes,
+// failing with errReprTruncated once a write would exceed them. The
+// written prefix is cut at a character boundary.
+type truncatingBuilder struct {
+	strings.Builder
+	max int
+}
+
+var _ StringBuilder = &truncatingBuilder{}
+
+func (tb *truncatingBuilder) Write(b []byte) (int, error) {
+	return tb.WriteString(string(b))
+}
+
+func (tb *truncatingBuilder) WriteString(s string) (int, error) {
+	if room := tb.max - tb.Len(); len(s) > room {
+		for room > 0 && !utf8.RuneStart(s[room]) {
+			room--
+		}
+		tb.Builder.WriteString(s[:room])
+		return room, errReprTruncated
+	}
+	return tb.Builder.WriteString(s)
+}
+
+func (tb *truncatingBuilder) WriteByte(b byte) error {
+	if tb.Len() >= tb.max {
+		return errReprTruncated
+	}
+	return tb.Builder.WriteByte(b)
+}
+
+func (tb *truncatingBuilder) WriteRune(r rune) (int, error) {
+	n := utf8.RuneLen(r)
+	if n < 0 {
+		n = len(string(utf8.RuneError))
+	}
+	if tb.Len()+n > tb.max {
+		return 0, errReprTruncated
+	}
+	return tb.Builder.WriteRune(r)
+}
+
+func (tb *truncatingBuilder) Grow(n int) {
+	if room := tb.max - tb.Len(); n > room {
+		n = room
+	}
+	if n > 0 {
+		tb.Builder.Grow(n)
+	}
+}
+
 // writeValue writes x to out.
 //
 // path is used to detect cycles.
@@ -2139,14 +2642,144 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 	return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
 }
 
-func sameType(x, y Value) bool {
-	return reflect.TypeOf(x) == reflect.TypeOf(y) || x.Type() == y.Type()
+// SafeCompare compares two Starlark values in the same way as Compare,
+// but charges the thread one step for each element visited while
+// comparing the contents of lists, tuples and dicts, and for each byte
+// scanned while comparing strings and bytes. Recursion is limited by the
+// lesser of CompareLimit and the depth set by SetMaxDepth.
+func SafeCompare(thread *Thread, op syntax.Token, x, y Value) (bool, error) {
+	depth := CompareLimit
+	if limit := thread.depthLimit(); limit < depth {
+		depth = limit
+	}
+	return safeCompareDepth(thread, op, x, y, depth)
 }
 
-// threeway interprets a three-way comparison value cmp (-1, 0, +1)
-// as a boolean comparison (e.g. x < y).
-func threeway(op syntax.Token, cmp int) bool {
-	switch op {
+func safeCompareDepth(thread *Thread, op syntax.Token, x, y Value, depth int) (bool, error) {
+	if depth < 1 {
+		return false, fmt.Errorf("comparison exceeded maximum recursion depth")
+	}
+	switch x := x.(type) {
+	case *List:
+		if y, ok := y.(*List); ok {
+			return safeSliceCompare(thread, op, x.elems, y.elems, depth)
+		}
+	case Tuple:
+		if y, ok := y.(Tuple); ok {
+			return safeSliceCompare(thread, op, x, y, depth)
+		}
+	case *Dict:
+		if y, ok := y.(*Dict); ok && (op == syntax.EQL || op == syntax.NEQ) {
+			eq, err := safeDictsEqual(thread, x, y, depth)
+			if err != nil {
+				return false, err
+			}
+			return eq == (op == syntax.EQL), nil
+		}
+	case String:
+		if y, ok := y.(String); ok {
+			return safeStringCompare(thread, op, string(x), string(y))
+		}
+	case Bytes:
+		if y, ok := y.(Bytes); ok {
+			return safeStringCompare(thread, op, string(x), string(y))
+		}
+	}
+	return CompareDepth(op, x, y, depth)
+}
+
+// safeStringCompare compares the bytes of x and y, charging a step per
+// byte of their common prefix. Bytes are compared in chunks, so that each
+// is charged for before it is scanned, stopping at the first difference.
+func safeStringCompare(thread *Thread, op syntax.Token, x, y string) (bool, error) {
+	// Fast path: check length.
+	if len(x) != len(y) && (op == syntax.EQL || op == syntax.NEQ) {
+		return op == syntax.NEQ, nil
+	}
+
+	const chunkSize = 64
+	n := len(x)
+	if len(y) < n {
+		n = len(y)
+	}
+	for start := 0; start < n; start += chunkSize {
+		end := start + chunkSize
+		if end > n {
+			end = n
+		}
+		if thread != nil {
+			if err := thread.AddSteps(SafeInt(end - start)); err != nil {
+				return false, err
+			}
+		}
+		if cmp := strings.Compare(x[start:end], y[start:end]); cmp != 0 {
+			return threeway(op, cmp), nil
+		}
+	}
+	return threeway(op, len(x)-len(y)), nil
+}
+
+func safeSliceCompare(thread *Thread, op syntax.Token, x, y []Value, depth int) (bool, error) {
+	// Fast path: check length.
+	if len(x) != len(y) && (op == syntax.EQL || op == syntax.NEQ) {
+		return op == syntax.NEQ, nil
+	}
+
+	// Find first element that is not equal in both lists.
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if thread != nil {
+			if err := thread.AddSteps(SafeInt(1)); err != nil {
+				return false, err
+			}
+		}
+		if eq, err := safeCompareDepth(thread, syntax.EQL, x[i], y[i], depth-1); err != nil {
+			return false, err
+		} else if !eq {
+			switch op {
+			case syntax.EQL:
+				return false, nil
+			case syntax.NEQ:
+				return true, nil
+			default:
+				return safeCompareDepth(thread, op, x[i], y[i], depth-1)
+			}
+		}
+	}
+
+	return threeway(op, len(x)-len(y)), nil
+}
+
+func safeDictsEqual(thread *Thread, x, y *Dict, depth int) (bool, error) {
+	if x.Len() != y.Len() {
+		return false, nil
+	}
+	for e := x.ht.head; e != nil; e = e.next {
+		if thread != nil {
+			if err := thread.AddSteps(SafeInt(1)); err != nil {
+				return false, err
+			}
+		}
+		if yval, found, err := y.ht.lookup(thread, e.key); err != nil {
+			return false, err
+		} else if !found {
+			return false, nil
+		} else if eq, err := safeCompareDepth(thread, syntax.EQL, e.value, yval, depth-1); err != nil {
+			return false, err
+		} else if !eq {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func sameType(x, y Value) bool {
+	return reflect.TypeOf(x) == reflect.TypeOf(y) || x.Type() == y.Type()
+}
+
+// threeway interprets a three-way comparison value cmp (-1, 0, +1)
+// as a boolean comparison (e.g. x < y).
+func threeway(op syntax.Token, cmp int) bool {
+	switch op {
 	case syntax.EQL:
 		return cmp == 0
 	case syntax.NEQ:
@@ -2188,6 +2821,38 @@ func Len(x Value) int {
 	return -1
 }
 
+// A HasSafeLen is a value whose length may be expensive to compute, and so
+// is computed while respecting the safety of the thread.
+type HasSafeLen interface {
+	Value
+	SafeLen(thread *Thread) (int, error)
+}
+
+// SafeLen returns the length of a string or sequence value, and -1 for all
+// others, as Len does. If x is a HasSafeLen, its SafeLen method is used;
+// otherwise its length is assumed to be cheap and is computed directly.
+func SafeLen(thread *Thread, x Value) (int, error) {
+	if x, ok := x.(HasSafeLen); ok {
+		return x.SafeLen(thread)
+	}
+	return Len(x), nil
+}
+
+// IsFrozen reports whether x is a built-in mutable value (a list,
+// dict or set) that has been frozen. It returns false for all other
+// values, including immutable ones, which need no freezing.
+func IsFrozen(x Value) bool {
+	switch x := x.(type) {
+	case *List:
+		return x.frozen
+	case *Dict:
+		return x.ht.frozen
+	case *Set:
+		return x.ht.frozen
+	}
+	return false
+}
+
 // Iterate return a new iterator for the value if iterable, nil otherwise.
 // If the result is non-nil, the caller must call Done when finished with it.
 //
@@ -2200,15 +2865,29 @@ func Iterate(x Value) Iterator {
 	return nil
 }
 
+// remainingHint returns the number of elements which iter, an iterator
+// over x, has yet to yield, or -1 if this is not known.
+func remainingHint(x Value, iter Iterator) int {
+	if iter, ok := iter.(SafeSizedIterator); ok {
+		if n, ok := iter.RemainingHint(); ok {
+			return n
+		}
+	}
+	return Len(x)
+}
+
 // guardedIterator provides a wrapper around an iterator which performs
-// optional actions on Next calls.
+// optional actions on Next calls: charging a step and, if countValues is
+// set, reporting a value for each element.
 type guardedIterator struct {
-	iter   SafeIterator
-	thread *Thread
-	err    error
+	iter        SafeIterator
+	thread      *Thread
+	err         error
+	chargeSteps bool
+	countValues bool
 }
 
-var _ SafeIterator = &guardedIterator{}
+var _ SafeSizedIterator = &guardedIterator{}
 
 func (gi *guardedIterator) Next(p *Value) bool {
 	if gi.Err() != nil {
@@ -2216,12 +2895,18 @@ func (gi *guardedIterator) Next(p *Value) bool {
 	}
 
 	ok := gi.iter.Next(p)
-	if ok {
+	if ok && gi.chargeSteps {
 		if err := gi.thread.AddSteps(SafeInt(1)); err != nil {
 			gi.err = err
 			return false
 		}
 	}
+	if ok && gi.countValues {
+		if err := gi.thread.AddValues(1); err != nil {
+			gi.err = err
+			return false
+		}
+	}
 	return ok
 }
 func (gi *guardedIterator) Done() { gi.iter.Done() }
@@ -2237,6 +2922,12 @@ func (gi *guardedIterator) Safety() SafetyFlags {
 	return wrapperSafety & gi.iter.Safety()
 }
 func (gi *guardedIterator) BindThread(thread *Thread) { gi.thread = thread }
+func (gi *guardedIterator) RemainingHint() (int, bool) {
+	if iter, ok := gi.iter.(SafeSizedIterator); ok {
+		return iter.RemainingHint()
+	}
+	return 0, false
+}
 
 // SafeIterate creates an iterator which is bound then to the given
 // thread. This iterator will check safety and respect sandboxing
@@ -2251,15 +2942,23 @@ func SafeIterate(thread *Thread, x Value) (Iterator, error) {
 			if safeIter, ok := iter.(SafeIterator); ok {
 				safeIter.BindThread(thread)
 				if err := thread.CheckPermits(safeIter); err != nil {
+					safeIter.Done()
 					return nil, err
 				}
-				if !thread.Permits(NotSafe) {
-					safeIter = &guardedIterator{iter: safeIter}
+				chargeSteps := !thread.Permits(NotSafe)
+				countValues := thread.maxValues > 0
+				if chargeSteps || countValues {
+					safeIter = &guardedIterator{
+						iter:        safeIter,
+						chargeSteps: chargeSteps,
+						countValues: countValues,
+					}
 					safeIter.BindThread(thread)
 				}
 				return safeIter, nil
 			}
 			if err := thread.CheckPermits(NotSafe); err != nil {
+				iter.Done()
 				return nil, err
 			}
 		}
@@ -2270,6 +2969,757 @@ func SafeIterate(thread *Thread, x Value) (Iterator, error) {
 	return nil, ErrUnsupported
 }
 
+// NewSafeIterableFunc returns an iterable whose iterators lazily yield the
+// values produced by successive calls to fn, starting with n = 0. Iteration
+// stops as soon as fn reports !ok or returns an error.
+//
+// As fn receives the iterating thread, it is responsible for accounting for
+// the resources it uses: the resulting iterators declare themselves safe.
+// When iterated without a thread, fn is passed nil.
+func NewSafeIterableFunc(fn func(thread *Thread, n int) (Value, bool, error)) Iterable {
+	return &safeIterableFunc{fn: fn}
+}
+
+type safeIterableFunc struct {
+	fn func(thread *Thread, n int) (Value, bool, error)
+}
+
+var _ Iterable = &safeIterableFunc{}
+
+func (sif *safeIterableFunc) Freeze() {}
+func (sif *safeIterableFunc) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable: %s", sif.Type())
+}
+func (sif *safeIterableFunc) String() string    { return "<iterable>" }
+func (sif *safeIterableFunc) Truth() Bool       { return True }
+func (sif *safeIterableFunc) Type() string      { return "iterable" }
+func (sif *safeIterableFunc) Iterate() Iterator { return &safeIterableFuncIterator{fn: sif.fn} }
+
+type safeIterableFuncIterator struct {
+	fn     func(thread *Thread, n int) (Value, bool, error)
+	n      int
+	done   bool
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &safeIterableFuncIterator{}
+
+func (it *safeIterableFuncIterator) BindThread(thread *Thread) { it.thread = thread }
+
+func (it *safeIterableFuncIterator) Next(p *Value) bool {
+	if it.done || it.err != nil {
+		return false
+	}
+	v, ok, err := it.fn(it.thread, it.n)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if !ok {
+		it.done = true
+		return false
+	}
+	it.n++
+	*p = v
+	return true
+}
+
+func (*safeIterableFuncIterator) Done() {}
+
+func (it *safeIterableFuncIterator) Err() error { return it.err }
+func (it *safeIterableFuncIterator) Safety() SafetyFlags {
+	if it.thread == nil {
+		return NotSafe
+	}
+	return CPUSafe | MemSafe | TimeSafe | IOSafe
+}
+
+// SafeWindowed returns an iterator over the overlapping n-tuples of
+// consecutive elements yielded by iter: the windows of size 2 over a,
+// b, c are (a, b) and (b, c). If iter yields fewer than n elements, the
+// result yields nothing.
+//
+// Only the most recent n elements are retained, in a buffer allocated on
+// the first call to Next. Each element consumed costs a step and each
+// window yielded is accounted as a new tuple. SafeWindowed panics if n is
+// not positive.
+func SafeWindowed(thread *Thread, iter SafeIterator, n int) SafeIterator {
+	if n < 1 {
+		panic(fmt.Sprintf("SafeWindowed: invalid window size %d", n))
+	}
+	wi := &windowedIterator{iter: iter, size: n}
+	wi.BindThread(thread)
+	return wi
+}
+
+type windowedIterator struct {
+	iter SafeIterator
+	size int
+
+	// buf holds the current window as a ring buffer whose oldest
+	// element is at index start.
+	buf   []Value
+	start int
+
+	done   bool
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &windowedIterator{}
+
+func (wi *windowedIterator) BindThread(thread *Thread) {
+	wi.thread = thread
+	wi.iter.BindThread(thread)
+}
+
+func (wi *windowedIterator) Safety() SafetyFlags {
+	if wi.thread == nil {
+		return NotSafe
+	}
+	const wrapperSafety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	return wrapperSafety & wi.iter.Safety()
+}
+
+// advance reads the next element of the underlying iterator into p.
+func (wi *windowedIterator) advance(p *Value) bool {
+	if !wi.iter.Next(p) {
+		wi.done = true
+		return false
+	}
+	if wi.thread != nil {
+		if err := wi.thread.AddSteps(SafeInt(1)); err != nil {
+			wi.err = err
+			return false
+		}
+	}
+	return true
+}
+
+func (wi *windowedIterator) Next(p *Value) bool {
+	if wi.done || wi.err != nil {
+		return false
+	}
+
+	if wi.buf == nil {
+		if wi.thread != nil {
+			if err := wi.thread.AddAllocs(EstimateMakeSize([]Value{}, SafeInt(wi.size))); err != nil {
+				wi.err = err
+				return false
+			}
+		}
+		wi.buf = make([]Value, 0, wi.size)
+		for len(wi.buf) < wi.size-1 {
+			var elem Value
+			if !wi.advance(&elem) {
+				return false
+			}
+			wi.buf = append(wi.buf, elem)
+		}
+	}
+
+	var elem Value
+	if !wi.advance(&elem) {
+		return false
+	}
+	if len(wi.buf) < wi.size {
+		wi.buf = append(wi.buf, elem)
+	} else {
+		wi.buf[wi.start] = elem
+		wi.start = (wi.start + 1) % wi.size
+	}
+
+	if wi.thread != nil {
+		windowSize := SafeAdd(EstimateMakeSize(Tuple{}, SafeInt(wi.size)), SliceTypeOverhead)
+		if err := wi.thread.AddAllocs(windowSize); err != nil {
+			wi.err = err
+			return false
+		}
+	}
+	window := make(Tuple, wi.size)
+	n := copy(window, wi.buf[wi.start:])
+	copy(window[n:], wi.buf[:wi.start])
+	*p = window
+	return true
+}
+
+func (wi *windowedIterator) Done() { wi.iter.Done() }
+
+func (wi *windowedIterator) Err() error {
+	if wi.err != nil {
+		return wi.err
+	}
+	return wi.iter.Err()
+}
+
+// SafePairwise returns an iterator over the overlapping pairs of consecutive
+// elements yielded by iter: the pairs of a, b, c are (a, b) and (b, c). If
+// iter yields fewer than two elements, the result yields nothing.
+//
+// It is equivalent to SafeWindowed with a window of size 2.
+func SafePairwise(thread *Thread, iter SafeIterator) SafeIterator {
+	return SafeWindowed(thread, iter, 2)
+}
+
+// SafeAccumulate returns an iterator over the running accumulation of the
+// elements yielded by iter: each result is fn(acc, elem), where acc is the
+// previous result. If initial is non-nil it is yielded first and used as
+// the starting accumulator; otherwise the first element of iter is.
+//
+// Results are computed lazily, one per call to Next. Each element consumed
+// costs a step and each call to fn is accounted for its arguments, in
+// addition to whatever fn itself uses. The iterator must be bound to a
+// thread before use, as fn is called on it.
+func SafeAccumulate(thread *Thread, iter SafeIterator, fn Callable, initial Value) SafeIterator {
+	ai := &accumulateIterator{iter: iter, fn: fn, acc: initial}
+	ai.BindThread(thread)
+	return ai
+}
+
+type accumulateIterator struct {
+	iter    SafeIterator
+	fn      Callable
+	acc     Value
+	started bool
+
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &accumulateIterator{}
+
+func (ai *accumulateIterator) BindThread(thread *Thread) {
+	ai.thread = thread
+	ai.iter.BindThread(thread)
+}
+
+func (ai *accumulateIterator) Safety() SafetyFlags {
+	if ai.thread == nil {
+		return NotSafe
+	}
+	const wrapperSafety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	return wrapperSafety & ai.iter.Safety()
+}
+
+func (ai *accumulateIterator) Next(p *Value) bool {
+	if ai.err != nil {
+		return false
+	}
+	if ai.thread == nil {
+		ai.err = errors.New("SafeAccumulate: iterator not bound to a thread")
+		return false
+	}
+
+	if !ai.started {
+		ai.started = true
+		if ai.acc != nil {
+			*p = ai.acc
+			return true
+		}
+	}
+
+	var elem Value
+	if !ai.iter.Next(&elem) {
+		return false
+	}
+	if err := ai.thread.AddSteps(SafeInt(1)); err != nil {
+		ai.err = err
+		return false
+	}
+	if ai.acc == nil {
+		ai.acc = elem
+	} else {
+		argsSize := SafeAdd(EstimateMakeSize(Tuple{}, SafeInt(2)), SliceTypeOverhead)
+		if err := ai.thread.AddAllocs(argsSize); err != nil {
+			ai.err = err
+			return false
+		}
+		acc, err := Call(ai.thread, ai.fn, Tuple{ai.acc, elem}, nil)
+		if err != nil {
+			ai.err = err
+			return false
+		}
+		ai.acc = acc
+	}
+	*p = ai.acc
+	return true
+}
+
+func (ai *accumulateIterator) Done() { ai.iter.Done() }
+
+func (ai *accumulateIterator) Err() error {
+	if ai.err != nil {
+		return ai.err
+	}
+	return ai.iter.Err()
+}
+
+// SafeTakeWhile returns an iterator over the elements of iter for which
+// pred(elem) is true, stopping at the first for which it is false.
+//
+// Elements are examined lazily, one per call to Next. Each element consumed
+// costs a step and each call to pred is accounted for its arguments, in
+// addition to whatever pred itself and the truth of its result use. The
+// iterator must be bound to a thread before use, as pred is called on it.
+func SafeTakeWhile(thread *Thread, iter SafeIterator, pred Callable) SafeIterator {
+	wi := &whileIterator{name: "SafeTakeWhile", iter: iter, pred: pred}
+	wi.BindThread(thread)
+	return wi
+}
+
+// SafeDropWhile returns an iterator which skips the elements of iter for
+// which pred(elem) is true and yields the rest, beginning with the first
+// for which it is false. Once an element has been yielded, pred is no
+// longer called.
+//
+// It is accounted for as SafeTakeWhile is, and must likewise be bound to a
+// thread before use.
+func SafeDropWhile(thread *Thread, iter SafeIterator, pred Callable) SafeIterator {
+	wi := &whileIterator{name: "SafeDropWhile", iter: iter, pred: pred, drop: true}
+	wi.BindThread(thread)
+	return wi
+}
+
+type whileIterator struct {
+	name string
+	iter SafeIterator
+	pred Callable
+	drop bool // skip, rather than yield, the leading elements
+	done bool // no more calls to pred are needed
+
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &whileIterator{}
+
+func (wi *whileIterator) BindThread(thread *Thread) {
+	wi.thread = thread
+	wi.iter.BindThread(thread)
+}
+
+func (wi *whileIterator) Safety() SafetyFlags {
+	if wi.thread == nil {
+		return NotSafe
+	}
+	const wrapperSafety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	return wrapperSafety & wi.iter.Safety()
+}
+
+func (wi *whileIterator) Next(p *Value) bool {
+	if wi.err != nil {
+		return false
+	}
+	if wi.thread == nil {
+		wi.err = fmt.Errorf("%s: iterator not bound to a thread", wi.name)
+		return false
+	}
+	if wi.done && !wi.drop {
+		return false
+	}
+
+	var elem Value
+	for wi.iter.Next(&elem) {
+		if err := wi.thread.AddSteps(SafeInt(1)); err != nil {
+			wi.err = err
+			return false
+		}
+		if wi.done {
+			*p = elem
+			return true
+		}
+
+		argsSize := SafeAdd(EstimateMakeSize(Tuple{}, SafeInt(1)), SliceTypeOverhead)
+		if err := wi.thread.AddAllocs(argsSize); err != nil {
+			wi.err = err
+			return false
+		}
+		result, err := Call(wi.thread, wi.pred, Tuple{elem}, nil)
+		if err != nil {
+			wi.err = err
+			return false
+		}
+		ok, err := SafeTruth(wi.thread, result)
+		if err != nil {
+			wi.err = err
+			return false
+		}
+		if !ok {
+			wi.done = true
+			if !wi.drop {
+				return false
+			}
+			*p = elem
+			return true
+		}
+		if !wi.drop {
+			*p = elem
+			return true
+		}
+	}
+	return false
+}
+
+func (wi *whileIterator) Done() { wi.iter.Done() }
+
+func (wi *whileIterator) Err() error {
+	if wi.err != nil {
+		return wi.err
+	}
+	return wi.iter.Err()
+}
+
+// SafeRoundRobin returns an iterator which yields an element from each of
+// iters in turn, skipping those which are exhausted, until all are. If a
+// source fails, iteration stops and its error is reported by Err.
+//
+// Beyond a list of the sources, allocated on the first call to Next, no
+// memory is used. Each element yielded costs a step.
+func SafeRoundRobin(thread *Thread, iters ...SafeIterator) SafeIterator {
+	rr := &roundRobinIterator{iters: iters}
+	rr.BindThread(thread)
+	return rr
+}
+
+type roundRobinIterator struct {
+	iters []SafeIterator
+
+	// active holds the sources which are not yet exhausted, in the
+	// order in which they are visited; next is the index of the
+	// source to visit next.
+	active  []SafeIterator
+	next    int
+	started bool
+
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &roundRobinIterator{}
+
+func (rr *roundRobinIterator) BindThread(thread *Thread) {
+	rr.thread = thread
+	for _, iter := range rr.iters {
+		iter.BindThread(thread)
+	}
+}
+
+func (rr *roundRobinIterator) Safety() SafetyFlags {
+	if rr.thread == nil {
+		return NotSafe
+	}
+	safety := CPUSafe | MemSafe | TimeSafe | IOSafe
+	for _, iter := range rr.iters {
+		safety &= iter.Safety()
+	}
+	return safety
+}
+
+func (rr *roundRobinIterator) Next(p *Value) bool {
+	if rr.err != nil {
+		return false
+	}
+	if !rr.started {
+		rr.started = true
+		if rr.thread != nil {
+			if err := rr.thread.AddAllocs(EstimateMakeSize([]SafeIterator{}, SafeInt(len(rr.iters)))); err != nil {
+				rr.err = err
+				return false
+			}
+		}
+		rr.active = append([]SafeIterator(nil), rr.iters...)
+	}
+	for len(rr.active) > 0 {
+		if rr.next >= len(rr.active) {
+			rr.next = 0
+		}
+		iter := rr.active[rr.next]
+		if iter.Next(p) {
+			rr.next++
+			if rr.thread != nil {
+				if err := rr.thread.AddSteps(SafeInt(1)); err != nil {
+					rr.err = err
+					return false
+				}
+			}
+			return true
+		}
+		if err := iter.Err(); err != nil {
+			rr.err = err
+			return false
+		}
+		// Drop the exhausted source; the next one takes its index.
+		rr.active = append(rr.active[:rr.next], rr.active[rr.next+1:]...)
+	}
+	return false
+}
+
+func (rr *roundRobinIterator) Done() {
+	for _, iter := range rr.iters {
+		iter.Done()
+	}
+}
+
+func (rr *roundRobinIterator) Err() error { return rr.err }
+
+// SafeZipLongest returns an iterator which yields tuples holding an element
+// from each of iters, like zip, but which continues until all of them are
+// exhausted. The positions of the sources which ran out early are filled
+// with fillvalue, or None if it is nil. If a source fails, iteration stops
+// and its error is reported by Err.
+//
+// Each tuple yielded is allocated afresh and costs a step per source.
+func SafeZipLongest(thread *Thread, fillvalue Value, iters ...SafeIterator) SafeIterator {
+	if fillvalue == nil {
+		fillvalue = None
+	}
+	zl := &zipLongestIterator{iters: iters, fillvalue: fillvalue}
+	zl.BindThread(thread)
+	return zl
+}
+
+type zipLongestIterator struct {
+	iters     []SafeIterator
+	fillvalue Value
+
+	// exhausted records which sources have run out, so that they are
+	// not asked for further elements; remaining counts the others.
+	exhausted []bool
+	remaining int
+	started   bool
+
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &zipLongestIterator{}
+
+func (zl *zipLongestIterator) BindThread(thread *Thread) {
+	zl.thread = thread
+	for _, iter := range zl.iters {
+		iter.BindThread(thread)
+	}
+}
+
+func (zl *zipLongestIterator) Safety() SafetyFlags {
+	if zl.thread == nil {
+		return NotSafe
+	}
+	safety := CPUSafe | MemSafe | TimeSafe | IOSafe
+	for _, iter := range zl.iters {
+		safety &= iter.Safety()
+	}
+	return safety
+}
+
+func (zl *zipLongestIterator) Next(p *Value) bool {
+	if zl.err != nil {
+		return false
+	}
+	cols := len(zl.iters)
+	if !zl.started {
+		zl.started = true
+		if zl.thread != nil {
+			if err := zl.thread.AddAllocs(EstimateMakeSize([]bool{}, SafeInt(cols))); err != nil {
+				zl.err = err
+				return false
+			}
+		}
+		zl.exhausted = make([]bool, cols)
+		zl.remaining = cols
+	}
+	if zl.remaining == 0 {
+		return false
+	}
+	if zl.thread != nil {
+		if err := zl.thread.AddSteps(SafeInt(cols)); err != nil {
+			zl.err = err
+			return false
+		}
+	}
+	tuple := make(Tuple, cols)
+	for i, iter := range zl.iters {
+		if !zl.exhausted[i] {
+			if iter.Next(&tuple[i]) {
+				continue
+			}
+			if err := iter.Err(); err != nil {
+				zl.err = err
+				return false
+			}
+			zl.exhausted[i] = true
+			zl.remaining--
+		}
+		tuple[i] = zl.fillvalue
+	}
+	if zl.remaining == 0 {
+		// Every source ran out on this row, which is therefore all
+		// padding and not part of the result, so is not charged.
+		return false
+	}
+	if zl.thread != nil {
+		tupleSize := SafeAdd(EstimateMakeSize(Tuple{}, SafeInt(cols)), SliceTypeOverhead)
+		if err := zl.thread.AddAllocs(tupleSize); err != nil {
+			zl.err = err
+			return false
+		}
+	}
+	*p = tuple
+	return true
+}
+
+func (zl *zipLongestIterator) Done() {
+	for _, iter := range zl.iters {
+		iter.Done()
+	}
+}
+
+func (zl *zipLongestIterator) Err() error { return zl.err }
+
+// SafeWithElementDeadline returns an iterator which yields the elements of
+// iter, failing if any one of them takes longer than d to produce. The error
+// reported by Err then wraps context.DeadlineExceeded.
+//
+// Once an element is overdue the thread is cancelled, so a source which
+// blocks while it watches the thread's context is interrupted. The
+// iteration as a whole is not bounded: use Thread.SetDeadline for that.
+func SafeWithElementDeadline(thread *Thread, iter SafeIterator, d time.Duration) SafeIterator {
+	di := &deadlineIterator{iter: iter, timeout: d}
+	di.BindThread(thread)
+	return di
+}
+
+type deadlineIterator struct {
+	iter    SafeIterator
+	timeout time.Duration
+
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &deadlineIterator{}
+
+func (di *deadlineIterator) BindThread(thread *Thread) {
+	di.thread = thread
+	di.iter.BindThread(thread)
+}
+
+func (di *deadlineIterator) Safety() SafetyFlags {
+	if di.thread == nil {
+		return NotSafe
+	}
+	const wrapperSafety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	return wrapperSafety & di.iter.Safety()
+}
+
+func (di *deadlineIterator) Next(p *Value) bool {
+	if di.err != nil {
+		return false
+	}
+	if di.thread == nil {
+		return di.iter.Next(p)
+	}
+	err := fmt.Errorf("iterator element exceeded deadline of %s: %w", di.timeout, context.DeadlineExceeded)
+	timer := time.AfterFunc(di.timeout, func() {
+		di.thread.cancel(err)
+	})
+	ok := di.iter.Next(p)
+	if !timer.Stop() {
+		// The timer fired, so the thread is already cancelled.
+		di.err = err
+		return false
+	}
+	return ok
+}
+
+func (di *deadlineIterator) Done() { di.iter.Done() }
+
+func (di *deadlineIterator) Err() error {
+	if di.err != nil {
+		return di.err
+	}
+	return di.iter.Err()
+}
+
+// SafeByteBudgetIterator returns an iterator which yields the elements of
+// iter, failing once the combined length of the strings and bytes yielded
+// would exceed maxBytes. Each int yielded counts as a single byte, as when
+// building bytes from an iterable, and elements of other types do not
+// count towards the budget. Once the budget is exceeded, the thread is
+// cancelled and the error reported by Err wraps ErrSafety.
+//
+// This bounds the size of results built up from many small strings, such
+// as those produced by joining the elements of an iterable. string.join
+// and bytes apply it with the budget set by Thread.SetMaxJoinBytes.
+func SafeByteBudgetIterator(thread *Thread, iter SafeIterator, maxBytes uint64) SafeIterator {
+	bi := &byteBudgetIterator{iter: iter, maxBytes: maxBytes}
+	bi.BindThread(thread)
+	return bi
+}
+
+type byteBudgetIterator struct {
+	iter     SafeIterator
+	maxBytes uint64
+	bytes    uint64
+
+	thread *Thread
+	err    error
+}
+
+var _ SafeIterator = &byteBudgetIterator{}
+
+func (bi *byteBudgetIterator) BindThread(thread *Thread) {
+	bi.thread = thread
+	bi.iter.BindThread(thread)
+}
+
+func (bi *byteBudgetIterator) Safety() SafetyFlags {
+	if bi.thread == nil {
+		return NotSafe
+	}
+	const wrapperSafety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	return wrapperSafety & bi.iter.Safety()
+}
+
+func (bi *byteBudgetIterator) Next(p *Value) bool {
+	if bi.err != nil {
+		return false
+	}
+	var elem Value
+	if !bi.iter.Next(&elem) {
+		return false
+	}
+	var n uint64
+	switch elem := elem.(type) {
+	case String:
+		n = uint64(len(elem))
+	case Bytes:
+		n = uint64(len(elem))
+	case Int:
+		n = 1
+	}
+	if n > bi.maxBytes-bi.bytes {
+		bi.err = fmt.Errorf("iterator exceeded byte budget of %d: %w", bi.maxBytes, ErrSafety)
+		if bi.thread != nil {
+			bi.thread.cancel(bi.err)
+		}
+		return false
+	}
+	bi.bytes += n
+	*p = elem
+	return true
+}
+
+func (bi *byteBudgetIterator) Done() { bi.iter.Done() }
+
+func (bi *byteBudgetIterator) Err() error {
+	if bi.err != nil {
+		return bi.err
+	}
+	return bi.iter.Err()
+}
+
 // Bytes is the type of a Starlark binary string.
 //
 // A Bytes encapsulates an immutable sequence of bytes.
@@ -2287,9 +3737,10 @@ func SafeIterate(thread *Thread, x Value) (Iterator, error) {
 type Bytes string
 
 var (
-	_ Comparable = Bytes("")
-	_ Sliceable  = Bytes("")
-	_ Indexable  = Bytes("")
+	_ Comparable    = Bytes("")
+	_ Sliceable     = Bytes("")
+	_ SafeSliceable = Bytes("")
+	_ Indexable     = Bytes("")
 )
 
 func (b Bytes) SafeString(thread *Thread, sb StringBuilder) error {
@@ -2342,13 +3793,26 @@ func (b Bytes) Slice(start, end, step int) Value {
 	}
 
 	sign := signum(step)
-	var str []byte
+	str := make([]byte, 0, rangeLen(start, end, step))
 	for i := start; signum(end-i) == sign; i += step {
 		str = append(str, b[i])
 	}
 	return Bytes(str)
 }
 
+func (b Bytes) SafeSlice(thread *Thread, start, end, step int) (Value, error) {
+	const safety = CPUSafe | MemSafe | TimeSafe | IOSafe
+	if err := CheckSafety(thread, safety); err != nil {
+		return nil, err
+	}
+	if thread != nil {
+		if err := accountStringSlice(thread, start, end, step); err != nil {
+			return nil, err
+		}
+	}
+	return b.Slice(start, end, step), nil
+}
+
 func (x Bytes) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error) {
 	y := y_.(Bytes)
 	return threeway(op, strings.Compare(string(x), string(y))), nil
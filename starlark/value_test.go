@@ -7,9 +7,12 @@ package starlark_test
 // This file defines tests of the Value API.
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/canonical/starlark/starlark"
 	"github.com/canonical/starlark/startest"
@@ -49,6 +52,556 @@ func TestListAppend(t *testing.T) {
 	}
 }
 
+func TestIsFrozen(t *testing.T) {
+	values := []starlark.Value{
+		starlark.NewList(nil),
+		starlark.NewDict(0),
+		starlark.NewSet(0),
+	}
+	for _, v := range values {
+		if starlark.IsFrozen(v) {
+			t.Errorf("new %s reported as frozen", v.Type())
+		}
+		v.Freeze()
+		if !starlark.IsFrozen(v) {
+			t.Errorf("frozen %s not reported as frozen", v.Type())
+		}
+	}
+
+	immutable := starlark.MakeInt(1)
+	immutable.Freeze()
+	if starlark.IsFrozen(immutable) {
+		t.Error("int reported as frozen")
+	}
+}
+
+func TestCapacityHints(t *testing.T) {
+	constructors := map[string]func(thread *starlark.Thread, size int) (starlark.Value, error){
+		"dict": func(thread *starlark.Thread, size int) (starlark.Value, error) {
+			return starlark.SafeNewDict(thread, size)
+		},
+		"set": func(thread *starlark.Thread, size int) (starlark.Value, error) {
+			return starlark.SafeNewSet(thread, size)
+		},
+	}
+	for name, construct := range constructors {
+		construct := construct
+		t.Run(name, func(t *testing.T) {
+			t.Run("resources", func(t *testing.T) {
+				st := startest.From(t)
+				st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+				st.SetMaxSteps(1)
+				st.RunThread(func(thread *starlark.Thread) {
+					value, err := construct(thread, st.N)
+					if err != nil {
+						st.Fatal(err)
+					}
+					st.KeepAlive(value)
+				})
+			})
+
+			t.Run("huge-hint", func(t *testing.T) {
+				thread := &starlark.Thread{}
+				thread.SetMaxAllocs(1 << 20)
+				// Building this table would need terabytes.
+				_, err := construct(thread, 1<<40)
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				expected := &starlark.AllocsSafetyError{}
+				if !errors.As(err, &expected) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			})
+		})
+	}
+}
+
+func TestSafeHash(t *testing.T) {
+	nested := func(depth int) starlark.Value {
+		var v starlark.Value = starlark.MakeInt(1)
+		for i := 0; i < depth; i++ {
+			v = starlark.Tuple{v, starlark.String("x")}
+		}
+		return v
+	}
+
+	t.Run("consistent", func(t *testing.T) {
+		for _, v := range []starlark.Value{
+			starlark.String("a"),
+			starlark.MakeInt(42),
+			starlark.Tuple{},
+			nested(10),
+		} {
+			want, err := v.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := starlark.SafeHash(&starlark.Thread{}, v); err != nil {
+				t.Errorf("%v: %v", v, err)
+			} else if got != want {
+				t.Errorf("%v: inconsistent hash: got %d, want %d", v, got, want)
+			}
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		key := costlyHashValue(1000)
+
+		t.Run("preferred", func(t *testing.T) {
+			thread := &starlark.Thread{}
+			if _, err := starlark.SafeHash(thread, starlark.Tuple{key}); err != nil {
+				t.Fatal(err)
+			}
+			// One step for the tuple, and the rest for its element.
+			if steps, _ := thread.Steps(); steps != 1+int64(key) {
+				t.Errorf("unexpected steps: got %d, want %d", steps, 1+key)
+			}
+		})
+
+		t.Run("budget", func(t *testing.T) {
+			thread := &starlark.Thread{}
+			thread.RequireSafety(starlark.CPUSafe)
+			thread.SetMaxSteps(int64(key) / 2)
+			set := starlark.Universe["set"]
+			elems := starlark.NewList([]starlark.Value{key})
+			_, err := starlark.Call(thread, set, starlark.Tuple{elems}, nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			expected := &starlark.StepsSafetyError{}
+			if !errors.As(err, &expected) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	})
+
+	t.Run("unhashable", func(t *testing.T) {
+		v := starlark.Tuple{starlark.NewList(nil)}
+		if _, err := starlark.SafeHash(&starlark.Thread{}, v); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("depth", func(t *testing.T) {
+		key := nested(100)
+		thread := &starlark.Thread{}
+		thread.SetMaxDepth(100)
+		dict := starlark.NewDict(1)
+		if err := dict.SafeSetKey(thread, key, starlark.None); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		thread.SetMaxDepth(99)
+		if _, _, err := dict.SafeGet(thread, key); err == nil {
+			t.Error("expected error")
+		} else if err.Error() != "hashing exceeded maximum depth" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("very-deep", func(t *testing.T) {
+		// Hashing fails cleanly rather than exhausting the stack.
+		key := nested(1_000_000)
+		_, err := starlark.Eval(&starlark.Thread{}, "hash.star", "{key: 1}", starlark.StringDict{"key": key})
+		if err == nil {
+			t.Error("expected error")
+		} else if !strings.Contains(err.Error(), "hashing exceeded maximum depth") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := key.Hash(); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			thread.SetMaxDepth(st.N + 1)
+			if _, err := starlark.SafeHash(thread, nested(st.N)); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("compare-depth", func(t *testing.T) {
+		x, y := nested(5), nested(5)
+		if eq, err := starlark.SafeCompare(&starlark.Thread{}, syntax.EQL, x, y); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if !eq {
+			t.Error("nested tuples compared unequal")
+		}
+		thread := &starlark.Thread{}
+		thread.SetMaxDepth(5)
+		if _, err := starlark.SafeCompare(thread, syntax.EQL, x, y); err == nil {
+			t.Error("expected error")
+		} else if err.Error() != "comparison exceeded maximum recursion depth" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+// costlyHashValue is a hashable value whose hash costs as many steps as
+// its magnitude.
+type costlyHashValue int
+
+var _ starlark.HasSafeHash = costlyHashValue(0)
+
+func (v costlyHashValue) String() string        { return fmt.Sprintf("costlyHashValue(%d)", int(v)) }
+func (v costlyHashValue) Type() string          { return "costlyHashValue" }
+func (v costlyHashValue) Freeze()               {}
+func (v costlyHashValue) Truth() starlark.Bool  { return v != 0 }
+func (v costlyHashValue) Hash() (uint32, error) { return uint32(v), nil }
+
+func (v costlyHashValue) SafeHash(thread *starlark.Thread) (uint32, error) {
+	if thread != nil {
+		if err := thread.AddSteps(starlark.SafeInt(int(v))); err != nil {
+			return 0, err
+		}
+	}
+	return v.Hash()
+}
+
+func TestHashtableKeyIdentity(t *testing.T) {
+	const tupleLen = 10_000
+	key := make(starlark.Tuple, tupleLen)
+	for i := range key {
+		key[i] = starlark.MakeInt(i)
+	}
+	equalKey := append(starlark.Tuple(nil), key...)
+
+	dict := starlark.NewDict(1)
+	if err := dict.SetKey(key, starlark.True); err != nil {
+		t.Fatal(err)
+	}
+	set := starlark.NewSet(1)
+	if err := set.Insert(key); err != nil {
+		t.Fatal(err)
+	}
+
+	lookupSteps := func(k starlark.Value) int64 {
+		thread := &starlark.Thread{}
+		if v, found, err := dict.SafeGet(thread, k); err != nil {
+			t.Fatal(err)
+		} else if !found || v != starlark.True {
+			t.Fatalf("key not found")
+		}
+		steps, _ := thread.Steps()
+		return steps
+	}
+
+	t.Run("identical", func(t *testing.T) {
+		if steps := lookupSteps(key); steps > 10 {
+			t.Errorf("identical key was compared in depth: %d steps", steps)
+		}
+	})
+
+	t.Run("equal", func(t *testing.T) {
+		if steps := lookupSteps(equalKey); steps < tupleLen {
+			t.Errorf("equal key comparison not accounted for: got %d steps, want at least %d", steps, tupleLen)
+		}
+	})
+
+	t.Run("repeated", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMaxSteps(10)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				if _, found, err := dict.SafeGet(thread, key); err != nil {
+					st.Error(err)
+				} else if !found {
+					st.Error("key not found")
+				}
+				if found, err := starlark.SafeBinary(thread, syntax.IN, key, set); err != nil {
+					st.Error(err)
+				} else if found != starlark.True {
+					st.Error("key not found")
+				}
+			}
+		})
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(tupleLen / 2)
+		_, _, err := dict.SafeGet(thread, equalKey)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestListSafeToTuple(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		const expected = starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(expected)
+		if _, err := starlark.NewList(nil).SafeToTuple(thread); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("result", func(t *testing.T) {
+		elems := []starlark.Value{starlark.MakeInt(1), starlark.String("a"), starlark.None}
+		list := starlark.NewList(elems)
+		result, err := list.SafeToTuple(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eq, err := starlark.Equal(result, starlark.Tuple(elems)); err != nil {
+			t.Fatal(err)
+		} else if !eq {
+			t.Errorf("unexpected result: got %v, want %v", result, starlark.Tuple(elems))
+		}
+		if err := list.Append(starlark.True); err != nil {
+			t.Fatal(err)
+		}
+		if result.Len() != len(elems) {
+			t.Error("result shares its backing array with the list")
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			list := starlark.NewList(make([]starlark.Value, st.N))
+			if _, err := list.SafeToTuple(thread); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		const n = 1000
+
+		list := starlark.NewList(make([]starlark.Value, n))
+		thread := &starlark.Thread{}
+		if _, err := list.SafeToTuple(thread); err != nil {
+			t.Fatal(err)
+		}
+		if count := thread.AllocCount(); count != 1 {
+			t.Errorf("unexpected allocation count: got %d, want 1", count)
+		}
+		want := mustInt64(starlark.SafeAdd(starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(n)), starlark.SliceTypeOverhead))
+		if allocs, _ := thread.Allocs(); allocs != want {
+			t.Errorf("unexpected result size: got %d, want %d", allocs, want)
+		}
+	})
+
+	t.Run("resources", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			list := starlark.NewList(make([]starlark.Value, st.N))
+			result, err := list.SafeToTuple(thread)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
+}
+
+func TestTupleSafeToList(t *testing.T) {
+	t.Run("safety-respected", func(t *testing.T) {
+		const expected = starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe
+
+		thread := &starlark.Thread{}
+		thread.RequireSafety(expected)
+		if _, err := (starlark.Tuple{}).SafeToList(thread); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("result", func(t *testing.T) {
+		tuple := starlark.Tuple{starlark.MakeInt(1), starlark.String("a"), starlark.None}
+		result, err := tuple.SafeToList(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eq, err := starlark.Equal(result, starlark.NewList(tuple)); err != nil {
+			t.Fatal(err)
+		} else if !eq {
+			t.Errorf("unexpected result: got %v, want %v", result, starlark.NewList(tuple))
+		}
+		if err := result.SetIndex(0, starlark.True); err != nil {
+			t.Fatal(err)
+		}
+		if tuple[0] == starlark.True {
+			t.Error("result shares its backing array with the tuple")
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			tuple := make(starlark.Tuple, st.N)
+			if _, err := tuple.SafeToList(thread); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		const n = 1000
+
+		tuple := make(starlark.Tuple, n)
+		thread := &starlark.Thread{}
+		if _, err := tuple.SafeToList(thread); err != nil {
+			t.Fatal(err)
+		}
+		if count := thread.AllocCount(); count != 1 {
+			t.Errorf("unexpected allocation count: got %d, want 1", count)
+		}
+		want := mustInt64(starlark.SafeAdd(starlark.EstimateSize(&starlark.List{}), starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(n))))
+		if allocs, _ := thread.Allocs(); allocs != want {
+			t.Errorf("unexpected result size: got %d, want %d", allocs, want)
+		}
+	})
+
+	t.Run("resources", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			tuple := make(starlark.Tuple, st.N)
+			result, err := tuple.SafeToList(thread)
+			if err != nil {
+				st.Error(err)
+			}
+			st.KeepAlive(result)
+		})
+	})
+}
+
+func TestSafeDeepMerge(t *testing.T) {
+	eval := func(t *testing.T, expr string) *starlark.Dict {
+		v, err := starlark.Eval(&starlark.Thread{}, "<expr>", expr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v.(*starlark.Dict)
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		dst := eval(t, `{"a": 1, "b": {"c": 2, "d": {"e": 3}}, "f": {"g": 4}}`)
+		src := eval(t, `{"a": 10, "b": {"d": {"h": 5}, "i": 6}, "f": 7, "j": {"k": {}}}`)
+		thread := &starlark.Thread{}
+		if err := starlark.SafeDeepMerge(thread, dst, src); err != nil {
+			t.Fatal(err)
+		}
+		want := eval(t, `{"a": 10, "b": {"c": 2, "d": {"e": 3, "h": 5}, "i": 6}, "f": 7, "j": {"k": {}}}`)
+		if eq, err := starlark.Equal(dst, want); err != nil {
+			t.Fatal(err)
+		} else if !eq {
+			t.Errorf("unexpected merge result: got %v, want %v", dst, want)
+		}
+
+		// Dicts copied from src are not shared with it.
+		j, _, _ := dst.Get(starlark.String("j"))
+		srcJ, _, _ := src.Get(starlark.String("j"))
+		if j == srcJ {
+			t.Error("nested dict was shared rather than copied")
+		}
+	})
+
+	t.Run("frozen", func(t *testing.T) {
+		dst := eval(t, `{"a": {"b": 1}}`)
+		dst.Freeze()
+		src := eval(t, `{"a": {"c": 2}}`)
+		if err := starlark.SafeDeepMerge(&starlark.Thread{}, dst, src); err == nil {
+			t.Error("expected error merging into frozen dict")
+		}
+	})
+
+	t.Run("max-depth", func(t *testing.T) {
+		const nested = `{"a": {"b": {"c": 1}}}`
+		thread := &starlark.Thread{}
+		thread.SetMaxDepth(3)
+		if err := starlark.SafeDeepMerge(thread, eval(t, nested), eval(t, nested)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		thread.SetMaxDepth(2)
+		err := starlark.SafeDeepMerge(thread, eval(t, nested), eval(t, nested))
+		if err == nil {
+			t.Error("expected error")
+		} else if err.Error() != "deep merge exceeded maximum depth" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		cyclic := starlark.NewDict(1)
+		cyclic.SetKey(starlark.String("self"), cyclic)
+		err := starlark.SafeDeepMerge(&starlark.Thread{}, cyclic, cyclic)
+		if err == nil {
+			t.Error("expected error")
+		} else if err.Error() != "deep merge exceeded maximum depth" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("resources", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe | starlark.MemSafe)
+		st.SetMinSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			src := starlark.NewDict(st.N)
+			for i := 0; i < st.N; i++ {
+				inner := starlark.NewDict(1)
+				inner.SetKey(starlark.MakeInt(i), starlark.None)
+				src.SetKey(starlark.MakeInt(i), inner)
+			}
+			dst, err := starlark.SafeNewDict(thread, 0)
+			if err != nil {
+				st.Fatal(err)
+			}
+			if err := starlark.SafeDeepMerge(thread, dst, src); err != nil {
+				st.Fatal(err)
+			}
+			if dst.Len() != st.N {
+				st.Errorf("unexpected merged length: got %d, want %d", dst.Len(), st.N)
+			}
+			st.KeepAlive(dst)
+		})
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		// Replacing existing entries allocates nothing but the
+		// snapshot of the items of src.
+		const n = 100
+		src, dst := starlark.NewDict(n), starlark.NewDict(n)
+		for i := 0; i < n; i++ {
+			src.SetKey(starlark.MakeInt(i), starlark.True)
+			dst.SetKey(starlark.MakeInt(i), starlark.False)
+		}
+		thread := &starlark.Thread{}
+		if err := starlark.SafeDeepMerge(thread, dst, src); err != nil {
+			t.Fatal(err)
+		}
+		want := mustInt64(starlark.SafeAdd(
+			starlark.EstimateMakeSize([]starlark.Tuple{}, starlark.SafeInt(n)),
+			starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(2*n)),
+		))
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Fatal("invalid allocation count")
+		} else if allocs != want {
+			t.Errorf("unexpected allocations: got %d, want %d", allocs, want)
+		}
+	})
+}
+
 func TestParamDefault(t *testing.T) {
 	tests := []struct {
 		desc         string
@@ -375,3 +928,1113 @@ func TestSafeUnary(t *testing.T) {
 		})
 	}
 }
+
+func TestNewSafeIterableFunc(t *testing.T) {
+	const elems = 100
+
+	// nth yields the first elems integers, declaring the allocation of each.
+	nth := func(thread *starlark.Thread, n int) (starlark.Value, bool, error) {
+		if n >= elems {
+			return nil, false, nil
+		}
+		result := starlark.Value(starlark.MakeInt(n))
+		if thread != nil {
+			if err := thread.AddAllocs(starlark.EstimateSize(result)); err != nil {
+				return nil, false, err
+			}
+		}
+		return result, true, nil
+	}
+	list, ok := starlark.Universe["list"]
+	if !ok {
+		t.Fatal("no such builtin: list")
+	}
+
+	t.Run("elements", func(t *testing.T) {
+		iterable := starlark.NewSafeIterableFunc(nth)
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.CPUSafe | starlark.MemSafe | starlark.TimeSafe | starlark.IOSafe)
+		for i := 0; i < 2; i++ {
+			result, err := starlark.Call(thread, list, starlark.Tuple{iterable}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l := result.(*starlark.List); l.Len() != elems {
+				t.Errorf("unexpected length: got %d, want %d", l.Len(), elems)
+			} else if last := l.Index(elems - 1); last != starlark.MakeInt(elems-1) {
+				t.Errorf("unexpected last element: got %v, want %d", last, elems-1)
+			}
+		}
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		iterable := starlark.NewSafeIterableFunc(nth)
+
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				result, err := starlark.Call(thread, list, starlark.Tuple{iterable}, nil)
+				if err != nil {
+					st.Error(err)
+				}
+				st.KeepAlive(result)
+			}
+		})
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		iterable := starlark.NewSafeIterableFunc(nth)
+		thread := &starlark.Thread{}
+		thread.RequireSafety(starlark.MemSafe)
+		thread.SetMaxAllocs(elems)
+		_, err := starlark.Call(thread, list, starlark.Tuple{iterable}, nil)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSafeWindowed(t *testing.T) {
+	ints := func(n int) *testSequence {
+		return &testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+		}
+	}
+	windows := func(thread *starlark.Thread, iter starlark.Iterator) ([]string, error) {
+		defer iter.Done()
+		var result []string
+		var window starlark.Value
+		for iter.Next(&window) {
+			result = append(result, window.String())
+		}
+		return result, iter.Err()
+	}
+
+	t.Run("windows", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			elems  int
+			size   int
+			expect []string
+		}{{
+			name:   "overlapping",
+			elems:  5,
+			size:   3,
+			expect: []string{"(1, 2, 3)", "(2, 3, 4)", "(3, 4, 5)"},
+		}, {
+			name:   "single",
+			elems:  3,
+			size:   1,
+			expect: []string{"(1,)", "(2,)", "(3,)"},
+		}, {
+			name:   "exact",
+			elems:  3,
+			size:   3,
+			expect: []string{"(1, 2, 3)"},
+		}, {
+			name:  "short",
+			elems: 2,
+			size:  3,
+		}, {
+			name: "empty",
+			size: 1,
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				thread := &starlark.Thread{}
+				iter := starlark.SafeWindowed(thread, ints(test.elems).Iterate().(starlark.SafeIterator), test.size)
+				result, err := windows(thread, iter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(test.expect, result); diff != "" {
+					t.Errorf("unexpected windows (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeWindowed(thread, ints(st.N).Iterate().(starlark.SafeIterator), 4)
+			if _, err := windows(thread, iter); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeWindowed(thread, ints(st.N).Iterate().(starlark.SafeIterator), 4)
+			defer iter.Done()
+			var window starlark.Value
+			for iter.Next(&window) {
+				st.KeepAlive(window)
+			}
+			if err := iter.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("buffer", func(t *testing.T) {
+		// Only the window is buffered, however long the input.
+		const size = 8
+		thread := &starlark.Thread{}
+		iter := starlark.SafeWindowed(thread, ints(1000).Iterate().(starlark.SafeIterator), size)
+		defer iter.Done()
+		var window starlark.Value
+		if !iter.Next(&window) {
+			t.Fatal(iter.Err())
+		}
+		expected := starlark.SafeAdd(
+			starlark.EstimateMakeSize([]starlark.Value{}, starlark.SafeInt(size)),
+			starlark.SafeAdd(starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(size)), starlark.SliceTypeOverhead),
+		)
+		want, _ := expected.Int64()
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Fatal("invalid allocation count")
+		} else if allocs != want {
+			t.Errorf("unexpected allocations: got %d, want %d", allocs, want)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(10)
+		iter := starlark.SafeWindowed(thread, ints(100).Iterate().(starlark.SafeIterator), 2)
+		_, err := windows(thread, iter)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSafePairwise(t *testing.T) {
+	ints := func(n int) starlark.SafeIterator {
+		return (&testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+		}).Iterate().(starlark.SafeIterator)
+	}
+	pairs := func(iter starlark.Iterator) ([]string, error) {
+		defer iter.Done()
+		var result []string
+		var pair starlark.Value
+		for iter.Next(&pair) {
+			result = append(result, pair.String())
+		}
+		return result, iter.Err()
+	}
+
+	t.Run("pairs", func(t *testing.T) {
+		tests := []struct {
+			elems  int
+			expect []string
+		}{
+			{elems: 0},
+			{elems: 1},
+			{elems: 2, expect: []string{"(1, 2)"}},
+			{elems: 4, expect: []string{"(1, 2)", "(2, 3)", "(3, 4)"}},
+		}
+		for _, test := range tests {
+			result, err := pairs(starlark.SafePairwise(&starlark.Thread{}, ints(test.elems)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expect, result); diff != "" {
+				t.Errorf("%d elements: unexpected pairs (-want +got):\n%s", test.elems, diff)
+			}
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			if _, err := pairs(starlark.SafePairwise(thread, ints(st.N))); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		// Beyond the pairs yielded, memory use does not depend on the
+		// length of the input.
+		pairSize := starlark.SafeAdd(starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(2)), starlark.SliceTypeOverhead)
+		overhead := func(n int) int64 {
+			thread := &starlark.Thread{}
+			if _, err := pairs(starlark.SafePairwise(thread, ints(n))); err != nil {
+				t.Fatal(err)
+			}
+			allocs, ok := thread.Allocs()
+			if !ok {
+				t.Fatal("invalid allocation count")
+			}
+			return allocs - mustInt64(starlark.SafeMul(pairSize, n-1))
+		}
+		if small, large := overhead(10), overhead(1000); small != large {
+			t.Errorf("auxiliary memory grew with input: %d bytes for 10 elements, %d for 1000", small, large)
+		}
+	})
+}
+
+func TestSafeAccumulate(t *testing.T) {
+	ints := func(n int) starlark.SafeIterator {
+		return (&testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+		}).Iterate().(starlark.SafeIterator)
+	}
+	var calls int
+	add := starlark.NewBuiltinWithSafety("add", starlark.CPUSafe|starlark.MemSafe,
+		func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			calls++
+			return starlark.SafeBinary(thread, syntax.PLUS, args[0], args[1])
+		})
+	results := func(iter starlark.Iterator) ([]string, error) {
+		defer iter.Done()
+		var result []string
+		var x starlark.Value
+		for iter.Next(&x) {
+			result = append(result, x.String())
+		}
+		return result, iter.Err()
+	}
+
+	t.Run("totals", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			elems   int
+			initial starlark.Value
+			expect  []string
+			calls   int
+		}{{
+			name:   "no-initial",
+			elems:  5,
+			expect: []string{"1", "3", "6", "10", "15"},
+			calls:  4,
+		}, {
+			name:    "initial",
+			elems:   3,
+			initial: starlark.MakeInt(100),
+			expect:  []string{"100", "101", "103", "106"},
+			calls:   3,
+		}, {
+			name: "empty",
+		}, {
+			name:    "empty-initial",
+			initial: starlark.MakeInt(100),
+			expect:  []string{"100"},
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				calls = 0
+				thread := &starlark.Thread{}
+				iter := starlark.SafeAccumulate(thread, ints(test.elems), add, test.initial)
+				result, err := results(iter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(test.expect, result); diff != "" {
+					t.Errorf("unexpected totals (-want +got):\n%s", diff)
+				}
+				if calls != test.calls {
+					t.Errorf("unexpected call count: got %d, want %d", calls, test.calls)
+				}
+			})
+		}
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		calls = 0
+		thread := &starlark.Thread{}
+		unbounded := &testIterable{
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+		}
+		iter := starlark.SafeAccumulate(thread, unbounded.Iterate().(starlark.SafeIterator), add, starlark.MakeInt(0))
+		defer iter.Done()
+		var x starlark.Value
+		for i := 0; i < 3; i++ {
+			if !iter.Next(&x) {
+				t.Fatal(iter.Err())
+			}
+		}
+		if calls != 2 {
+			t.Errorf("unexpected call count: got %d, want 2", calls)
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeAccumulate(thread, ints(st.N), add, starlark.MakeInt(0))
+			if _, err := results(iter); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			initial := starlark.MakeInt(1).Lsh(100)
+			iter := starlark.SafeAccumulate(thread, ints(st.N), add, initial)
+			defer iter.Done()
+			var x starlark.Value
+			for iter.Next(&x) {
+				st.KeepAlive(x)
+			}
+			if err := iter.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeAccumulate(thread, ints(3), add, starlark.None)
+		if _, err := results(iter); err == nil {
+			t.Error("expected error")
+		} else if !strings.Contains(err.Error(), "unknown binary op: NoneType + int") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(10)
+		iter := starlark.SafeAccumulate(thread, ints(100), add, nil)
+		if _, err := results(iter); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSafeTakeWhile(t *testing.T) {
+	ints := func(n int) starlark.SafeIterator {
+		return (&testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+		}).Iterate().(starlark.SafeIterator)
+	}
+	var calls int
+	lessThan := func(max int) starlark.Callable {
+		return starlark.NewBuiltinWithSafety("less_than", starlark.CPUSafe|starlark.MemSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				calls++
+				n, _ := starlark.AsInt32(args[0])
+				return starlark.Bool(n < max), nil
+			})
+	}
+	results := func(iter starlark.Iterator) ([]string, error) {
+		defer iter.Done()
+		var result []string
+		var x starlark.Value
+		for iter.Next(&x) {
+			result = append(result, x.String())
+		}
+		return result, iter.Err()
+	}
+
+	t.Run("boundaries", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			elems  int
+			max    int
+			expect []string
+			calls  int
+		}{{
+			name:   "prefix",
+			elems:  5,
+			max:    3,
+			expect: []string{"1", "2"},
+			calls:  3,
+		}, {
+			name:  "none",
+			elems: 5,
+			max:   1,
+			calls: 1,
+		}, {
+			name:   "all",
+			elems:  3,
+			max:    10,
+			expect: []string{"1", "2", "3"},
+			calls:  3,
+		}, {
+			name: "empty",
+			max:  10,
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				calls = 0
+				thread := &starlark.Thread{}
+				iter := starlark.SafeTakeWhile(thread, ints(test.elems), lessThan(test.max))
+				result, err := results(iter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(test.expect, result); diff != "" {
+					t.Errorf("unexpected elements (-want +got):\n%s", diff)
+				}
+				if calls != test.calls {
+					t.Errorf("unexpected call count: got %d, want %d", calls, test.calls)
+				}
+			})
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(1)
+		st.SetMaxSteps(1)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeTakeWhile(thread, ints(st.N), lessThan(st.N+1))
+			if _, err := results(iter); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeTakeWhile(thread, ints(st.N), lessThan(st.N+1))
+			defer iter.Done()
+			var x starlark.Value
+			for iter.Next(&x) {
+				st.KeepAlive(x)
+			}
+			if err := iter.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		expensive := starlark.NewBuiltinWithSafety("expensive", starlark.CPUSafe|starlark.MemSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				if err := thread.AddSteps(starlark.SafeInt(10)); err != nil {
+					return nil, err
+				}
+				return starlark.True, nil
+			})
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(50)
+		iter := starlark.SafeTakeWhile(thread, ints(100), expensive)
+		if result, err := results(iter); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		} else if len(result) >= 100 {
+			t.Errorf("iteration was not aborted: got %d elements", len(result))
+		}
+	})
+
+	t.Run("safe-truth", func(t *testing.T) {
+		costlyTrue := starlark.NewBuiltinWithSafety("costly_true", starlark.CPUSafe|starlark.MemSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				return &costlyTruther{truth: true, cost: 10}, nil
+			})
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(50)
+		iter := starlark.SafeTakeWhile(thread, ints(100), costlyTrue)
+		if result, err := results(iter); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		} else if len(result) >= 100 {
+			t.Errorf("iteration was not aborted: got %d elements", len(result))
+		}
+	})
+}
+
+func TestSafeDropWhile(t *testing.T) {
+	ints := func(n int) starlark.SafeIterator {
+		return (&testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+		}).Iterate().(starlark.SafeIterator)
+	}
+	var calls int
+	lessThan := func(max int) starlark.Callable {
+		return starlark.NewBuiltinWithSafety("less_than", starlark.CPUSafe|starlark.MemSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				calls++
+				n, _ := starlark.AsInt32(args[0])
+				return starlark.Bool(n < max), nil
+			})
+	}
+	results := func(iter starlark.Iterator) ([]string, error) {
+		defer iter.Done()
+		var result []string
+		var x starlark.Value
+		for iter.Next(&x) {
+			result = append(result, x.String())
+		}
+		return result, iter.Err()
+	}
+
+	t.Run("boundaries", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			elems  int
+			max    int
+			expect []string
+			calls  int
+		}{{
+			name:   "suffix",
+			elems:  5,
+			max:    3,
+			expect: []string{"3", "4", "5"},
+			calls:  3,
+		}, {
+			name:   "none-dropped",
+			elems:  3,
+			max:    1,
+			expect: []string{"1", "2", "3"},
+			calls:  1,
+		}, {
+			name:  "all-dropped",
+			elems: 3,
+			max:   10,
+			calls: 3,
+		}, {
+			name: "empty",
+			max:  10,
+		}}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				calls = 0
+				thread := &starlark.Thread{}
+				iter := starlark.SafeDropWhile(thread, ints(test.elems), lessThan(test.max))
+				result, err := results(iter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(test.expect, result); diff != "" {
+					t.Errorf("unexpected elements (-want +got):\n%s", diff)
+				}
+				if calls != test.calls {
+					t.Errorf("unexpected call count: got %d, want %d", calls, test.calls)
+				}
+			})
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		for _, max := range []int{0, 1 << 30} {
+			st := startest.From(t)
+			st.RequireSafety(starlark.CPUSafe)
+			st.SetMinSteps(1)
+			st.SetMaxSteps(1)
+			st.RunThread(func(thread *starlark.Thread) {
+				iter := starlark.SafeDropWhile(thread, ints(st.N), lessThan(max))
+				if _, err := results(iter); err != nil {
+					st.Error(err)
+				}
+			})
+		}
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeDropWhile(thread, ints(st.N), lessThan(st.N/2))
+			defer iter.Done()
+			var x starlark.Value
+			for iter.Next(&x) {
+				st.KeepAlive(x)
+			}
+			if err := iter.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		expensive := starlark.NewBuiltinWithSafety("expensive", starlark.CPUSafe|starlark.MemSafe,
+			func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				if err := thread.AddSteps(starlark.SafeInt(10)); err != nil {
+					return nil, err
+				}
+				return starlark.True, nil
+			})
+		thread := &starlark.Thread{}
+		thread.SetMaxSteps(50)
+		iter := starlark.SafeDropWhile(thread, ints(100), expensive)
+		if result, err := results(iter); err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		} else if len(result) != 0 {
+			t.Errorf("unexpected elements: %v", result)
+		}
+	})
+}
+
+func TestSafeRoundRobin(t *testing.T) {
+	tagged := func(tag string, n int) *testSequence {
+		return &testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.String(fmt.Sprintf("%s%d", tag, n)), nil
+			},
+		}
+	}
+	ints := func(n int) starlark.SafeIterator {
+		return (&testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.MakeInt(n), nil
+			},
+		}).Iterate().(starlark.SafeIterator)
+	}
+	drain := func(iter starlark.Iterator) ([]string, error) {
+		defer iter.Done()
+		var result []string
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			s, _ := starlark.AsString(elem)
+			result = append(result, s)
+		}
+		return result, iter.Err()
+	}
+
+	t.Run("interleaving", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeRoundRobin(thread,
+			tagged("a", 3).Iterate().(starlark.SafeIterator),
+			tagged("b", 1).Iterate().(starlark.SafeIterator),
+			tagged("c", 2).Iterate().(starlark.SafeIterator),
+		)
+		result, err := drain(iter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []string{"a1", "b1", "c1", "a2", "c2", "a3"}
+		if diff := cmp.Diff(expect, result); diff != "" {
+			t.Errorf("unexpected order (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		for _, iter := range []starlark.Iterator{
+			starlark.SafeRoundRobin(thread),
+			starlark.SafeRoundRobin(thread, tagged("a", 0).Iterate().(starlark.SafeIterator)),
+		} {
+			if result, err := drain(iter); err != nil {
+				t.Error(err)
+			} else if len(result) != 0 {
+				t.Errorf("unexpected elements: %v", result)
+			}
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		failing := &testSequence{
+			maxN: 5,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				if n == 2 {
+					return nil, errors.New("source failed")
+				}
+				return starlark.String("f"), nil
+			},
+		}
+		thread := &starlark.Thread{}
+		iter := starlark.SafeRoundRobin(thread,
+			tagged("a", 5).Iterate().(starlark.SafeIterator),
+			failing.Iterate().(starlark.SafeIterator),
+		)
+		result, err := drain(iter)
+		if err == nil {
+			t.Error("expected error")
+		} else if err.Error() != "source failed" {
+			t.Errorf("unexpected error: %v", err)
+		}
+		expect := []string{"a1", "f", "a2"}
+		if diff := cmp.Diff(expect, result); diff != "" {
+			t.Errorf("unexpected elements (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(3)
+		st.SetMaxSteps(3)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeRoundRobin(thread, ints(st.N), ints(st.N), ints(st.N))
+			if _, err := drain(iter); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		// Only the list of sources is allocated, however long they are.
+		thread := &starlark.Thread{}
+		iter := starlark.SafeRoundRobin(thread, ints(1000), ints(10), ints(100))
+		result, err := drain(iter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1110 {
+			t.Errorf("unexpected length: got %d, want 1110", len(result))
+		}
+		want, _ := starlark.EstimateMakeSize([]starlark.SafeIterator{}, starlark.SafeInt(3)).Int64()
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Fatal("invalid allocation count")
+		} else if allocs != want {
+			t.Errorf("unexpected allocations: got %d, want %d", allocs, want)
+		}
+	})
+}
+
+func TestSafeZipLongest(t *testing.T) {
+	tagged := func(tag string, n int) starlark.SafeIterator {
+		return (&testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				return starlark.String(fmt.Sprintf("%s%d", tag, n)), nil
+			},
+		}).Iterate().(starlark.SafeIterator)
+	}
+	drain := func(iter starlark.Iterator) ([]string, error) {
+		defer iter.Done()
+		var result []string
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			result = append(result, elem.String())
+		}
+		return result, iter.Err()
+	}
+
+	t.Run("padding", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeZipLongest(thread, starlark.String("-"), tagged("a", 3), tagged("b", 1), tagged("c", 2))
+		result, err := drain(iter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []string{
+			`("a1", "b1", "c1")`,
+			`("a2", "-", "c2")`,
+			`("a3", "-", "-")`,
+		}
+		if diff := cmp.Diff(expect, result); diff != "" {
+			t.Errorf("unexpected rows (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("default-fillvalue", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeZipLongest(thread, nil, tagged("a", 1), tagged("b", 2))
+		result, err := drain(iter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []string{`("a1", "b1")`, `(None, "b2")`}
+		if diff := cmp.Diff(expect, result); diff != "" {
+			t.Errorf("unexpected rows (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		for _, iter := range []starlark.Iterator{
+			starlark.SafeZipLongest(thread, nil),
+			starlark.SafeZipLongest(thread, nil, tagged("a", 0), tagged("b", 0)),
+		} {
+			if result, err := drain(iter); err != nil {
+				t.Error(err)
+			} else if len(result) != 0 {
+				t.Errorf("unexpected rows: %v", result)
+			}
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		failing := &testSequence{
+			maxN: 5,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				if n == 2 {
+					return nil, errors.New("source failed")
+				}
+				return starlark.String("f"), nil
+			},
+		}
+		thread := &starlark.Thread{}
+		iter := starlark.SafeZipLongest(thread, nil, tagged("a", 1), failing.Iterate().(starlark.SafeIterator))
+		result, err := drain(iter)
+		if err == nil {
+			t.Error("expected error")
+		} else if err.Error() != "source failed" {
+			t.Errorf("unexpected error: %v", err)
+		}
+		expect := []string{`("a1", "f")`}
+		if diff := cmp.Diff(expect, result); diff != "" {
+			t.Errorf("unexpected rows (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("steps", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.CPUSafe)
+		st.SetMinSteps(3)
+		st.SetMaxSteps(3)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeZipLongest(thread, nil, tagged("a", st.N), tagged("b", st.N/2), tagged("c", 0))
+			if _, err := drain(iter); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		nones := func(n int) starlark.SafeIterator {
+			return (&testSequence{
+				maxN: n,
+				nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+					return starlark.None, nil
+				},
+			}).Iterate().(starlark.SafeIterator)
+		}
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.RunThread(func(thread *starlark.Thread) {
+			iter := starlark.SafeZipLongest(thread, nil, nones(st.N), nones(1))
+			defer iter.Done()
+			var row starlark.Value
+			for iter.Next(&row) {
+				st.KeepAlive(row)
+			}
+			if err := iter.Err(); err != nil {
+				st.Error(err)
+			}
+		})
+	})
+
+	t.Run("per-row-allocs", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeZipLongest(thread, nil, tagged("a", 10), tagged("b", 3))
+		if result, err := drain(iter); err != nil {
+			t.Fatal(err)
+		} else if len(result) != 10 {
+			t.Fatalf("unexpected row count: got %d, want 10", len(result))
+		}
+		// One tuple per row, but not for the final all-padding one, and
+		// the exhaustion flags.
+		tupleSize := starlark.SafeAdd(starlark.EstimateMakeSize(starlark.Tuple{}, starlark.SafeInt(2)), starlark.SliceTypeOverhead)
+		want := mustInt64(starlark.SafeAdd(
+			starlark.SafeMul(tupleSize, starlark.SafeInt(10)),
+			starlark.EstimateMakeSize([]bool{}, starlark.SafeInt(2)),
+		))
+		if allocs, ok := thread.Allocs(); !ok {
+			t.Fatal("invalid allocation count")
+		} else if allocs != want {
+			t.Errorf("unexpected allocations: got %d, want %d", allocs, want)
+		}
+	})
+}
+
+func TestSafeWithElementDeadline(t *testing.T) {
+	// blocking returns an iterator whose element at index stuck is only
+	// produced once the thread is cancelled.
+	blocking := func(n int, stuck int) starlark.SafeIterator {
+		return (&testSequence{
+			maxN: n,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				if n == stuck {
+					<-thread.Context().Done()
+				}
+				return starlark.MakeInt(n), nil
+			},
+		}).Iterate().(starlark.SafeIterator)
+	}
+	drain := func(iter starlark.Iterator) (int, error) {
+		defer iter.Done()
+		count := 0
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			count++
+		}
+		return count, iter.Err()
+	}
+
+	t.Run("within-deadline", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeWithElementDeadline(thread, blocking(5, -1), time.Second)
+		if count, err := drain(iter); err != nil {
+			t.Error(err)
+		} else if count != 5 {
+			t.Errorf("unexpected element count: got %d, want 5", count)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeWithElementDeadline(thread, blocking(5, 3), 10*time.Millisecond)
+		count, err := drain(iter)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if count != 2 {
+			t.Errorf("unexpected element count: got %d, want 2", count)
+		}
+		if err := thread.Context().Err(); err != context.DeadlineExceeded {
+			t.Errorf("expected thread to be cancelled with %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("total-time-not-limited", func(t *testing.T) {
+		// Slow iteration as a whole is allowed, so long as each element
+		// is produced promptly.
+		slow := &testSequence{
+			maxN: 5,
+			nth: func(thread *starlark.Thread, n int) (starlark.Value, error) {
+				time.Sleep(5 * time.Millisecond)
+				return starlark.None, nil
+			},
+		}
+		thread := &starlark.Thread{}
+		iter := starlark.SafeWithElementDeadline(thread, slow.Iterate().(starlark.SafeIterator), time.Second)
+		if count, err := drain(iter); err != nil {
+			t.Error(err)
+		} else if count != 5 {
+			t.Errorf("unexpected element count: got %d, want 5", count)
+		}
+	})
+
+	t.Run("safety", func(t *testing.T) {
+		iter := starlark.SafeWithElementDeadline(nil, blocking(1, -1), time.Second)
+		if safety := iter.Safety(); safety != starlark.NotSafe {
+			t.Errorf("unexpected safety with nil thread: %v", safety)
+		}
+		iter.BindThread(&starlark.Thread{})
+		if safety := iter.Safety(); safety == starlark.NotSafe {
+			t.Error("unexpected safety with bound thread: NotSafe")
+		}
+	})
+}
+
+func TestSafeByteBudgetIterator(t *testing.T) {
+	join := func(iter starlark.Iterator) (string, error) {
+		defer iter.Done()
+		var buf strings.Builder
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			if s, ok := starlark.AsString(elem); ok {
+				buf.WriteString(s)
+			} else if b, ok := elem.(starlark.Bytes); ok {
+				buf.WriteString(string(b))
+			}
+		}
+		return buf.String(), iter.Err()
+	}
+	strs := func(n int, s string) starlark.SafeIterator {
+		elems := make([]starlark.Value, n)
+		for i := range elems {
+			elems[i] = starlark.String(s)
+		}
+		return starlark.NewList(elems).Iterate().(starlark.SafeIterator)
+	}
+
+	t.Run("within-budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeByteBudgetIterator(thread, strs(10, "ab"), 20)
+		if result, err := join(iter); err != nil {
+			t.Error(err)
+		} else if result != strings.Repeat("ab", 10) {
+			t.Errorf("unexpected result: %q", result)
+		}
+	})
+
+	t.Run("over-budget", func(t *testing.T) {
+		thread := &starlark.Thread{}
+		iter := starlark.SafeByteBudgetIterator(thread, strs(1000, "ab"), 15)
+		result, err := join(iter)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if result != strings.Repeat("ab", 7) {
+			t.Errorf("unexpected result: %q", result)
+		}
+	})
+
+	t.Run("mixed", func(t *testing.T) {
+		elems := []starlark.Value{
+			starlark.String("abc"),
+			starlark.MakeInt(1),
+			starlark.Bytes("de"),
+			starlark.None,
+			starlark.String("f"),
+		}
+		thread := &starlark.Thread{}
+		iter := starlark.SafeByteBudgetIterator(thread, starlark.Tuple(elems).Iterate().(starlark.SafeIterator), 5)
+		result, err := join(iter)
+		if err == nil {
+			t.Error("expected error")
+		} else if !errors.Is(err, starlark.ErrSafety) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// The int counts as a byte, so "de" exceeds the budget.
+		if result != "abc" {
+			t.Errorf("unexpected result: %q", result)
+		}
+		if err := thread.Context().Err(); err != context.Canceled {
+			t.Errorf("expected thread to be cancelled, got %v", err)
+		}
+	})
+
+	t.Run("safety", func(t *testing.T) {
+		iter := starlark.SafeByteBudgetIterator(nil, strs(1, "a"), 1)
+		if safety := iter.Safety(); safety != starlark.NotSafe {
+			t.Errorf("unexpected safety with nil thread: %v", safety)
+		}
+		iter.BindThread(&starlark.Thread{})
+		if safety := iter.Safety(); safety == starlark.NotSafe {
+			t.Error("unexpected safety with bound thread: NotSafe")
+		}
+	})
+}
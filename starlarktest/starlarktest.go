@@ -14,6 +14,7 @@ package starlarktest // import "github.com/canonical/starlark/starlarktest"
 
 import (
 	_ "embed"
+	"errors"
 	"fmt"
 	"math"
 	"os"
@@ -83,13 +84,18 @@ func LoadAssertModule() (starlark.StringDict, error) {
 }
 
 // catch(f) evaluates f() and returns its evaluation error message
-// if it failed or None if it succeeded.
+// if it failed or None if it succeeded. Errors caused by the thread's
+// safety constraints, such as exceeding its step or allocation limits,
+// are not expected failures of f and are returned as is.
 func catch(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var fn starlark.Callable
 	if err := starlark.UnpackArgs("catch", args, kwargs, "fn", &fn); err != nil {
 		return nil, err
 	}
 	if _, err := starlark.Call(thread, fn, nil, nil); err != nil {
+		if errors.Is(err, starlark.ErrSafety) {
+			return nil, err
+		}
 		return starlark.String(err.Error()), nil
 	}
 	return starlark.None, nil
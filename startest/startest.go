@@ -18,9 +18,10 @@
 // running environment of a Starlark script, use the AddValue, AddBuiltin and
 // AddLocal methods. All safety conditions are required by default; to instead
 // test a specific subset of safety conditions, use the RequireSafety method.
-// To test resource usage, use the SetMaxAllocs method. To count the memory
-// cost of a value in a test, use the KeepAlive method. The Error, Errorf,
-// Fatal, Fatalf, Log and Logf methods are inherited from the test's base.
+// To test resource usage, use the SetMaxAllocs and SetMaxAllocCount methods.
+// To count the memory cost of a value in a test, use the KeepAlive method. The
+// Error, Errorf, Fatal, Fatalf, Log and Logf methods are inherited from the
+// test's base.
 //
 // When executing Starlark code, the startest instance can be accessed through
 // the global st. To access the exposed N, use st.n. To count the memory cost
@@ -60,6 +61,7 @@ type TestBase interface {
 type ST struct {
 	ctx            context.Context
 	maxAllocs      int64
+	maxAllocCount  uint64
 	maxSteps       int64
 	minSteps       int64
 	alive          []interface{}
@@ -83,10 +85,11 @@ var _ TestBase = &check.C{}
 // From returns a new starTest instance with a given test base.
 func From(base TestBase) *ST {
 	return &ST{
-		TestBase:  base,
-		ctx:       context.Background(),
-		maxAllocs: math.MaxInt64,
-		maxSteps:  math.MaxInt64,
+		TestBase:      base,
+		ctx:           context.Background(),
+		maxAllocs:     math.MaxInt64,
+		maxAllocCount: math.MaxUint64,
+		maxSteps:      math.MaxInt64,
 	}
 }
 
@@ -100,6 +103,12 @@ func (st *ST) SetMaxAllocs(maxAllocs int64) {
 	st.maxAllocs = maxAllocs
 }
 
+// SetMaxAllocCount optionally sets the max number of allocations declared
+// per unit of st.N, regardless of their size.
+func (st *ST) SetMaxAllocCount(maxAllocCount uint64) {
+	st.maxAllocCount = maxAllocCount
+}
+
 // SetMaxSteps optionally sets the max steps allowed per unit
 // of st.N.
 func (st *ST) SetMaxSteps(maxSteps int64) {
@@ -270,6 +279,14 @@ func (st *ST) RunThread(fn func(*starlark.Thread)) {
 		}
 	}
 
+	if st.maxAllocCount != math.MaxUint64 {
+		nSum := uint64(stats.nSum)
+		meanAllocCount := (thread.AllocCount() + nSum/2) / nSum
+		if meanAllocCount > st.maxAllocCount {
+			st.Errorf("declared allocation count is above maximum (%d > %d)", meanAllocCount, st.maxAllocCount)
+		}
+	}
+
 	if st.maxSteps != math.MaxInt64 && st.maxSteps >= 0 && meanSteps > st.maxSteps {
 		st.Errorf("steps are above maximum (%d > %d)", meanSteps, st.maxSteps)
 	}
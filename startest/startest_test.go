@@ -297,6 +297,41 @@ func TestStepBounding(t *testing.T) {
 	})
 }
 
+func TestAllocCountBounding(t *testing.T) {
+	t.Run("count=safe", func(t *testing.T) {
+		st := startest.From(t)
+		st.RequireSafety(starlark.MemSafe)
+		st.SetMaxAllocCount(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				st.KeepAlive(new(int32), new(int32))
+				thread.AddAllocs(starlark.SafeInt(4))
+				thread.AddAllocs(starlark.SafeInt(4))
+			}
+		})
+	})
+
+	t.Run("count=not-safe", func(t *testing.T) {
+		const expected = "declared allocation count is above maximum (4 > 2)"
+
+		dummy := &dummyBase{}
+		st := startest.From(dummy)
+		st.RequireSafety(starlark.MemSafe)
+		st.SetMaxAllocCount(2)
+		st.RunThread(func(thread *starlark.Thread) {
+			for i := 0; i < st.N; i++ {
+				st.KeepAlive(new(int64))
+				for j := 0; j < 4; j++ {
+					thread.AddAllocs(starlark.SafeInt(2))
+				}
+			}
+		})
+		if errLog := dummy.Errors(); errLog != expected {
+			t.Errorf("unexpected error(s): %s", errLog)
+		}
+	})
+}
+
 func TestThread(t *testing.T) {
 	st := startest.From(t)
 	st.RunThread(func(thread *starlark.Thread) {
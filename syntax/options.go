@@ -30,6 +30,12 @@ type FileOptions struct {
 
 	// compiler
 	Recursion bool // disable recursion check for functions in this file
+
+	// MaxLiteralBytes limits the total size of the literal constants of
+	// a file, each occurrence counted separately, so that a source cannot
+	// build arbitrarily large values merely by being compiled. Zero means
+	// no limit.
+	MaxLiteralBytes int
 }
 
 // TODO(adonovan): provide a canonical flag parser for FileOptions.